@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"github.com/fstab/grok_exporter/config/v2"
 	v3 "github.com/fstab/grok_exporter/config/v3"
+	v4 "github.com/fstab/grok_exporter/config/v4"
 	"io/ioutil"
 	"regexp"
 	"strconv"
@@ -26,7 +27,7 @@ import (
 
 // Example config: See ./example/config.yml
 
-func LoadConfigFile(filename string) (*v3.Config, string, error) {
+func LoadConfigFile(filename string) (*v4.Config, string, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, "", fmt.Errorf("Failed to load %v: %v", filename, err.Error())
@@ -38,7 +39,7 @@ func LoadConfigFile(filename string) (*v3.Config, string, error) {
 	return cfg, warn, nil
 }
 
-func LoadConfigString(content []byte) (*v3.Config, string, error) {
+func LoadConfigString(content []byte) (*v4.Config, string, error) {
 	version, warn, err := findVersion(string(content))
 	if err != nil {
 		return nil, warn, err
@@ -49,7 +50,7 @@ func LoadConfigString(content []byte) (*v3.Config, string, error) {
 
 // returns (version, warning, error).
 func findVersion(content string) (int, string, error) {
-	warning := "Configuration version 2 found. This is still supported, but we recommend updating to version 3. Run grok_exporter with the -showconfig command line parameter to automatically convert to version 3 and write the result to the console."
+	warning := "Configuration version 2 found. This is still supported, but we recommend updating to version 4. Run grok_exporter with the -showconfig command line parameter to automatically convert to version 4 and write the result to the console."
 	versionExpr := regexp.MustCompile(`"?global"?:\s*"?config_version"?:[\t\f ]*(\S+)`)
 	versionInfo := versionExpr.FindStringSubmatch(content)
 	if len(versionInfo) == 2 {
@@ -67,16 +68,26 @@ func findVersion(content string) (int, string, error) {
 	}
 }
 
-func unmarshal(content []byte, version int) (*v3.Config, error) {
+func unmarshal(content []byte, version int) (*v4.Config, error) {
 	switch version {
 	case 2:
 		v2cfg, err := v2.Unmarshal(content)
 		if err != nil {
 			return nil, err
 		}
-		return v3.Convert(v2cfg)
+		v3cfg, err := v3.Convert(v2cfg)
+		if err != nil {
+			return nil, err
+		}
+		return v4.Convert(v3cfg)
 	case 3:
-		return v3.Unmarshal(content)
+		v3cfg, err := v3.Unmarshal(content)
+		if err != nil {
+			return nil, err
+		}
+		return v4.Convert(v3cfg)
+	case 4:
+		return v4.Unmarshal(content)
 	default:
 		return nil, fmt.Errorf("global.config_version %v is not supported", version)
 	}
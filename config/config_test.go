@@ -66,6 +66,7 @@ func TestVersionOk(t *testing.T) {
 	expectVersion(t, "config_version: 1", 1, false, false)
 	expectVersion(t, "config_version: 2", 2, true, false)
 	expectVersion(t, "config_version: 3", 3, false, false)
+	expectVersion(t, "config_version: 4", 4, false, false)
 }
 
 func TestVersionInvalid(t *testing.T) {
@@ -47,6 +47,9 @@ func (f *fileLoader) LoadGlob(globString string) ([]*ConfigFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	if g.BaseDir() != g.Dir() {
+		return nil, fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", globString)
+	}
 	fileInfos, err := ioutil.ReadDir(g.Dir())
 	if err != nil {
 		return nil, err
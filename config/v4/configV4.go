@@ -0,0 +1,1413 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v4
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	v3 "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/fstab/grok_exporter/tailer/jsonselector"
+	"github.com/fstab/grok_exporter/template"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultRetentionCheckInterval = 53 * time.Second
+	defaultPositionSyncInterval   = 10 * time.Second
+	defaultStateSyncInterval      = 10 * time.Second
+	defaultMultilineMaxLines      = 500
+	defaultMultilineMaxBytes      = 1024 * 1024
+	defaultMultilineFlushTimeout  = 1 * time.Second
+	defaultWebhookQueueSize       = 10000
+	defaultWebhookMaxBodyBytes    = 10 * 1024 * 1024
+	inputTypeStdin                = "stdin"
+	inputTypeFile                 = "file"
+	inputTypeWebhook              = "webhook"
+	inputTypeKafka                = "kafka"
+	inputTypeSyslog               = "syslog"
+	inputTypeJournald             = "journald"
+	inputTypeFluentForward        = "fluent_forward"
+	defaultFluentForwardAddress   = ":24224"
+	defaultFluentForwardRecordKey = "log"
+	inputTypeGelf                 = "gelf"
+	defaultGelfMessageField       = "short_message"
+	defaultGelfChunkTimeout       = 5 * time.Second
+	inputTypeTcp                  = "tcp"
+	inputTypeUnix                 = "unix"
+	defaultMaxConnections         = 100
+	inputTypeExec                 = "exec"
+	defaultExecRestartDelay       = 1 * time.Second
+	defaultExecMaxRestartDelay    = 1 * time.Minute
+	importMetricsType             = "metrics"
+	importPatternsType            = "grok_patterns"
+)
+
+func Unmarshal(config []byte) (*Config, error) {
+	return unmarshal(config, v3.NewFileLoader())
+}
+
+// For testing, allow injection of mock file loader.
+func unmarshal(config []byte, fileLoader v3.FileLoader) (*Config, error) {
+	cfg := &Config{}
+	err := yaml.Unmarshal(config, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v. make sure to use 'single quotes' around strings with special characters (like match patterns or label templates), and make sure to use '-' only for lists (metrics) but not for maps (labels)", err.Error())
+	}
+	importedMetrics, err := importMetrics(cfg.Imports, fileLoader)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range cfg.OrigMetrics {
+		cfg.AllMetrics = append(cfg.AllMetrics, metric)
+	}
+	for _, metric := range importedMetrics {
+		cfg.AllMetrics = append(cfg.AllMetrics, metric)
+	}
+	err = AddDefaultsAndValidate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func Convert(v3cfg *v3.Config) (*Config, error) {
+	v4cfg := convert(v3cfg) // imported metrics are already loaded in v3cfg.AllMetrics
+	err := AddDefaultsAndValidate(v4cfg)
+	if err != nil {
+		return nil, err
+	}
+	return v4cfg, nil
+}
+
+type Config struct {
+	Global       GlobalConfig       `yaml:",omitempty"`
+	Inputs       InputsConfig       `yaml:",omitempty"`
+	Imports      ImportsConfig      `yaml:",omitempty"`
+	GrokPatterns GrokPatternsConfig `yaml:"grok_patterns,omitempty"`
+	OrigMetrics  MetricsConfig      `yaml:"metrics,omitempty"` // not including imported config files
+	AllMetrics   MetricsConfig      `yaml:"-"`                 // including metrics from imported config files
+	Server       ServerConfig       `yaml:",omitempty"`
+}
+
+type GlobalConfig struct {
+	ConfigVersion          int           `yaml:"config_version,omitempty"`
+	RetentionCheckInterval time.Duration `yaml:"retention_check_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	MaxLinesInBuffer       int           `yaml:"max_lines_in_buffer,omitempty"`      // all inputs share the same line buffer
+	StateFile              string        `yaml:"state_file,omitempty"`
+	StateSyncInterval      time.Duration `yaml:"state_sync_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+}
+
+type InputsConfig []InputConfig
+
+type InputConfig struct {
+	Name                       string `yaml:",omitempty"`
+	Type                       string `yaml:",omitempty"`
+	PathsAndGlobs              `yaml:",inline"`
+	FailOnMissingLogfileString string             `yaml:"fail_on_missing_logfile,omitempty"` // cannot use bool directly, because yaml.v2 doesn't support true as default value.
+	FailOnMissingLogfile       bool               `yaml:"-"`
+	Readall                    bool               `yaml:",omitempty"`
+	PollInterval               time.Duration      `yaml:"poll_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	PositionFile               string             `yaml:"position_file,omitempty"`
+	PositionSyncInterval       time.Duration      `yaml:"position_sync_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	RotationGracePeriod        time.Duration      `yaml:"rotation_grace_period,omitempty"`  // implicitly parsed with time.ParseDuration()
+	WebhookPath                string             `yaml:"webhook_path,omitempty"`
+	WebhookFormat              string             `yaml:"webhook_format,omitempty"`
+	WebhookJsonSelector        string             `yaml:"webhook_json_selector,omitempty"`
+	WebhookTextBulkSeparator   string             `yaml:"webhook_text_bulk_separator,omitempty"`
+	WebhookQueueSize           int                `yaml:"webhook_queue_size,omitempty"`     // number of lines
+	WebhookMaxBodyBytes        int                `yaml:"webhook_max_body_bytes,omitempty"` // after decompression
+	WebhookAuth                *WebhookAuthConfig `yaml:"webhook_auth,omitempty"`
+	KafkaVersion               string             `yaml:"kafka_version,omitempty"`
+	KafkaBrokers               []string           `yaml:"kafka_brokers,omitempty"`
+	KafkaTopics                []string           `yaml:"kafka_topics,omitempty"`
+	KafkaPartitionAssignor     string             `yaml:"kafka_partition_assignor,omitempty"`
+	KafkaConsumerGroupName     string             `yaml:"kafka_consumer_group_name,omitempty"`
+	KafkaConsumeFromOldest     bool               `yaml:"kafka_consume_from_oldest,omitempty"`
+	SyslogUdpAddress           string             `yaml:"syslog_udp_address,omitempty"`
+	SyslogTcpAddress           string             `yaml:"syslog_tcp_address,omitempty"`
+	FluentForwardAddress       string             `yaml:"fluent_forward_address,omitempty"`
+	FluentForwardRecordKey     string             `yaml:"fluent_forward_record_key,omitempty"`
+	GelfUdpAddress             string             `yaml:"gelf_udp_address,omitempty"`
+	GelfTcpAddress             string             `yaml:"gelf_tcp_address,omitempty"`
+	GelfMessageField           string             `yaml:"gelf_message_field,omitempty"`
+	GelfChunkTimeout           time.Duration      `yaml:"gelf_chunk_timeout,omitempty"` // implicitly parsed with time.ParseDuration()
+	TcpAddress                 string             `yaml:"tcp_address,omitempty"`
+	UnixSocketPath             string             `yaml:"unix_socket_path,omitempty"`
+	MaxConnections             int                `yaml:"max_connections,omitempty"`
+	TlsCert                    string             `yaml:"tls_cert,omitempty"`
+	TlsKey                     string             `yaml:"tls_key,omitempty"`
+	TlsClientCA                string             `yaml:"tls_client_ca,omitempty"`
+	ExecCommand                []string           `yaml:"exec_command,omitempty"`
+	ExecStderr                 bool               `yaml:"exec_stderr,omitempty"`
+	ExecRestartDelay           time.Duration      `yaml:"exec_restart_delay,omitempty"`     // implicitly parsed with time.ParseDuration()
+	ExecMaxRestartDelay        time.Duration      `yaml:"exec_max_restart_delay,omitempty"` // implicitly parsed with time.ParseDuration()
+	JournaldFormat             string             `yaml:"journald_format,omitempty"`
+	JournaldCursorFile         string             `yaml:"journald_cursor_file,omitempty"`
+	ContainerFormat            string             `yaml:"container_format,omitempty"`
+	Encoding                   string             `yaml:"encoding,omitempty"`
+	MaxLineBytes               int                `yaml:"max_line_bytes,omitempty"`
+	OversizedLines             string             `yaml:"oversized_lines,omitempty"` // "truncate" or "drop"
+	Multiline                  *MultilineConfig   `yaml:",omitempty"`
+}
+
+// Multiple lines are joined into a single log event, like stack traces or continuation lines.
+// Either StartPattern or ContinuationPattern is set.
+type MultilineConfig struct {
+	StartPattern        string        `yaml:"start_pattern,omitempty"`        // a line matching this grok pattern starts a new event
+	ContinuationPattern string        `yaml:"continuation_pattern,omitempty"` // a line matching this grok pattern is appended to the current event
+	MaxLines            int           `yaml:"max_lines,omitempty"`
+	MaxBytes            int           `yaml:"max_bytes,omitempty"`
+	FlushTimeout        time.Duration `yaml:"flush_timeout,omitempty"` // implicitly parsed with time.ParseDuration()
+}
+
+// Authentication for the webhook input. If more than one method is configured, all of them must succeed.
+// Secrets are either configured directly or read from a file, so that they can be kept out of the configuration file.
+type WebhookAuthConfig struct {
+	BearerToken      string `yaml:"bearer_token,omitempty"`
+	BearerTokenFile  string `yaml:"bearer_token_file,omitempty"`
+	Username         string `yaml:"username,omitempty"`      // basic auth
+	PasswordHash     string `yaml:"password_hash,omitempty"` // bcrypt hash of the basic auth password
+	PasswordHashFile string `yaml:"password_hash_file,omitempty"`
+	HmacSecret       string `yaml:"hmac_secret,omitempty"`
+	HmacSecretFile   string `yaml:"hmac_secret_file,omitempty"`
+	HmacHeader       string `yaml:"hmac_header,omitempty"`
+	HmacFormat       string `yaml:"hmac_format,omitempty"` // "github", "stripe", or "hex"
+}
+
+type GrokPatternsConfig []string
+
+type PathsAndGlobs struct {
+	Path         string      `yaml:",omitempty"`
+	Paths        []string    `yaml:",omitempty"`
+	ExcludePaths []string    `yaml:"exclude_paths,omitempty"` // files matching Path or Paths are ignored if they match one of the ExcludePaths
+	Globs        []glob.Glob `yaml:"-"`
+	ExcludeGlobs []glob.Glob `yaml:"-"`
+}
+
+type MetricConfig struct {
+	Type                 string   `yaml:",omitempty"`
+	Name                 string   `yaml:",omitempty"`
+	Help                 string   `yaml:",omitempty"`
+	Inputs               []string `yaml:",omitempty"` // names of the inputs this metric applies to, empty means all inputs.
+	PathsAndGlobs        `yaml:",inline"`
+	Format               string              `yaml:",omitempty"` // grok (default), json, or logfmt
+	Match                string              `yaml:",omitempty"`
+	MatchFields          map[string]string   `yaml:"match_fields,omitempty"`    // json selector or logfmt key -> grok pattern
+	RequiredFields       []string            `yaml:"required_fields,omitempty"` // logfmt keys that must be present
+	Retention            time.Duration       `yaml:",omitempty"`                // implicitly parsed with time.ParseDuration()
+	Value                string              `yaml:",omitempty"`
+	Cumulative           bool                `yaml:",omitempty"`
+	Buckets              []float64           `yaml:",flow,omitempty"`
+	Quantiles            map[float64]float64 `yaml:",flow,omitempty"`
+	MaxAge               time.Duration       `yaml:"max_age,omitempty"`
+	Labels               map[string]string   `yaml:",omitempty"`
+	LabelTemplates       []template.Template `yaml:"-"` // parsed version of Labels, will not be serialized to yaml.
+	ValueTemplate        template.Template   `yaml:"-"` // parsed version of Value, will not be serialized to yaml.
+	DeleteMatch          string              `yaml:"delete_match,omitempty"`
+	DeleteLabels         map[string]string   `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
+	DeleteLabelTemplates []template.Template `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+}
+
+type MetricsConfig []MetricConfig
+
+type ImportsConfig []ImportConfig
+
+type ImportConfig struct {
+	Type     string        `yaml:",omitempty"`
+	Dir      string        `yaml:",omitempty"`
+	File     string        `yaml:",omitempty"`
+	Defaults DefaultConfig `yaml:",omitempty"`
+}
+
+type DefaultConfig struct {
+	Inputs        []string `yaml:",omitempty"`
+	PathsAndGlobs `yaml:",inline"`
+	Retention     time.Duration       `yaml:",omitempty"` // implicitly parsed with time.ParseDuration()
+	Buckets       []float64           `yaml:",flow,omitempty"`
+	Quantiles     map[float64]float64 `yaml:",flow,omitempty"`
+	MaxAge        time.Duration       `yaml:"max_age,omitempty"`
+	Labels        map[string]string   `yaml:",omitempty"`
+}
+
+type ServerConfig struct {
+	Protocol   string `yaml:",omitempty"`
+	Host       string `yaml:",omitempty"`
+	Port       int    `yaml:",omitempty"`
+	Path       string `yaml:",omitempty"`
+	Cert       string `yaml:",omitempty"`
+	Key        string `yaml:",omitempty"`
+	ClientCA   string `yaml:"client_ca,omitempty"`
+	ClientAuth string `yaml:"client_auth,omitempty"`
+}
+
+func importMetrics(importsConfig ImportsConfig, fileLoader v3.FileLoader) (MetricsConfig, error) {
+	var (
+		importConfig ImportConfig
+		result       MetricsConfig
+		err          error
+		files        []*v3.ConfigFile
+	)
+	for _, importConfig = range importsConfig {
+		if importConfig.Type != importMetricsType {
+			continue
+		}
+		err = importConfig.validate()
+		if err != nil {
+			return nil, err
+		}
+		if len(importConfig.Dir) > 0 {
+			files, err = fileLoader.LoadDir(importConfig.Dir)
+		} else {
+			files, err = fileLoader.LoadGlob(importConfig.File)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			var metricsConfig MetricsConfig
+			err := yaml.Unmarshal([]byte(file.Contents), &metricsConfig)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", file.Path, err)
+			}
+			for i := range metricsConfig {
+				applyImportDefaults(&metricsConfig[i], importConfig.Defaults)
+				result = append(result, metricsConfig[i])
+			}
+		}
+	}
+	return result, nil
+}
+
+func applyImportDefaults(metricConfig *MetricConfig, defaults DefaultConfig) {
+	for key, value := range defaults.Labels {
+		if _, exists := metricConfig.Labels[key]; !exists {
+			if metricConfig.Labels == nil {
+				metricConfig.Labels = make(map[string]string)
+			}
+			metricConfig.Labels[key] = value
+		}
+	}
+	if metricConfig.Type == "summary" && len(metricConfig.Quantiles) == 0 {
+		metricConfig.Quantiles = defaults.Quantiles
+	}
+	if metricConfig.Type == "summary" && metricConfig.MaxAge == 0 {
+		metricConfig.MaxAge = defaults.MaxAge
+	}
+	if metricConfig.Type == "histogram" && len(metricConfig.Buckets) == 0 {
+		metricConfig.Buckets = defaults.Buckets
+	}
+	if metricConfig.Retention == 0 {
+		metricConfig.Retention = defaults.Retention
+	}
+	if len(metricConfig.Inputs) == 0 {
+		metricConfig.Inputs = defaults.Inputs
+	}
+	if len(metricConfig.Path) == 0 && len(metricConfig.Paths) == 0 {
+		metricConfig.Path = defaults.Path
+		metricConfig.Paths = defaults.Paths
+	}
+	if len(metricConfig.ExcludePaths) == 0 {
+		metricConfig.ExcludePaths = defaults.ExcludePaths
+	}
+}
+
+func (cfg *Config) addDefaults() {
+	cfg.Global.addDefaults()
+	cfg.Inputs.addDefaults()
+	cfg.GrokPatterns.addDefaults()
+	if cfg.AllMetrics != nil {
+		cfg.AllMetrics.addDefaults()
+	}
+	cfg.Server.addDefaults()
+}
+
+func (c *GlobalConfig) addDefaults() {
+	if c.ConfigVersion == 0 {
+		c.ConfigVersion = 4
+	}
+	if c.RetentionCheckInterval == 0 {
+		c.RetentionCheckInterval = defaultRetentionCheckInterval
+	}
+	if len(c.StateFile) > 0 && c.StateSyncInterval == 0 {
+		c.StateSyncInterval = defaultStateSyncInterval
+	}
+}
+
+func (c *InputsConfig) addDefaults() {
+	if len(*c) == 0 {
+		*c = []InputConfig{{}}
+	}
+	for i := range *c {
+		(*c)[i].addDefaults()
+	}
+}
+
+func (c *InputConfig) addDefaults() {
+	if c.Type == "" {
+		c.Type = inputTypeStdin
+	}
+	if c.Name == "" {
+		c.Name = c.Type
+	}
+	if c.Type == inputTypeFile && len(c.FailOnMissingLogfileString) == 0 {
+		c.FailOnMissingLogfileString = "true"
+	}
+	if c.Type == inputTypeFile && len(c.PositionFile) > 0 && c.PositionSyncInterval == 0 {
+		c.PositionSyncInterval = defaultPositionSyncInterval
+	}
+	if c.Type == inputTypeWebhook {
+		if len(c.WebhookPath) == 0 {
+			c.WebhookPath = "/webhook"
+		}
+		if len(c.WebhookFormat) == 0 {
+			c.WebhookFormat = "text_single"
+		}
+		if len(c.WebhookJsonSelector) == 0 {
+			c.WebhookJsonSelector = ".message"
+		}
+		if len(c.WebhookTextBulkSeparator) == 0 {
+			c.WebhookTextBulkSeparator = "\n\n"
+		}
+		if c.WebhookQueueSize == 0 {
+			c.WebhookQueueSize = defaultWebhookQueueSize
+		}
+		if c.WebhookMaxBodyBytes == 0 {
+			c.WebhookMaxBodyBytes = defaultWebhookMaxBodyBytes
+		}
+		if c.WebhookAuth != nil && (len(c.WebhookAuth.HmacSecret) > 0 || len(c.WebhookAuth.HmacSecretFile) > 0) {
+			if len(c.WebhookAuth.HmacFormat) == 0 {
+				c.WebhookAuth.HmacFormat = "github"
+			}
+			if len(c.WebhookAuth.HmacHeader) == 0 {
+				switch c.WebhookAuth.HmacFormat {
+				case "github":
+					c.WebhookAuth.HmacHeader = "X-Hub-Signature-256"
+				case "stripe":
+					c.WebhookAuth.HmacHeader = "Stripe-Signature"
+				}
+			}
+		}
+	}
+	if c.Type == inputTypeJournald && len(c.JournaldFormat) == 0 {
+		c.JournaldFormat = "export"
+	}
+	if c.Type == inputTypeFluentForward {
+		if len(c.FluentForwardAddress) == 0 {
+			c.FluentForwardAddress = defaultFluentForwardAddress
+		}
+		if len(c.FluentForwardRecordKey) == 0 {
+			c.FluentForwardRecordKey = defaultFluentForwardRecordKey
+		}
+	}
+	if c.Type == inputTypeGelf {
+		if len(c.GelfMessageField) == 0 {
+			c.GelfMessageField = defaultGelfMessageField
+		}
+		if c.GelfChunkTimeout == 0 {
+			c.GelfChunkTimeout = defaultGelfChunkTimeout
+		}
+	}
+	if (c.Type == inputTypeTcp || c.Type == inputTypeUnix || c.Type == inputTypeFluentForward) && c.MaxConnections == 0 {
+		c.MaxConnections = defaultMaxConnections
+	}
+	if c.Type == inputTypeExec {
+		if c.ExecRestartDelay == 0 {
+			c.ExecRestartDelay = defaultExecRestartDelay
+		}
+		if c.ExecMaxRestartDelay == 0 {
+			c.ExecMaxRestartDelay = defaultExecMaxRestartDelay
+		}
+	}
+	if c.MaxLineBytes > 0 && len(c.OversizedLines) == 0 {
+		c.OversizedLines = "truncate"
+	}
+	if c.Multiline != nil {
+		if c.Multiline.MaxLines == 0 {
+			c.Multiline.MaxLines = defaultMultilineMaxLines
+		}
+		if c.Multiline.MaxBytes == 0 {
+			c.Multiline.MaxBytes = defaultMultilineMaxBytes
+		}
+		if c.Multiline.FlushTimeout == 0 {
+			c.Multiline.FlushTimeout = defaultMultilineFlushTimeout
+		}
+	}
+	if c.Type == inputTypeKafka {
+		c.KafkaConsumeFromOldest = false
+
+		if c.KafkaPartitionAssignor == "" {
+			c.KafkaPartitionAssignor = "range"
+		}
+		if c.KafkaVersion == "" {
+			c.KafkaVersion = "2.1.0"
+		}
+		if c.KafkaConsumerGroupName == "" {
+			c.KafkaConsumerGroupName = "grok_exporter"
+		}
+	}
+}
+
+func (c *GrokPatternsConfig) addDefaults() {}
+
+func (c *MetricsConfig) addDefaults() {
+	for i := range *c {
+		metric := &(*c)[i]
+		if metric.Type == "counter" && len(metric.Value) == 0 {
+			metric.Value = "1.0"
+		}
+	}
+}
+
+func (c *ServerConfig) addDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = "http"
+	}
+	if c.Port == 0 {
+		c.Port = 9144
+	}
+	if c.Path == "" {
+		c.Path = "/metrics"
+	}
+	if len(c.ClientCA) > 0 && len(c.ClientAuth) == 0 {
+		c.ClientAuth = "RequireAndVerifyClientCert"
+	}
+}
+
+func (cfg *Config) validate() error {
+	err := cfg.Global.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.Inputs.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.GrokPatterns.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.Imports.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.AllMetrics.validate(cfg.Inputs)
+	if err != nil {
+		return err
+	}
+	err = cfg.Server.validate()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *GlobalConfig) validate() error {
+	if c.MaxLinesInBuffer < 0 {
+		return fmt.Errorf("invalid 'global.max_lines_in_buffer': %v", c.MaxLinesInBuffer)
+	}
+	if len(c.StateFile) == 0 && c.StateSyncInterval != 0 {
+		return fmt.Errorf("'global.state_sync_interval' can only be used together with 'global.state_file'")
+	}
+	if c.StateSyncInterval < 0 {
+		return fmt.Errorf("invalid 'global.state_sync_interval': %v", c.StateSyncInterval)
+	}
+	return nil
+}
+
+func validateGlobs(p *PathsAndGlobs, optional bool, prefix string) error {
+	if !optional && len(p.Path) == 0 && len(p.Paths) == 0 {
+		return fmt.Errorf("%v: one of 'path' or 'paths' is required", prefix)
+	}
+	if len(p.Path) > 0 && len(p.Paths) > 0 {
+		return fmt.Errorf("%v: use either 'path' or 'paths' but not both", prefix)
+	}
+	if len(p.Path) > 0 {
+		parsedGlob, err := glob.Parse(p.Path)
+		if err != nil {
+			return fmt.Errorf("%v: %v", prefix, err)
+		}
+		p.Globs = []glob.Glob{parsedGlob}
+	}
+	if len(p.Paths) > 0 {
+		p.Globs = make([]glob.Glob, 0, len(p.Paths))
+		for _, path := range p.Paths {
+			parsedGlob, err := glob.Parse(path)
+			if err != nil {
+				return fmt.Errorf("%v: %v", prefix, err)
+			}
+			p.Globs = append(p.Globs, parsedGlob)
+		}
+	}
+	p.ExcludeGlobs = nil
+	for _, path := range p.ExcludePaths {
+		parsedGlob, err := glob.Parse(path)
+		if err != nil {
+			return fmt.Errorf("%v: 'exclude_paths': %v", prefix, err)
+		}
+		p.ExcludeGlobs = append(p.ExcludeGlobs, parsedGlob)
+	}
+	return nil
+}
+
+func (c *InputsConfig) validate() error {
+	names := make(map[string]bool)
+	webhookPaths := make(map[string]bool)
+	syslogAddresses := make(map[string]bool)
+	fluentForwardAddresses := make(map[string]bool)
+	gelfAddresses := make(map[string]bool)
+	socketAddresses := make(map[string]bool)
+	positionFiles := make(map[string]bool)
+	nStdin := 0
+	for i := range *c {
+		input := &(*c)[i] // validate modifies the input, therefore we must use it by reference here.
+		err := input.validate()
+		if err != nil {
+			return err
+		}
+		if names[input.Name] {
+			return fmt.Errorf("invalid input configuration: input name '%v' is used more than once, use 'name' to give each input a unique name", input.Name)
+		}
+		names[input.Name] = true
+		if input.Type == inputTypeWebhook {
+			if webhookPaths[input.WebhookPath] {
+				return fmt.Errorf("invalid input configuration: webhook_path '%v' is used by more than one input", input.WebhookPath)
+			}
+			webhookPaths[input.WebhookPath] = true
+		}
+		if input.Type == inputTypeSyslog {
+			for _, address := range []struct{ option, value string }{
+				{"syslog_udp_address", input.SyslogUdpAddress},
+				{"syslog_tcp_address", input.SyslogTcpAddress},
+			} {
+				if len(address.value) == 0 {
+					continue
+				}
+				if syslogAddresses[address.option+" "+address.value] {
+					return fmt.Errorf("invalid input configuration: %v '%v' is used by more than one input", address.option, address.value)
+				}
+				syslogAddresses[address.option+" "+address.value] = true
+			}
+		}
+		if input.Type == inputTypeFluentForward {
+			if fluentForwardAddresses[input.FluentForwardAddress] {
+				return fmt.Errorf("invalid input configuration: fluent_forward_address '%v' is used by more than one input", input.FluentForwardAddress)
+			}
+			fluentForwardAddresses[input.FluentForwardAddress] = true
+		}
+		if input.Type == inputTypeGelf {
+			for _, address := range []struct{ option, value string }{
+				{"gelf_udp_address", input.GelfUdpAddress},
+				{"gelf_tcp_address", input.GelfTcpAddress},
+			} {
+				if len(address.value) == 0 {
+					continue
+				}
+				if gelfAddresses[address.option+" "+address.value] {
+					return fmt.Errorf("invalid input configuration: %v '%v' is used by more than one input", address.option, address.value)
+				}
+				gelfAddresses[address.option+" "+address.value] = true
+			}
+		}
+		if input.Type == inputTypeTcp {
+			if socketAddresses["tcp "+input.TcpAddress] {
+				return fmt.Errorf("invalid input configuration: tcp_address '%v' is used by more than one input", input.TcpAddress)
+			}
+			socketAddresses["tcp "+input.TcpAddress] = true
+		}
+		if input.Type == inputTypeUnix {
+			if socketAddresses["unix "+input.UnixSocketPath] {
+				return fmt.Errorf("invalid input configuration: unix_socket_path '%v' is used by more than one input", input.UnixSocketPath)
+			}
+			socketAddresses["unix "+input.UnixSocketPath] = true
+		}
+		if len(input.PositionFile) > 0 {
+			if positionFiles[input.PositionFile] {
+				return fmt.Errorf("invalid input configuration: position_file '%v' is used by more than one input", input.PositionFile)
+			}
+			positionFiles[input.PositionFile] = true
+		}
+		if input.Type == inputTypeStdin || input.Type == inputTypeJournald {
+			nStdin++
+			if nStdin > 1 {
+				return fmt.Errorf("invalid input configuration: there can only be one input of type %v or %v, because both read from stdin", inputTypeStdin, inputTypeJournald)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *InputConfig) validate() error {
+	var err error
+	prefix := fmt.Sprintf("invalid configuration for input %v", c.Name)
+	if c.Type != inputTypeFile && len(c.PositionFile) > 0 {
+		return fmt.Errorf("%v: cannot use 'position_file' when 'type' is %v", prefix, c.Type)
+	}
+	if len(c.PositionFile) == 0 && c.PositionSyncInterval != 0 {
+		return fmt.Errorf("%v: 'position_sync_interval' can only be used together with 'position_file'", prefix)
+	}
+	if c.PositionSyncInterval < 0 {
+		return fmt.Errorf("%v: invalid 'position_sync_interval': %v", prefix, c.PositionSyncInterval)
+	}
+	if c.Type != inputTypeFile && c.RotationGracePeriod != 0 {
+		return fmt.Errorf("%v: cannot use 'rotation_grace_period' when 'type' is %v", prefix, c.Type)
+	}
+	if c.RotationGracePeriod < 0 {
+		return fmt.Errorf("%v: invalid 'rotation_grace_period': %v", prefix, c.RotationGracePeriod)
+	}
+	if c.Type != inputTypeFile && len(c.ExcludePaths) > 0 {
+		return fmt.Errorf("%v: cannot use 'exclude_paths' when 'type' is %v", prefix, c.Type)
+	}
+	if len(c.ContainerFormat) > 0 {
+		if c.Type != inputTypeFile {
+			return fmt.Errorf("%v: cannot use 'container_format' when 'type' is %v", prefix, c.Type)
+		}
+		if c.ContainerFormat != "docker" && c.ContainerFormat != "cri" && c.ContainerFormat != "auto" {
+			return fmt.Errorf("%v: '%v' is not a valid 'container_format'. Expecting 'docker', 'cri', or 'auto'.", prefix, c.ContainerFormat)
+		}
+	}
+	if len(c.Encoding) > 0 {
+		if c.Type != inputTypeFile {
+			return fmt.Errorf("%v: cannot use 'encoding' when 'type' is %v", prefix, c.Type)
+		}
+		switch c.Encoding {
+		case "utf-8", "utf-16", "utf-16le", "utf-16be", "iso-8859-1", "windows-1252":
+		default:
+			return fmt.Errorf("%v: '%v' is not a valid 'encoding'. Expecting 'utf-8', 'utf-16', 'utf-16le', 'utf-16be', 'iso-8859-1', or 'windows-1252'.", prefix, c.Encoding)
+		}
+	}
+	if c.MaxLineBytes != 0 {
+		if c.Type != inputTypeFile && c.Type != inputTypeStdin && c.Type != inputTypeWebhook && c.Type != inputTypeKafka && c.Type != inputTypeTcp && c.Type != inputTypeUnix && c.Type != inputTypeExec {
+			return fmt.Errorf("%v: cannot use 'max_line_bytes' when 'type' is %v", prefix, c.Type)
+		}
+		if c.MaxLineBytes < 0 {
+			return fmt.Errorf("%v: invalid 'max_line_bytes': %v", prefix, c.MaxLineBytes)
+		}
+	}
+	if len(c.OversizedLines) > 0 {
+		if c.MaxLineBytes == 0 {
+			return fmt.Errorf("%v: 'oversized_lines' can only be used together with 'max_line_bytes'", prefix)
+		}
+		if c.OversizedLines != "truncate" && c.OversizedLines != "drop" {
+			return fmt.Errorf("%v: '%v' is not a valid 'oversized_lines'. Expecting 'truncate' or 'drop'.", prefix, c.OversizedLines)
+		}
+	}
+	if c.Type != inputTypeWebhook && c.WebhookAuth != nil {
+		return fmt.Errorf("%v: cannot use 'webhook_auth' when 'type' is %v", prefix, c.Type)
+	}
+	if c.Type != inputTypeTcp && c.Type != inputTypeUnix && c.Type != inputTypeFluentForward && c.MaxConnections != 0 {
+		return fmt.Errorf("%v: cannot use 'max_connections' when 'type' is %v", prefix, c.Type)
+	}
+	if c.Type != inputTypeTcp && (len(c.TlsCert) > 0 || len(c.TlsKey) > 0 || len(c.TlsClientCA) > 0) {
+		return fmt.Errorf("%v: cannot use 'tls_cert', 'tls_key', or 'tls_client_ca' when 'type' is %v", prefix, c.Type)
+	}
+	if c.Type != inputTypeExec && (len(c.ExecCommand) > 0 || c.ExecStderr || c.ExecRestartDelay != 0 || c.ExecMaxRestartDelay != 0) {
+		return fmt.Errorf("%v: cannot use 'exec_command', 'exec_stderr', 'exec_restart_delay', or 'exec_max_restart_delay' when 'type' is %v", prefix, c.Type)
+	}
+	if c.Multiline != nil {
+		if c.Type != inputTypeFile && c.Type != inputTypeStdin && c.Type != inputTypeKafka && c.Type != inputTypeExec {
+			return fmt.Errorf("%v: cannot use 'multiline' when 'type' is %v", prefix, c.Type)
+		}
+		err = c.Multiline.validate(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.Type == inputTypeStdin:
+		if len(c.Path) > 0 {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is stdin", prefix)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is stdin", prefix)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is stdin", prefix)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is stdin", prefix)
+		}
+	case c.Type == inputTypeFile:
+		err = validateGlobs(&c.PathsAndGlobs, false, prefix)
+		if err != nil {
+			return err
+		}
+		if len(c.FailOnMissingLogfileString) > 0 {
+			c.FailOnMissingLogfile, err = strconv.ParseBool(c.FailOnMissingLogfileString)
+			if err != nil {
+				return fmt.Errorf("%v: '%v' is not a valid boolean value in 'fail_on_missing_logfile'", prefix, c.FailOnMissingLogfileString)
+			}
+		}
+	case c.Type == inputTypeWebhook:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeWebhook)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeWebhook)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeWebhook)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeWebhook)
+		}
+		if c.WebhookPath == "" {
+			return fmt.Errorf("%v: 'webhook_path' is required for input type \"webhook\"", prefix)
+		} else if c.WebhookPath[0] != '/' {
+			return fmt.Errorf("%v: 'webhook_path' must start with \"/\"", prefix)
+		}
+		if c.WebhookFormat != "text_single" && c.WebhookFormat != "text_bulk" && c.WebhookFormat != "json_single" && c.WebhookFormat != "json_bulk" && c.WebhookFormat != "json_lines" && c.WebhookFormat != "loki_push" && c.WebhookFormat != "otlp_logs" {
+			return fmt.Errorf("%v: 'webhook_format' must be \"text_single|text_bulk|json_single|json_bulk|json_lines|loki_push|otlp_logs\"", prefix)
+		}
+		if c.WebhookJsonSelector == "" {
+			return fmt.Errorf("%v: 'webhook_json_selector' is required for input type \"webhook\"", prefix)
+		} else if c.WebhookJsonSelector[0] != '.' {
+			return fmt.Errorf("%v: 'webhook_json_selector' must start with \".\"", prefix)
+		}
+		if c.WebhookFormat == "text_bulk" && c.WebhookTextBulkSeparator == "" {
+			return fmt.Errorf("%v: 'webhook_text_bulk_separator' is required for input type \"webhook\" and webhook_format \"text_bulk\"", prefix)
+		}
+		if c.WebhookQueueSize < 0 {
+			return fmt.Errorf("%v: invalid 'webhook_queue_size': %v", prefix, c.WebhookQueueSize)
+		}
+		if c.WebhookMaxBodyBytes < 0 {
+			return fmt.Errorf("%v: invalid 'webhook_max_body_bytes': %v", prefix, c.WebhookMaxBodyBytes)
+		}
+		if c.WebhookAuth != nil {
+			err = c.WebhookAuth.validate(prefix)
+			if err != nil {
+				return err
+			}
+		}
+	case c.Type == inputTypeSyslog:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeSyslog)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeSyslog)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeSyslog)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeSyslog)
+		}
+		if len(c.SyslogUdpAddress) == 0 && len(c.SyslogTcpAddress) == 0 {
+			return fmt.Errorf("%v: one of 'syslog_udp_address' or 'syslog_tcp_address' is required for input type \"syslog\"", prefix)
+		}
+	case c.Type == inputTypeFluentForward:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeFluentForward)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeFluentForward)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeFluentForward)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeFluentForward)
+		}
+		if c.MaxConnections < 0 {
+			return fmt.Errorf("%v: invalid 'max_connections': %v", prefix, c.MaxConnections)
+		}
+	case c.Type == inputTypeGelf:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeGelf)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeGelf)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeGelf)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeGelf)
+		}
+		if len(c.GelfUdpAddress) == 0 && len(c.GelfTcpAddress) == 0 {
+			return fmt.Errorf("%v: one of 'gelf_udp_address' or 'gelf_tcp_address' is required for input type \"gelf\"", prefix)
+		}
+		if c.GelfChunkTimeout < 0 {
+			return fmt.Errorf("%v: invalid 'gelf_chunk_timeout': %v", prefix, c.GelfChunkTimeout)
+		}
+	case c.Type == inputTypeTcp || c.Type == inputTypeUnix:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, c.Type)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, c.Type)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, c.Type)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, c.Type)
+		}
+		if c.Type == inputTypeTcp && len(c.TcpAddress) == 0 {
+			return fmt.Errorf("%v: 'tcp_address' is required for input type \"tcp\"", prefix)
+		}
+		if c.Type == inputTypeUnix && len(c.UnixSocketPath) == 0 {
+			return fmt.Errorf("%v: 'unix_socket_path' is required for input type \"unix\"", prefix)
+		}
+		if c.MaxConnections < 0 {
+			return fmt.Errorf("%v: invalid 'max_connections': %v", prefix, c.MaxConnections)
+		}
+		if (len(c.TlsCert) > 0) != (len(c.TlsKey) > 0) {
+			return fmt.Errorf("%v: 'tls_cert' and 'tls_key' must be configured together", prefix)
+		}
+		if len(c.TlsClientCA) > 0 && len(c.TlsCert) == 0 {
+			return fmt.Errorf("%v: cannot use 'tls_client_ca' without 'tls_cert' and 'tls_key'", prefix)
+		}
+	case c.Type == inputTypeExec:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeExec)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeExec)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeExec)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeExec)
+		}
+		if len(c.ExecCommand) == 0 || len(c.ExecCommand[0]) == 0 {
+			return fmt.Errorf("%v: 'exec_command' is required for input type \"exec\"", prefix)
+		}
+		if c.ExecRestartDelay < 0 {
+			return fmt.Errorf("%v: invalid 'exec_restart_delay': %v", prefix, c.ExecRestartDelay)
+		}
+		if c.ExecMaxRestartDelay < c.ExecRestartDelay {
+			return fmt.Errorf("%v: 'exec_max_restart_delay' %v must not be less than 'exec_restart_delay' %v", prefix, c.ExecMaxRestartDelay, c.ExecRestartDelay)
+		}
+	case c.Type == inputTypeJournald:
+		if c.Path != "" {
+			return fmt.Errorf("%v: cannot use 'path' when 'type' is %v", prefix, inputTypeJournald)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("%v: cannot use 'paths' when 'type' is %v", prefix, inputTypeJournald)
+		}
+		if c.Readall {
+			return fmt.Errorf("%v: cannot use 'readall' when 'type' is %v", prefix, inputTypeJournald)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("%v: cannot use 'poll_interval' when 'type' is %v", prefix, inputTypeJournald)
+		}
+		if c.JournaldFormat != "export" && c.JournaldFormat != "json" {
+			return fmt.Errorf("%v: 'journald_format' must be \"export|json\"", prefix)
+		}
+	case c.Type == inputTypeKafka:
+		if len(c.KafkaBrokers) == 0 {
+			return fmt.Errorf("%v: Kafka 'kafka_brokers' cannot be empty", prefix)
+		}
+		if len(c.KafkaTopics) == 0 {
+			return fmt.Errorf("%v: Kafka 'kafka_topics' cannot be empty", prefix)
+		}
+
+		matched, _ := regexp.MatchString(`^[0-9]\.[0-9]\.[0-9]$`, c.KafkaVersion)
+		if !matched {
+			return fmt.Errorf("%v: Kafka 'kafka_version' must a valid semantic version X.Y.Z", prefix)
+		}
+
+		versionParts := strings.Split(c.KafkaVersion, ".")
+		vMajor, vMajorErr := strconv.Atoi(versionParts[0])
+		vMinor, vMinorErr := strconv.Atoi(versionParts[1])
+		if vMajorErr != nil && vMinorErr != nil && vMajor < 1 && vMinor < 8 {
+			return fmt.Errorf("%v: Kafka 'kafka_version' must be >= 0.8.0", prefix)
+		}
+
+	default:
+		return fmt.Errorf("unsupported input type '%v' for input %v", c.Type, c.Name)
+	}
+	return nil
+}
+
+func (c *MultilineConfig) validate(prefix string) error {
+	if len(c.StartPattern) == 0 && len(c.ContinuationPattern) == 0 {
+		return fmt.Errorf("%v: one of 'multiline.start_pattern' or 'multiline.continuation_pattern' is required", prefix)
+	}
+	if len(c.StartPattern) > 0 && len(c.ContinuationPattern) > 0 {
+		return fmt.Errorf("%v: use either 'multiline.start_pattern' or 'multiline.continuation_pattern' but not both", prefix)
+	}
+	if c.MaxLines < 0 {
+		return fmt.Errorf("%v: invalid 'multiline.max_lines': %v", prefix, c.MaxLines)
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("%v: invalid 'multiline.max_bytes': %v", prefix, c.MaxBytes)
+	}
+	if c.FlushTimeout < 0 {
+		return fmt.Errorf("%v: invalid 'multiline.flush_timeout': %v", prefix, c.FlushTimeout)
+	}
+	return nil
+}
+
+func (c *WebhookAuthConfig) validate(prefix string) error {
+	for _, secret := range []struct {
+		name, value, file string
+	}{
+		{"bearer_token", c.BearerToken, c.BearerTokenFile},
+		{"password_hash", c.PasswordHash, c.PasswordHashFile},
+		{"hmac_secret", c.HmacSecret, c.HmacSecretFile},
+	} {
+		if len(secret.value) > 0 && len(secret.file) > 0 {
+			return fmt.Errorf("%v: use either 'webhook_auth.%v' or 'webhook_auth.%v_file' but not both", prefix, secret.name, secret.name)
+		}
+	}
+	hasBearerToken := len(c.BearerToken) > 0 || len(c.BearerTokenFile) > 0
+	hasPasswordHash := len(c.PasswordHash) > 0 || len(c.PasswordHashFile) > 0
+	hasHmacSecret := len(c.HmacSecret) > 0 || len(c.HmacSecretFile) > 0
+	if !hasBearerToken && !hasPasswordHash && !hasHmacSecret && len(c.Username) == 0 {
+		return fmt.Errorf("%v: 'webhook_auth' requires a 'bearer_token', basic auth 'username' and 'password_hash', or an 'hmac_secret'", prefix)
+	}
+	if len(c.Username) > 0 != hasPasswordHash {
+		return fmt.Errorf("%v: 'webhook_auth.username' and 'webhook_auth.password_hash' must be used together", prefix)
+	}
+	if hasBearerToken && hasPasswordHash {
+		return fmt.Errorf("%v: use either 'webhook_auth.bearer_token' or basic auth but not both, because both use the Authorization header", prefix)
+	}
+	if len(c.PasswordHash) > 0 {
+		if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+			return fmt.Errorf("%v: 'webhook_auth.password_hash' is not a valid bcrypt hash: %v", prefix, err)
+		}
+	}
+	if !hasHmacSecret {
+		if len(c.HmacHeader) > 0 || len(c.HmacFormat) > 0 {
+			return fmt.Errorf("%v: 'webhook_auth.hmac_header' and 'webhook_auth.hmac_format' can only be used together with 'webhook_auth.hmac_secret'", prefix)
+		}
+		return nil
+	}
+	if c.HmacFormat != "github" && c.HmacFormat != "stripe" && c.HmacFormat != "hex" {
+		return fmt.Errorf("%v: '%v' is not a valid 'webhook_auth.hmac_format'. Expecting 'github', 'stripe', or 'hex'.", prefix, c.HmacFormat)
+	}
+	if len(c.HmacHeader) == 0 {
+		return fmt.Errorf("%v: 'webhook_auth.hmac_header' is required for 'hmac_format' %v", prefix, c.HmacFormat)
+	}
+	return nil
+}
+
+func (c ImportConfig) validate() error {
+	switch c.Type {
+	case importPatternsType:
+		for _, field := range []struct {
+			name    string
+			present bool
+		}{
+			{"inputs", len(c.Defaults.Inputs) > 0},
+			{"path", len(c.Defaults.Path) > 0},
+			{"paths", len(c.Defaults.Paths) > 0},
+			{"exclude_paths", len(c.Defaults.ExcludePaths) > 0},
+			{"retention", c.Defaults.Retention != 0},
+			{"buckets", len(c.Defaults.Buckets) > 0},
+			{"quantiles", len(c.Defaults.Quantiles) > 0},
+			{"max_age", c.Defaults.MaxAge != 0},
+			{"labels", len(c.Defaults.Labels) > 0},
+		} {
+			if field.present {
+				return fmt.Errorf("invalid imports configuration: cannot use imports.%v for imports.type=%v", field.name, c.Type)
+			}
+		}
+	case importMetricsType:
+		if len(c.Defaults.Path) > 0 && len(c.Defaults.Paths) > 0 {
+			return fmt.Errorf("invalid imports configuration: use either imports.defaults.path or imports.defaults.paths, but not both")
+		}
+		// TODO: Validate the other fields
+	default:
+		return fmt.Errorf("invalid imports configuration: unsupported imports.type: %v", c.Type)
+	}
+	if len(c.Dir) > 0 && len(c.File) > 0 {
+		return fmt.Errorf("invalid imports configuration: either use imports.dir or imports.file, but not both")
+	}
+	if len(c.Dir) == 0 && len(c.File) == 0 {
+		return fmt.Errorf("invalid imports configuration: one of imports.dir or imports.file must be present")
+	}
+	return nil
+}
+
+func (c *GrokPatternsConfig) validate() error {
+	return nil
+}
+
+func (c *ImportsConfig) validate() error {
+	for _, cfg := range *c {
+		err := cfg.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MetricsConfig) validate(inputs InputsConfig) error {
+	if len(*c) == 0 {
+		return fmt.Errorf("Invalid metrics configuration: 'metrics' must not be empty.")
+	}
+	metricNames := make(map[string]bool)
+	for i := range *c {
+		metric := &(*c)[i] // validate modifies the metric, therefore we must use it by reference here.
+		err := metric.validate()
+		if err != nil {
+			return err
+		}
+		_, exists := metricNames[metric.Name]
+		if exists {
+			return fmt.Errorf("Invalid metric configuration: metric '%v' defined twice.", metric.Name)
+		}
+		metricNames[metric.Name] = true
+
+		if len(metric.Path) > 0 && len(metric.Paths) > 0 {
+			return fmt.Errorf("invalid metric configuration: metric %v defines both path and paths, you should use either one or the other", metric.Name)
+		}
+		if len(metric.Path) > 0 {
+			metric.Paths = []string{metric.Path}
+			metric.Path = ""
+		}
+		for _, inputName := range metric.Inputs {
+			if inputs.find(inputName) == nil {
+				return fmt.Errorf("invalid metric configuration: metric %v refers to input %v, but there is no input with that name", metric.Name, inputName)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *MetricConfig) validate() error {
+	switch {
+	case c.Type == "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.type' must not be empty.")
+	case c.Name == "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.name' must not be empty.")
+	case c.Help == "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.help' must not be empty.")
+	}
+	switch c.Format {
+	case "", "grok":
+		if c.Match == "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
+		}
+		if len(c.MatchFields) > 0 {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match_fields' can only be used for metrics with format json or logfmt.")
+		}
+	case "json", "logfmt":
+		if c.Match != "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' cannot be used for metrics with format %v, use 'metrics.match_fields' instead.", c.Format)
+		}
+		if len(c.DeleteMatch) > 0 {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.delete_match' cannot be used for metrics with format %v.", c.Format)
+		}
+		for field, pattern := range c.MatchFields {
+			if c.Format == "json" {
+				if _, err := jsonselector.Parse(field); err != nil {
+					return fmt.Errorf("Invalid metric configuration: 'metrics.match_fields': %v", err)
+				}
+			} else if !isValidLogfmtKey(field) {
+				return fmt.Errorf("Invalid metric configuration: 'metrics.match_fields': %q is not a valid logfmt key.", field)
+			}
+			if pattern == "" {
+				return fmt.Errorf("Invalid metric configuration: 'metrics.match_fields': the pattern for %v must not be empty.", field)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid 'metrics.format': '%v'. Expecting 'grok', 'json', or 'logfmt'.", c.Format)
+	}
+	if len(c.RequiredFields) > 0 && c.Format != "logfmt" {
+		return fmt.Errorf("Invalid metric configuration: 'metrics.required_fields' can only be used for metrics with format logfmt.")
+	}
+	for _, field := range c.RequiredFields {
+		if !isValidLogfmtKey(field) {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.required_fields': %q is not a valid logfmt key.", field)
+		}
+	}
+	err := validateGlobs(&c.PathsAndGlobs, true, fmt.Sprintf("invalid metric configuration: %v", c.Name))
+	if err != nil {
+		return err
+	}
+	var cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed bool
+	switch c.Type {
+	case "counter":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, false, false
+	case "gauge":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = true, false, false, false
+	case "histogram":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, true, false, false
+	case "summary":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, true, true
+	default:
+		return fmt.Errorf("Invalid 'metrics.type': '%v'. We currently only support 'counter' and 'gauge'.", c.Type)
+	}
+	switch {
+	case len(c.Value) == 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.value' must not be empty for %v metrics.", c.Type)
+	case !cumulativeAllowed && c.Cumulative:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.cumulative' cannot be used for %v metrics.", c.Type)
+	case !bucketsAllowed && len(c.Buckets) > 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.buckets' cannot be used for %v metrics.", c.Type)
+	case !quantilesAllowed && len(c.Quantiles) > 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.quantiles' cannot be used for %v metrics.", c.Type)
+	case !maxAgeAllowed && c.MaxAge != 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.max_age' cannot be used for %v metrics.", c.Type)
+	}
+	if len(c.DeleteMatch) > 0 && len(c.Labels) == 0 {
+		return fmt.Errorf("Invalid metric configuration: 'metrics.delete_match' is only supported for metrics with labels.")
+	}
+	if len(c.DeleteMatch) == 0 && len(c.DeleteLabelTemplates) > 0 {
+		return fmt.Errorf("Invalid metric configuration: 'metrics.delete_labels' can only be used when 'metrics.delete_match' is present.")
+	}
+	if c.Retention > 0 && len(c.Labels) == 0 {
+		return fmt.Errorf("Invalid metric configuration: 'metrics.retention' is only supported for metrics with labels.")
+	}
+	for _, deleteLabelTemplate := range c.DeleteLabelTemplates {
+		found := false
+		for _, labelTemplate := range c.LabelTemplates {
+			if deleteLabelTemplate.Name() == labelTemplate.Name() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Invalid metric configuration: '%v' cannot be used as a delete_label, because the metric does not have a label named '%v'.", deleteLabelTemplate.Name(), deleteLabelTemplate.Name())
+		}
+	}
+	// InitTemplates() validates that labels/delete_labels/value are present as grok_fields in the grok pattern.
+	return nil
+}
+
+func isValidLogfmtKey(key string) bool {
+	return len(key) > 0 && !strings.ContainsAny(key, " =\"")
+}
+
+func (c *ServerConfig) validate() error {
+
+	clientAuthTypes := map[string]interface{}{
+		"NoClientCert":               nil,
+		"RequestClientCert":          nil,
+		"RequireAnyClientCert":       nil,
+		"VerifyClientCertIfGiven":    nil,
+		"RequireAndVerifyClientCert": nil,
+	}
+
+	switch {
+	case c.Protocol != "https" && c.Protocol != "http":
+		return fmt.Errorf("invalid 'server.protocol': '%v'. Expecting 'http' or 'https'.", c.Protocol)
+	case c.Port <= 0:
+		return fmt.Errorf("invalid 'server.port': '%v'.", c.Port)
+	case !strings.HasPrefix(c.Path, "/"):
+		return fmt.Errorf("invalid server configuration: 'server.path' must start with '/'.")
+	case c.Protocol == "https":
+		if c.Cert != "" && c.Key == "" {
+			return fmt.Errorf("invalid server configuration: 'server.cert' must not be specified without 'server.key'")
+		}
+		if c.Cert == "" && c.Key != "" {
+			return fmt.Errorf("invalid server configuration: 'server.key' must not be specified without 'server.cert'")
+		}
+		if len(c.ClientAuth) > 0 {
+			if len(c.ClientCA) == 0 {
+				return fmt.Errorf("invalid server configuration: cannot use client_auth without client_ca")
+			}
+			if _, ok := clientAuthTypes[c.ClientAuth]; !ok {
+				return fmt.Errorf("invalid server configuration: client_auth '%v' is invalid", c.ClientAuth)
+			}
+		}
+	case c.Protocol == "http":
+		if c.Cert != "" || c.Key != "" {
+			return fmt.Errorf("invalid server configuration: 'server.cert' and 'server.key' can only be configured for protocol 'https'")
+		}
+		if len(c.ClientCA) > 0 {
+			return fmt.Errorf("invalid server configuration: client_ca can only be configured for protocol 'https'")
+		}
+		if len(c.ClientAuth) > 0 {
+			return fmt.Errorf("invalid server configuration: client_auth can only be configured for protocol 'https'")
+		}
+	}
+	return nil
+}
+
+// Returns the input with the given name, or nil if there is no such input.
+func (c InputsConfig) find(name string) *InputConfig {
+	for i := range c {
+		if c[i].Name == name {
+			return &c[i]
+		}
+	}
+	return nil
+}
+
+// Made this public so it can be called when converting config v3 to config v4.
+func AddDefaultsAndValidate(cfg *Config) error {
+	var err error
+	cfg.addDefaults()
+	for i := range []MetricConfig(cfg.AllMetrics) {
+		err = cfg.AllMetrics[i].InitTemplates()
+		if err != nil {
+			return err
+		}
+	}
+	return cfg.validate()
+}
+
+// Made this public so MetricConfig can be initialized in tests.
+func (metric *MetricConfig) InitTemplates() error {
+	var (
+		err   error
+		tmplt template.Template
+		msg   = "invalid configuration: failed to read metric %v: error parsing %v template: %v: " +
+			"don't forget to put a . (dot) in front of grok fields, otherwise it will be interpreted as a function."
+	)
+	for _, t := range []struct {
+		src  map[string]string    // label / template string as read from the config file
+		dest *[]template.Template // parsed template used internally in grok_exporter
+	}{
+		{
+			src:  metric.Labels,
+			dest: &(metric.LabelTemplates),
+		},
+		{
+			src:  metric.DeleteLabels,
+			dest: &(metric.DeleteLabelTemplates),
+		},
+	} {
+		*t.dest = make([]template.Template, 0, len(t.src))
+		for name, templateString := range t.src {
+			tmplt, err = template.New(name, templateString)
+			if err != nil {
+				return fmt.Errorf(msg, fmt.Sprintf("label %v", metric.Name), name, err.Error())
+			}
+			*t.dest = append(*t.dest, tmplt)
+		}
+	}
+	metric.ValueTemplate, err = template.New("__value__", metric.Value)
+	if err != nil {
+		return fmt.Errorf(msg, "value", metric.Name, err.Error())
+	}
+	return nil
+}
+
+// YAML representation, does not include default values.
+func (cfg *Config) String() string {
+	stripped := cfg.copy()
+	if stripped.Global.RetentionCheckInterval == defaultRetentionCheckInterval {
+		stripped.Global.RetentionCheckInterval = 0
+	}
+	if stripped.Global.StateSyncInterval == defaultStateSyncInterval {
+		stripped.Global.StateSyncInterval = 0
+	}
+	for i := range stripped.Inputs {
+		input := &stripped.Inputs[i]
+		if input.Name == input.Type {
+			input.Name = ""
+		}
+		if input.FailOnMissingLogfileString == "true" {
+			input.FailOnMissingLogfileString = ""
+		}
+		if input.PositionSyncInterval == defaultPositionSyncInterval {
+			input.PositionSyncInterval = 0
+		}
+		if input.OversizedLines == "truncate" {
+			input.OversizedLines = ""
+		}
+		if input.FluentForwardAddress == defaultFluentForwardAddress {
+			input.FluentForwardAddress = ""
+		}
+		if input.FluentForwardRecordKey == defaultFluentForwardRecordKey {
+			input.FluentForwardRecordKey = ""
+		}
+		if input.GelfMessageField == defaultGelfMessageField {
+			input.GelfMessageField = ""
+		}
+		if input.GelfChunkTimeout == defaultGelfChunkTimeout {
+			input.GelfChunkTimeout = 0
+		}
+		if input.MaxConnections == defaultMaxConnections {
+			input.MaxConnections = 0
+		}
+		if input.ExecRestartDelay == defaultExecRestartDelay {
+			input.ExecRestartDelay = 0
+		}
+		if input.ExecMaxRestartDelay == defaultExecMaxRestartDelay {
+			input.ExecMaxRestartDelay = 0
+		}
+		if input.WebhookQueueSize == defaultWebhookQueueSize {
+			input.WebhookQueueSize = 0
+		}
+		if input.WebhookMaxBodyBytes == defaultWebhookMaxBodyBytes {
+			input.WebhookMaxBodyBytes = 0
+		}
+		if input.Multiline != nil {
+			if input.Multiline.MaxLines == defaultMultilineMaxLines {
+				input.Multiline.MaxLines = 0
+			}
+			if input.Multiline.MaxBytes == defaultMultilineMaxBytes {
+				input.Multiline.MaxBytes = 0
+			}
+			if input.Multiline.FlushTimeout == defaultMultilineFlushTimeout {
+				input.Multiline.FlushTimeout = 0
+			}
+		}
+		if len(input.Paths) == 1 {
+			input.Path = input.Paths[0]
+			input.Paths = nil
+		}
+	}
+	if stripped.Server.Path == "/metrics" {
+		stripped.Server.Path = ""
+	}
+	if stripped.Server.ClientAuth == "RequireAndVerifyClientCert" {
+		stripped.Server.ClientAuth = ""
+	}
+	for i := range stripped.OrigMetrics {
+		if len(stripped.OrigMetrics[i].Paths) == 1 {
+			stripped.OrigMetrics[i].Path = stripped.OrigMetrics[i].Paths[0]
+			stripped.OrigMetrics[i].Paths = nil
+		}
+	}
+	return stripped.marshalToString()
+}
+
+func (cfg *Config) copy() *Config {
+	var result Config
+	err := yaml.Unmarshal([]byte(cfg.marshalToString()), &result)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "unexpected fatal error: failed to unmarshal config: %v", err)
+	}
+	return &result
+}
+
+func (cfg *Config) marshalToString() string {
+	var newlineEscape = "___GROK_EXPORTER_NEWLINE_ESCAPE___"
+	for i := range cfg.Inputs {
+		cfg.Inputs[i].WebhookTextBulkSeparator = strings.Replace(cfg.Inputs[i].WebhookTextBulkSeparator, "\n", newlineEscape, -1)
+	}
+	out, err := yaml.Marshal(cfg)
+	// restore the original separator, because marshalToString() is also called on the original config in copy()
+	for i := range cfg.Inputs {
+		cfg.Inputs[i].WebhookTextBulkSeparator = strings.Replace(cfg.Inputs[i].WebhookTextBulkSeparator, newlineEscape, "\n", -1)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "unexpected fatal error: failed to marshal config: %v", err)
+		os.Exit(1)
+	}
+	result := string(out)
+	// Pretend fail_on_missing_logfile is a boolean, remove quotes
+	result = strings.Replace(result, "fail_on_missing_logfile: \"false\"", "fail_on_missing_logfile: false", -1)
+	result = strings.Replace(result, "fail_on_missing_logfile: \"true\"", "fail_on_missing_logfile: true", -1)
+	// write newlines like \n instead of actual newlines
+	result = strings.Replace(result, newlineEscape, "\\n", -1)
+	return result
+}
@@ -0,0 +1,1282 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v4
+
+import (
+	"fmt"
+	v3 "github.com/fstab/grok_exporter/config/v3"
+	"strings"
+	"testing"
+	"time"
+)
+
+const counter_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: x/x/x
+      fail_on_missing_logfile: false
+      readall: true
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+      labels:
+          label_a: '{{.some_grok_field_a}}'
+          label_b: '{{.some_grok_field_b}}'
+server:
+    protocol: https
+    port: 1111
+`
+
+const gauge_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: x/x/x
+metrics:
+    - type: gauge
+      name: test_histogram
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      cumulative: true
+server:
+    protocol: http
+    host: localhost
+    port: 9144
+`
+
+const histogram_config = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+metrics:
+    - type: histogram
+      name: test_histogram
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      buckets: $BUCKETS
+server:
+    protocol: http
+    port: 9144
+`
+
+const summary_config = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+metrics:
+    - type: summary
+      name: test_summary
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      quantiles: $QUANTILES
+server:
+    protocol: http
+    port: 9144
+`
+
+const delete_labels_config = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+      labels:
+          label_a: '{{.some_grok_field_a}}'
+          label_b: '{{.some_grok_field_b}}'
+      delete_match: Some shutdown message
+      delete_labels:
+          label_a: '{{.some_grok_field_a}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+const retention_config = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE:date}.
+      retention: 2h45m0s
+      labels:
+          date: '{{.date}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+const multiple_paths_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      paths:
+      - /tmp/dir1/*.log
+      - /tmp/dir2/*.log
+      fail_on_missing_logfile: false
+      readall: true
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      paths:
+      - /tmp/dir1/*.log
+      - /tmp/dir2/*.log
+      match: Some text here, then a %{DATE}.
+      labels:
+          label_a: '{{.some_grok_field_a}}'
+          label_b: '{{.some_grok_field_b}}'
+server:
+    protocol: https
+    port: 1111
+`
+
+const empty_grok_section = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /tmp/test/*.log
+metrics:
+    - type: counter
+      name: errors_total
+      help: Dummy help message.
+      match: ERROR
+server:
+    protocol: http
+    port: 9144
+`
+
+const config_with_imports = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+imports:
+    - type: metrics
+      file: /etc/grok/metrics.d/*.yaml
+      defaults:
+          path: /var/log/syslog/*
+          retention: 2h30m0s
+          buckets: [0, 1, 2, 3]
+          quantiles: {0.5: 0.05, 0.9: 0.02, 0.99: 0.002}
+          labels:
+              logfile: '{{base .logfile}}'
+grok_patterns:
+    - WARN WARN
+    - ERROR ERROR
+metrics:
+    - type: counter
+      name: errors_total
+      help: Dummy help message.
+      match: ERROR
+server:
+    protocol: http
+    port: 9144
+`
+
+const multiple_inputs_config = `
+global:
+    config_version: 4
+    max_lines_in_buffer: 1024
+inputs:
+    - type: file
+      path: /var/log/syslog
+    - name: access_log
+      type: file
+      paths:
+      - /var/log/nginx/access.log
+      - /var/log/nginx/access.log.1
+    - type: webhook
+      webhook_path: /webhook
+      webhook_format: text_single
+      webhook_json_selector: .message
+      webhook_text_bulk_separator: \n\n
+metrics:
+    - type: counter
+      name: errors_total
+      help: Dummy help message.
+      match: ERROR
+    - type: counter
+      name: requests_total
+      help: Dummy help message.
+      inputs:
+      - access_log
+      - webhook
+      match: GET
+server:
+    protocol: http
+    port: 9144
+`
+
+const import_1 = `
+    - type: histogram
+      name: test_histogram_1
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      paths:
+        - /var/log/syslog/2021-*.log
+        - /var/log/syslog/2022-*.log
+    - type: summary
+      name: test_summary_1
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      retention: 4h30m0s
+`
+
+const import_2 = `
+    - type: histogram
+      name: test_histogram_2
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      value: '{{.val}}'
+      buckets: [0, 1, 2, 3, 4]
+      retention: 5h30m0s
+    - type: summary
+      name: test_summary_2
+      help: Dummy help message.
+      match: Some %{NUMBER:val} here, then a %{DATE}.
+      quantiles: {0.5: 0.05, 0.9: 0.02, 0.99: 0.002, 0.999: 0.0002}
+      value: '{{.val}}'
+`
+
+type mockLoader struct {
+	files []*v3.ConfigFile
+}
+
+func (f *mockLoader) LoadDir(dir string) ([]*v3.ConfigFile, error) {
+	return f.files, nil
+}
+
+func (f *mockLoader) LoadGlob(globString string) ([]*v3.ConfigFile, error) {
+	return f.files, nil
+}
+
+func TestCounterValidConfig(t *testing.T) {
+	loadOrFail(t, counter_config)
+}
+
+func TestGaugeValidConfig(t *testing.T) {
+	loadOrFail(t, gauge_config)
+}
+
+func TestGaugeInvalidConfig(t *testing.T) {
+	invalidCfg := strings.Replace(gauge_config, "      value: '{{.val}}'\n", "", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil || !strings.Contains(err.Error(), "'metrics.value' must not be empty") {
+		t.Fatal("Expected error message saying that value is missing.")
+	}
+}
+
+func TestGaugeCumulativeConfig(t *testing.T) {
+	cfg := loadOrFail(t, gauge_config)
+	if cfg.AllMetrics[0].Cumulative != true {
+		t.Fatal("Expected 'true' as gauge cumulative option.")
+	}
+}
+
+func TestGaugeDefaultCumulativeConfig(t *testing.T) {
+	cfgString := strings.Replace(gauge_config, "      cumulative: true\n", "", 1)
+	cfg := loadOrFail(t, cfgString)
+	if cfg.AllMetrics[0].Cumulative != false {
+		t.Fatal("Expected 'false' as default for gauge cumulative option.")
+	}
+}
+
+func TestGaugeInvalidCumulativeConfig(t *testing.T) {
+	invalidCfg := strings.Replace(gauge_config, "      cumulative: true\n", "      cumulative: dontknow\n", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil || !strings.Contains(err.Error(), "dontknow") {
+		t.Fatal("Expected error message saying that 'dontknow' is invalid.", err)
+	}
+}
+
+func TestHistogramValidConfig(t *testing.T) {
+	validCfg := strings.Replace(histogram_config, "$BUCKETS", "[0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10]", 1)
+	cfg := loadOrFail(t, validCfg)
+	metric := cfg.AllMetrics[0]
+	if len(metric.Buckets) != 11 || metric.Buckets[0] != 0.005 || metric.Buckets[10] != 10 {
+		t.Fatalf("Error parsing bucket list: Got %v", metric.Buckets)
+	}
+}
+
+func TestHistogramInvalidConfig(t *testing.T) {
+	invalidCfg := strings.Replace(histogram_config, "$BUCKETS", "[0.005, oops, 10]", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatal("Expected error saying that 'oops' is not a valid number.")
+	}
+}
+
+func TestSummaryValidConfig(t *testing.T) {
+	validCfg := strings.Replace(summary_config, "$QUANTILES", "{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}", 1)
+	cfg := loadOrFail(t, validCfg)
+	metric := cfg.AllMetrics[0]
+	if len(metric.Quantiles) != 3 || metric.Quantiles[0.5] != 0.05 || metric.Quantiles[0.99] != 0.001 {
+		t.Fatalf("Error parsing bucket list: Got %v", metric.Buckets)
+	}
+}
+
+func TestSummaryInvalidConfig(t *testing.T) {
+	invalidCfg := strings.Replace(summary_config, "$QUANTILES", "[0.005, 0.2, 10]", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil {
+		t.Fatal("Expected error, because quantiles are a list and not a map.")
+	}
+}
+
+func TestValueInvalidTemplate(t *testing.T) {
+	invalidCfg := strings.Replace(gauge_config, "value: '{{.val}}'", "value: '{{val}}'", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil {
+		t.Fatal("Expected error, because using {{val}} instead of {{.val}}.")
+	}
+}
+
+func TestDeleteLabelConfig(t *testing.T) {
+	cfg := loadOrFail(t, delete_labels_config)
+	if len(cfg.AllMetrics) != 1 {
+		t.Fatalf("Expected 1 metric, but found %v.", len(cfg.AllMetrics))
+	}
+	metric := cfg.AllMetrics[0]
+	if len(metric.LabelTemplates) != 2 {
+		t.Fatalf("Expected 2 label templates, but found %v.", len(metric.LabelTemplates))
+	}
+	if len(metric.DeleteLabelTemplates) != 1 {
+		t.Fatalf("Expected 1 delete label template, but found %v.", len(metric.DeleteLabelTemplates))
+	}
+}
+
+func TestRetentionValidConfig(t *testing.T) {
+	cfg := loadOrFail(t, retention_config)
+	if cfg.AllMetrics[0].Retention != 2*time.Hour+45*time.Minute {
+		t.Fatalf("Error parsing retention, got %v", (cfg.AllMetrics)[0].Retention)
+	}
+}
+
+func TestRetentionInvalidConfig(t *testing.T) {
+	invalidCfg := strings.Replace(retention_config, "2h45m0s", "abc", 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil || !strings.Contains(err.Error(), "abc") {
+		t.Fatal("Expected error saying that 'abc' is not a valid duration.")
+	}
+}
+
+func TestPathsValidConfig(t *testing.T) {
+	loadOrFail(t, multiple_paths_config)
+}
+
+func TestDuplicateInputPaths(t *testing.T) {
+	var s = `type: file
+      path: /some/path/file.log`
+	invalidCfg := strings.Replace(multiple_paths_config, "type: file", s, 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil {
+		t.Fatal("Expected error, but unmarshalling was successful.")
+	}
+	// Make sure it's the right error and not an error accidentally caused by incorrect indentation of the injected 'path' field.
+	if !strings.Contains(err.Error(), "use either 'path' or 'paths' but not both") {
+		t.Fatalf("Expected error message about path and paths being mutually exclusive, but got %v", err)
+	}
+}
+
+func TestDuplicateMetricPaths(t *testing.T) {
+	var s = `help: Dummy help message.
+      path: /some/path/file.log`
+	invalidCfg := strings.Replace(multiple_paths_config, "help: Dummy help message.", s, 1)
+	_, err := Unmarshal([]byte(invalidCfg))
+	if err == nil {
+		t.Fatal("Expected error, but unmarshalling was successful.")
+	}
+	// Make sure it's the right error and not an error accidentally caused by incorrect indentation of the injected 'path' field.
+	if !strings.Contains(err.Error(), "use either 'path' or 'paths' but not both") {
+		t.Fatalf("Expected error message about path and paths being mutually exclusive, but got %v", err)
+	}
+}
+
+func TestGlobsAreGenerated(t *testing.T) {
+	cfg, err := Unmarshal([]byte(multiple_paths_config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Inputs[0].Globs) != 2 {
+		t.Fatalf("expected 2 Globs in input config, but found %v", len(cfg.Inputs[0].Globs))
+	}
+	if len(cfg.AllMetrics[0].Globs) != 2 {
+		t.Fatalf("expected 2 Globs in metric config, but found %v", len(cfg.AllMetrics[0].Globs))
+	}
+}
+
+const exclude_paths_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /var/log/nginx/*
+      exclude_paths:
+      - /var/log/nginx/*.gz
+      - /var/log/nginx/error.log
+metrics:
+    - type: counter
+      name: requests_total
+      help: Dummy help message.
+      exclude_paths:
+      - /var/log/nginx/*.1
+      match: GET
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestExcludePaths(t *testing.T) {
+	cfg := loadOrFail(t, exclude_paths_config)
+	if len(cfg.Inputs[0].ExcludeGlobs) != 2 {
+		t.Fatalf("expected 2 exclude globs in input config, but found %v", len(cfg.Inputs[0].ExcludeGlobs))
+	}
+	if len(cfg.AllMetrics[0].ExcludeGlobs) != 1 || !cfg.AllMetrics[0].ExcludeGlobs[0].Match("/var/log/nginx/access.log.1") {
+		t.Fatalf("unexpected exclude globs in metric config: %v", cfg.AllMetrics[0].ExcludeGlobs)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"- type: file\n      path: /var/log/nginx/*\n", "- type: stdin\n", "cannot use 'exclude_paths' when 'type' is stdin"},
+		{"- /var/log/nginx/*.gz", "- /var/log/nginx/[.gz", "invalid glob pattern"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(exclude_paths_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+func TestEmptyGrokSection(t *testing.T) {
+	loadOrFail(t, empty_grok_section)
+}
+
+func TestImportSuccess(t *testing.T) {
+	fileLoader := &mockLoader{
+		files: []*v3.ConfigFile{
+			{Path: "file1.yaml", Contents: import_1},
+			{Path: "file2.yaml", Contents: import_2},
+		},
+	}
+	cfg, err := unmarshal([]byte(config_with_imports), fileLoader)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err.Error())
+	}
+	err = equalsIgnoreIndentation(cfg.String(), config_with_imports)
+	if err != nil {
+		t.Fatalf("Expected:\n%v\nActual:\n%v\n%v", config_with_imports, cfg, err)
+	}
+	if len(cfg.AllMetrics) != 5 {
+		t.Fatalf("expected 5 metrics, but found %v", len(cfg.AllMetrics))
+	}
+	expectMetric(t, cfg.AllMetrics[1], "test_histogram_1", []string{"/var/log/syslog/2021-*.log", "/var/log/syslog/2022-*.log"}, 4, 0, 2*time.Hour+30*time.Minute)
+	expectMetric(t, cfg.AllMetrics[2], "test_summary_1", []string{"/var/log/syslog/*"}, 0, 3, 4*time.Hour+30*time.Minute)
+	expectMetric(t, cfg.AllMetrics[3], "test_histogram_2", []string{"/var/log/syslog/*"}, 5, 0, 5*time.Hour+30*time.Minute)
+	expectMetric(t, cfg.AllMetrics[4], "test_summary_2", []string{"/var/log/syslog/*"}, 0, 4, 2*time.Hour+30*time.Minute)
+}
+
+func expectMetric(t *testing.T, metric MetricConfig, name string, paths []string, bucketLen, quantilesLen int, retention time.Duration) {
+	if metric.Name != name {
+		t.Fatalf("expected metric %v but found %v", name, metric.Name)
+	}
+	if len(metric.Paths) != len(paths) {
+		t.Fatalf("expected len(paths)=%v for metric %v, but found len(paths)=%v", len(paths), name, len(metric.Paths))
+	}
+	for i := range paths {
+		if metric.Paths[i] != paths[i] {
+			t.Fatalf("expected paths[%v]=%v for metric %v, but found paths[%v]=%v", i, paths[i], name, i, metric.Paths[i])
+		}
+	}
+	if len(metric.Buckets) != bucketLen {
+		t.Fatalf("expected %v buckets for metric %v, but found %v buckets", bucketLen, name, len(metric.Buckets))
+	}
+	if len(metric.Quantiles) != quantilesLen {
+		t.Fatalf("expected %v quantiles for metric %v, but found %v quantiles", quantilesLen, name, len(metric.Quantiles))
+	}
+	if metric.Retention != retention {
+		t.Fatalf("expected retention %v for metric %v, but found %v", retention, name, metric.Retention)
+	}
+}
+
+func TestImportDuplicateMetric(t *testing.T) {
+	fileLoader := &mockLoader{
+		files: []*v3.ConfigFile{
+			{Path: "file1.yaml", Contents: import_1},
+			{Path: "file2.yaml", Contents: strings.Replace(import_2, "name: test_histogram_2", "name: errors_total", 1)},
+		},
+	}
+	_, err := unmarshal([]byte(config_with_imports), fileLoader)
+	if err == nil {
+		t.Fatalf("expected error about duplicate metric name, but got no error")
+	}
+	if !strings.Contains(err.Error(), "errors_total") {
+		t.Fatalf("expected error message to contain the name of the duplicate metric")
+	}
+}
+
+func TestMultipleInputs(t *testing.T) {
+	cfg := loadOrFail(t, multiple_inputs_config)
+	if len(cfg.Inputs) != 3 {
+		t.Fatalf("expected 3 inputs, but found %v", len(cfg.Inputs))
+	}
+	for i, name := range []string{"file", "access_log", "webhook"} {
+		if cfg.Inputs[i].Name != name {
+			t.Fatalf("expected name %v for input %v, but found %v", name, i, cfg.Inputs[i].Name)
+		}
+	}
+	if cfg.Global.MaxLinesInBuffer != 1024 {
+		t.Fatalf("expected max_lines_in_buffer 1024, but found %v", cfg.Global.MaxLinesInBuffer)
+	}
+	if len(cfg.AllMetrics[0].Inputs) != 0 || len(cfg.AllMetrics[1].Inputs) != 2 {
+		t.Fatalf("unexpected inputs in metric config: %v, %v", cfg.AllMetrics[0].Inputs, cfg.AllMetrics[1].Inputs)
+	}
+	if cfg.Inputs[2].WebhookQueueSize != 10000 {
+		t.Fatalf("expected default webhook_queue_size 10000, but found %v", cfg.Inputs[2].WebhookQueueSize)
+	}
+	if cfg.Inputs[2].WebhookMaxBodyBytes != 10*1024*1024 {
+		t.Fatalf("expected default webhook_max_body_bytes 10485760, but found %v", cfg.Inputs[2].WebhookMaxBodyBytes)
+	}
+}
+
+func TestDefaultInput(t *testing.T) {
+	cfg := loadOrFail(t, empty_grok_section)
+	if len(cfg.Inputs) != 1 || cfg.Inputs[0].Name != "file" {
+		t.Fatalf("expected a single input named 'file', but found %v", cfg.Inputs)
+	}
+	invalidCfg := strings.Replace(empty_grok_section, "inputs:\n    - type: file\n      path: /tmp/test/*.log\n", "", 1)
+	cfg, err := Unmarshal([]byte(invalidCfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Inputs) != 1 || cfg.Inputs[0].Type != "stdin" {
+		t.Fatalf("expected stdin as default input, but found %v", cfg.Inputs)
+	}
+}
+
+func TestInvalidInputs(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		old, new    string
+		expectedErr string
+	}{
+		{"duplicate name", "name: access_log", "name: file", "input name 'file' is used more than once"},
+		{"unknown input", "      - webhook\n", "      - kafka\n", "there is no input with that name"},
+		{"duplicate webhook_path", "    - type: file\n      path: /var/log/syslog\n", "    - type: webhook\n      name: hook\n", "webhook_path '/webhook' is used by more than one input"},
+		{"duplicate stdin", "    - type: file\n      path: /var/log/syslog\n", "    - type: stdin\n    - type: stdin\n      name: stdin2\n", "there can only be one input of type stdin"},
+		{"invalid webhook_queue_size", "webhook_path: /webhook\n", "webhook_path: /webhook\n      webhook_queue_size: -1\n", "invalid 'webhook_queue_size': -1"},
+		{"invalid webhook_max_body_bytes", "webhook_path: /webhook\n", "webhook_path: /webhook\n      webhook_max_body_bytes: -1\n", "invalid 'webhook_max_body_bytes': -1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			invalidCfg := strings.Replace(multiple_inputs_config, test.old, test.new, 1)
+			if invalidCfg == multiple_inputs_config {
+				t.Fatalf("test config was not modified")
+			}
+			_, err := Unmarshal([]byte(invalidCfg))
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Fatalf("expected error containing %q, but got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestPositionFile(t *testing.T) {
+	cfgString := strings.Replace(multiple_inputs_config, "      path: /var/log/syslog\n", "      path: /var/log/syslog\n      position_file: /var/lib/grok_exporter/syslog.pos\n", 1)
+	cfg := loadOrFail(t, cfgString)
+	if cfg.Inputs[0].PositionFile != "/var/lib/grok_exporter/syslog.pos" {
+		t.Fatalf("unexpected position_file: %v", cfg.Inputs[0].PositionFile)
+	}
+	if cfg.Inputs[0].PositionSyncInterval != 10*time.Second {
+		t.Fatalf("expected default position_sync_interval 10s, but found %v", cfg.Inputs[0].PositionSyncInterval)
+	}
+	if cfg.Inputs[1].PositionSyncInterval != 0 {
+		t.Fatalf("expected no position_sync_interval for input without position_file, but found %v", cfg.Inputs[1].PositionSyncInterval)
+	}
+	cfgString = strings.Replace(cfgString, "      position_file: /var/lib/grok_exporter/syslog.pos\n", "      position_file: /var/lib/grok_exporter/syslog.pos\n      position_sync_interval: 1m0s\n", 1)
+	cfg = loadOrFail(t, cfgString)
+	if cfg.Inputs[0].PositionSyncInterval != time.Minute {
+		t.Fatalf("expected position_sync_interval 1m, but found %v", cfg.Inputs[0].PositionSyncInterval)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      webhook_path: /webhook\n", "      webhook_path: /webhook\n      position_file: /tmp/webhook.pos\n", "cannot use 'position_file' when 'type' is webhook"},
+		{"      - /var/log/nginx/access.log.1\n", "      - /var/log/nginx/access.log.1\n      position_file: /var/lib/grok_exporter/syslog.pos\n", "is used by more than one input"},
+		{"      - /var/log/nginx/access.log.1\n", "      - /var/log/nginx/access.log.1\n      position_sync_interval: 5s\n", "can only be used together with 'position_file'"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(cfgString, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	cfgString := strings.Replace(multiple_inputs_config, "    max_lines_in_buffer: 1024\n", "    max_lines_in_buffer: 1024\n    state_file: /var/lib/grok_exporter/state.json\n", 1)
+	cfg := loadOrFail(t, cfgString)
+	if cfg.Global.StateFile != "/var/lib/grok_exporter/state.json" {
+		t.Fatalf("unexpected state_file: %v", cfg.Global.StateFile)
+	}
+	if cfg.Global.StateSyncInterval != 10*time.Second {
+		t.Fatalf("expected default state_sync_interval 10s, but found %v", cfg.Global.StateSyncInterval)
+	}
+	cfgString = strings.Replace(cfgString, "    state_file: /var/lib/grok_exporter/state.json\n", "    state_file: /var/lib/grok_exporter/state.json\n    state_sync_interval: 1m0s\n", 1)
+	cfg = loadOrFail(t, cfgString)
+	if cfg.Global.StateSyncInterval != time.Minute {
+		t.Fatalf("expected state_sync_interval 1m, but found %v", cfg.Global.StateSyncInterval)
+	}
+	cfg = loadOrFail(t, multiple_inputs_config)
+	if cfg.Global.StateSyncInterval != 0 {
+		t.Fatalf("expected no state_sync_interval without state_file, but found %v", cfg.Global.StateSyncInterval)
+	}
+	_, err := Unmarshal([]byte(strings.Replace(multiple_inputs_config, "    max_lines_in_buffer: 1024\n", "    max_lines_in_buffer: 1024\n    state_sync_interval: 5s\n", 1)))
+	if err == nil || !strings.Contains(err.Error(), "can only be used together with 'global.state_file'") {
+		t.Fatalf("expected error for state_sync_interval without state_file, but got %v", err)
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	cfgString := strings.Replace(multiple_inputs_config, "      path: /var/log/syslog\n", "      path: /var/log/syslog\n      multiline:\n        start_pattern: '%{TIMESTAMP_ISO8601} '\n", 1)
+	cfg := loadOrFail(t, cfgString)
+	multiline := cfg.Inputs[0].Multiline
+	if multiline == nil || multiline.StartPattern != "%{TIMESTAMP_ISO8601} " {
+		t.Fatalf("unexpected multiline configuration: %v", multiline)
+	}
+	if multiline.MaxLines != 500 || multiline.MaxBytes != 1024*1024 || multiline.FlushTimeout != time.Second {
+		t.Fatalf("unexpected multiline defaults: %v", multiline)
+	}
+	if cfg.Inputs[1].Multiline != nil {
+		t.Fatalf("expected no multiline configuration for input %v", cfg.Inputs[1].Name)
+	}
+	cfgString = strings.Replace(cfgString, "        start_pattern: '%{TIMESTAMP_ISO8601} '\n", "        continuation_pattern: ^\\s\n        max_lines: 10\n        max_bytes: 1000\n        flush_timeout: 5s\n", 1)
+	cfg = loadOrFail(t, cfgString)
+	multiline = cfg.Inputs[0].Multiline
+	if multiline.ContinuationPattern != "^\\s" || multiline.MaxLines != 10 || multiline.MaxBytes != 1000 || multiline.FlushTimeout != 5*time.Second {
+		t.Fatalf("unexpected multiline configuration: %v", multiline)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"        continuation_pattern: ^\\s\n", "        continuation_pattern: ^\\s\n        start_pattern: ^\\S\n", "use either 'multiline.start_pattern' or 'multiline.continuation_pattern' but not both"},
+		{"        continuation_pattern: ^\\s\n", "", "one of 'multiline.start_pattern' or 'multiline.continuation_pattern' is required"},
+		{"        max_lines: 10\n", "        max_lines: -1\n", "invalid 'multiline.max_lines'"},
+		{"      webhook_path: /webhook\n", "      webhook_path: /webhook\n      multiline:\n        start_pattern: x\n", "cannot use 'multiline' when 'type' is webhook"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(cfgString, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const syslog_config = `
+global:
+    config_version: 4
+inputs:
+    - name: network_devices
+      type: syslog
+      syslog_udp_address: :5514
+      syslog_tcp_address: 127.0.0.1:5514
+metrics:
+    - type: counter
+      name: messages_total
+      help: Total number of syslog messages.
+      match: .*
+      labels:
+        hostname: '{{ index .extra "hostname" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestSyslogInput(t *testing.T) {
+	cfg := loadOrFail(t, syslog_config)
+	if cfg.Inputs[0].SyslogUdpAddress != ":5514" || cfg.Inputs[0].SyslogTcpAddress != "127.0.0.1:5514" {
+		t.Fatalf("unexpected syslog addresses: %v %v", cfg.Inputs[0].SyslogUdpAddress, cfg.Inputs[0].SyslogTcpAddress)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      syslog_udp_address: :5514\n      syslog_tcp_address: 127.0.0.1:5514\n", "", "one of 'syslog_udp_address' or 'syslog_tcp_address' is required"},
+		{"      syslog_udp_address: :5514\n", "      syslog_udp_address: :5514\n      readall: true\n", "cannot use 'readall' when 'type' is syslog"},
+		{"metrics:", "    - name: other\n      type: syslog\n      syslog_udp_address: :5514\nmetrics:", "syslog_udp_address ':5514' is used by more than one input"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(syslog_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const fluent_forward_config = `
+global:
+    config_version: 4
+inputs:
+    - type: fluent_forward
+      fluent_forward_address: 127.0.0.1:24224
+metrics:
+    - type: counter
+      name: records_total
+      help: Total number of records by tag.
+      match: .*
+      labels:
+        tag: '{{ index .extra "tag" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestFluentForwardInput(t *testing.T) {
+	cfg := loadOrFail(t, fluent_forward_config)
+	if cfg.Inputs[0].FluentForwardAddress != "127.0.0.1:24224" || cfg.Inputs[0].FluentForwardRecordKey != "log" || cfg.Inputs[0].MaxConnections != 100 {
+		t.Fatalf("unexpected fluent_forward configuration: %v %v %v", cfg.Inputs[0].FluentForwardAddress, cfg.Inputs[0].FluentForwardRecordKey, cfg.Inputs[0].MaxConnections)
+	}
+	cfg = loadOrFail(t, strings.Replace(fluent_forward_config, "      fluent_forward_address: 127.0.0.1:24224\n", "      fluent_forward_record_key: message\n      max_connections: 10\n", 1))
+	if cfg.Inputs[0].FluentForwardAddress != ":24224" || cfg.Inputs[0].FluentForwardRecordKey != "message" || cfg.Inputs[0].MaxConnections != 10 {
+		t.Fatalf("unexpected fluent_forward configuration: %v %v %v", cfg.Inputs[0].FluentForwardAddress, cfg.Inputs[0].FluentForwardRecordKey, cfg.Inputs[0].MaxConnections)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      fluent_forward_address: 127.0.0.1:24224\n", "      fluent_forward_address: 127.0.0.1:24224\n      readall: true\n", "cannot use 'readall' when 'type' is fluent_forward"},
+		{"      fluent_forward_address: 127.0.0.1:24224\n", "      fluent_forward_address: 127.0.0.1:24224\n      max_connections: -1\n", "invalid 'max_connections'"},
+		{"metrics:", "    - name: other\n      type: fluent_forward\n      fluent_forward_address: 127.0.0.1:24224\nmetrics:", "fluent_forward_address '127.0.0.1:24224' is used by more than one input"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(fluent_forward_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const gelf_config = `
+global:
+    config_version: 4
+inputs:
+    - type: gelf
+      gelf_udp_address: 127.0.0.1:12201
+metrics:
+    - type: counter
+      name: messages_total
+      help: Total number of GELF messages by host.
+      match: .*
+      labels:
+        host: '{{ index .extra "host" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestGelfInput(t *testing.T) {
+	cfg := loadOrFail(t, gelf_config)
+	if cfg.Inputs[0].GelfUdpAddress != "127.0.0.1:12201" || cfg.Inputs[0].GelfMessageField != "short_message" || cfg.Inputs[0].GelfChunkTimeout != 5*time.Second {
+		t.Fatalf("unexpected gelf configuration: %v %v %v", cfg.Inputs[0].GelfUdpAddress, cfg.Inputs[0].GelfMessageField, cfg.Inputs[0].GelfChunkTimeout)
+	}
+	cfg = loadOrFail(t, strings.Replace(gelf_config, "      gelf_udp_address: 127.0.0.1:12201\n", "      gelf_tcp_address: 127.0.0.1:12201\n      gelf_message_field: full_message\n      gelf_chunk_timeout: 1s\n", 1))
+	if cfg.Inputs[0].GelfTcpAddress != "127.0.0.1:12201" || cfg.Inputs[0].GelfMessageField != "full_message" || cfg.Inputs[0].GelfChunkTimeout != time.Second {
+		t.Fatalf("unexpected gelf configuration: %v %v %v", cfg.Inputs[0].GelfTcpAddress, cfg.Inputs[0].GelfMessageField, cfg.Inputs[0].GelfChunkTimeout)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      gelf_udp_address: 127.0.0.1:12201\n", "", "one of 'gelf_udp_address' or 'gelf_tcp_address' is required"},
+		{"      gelf_udp_address: 127.0.0.1:12201\n", "      gelf_udp_address: 127.0.0.1:12201\n      path: /tmp/test.log\n", "cannot use 'path' when 'type' is gelf"},
+		{"      gelf_udp_address: 127.0.0.1:12201\n", "      gelf_udp_address: 127.0.0.1:12201\n      gelf_chunk_timeout: -1s\n", "invalid 'gelf_chunk_timeout'"},
+		{"metrics:", "    - name: other\n      type: gelf\n      gelf_udp_address: 127.0.0.1:12201\nmetrics:", "gelf_udp_address '127.0.0.1:12201' is used by more than one input"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(gelf_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const tcp_config = `
+global:
+    config_version: 4
+inputs:
+    - type: tcp
+      tcp_address: 127.0.0.1:5170
+metrics:
+    - type: counter
+      name: lines_total
+      help: Total number of lines by client.
+      match: .*
+      labels:
+        client: '{{ index .extra "remote_addr" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestSocketInputs(t *testing.T) {
+	cfg := loadOrFail(t, tcp_config)
+	if cfg.Inputs[0].TcpAddress != "127.0.0.1:5170" || cfg.Inputs[0].MaxConnections != 100 {
+		t.Fatalf("unexpected tcp configuration: %v %v", cfg.Inputs[0].TcpAddress, cfg.Inputs[0].MaxConnections)
+	}
+	if strings.Contains(cfg.String(), "max_connections") {
+		t.Fatalf("default max_connections should not be included in the configuration string:\n%v", cfg)
+	}
+	cfg = loadOrFail(t, strings.Replace(tcp_config, "    - type: tcp\n      tcp_address: 127.0.0.1:5170\n", "    - type: unix\n      unix_socket_path: /tmp/grok_exporter.sock\n      max_connections: 10\n", 1))
+	if cfg.Inputs[0].UnixSocketPath != "/tmp/grok_exporter.sock" || cfg.Inputs[0].MaxConnections != 10 {
+		t.Fatalf("unexpected unix configuration: %v %v", cfg.Inputs[0].UnixSocketPath, cfg.Inputs[0].MaxConnections)
+	}
+	loadOrFail(t, strings.Replace(tcp_config, "      tcp_address: 127.0.0.1:5170\n", "      tcp_address: 127.0.0.1:5170\n      tls_cert: server.crt\n      tls_key: server.key\n      tls_client_ca: ca.crt\n", 1))
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      tcp_address: 127.0.0.1:5170\n", "", "'tcp_address' is required"},
+		{"    - type: tcp\n      tcp_address: 127.0.0.1:5170\n", "    - type: unix\n", "'unix_socket_path' is required"},
+		{"      tcp_address: 127.0.0.1:5170\n", "      tcp_address: 127.0.0.1:5170\n      readall: true\n", "cannot use 'readall' when 'type' is tcp"},
+		{"      tcp_address: 127.0.0.1:5170\n", "      tcp_address: 127.0.0.1:5170\n      max_connections: -1\n", "invalid 'max_connections'"},
+		{"      tcp_address: 127.0.0.1:5170\n", "      tcp_address: 127.0.0.1:5170\n      tls_cert: server.crt\n", "'tls_cert' and 'tls_key' must be configured together"},
+		{"      tcp_address: 127.0.0.1:5170\n", "      tcp_address: 127.0.0.1:5170\n      tls_client_ca: ca.crt\n", "cannot use 'tls_client_ca' without 'tls_cert' and 'tls_key'"},
+		{"    - type: tcp\n      tcp_address: 127.0.0.1:5170\n", "    - type: unix\n      unix_socket_path: /tmp/grok_exporter.sock\n      tls_cert: server.crt\n      tls_key: server.key\n", "cannot use 'tls_cert', 'tls_key', or 'tls_client_ca' when 'type' is unix"},
+		{"metrics:", "    - name: other\n      type: tcp\n      tcp_address: 127.0.0.1:5170\nmetrics:", "tcp_address '127.0.0.1:5170' is used by more than one input"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(tcp_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const exec_config = `
+global:
+    config_version: 4
+inputs:
+    - type: exec
+      exec_command:
+      - kubectl
+      - logs
+      - -f
+      - deployment/app
+metrics:
+    - type: counter
+      name: lines_total
+      help: Total number of lines by stream.
+      match: .*
+      labels:
+        stream: '{{ index .extra "stream" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestExecInput(t *testing.T) {
+	cfg := loadOrFail(t, exec_config)
+	if len(cfg.Inputs[0].ExecCommand) != 4 || cfg.Inputs[0].ExecRestartDelay != time.Second || cfg.Inputs[0].ExecMaxRestartDelay != time.Minute {
+		t.Fatalf("unexpected exec configuration: %v %v %v", cfg.Inputs[0].ExecCommand, cfg.Inputs[0].ExecRestartDelay, cfg.Inputs[0].ExecMaxRestartDelay)
+	}
+	if strings.Contains(cfg.String(), "exec_restart_delay") || strings.Contains(cfg.String(), "exec_max_restart_delay") {
+		t.Fatalf("default restart delays should not be included in the configuration string:\n%v", cfg)
+	}
+	cfg = loadOrFail(t, strings.Replace(exec_config, "      - deployment/app\n", "      - deployment/app\n      exec_stderr: true\n      exec_restart_delay: 5s\n      max_line_bytes: 1024\n", 1))
+	if !cfg.Inputs[0].ExecStderr || cfg.Inputs[0].ExecRestartDelay != 5*time.Second || cfg.Inputs[0].MaxLineBytes != 1024 {
+		t.Fatalf("unexpected exec configuration: %v %v %v", cfg.Inputs[0].ExecStderr, cfg.Inputs[0].ExecRestartDelay, cfg.Inputs[0].MaxLineBytes)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"      exec_command:\n      - kubectl\n      - logs\n      - -f\n      - deployment/app\n", "", "'exec_command' is required"},
+		{"      - deployment/app\n", "      - deployment/app\n      readall: true\n", "cannot use 'readall' when 'type' is exec"},
+		{"      - deployment/app\n", "      - deployment/app\n      exec_restart_delay: -1s\n", "invalid 'exec_restart_delay'"},
+		{"      - deployment/app\n", "      - deployment/app\n      exec_restart_delay: 2m\n", "'exec_max_restart_delay' 1m0s must not be less than 'exec_restart_delay' 2m0s"},
+		{"    - type: exec\n", "    - type: stdin\n      exec_stderr: true\n", "cannot use 'exec_command', 'exec_stderr', 'exec_restart_delay', or 'exec_max_restart_delay' when 'type' is stdin"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(exec_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const journald_config = `
+global:
+    config_version: 4
+inputs:
+    - type: journald
+      journald_format: json
+      journald_cursor_file: /var/lib/grok_exporter/journal.cursor
+metrics:
+    - type: counter
+      name: messages_total
+      help: Total number of journal entries.
+      match: .*
+      labels:
+        unit: '{{ index .extra "_SYSTEMD_UNIT" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestJournaldInput(t *testing.T) {
+	cfg := loadOrFail(t, journald_config)
+	if cfg.Inputs[0].JournaldFormat != "json" || cfg.Inputs[0].JournaldCursorFile != "/var/lib/grok_exporter/journal.cursor" {
+		t.Fatalf("unexpected journald configuration: %v %v", cfg.Inputs[0].JournaldFormat, cfg.Inputs[0].JournaldCursorFile)
+	}
+	cfg, err := Unmarshal([]byte(strings.Replace(journald_config, "      journald_format: json\n", "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Inputs[0].JournaldFormat != "export" {
+		t.Fatalf("expected default journald_format \"export\", but got %q", cfg.Inputs[0].JournaldFormat)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"journald_format: json", "journald_format: short", "'journald_format' must be \"export|json\""},
+		{"      journald_format: json\n", "      journald_format: json\n      path: /tmp/test.log\n", "cannot use 'path' when 'type' is journald"},
+		{"metrics:", "    - type: stdin\nmetrics:", "there can only be one input of type stdin or journald"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(journald_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const container_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /var/log/containers/*.log
+      container_format: auto
+metrics:
+    - type: counter
+      name: container_lines_total
+      help: Total number of container log lines.
+      match: .*
+      labels:
+        namespace: '{{ index .extra "namespace" }}'
+        stream: '{{ index .extra "stream" }}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestContainerFormat(t *testing.T) {
+	cfg := loadOrFail(t, container_config)
+	if cfg.Inputs[0].ContainerFormat != "auto" {
+		t.Fatalf("expected container_format \"auto\", but got %q", cfg.Inputs[0].ContainerFormat)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"container_format: auto", "container_format: podman", "'podman' is not a valid 'container_format'"},
+		{"- type: file\n      path: /var/log/containers/*.log", "- type: stdin", "cannot use 'container_format' when 'type' is stdin"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(container_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const json_format_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /var/log/app.log
+metrics:
+    - type: counter
+      name: http_errors_total
+      help: HTTP errors.
+      format: json
+      match_fields:
+        .http.status: 5\d\d
+        .level: error
+      labels:
+        path: '{{.http.path}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestJsonFormat(t *testing.T) {
+	cfg := loadOrFail(t, json_format_config)
+	if cfg.AllMetrics[0].Format != "json" || cfg.AllMetrics[0].MatchFields[".http.status"] != "5\\d\\d" {
+		t.Fatalf("unexpected metric configuration: %v", cfg.AllMetrics[0])
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"format: json", "format: xml", "Invalid 'metrics.format': 'xml'"},
+		{"format: json", "format: grok\n      match: .*", "'metrics.match_fields' can only be used for metrics with format json"},
+		{"format: json", "format: json\n      match: .*", "'metrics.match' cannot be used for metrics with format json"},
+		{".level: error", "level: error", "invalid json selector"},
+		{"format: json", "format: logfmt\n      required_fields: ['a=b']", "\"a=b\" is not a valid logfmt key"},
+		{"format: json", "format: json\n      required_fields: [user]", "'metrics.required_fields' can only be used for metrics with format logfmt"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(json_format_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+func loadOrFail(t *testing.T, cfgString string) *Config {
+	cfg, err := Unmarshal([]byte(cfgString))
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err.Error())
+	}
+	err = equalsIgnoreIndentation(cfg.String(), cfgString)
+	if err != nil {
+		t.Fatalf("Expected:\n%v\nActual:\n%v\n%v", cfgString, cfg, err)
+	}
+	return cfg
+}
+
+func equalsIgnoreIndentation(actual, expected string) error {
+	actualLines := stripEmptyLines(strings.Split(actual, "\n"))
+	expectedLines := stripEmptyLines(strings.Split(expected, "\n"))
+	length := len(actualLines)
+	if len(expectedLines) < length {
+		length = len(expectedLines)
+	}
+	for i := 0; i < length; i++ {
+		if strings.TrimSpace(actualLines[i]) != strings.TrimSpace(expectedLines[i]) {
+			return fmt.Errorf("line %v: expected '%v' but got '%v'", i, expectedLines[i], actualLines[i])
+		}
+	}
+	if len(actualLines) != len(expectedLines) {
+		return fmt.Errorf("expected %v non-empty lines, but got %v non-empty lines", len(expectedLines), len(actualLines))
+	}
+	return nil
+}
+
+func stripEmptyLines(lines []string) []string {
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+const rotation_grace_period_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /var/log/app.log
+      rotation_grace_period: 30s
+metrics:
+    - type: counter
+      name: app_lines_total
+      help: Total number of app log lines.
+      match: .*
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestRotationGracePeriod(t *testing.T) {
+	cfg := loadOrFail(t, rotation_grace_period_config)
+	if cfg.Inputs[0].RotationGracePeriod != 30*time.Second {
+		t.Fatalf("expected rotation_grace_period 30s, but got %v", cfg.Inputs[0].RotationGracePeriod)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"rotation_grace_period: 30s", "rotation_grace_period: -30s", "invalid 'rotation_grace_period': -30s"},
+		{"- type: file\n      path: /var/log/app.log", "- type: stdin", "cannot use 'rotation_grace_period' when 'type' is stdin"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(rotation_grace_period_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const encoding_config = `
+global:
+    config_version: 4
+inputs:
+    - type: file
+      path: /var/log/service.log
+      encoding: utf-16
+metrics:
+    - type: counter
+      name: service_lines_total
+      help: Total number of service log lines.
+      match: .*
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestEncoding(t *testing.T) {
+	cfg := loadOrFail(t, encoding_config)
+	if cfg.Inputs[0].Encoding != "utf-16" {
+		t.Fatalf("expected encoding \"utf-16\", but got %q", cfg.Inputs[0].Encoding)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"encoding: utf-16", "encoding: ebcdic", "'ebcdic' is not a valid 'encoding'"},
+		{"- type: file\n      path: /var/log/service.log", "- type: stdin", "cannot use 'encoding' when 'type' is stdin"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(encoding_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const max_line_bytes_config = `
+global:
+    config_version: 4
+inputs:
+    - type: stdin
+      max_line_bytes: 1024
+metrics:
+    - type: counter
+      name: stdin_lines_total
+      help: Total number of stdin lines.
+      match: .*
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestMaxLineBytes(t *testing.T) {
+	cfg := loadOrFail(t, max_line_bytes_config)
+	if cfg.Inputs[0].MaxLineBytes != 1024 {
+		t.Fatalf("expected max_line_bytes 1024, but got %v", cfg.Inputs[0].MaxLineBytes)
+	}
+	if cfg.Inputs[0].OversizedLines != "truncate" {
+		t.Fatalf("expected default oversized_lines \"truncate\", but got %q", cfg.Inputs[0].OversizedLines)
+	}
+	if strings.Contains(cfg.String(), "oversized_lines") {
+		t.Fatalf("expected default oversized_lines to be stripped from the config string:\n%v", cfg)
+	}
+	cfg = loadOrFail(t, strings.Replace(max_line_bytes_config, "max_line_bytes: 1024", "max_line_bytes: 1024\n      oversized_lines: drop", 1))
+	if cfg.Inputs[0].OversizedLines != "drop" {
+		t.Fatalf("expected oversized_lines \"drop\", but got %q", cfg.Inputs[0].OversizedLines)
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"max_line_bytes: 1024", "max_line_bytes: -1", "invalid 'max_line_bytes': -1"},
+		{"max_line_bytes: 1024", "max_line_bytes: 1024\n      oversized_lines: split", "'split' is not a valid 'oversized_lines'"},
+		{"max_line_bytes: 1024", "oversized_lines: drop", "'oversized_lines' can only be used together with 'max_line_bytes'"},
+		{"- type: stdin", "- type: journald", "cannot use 'max_line_bytes' when 'type' is journald"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(max_line_bytes_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
+
+const webhook_auth_config = `
+global:
+    config_version: 4
+inputs:
+    - type: webhook
+      webhook_path: /webhook
+      webhook_format: text_single
+      webhook_json_selector: .message
+      webhook_text_bulk_separator: \n\n
+      webhook_auth:
+        bearer_token_file: /etc/grok_exporter/token
+        hmac_secret_file: /etc/grok_exporter/hmac_secret
+        hmac_header: X-Hub-Signature-256
+        hmac_format: github
+metrics:
+    - type: counter
+      name: webhook_lines_total
+      help: Total number of webhook lines.
+      match: .*
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestWebhookAuth(t *testing.T) {
+	cfg := loadOrFail(t, webhook_auth_config)
+	if cfg.Inputs[0].WebhookAuth.BearerTokenFile != "/etc/grok_exporter/token" {
+		t.Fatalf("expected bearer_token_file \"/etc/grok_exporter/token\", but got %q", cfg.Inputs[0].WebhookAuth.BearerTokenFile)
+	}
+	// The hmac_header depends on the hmac_format.
+	for format, header := range map[string]string{"github": "X-Hub-Signature-256", "stripe": "Stripe-Signature"} {
+		cfgString := strings.Replace(webhook_auth_config, "        hmac_header: X-Hub-Signature-256\n", "", 1)
+		cfgString = strings.Replace(cfgString, "hmac_format: github", "hmac_format: "+format, 1)
+		cfg, err := Unmarshal([]byte(cfgString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Inputs[0].WebhookAuth.HmacHeader != header {
+			t.Fatalf("expected default hmac_header %q for hmac_format %v, but got %q", header, format, cfg.Inputs[0].WebhookAuth.HmacHeader)
+		}
+	}
+	for _, invalid := range []struct {
+		old, new    string
+		expectedErr string
+	}{
+		{"bearer_token_file: /etc/grok_exporter/token", "bearer_token_file: /etc/grok_exporter/token\n        bearer_token: s3cr3t", "use either 'webhook_auth.bearer_token' or 'webhook_auth.bearer_token_file' but not both"},
+		{"bearer_token_file: /etc/grok_exporter/token", "username: shipper", "'webhook_auth.username' and 'webhook_auth.password_hash' must be used together"},
+		{"bearer_token_file: /etc/grok_exporter/token", "username: shipper\n        password_hash: s3cr3t", "'webhook_auth.password_hash' is not a valid bcrypt hash"},
+		{"bearer_token_file: /etc/grok_exporter/token", "bearer_token_file: /etc/grok_exporter/token\n        username: shipper\n        password_hash_file: /etc/grok_exporter/password_hash", "use either 'webhook_auth.bearer_token' or basic auth but not both"},
+		{"hmac_format: github", "hmac_format: sha1", "'sha1' is not a valid 'webhook_auth.hmac_format'"},
+		{"        hmac_header: X-Hub-Signature-256\n        hmac_format: github", "        hmac_format: hex", "'webhook_auth.hmac_header' is required for 'hmac_format' hex"},
+		{"        hmac_secret_file: /etc/grok_exporter/hmac_secret\n", "", "'webhook_auth.hmac_header' and 'webhook_auth.hmac_format' can only be used together with 'webhook_auth.hmac_secret'"},
+		{"    - type: webhook\n      webhook_path: /webhook\n      webhook_format: text_single\n      webhook_json_selector: .message\n      webhook_text_bulk_separator: \\n\\n\n", "    - type: stdin\n", "cannot use 'webhook_auth' when 'type' is stdin"},
+	} {
+		_, err := Unmarshal([]byte(strings.Replace(webhook_auth_config, invalid.old, invalid.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), invalid.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", invalid.expectedErr, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v4
+
+import (
+	v3 "github.com/fstab/grok_exporter/config/v3"
+)
+
+func convert(v3cfg *v3.Config) *Config {
+	return &Config{
+		Global:       convertGlobal(v3cfg),
+		Inputs:       convertInputs(v3cfg),
+		GrokPatterns: convertGrok(v3cfg),
+		OrigMetrics:  convertMetrics(v3cfg.OrigMetrics),
+		AllMetrics:   convertMetrics(v3cfg.AllMetrics),
+		Imports:      convertImports(v3cfg),
+		Server:       convertServer(v3cfg),
+	}
+}
+
+func convertGlobal(v3cfg *v3.Config) GlobalConfig {
+	return GlobalConfig{
+		ConfigVersion:          4,
+		RetentionCheckInterval: v3cfg.Global.RetentionCheckInterval,
+		MaxLinesInBuffer:       v3cfg.Input.MaxLinesInBuffer,
+	}
+}
+
+// Config version 3 has a single unnamed input. It becomes the only input in config version 4,
+// and the name defaults to the input type.
+func convertInputs(v3cfg *v3.Config) InputsConfig {
+	return []InputConfig{{
+		Type:                       v3cfg.Input.Type,
+		PathsAndGlobs:              convertPathsAndGlobs(v3cfg.Input.PathsAndGlobs),
+		FailOnMissingLogfileString: v3cfg.Input.FailOnMissingLogfileString,
+		FailOnMissingLogfile:       v3cfg.Input.FailOnMissingLogfile,
+		Readall:                    v3cfg.Input.Readall,
+		PollInterval:               v3cfg.Input.PollInterval,
+		WebhookPath:                v3cfg.Input.WebhookPath,
+		WebhookFormat:              v3cfg.Input.WebhookFormat,
+		WebhookJsonSelector:        v3cfg.Input.WebhookJsonSelector,
+		WebhookTextBulkSeparator:   v3cfg.Input.WebhookTextBulkSeparator,
+		KafkaVersion:               v3cfg.Input.KafkaVersion,
+		KafkaBrokers:               v3cfg.Input.KafkaBrokers,
+		KafkaTopics:                v3cfg.Input.KafkaTopics,
+		KafkaPartitionAssignor:     v3cfg.Input.KafkaPartitionAssignor,
+		KafkaConsumerGroupName:     v3cfg.Input.KafkaConsumerGroupName,
+		KafkaConsumeFromOldest:     v3cfg.Input.KafkaConsumeFromOldest,
+	}}
+}
+
+func convertPathsAndGlobs(v3globs v3.PathsAndGlobs) PathsAndGlobs {
+	return PathsAndGlobs{
+		Path:  v3globs.Path,
+		Paths: v3globs.Paths,
+		Globs: v3globs.Globs,
+	}
+}
+
+func convertGrok(v3cfg *v3.Config) GrokPatternsConfig {
+	result := make([]string, 0, len(v3cfg.GrokPatterns))
+	for _, pattern := range v3cfg.GrokPatterns {
+		result = append(result, pattern)
+	}
+	return result
+}
+
+func convertMetrics(v3metrics v3.MetricsConfig) MetricsConfig {
+	result := make([]MetricConfig, 0, len(v3metrics))
+	for _, v3metric := range v3metrics {
+		result = append(result, MetricConfig{
+			Type:                 v3metric.Type,
+			Name:                 v3metric.Name,
+			Help:                 v3metric.Help,
+			PathsAndGlobs:        convertPathsAndGlobs(v3metric.PathsAndGlobs),
+			Match:                v3metric.Match,
+			Retention:            v3metric.Retention,
+			Value:                v3metric.Value,
+			Cumulative:           v3metric.Cumulative,
+			Buckets:              v3metric.Buckets,
+			Quantiles:            v3metric.Quantiles,
+			MaxAge:               v3metric.MaxAge,
+			Labels:               v3metric.Labels,
+			LabelTemplates:       v3metric.LabelTemplates,
+			ValueTemplate:        v3metric.ValueTemplate,
+			DeleteMatch:          v3metric.DeleteMatch,
+			DeleteLabels:         v3metric.DeleteLabels,
+			DeleteLabelTemplates: v3metric.DeleteLabelTemplates,
+		})
+	}
+	return result
+}
+
+func convertImports(v3cfg *v3.Config) ImportsConfig {
+	result := make([]ImportConfig, 0, len(v3cfg.Imports))
+	for _, v3import := range v3cfg.Imports {
+		result = append(result, ImportConfig{
+			Type: v3import.Type,
+			Dir:  v3import.Dir,
+			File: v3import.File,
+			Defaults: DefaultConfig{
+				PathsAndGlobs: convertPathsAndGlobs(v3import.Defaults.PathsAndGlobs),
+				Retention:     v3import.Defaults.Retention,
+				Buckets:       v3import.Defaults.Buckets,
+				Quantiles:     v3import.Defaults.Quantiles,
+				MaxAge:        v3import.Defaults.MaxAge,
+				Labels:        v3import.Defaults.Labels,
+			},
+		})
+	}
+	return result
+}
+
+func convertServer(v3cfg *v3.Config) ServerConfig {
+	return ServerConfig{
+		Protocol:   v3cfg.Server.Protocol,
+		Host:       v3cfg.Server.Host,
+		Port:       v3cfg.Server.Port,
+		Path:       v3cfg.Server.Path,
+		Cert:       v3cfg.Server.Cert,
+		Key:        v3cfg.Server.Key,
+		ClientCA:   v3cfg.Server.ClientCA,
+		ClientAuth: v3cfg.Server.ClientAuth,
+	}
+}
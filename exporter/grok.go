@@ -16,7 +16,7 @@ package exporter
 
 import (
 	"fmt"
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/template"
 	"regexp"
@@ -36,21 +36,26 @@ func Compile(pattern string, patterns *Patterns) (*oniguruma.Regex, error) {
 	return result, nil
 }
 
-func VerifyFieldNames(m *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex, additionalFieldDefinitions map[string]string) error {
+// Expand a grok pattern string into a regular expression, without compiling it.
+func Expand(pattern string, patterns *Patterns) (string, error) {
+	return expand(pattern, patterns)
+}
+
+func VerifyFieldNames(m *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex, additionalFieldDefinitions map[string]string) error {
 	for _, template := range m.LabelTemplates {
-		err := verifyFieldName(m.Name, template, regex, additionalFieldDefinitions)
+		err := verifyFieldName(m.Name, template, matcher, additionalFieldDefinitions)
 		if err != nil {
 			return err
 		}
 	}
 	for _, template := range m.DeleteLabelTemplates {
-		err := verifyFieldName(m.Name, template, deleteRegex, additionalFieldDefinitions)
+		err := verifyFieldName(m.Name, template, NewGrokMatcher(deleteRegex), additionalFieldDefinitions)
 		if err != nil {
 			return err
 		}
 	}
 	if m.ValueTemplate != nil {
-		err := verifyFieldName(m.Name, m.ValueTemplate, regex, additionalFieldDefinitions)
+		err := verifyFieldName(m.Name, m.ValueTemplate, matcher, additionalFieldDefinitions)
 		if err != nil {
 			return err
 		}
@@ -58,20 +63,12 @@ func VerifyFieldNames(m *configuration.MetricConfig, regex, deleteRegex *oniguru
 	return nil
 }
 
-func verifyFieldName(metricName string, template template.Template, regex *oniguruma.Regex, additionalFieldDefinitions map[string]string) error {
+func verifyFieldName(metricName string, template template.Template, matcher Matcher, additionalFieldDefinitions map[string]string) error {
 	if template != nil {
 		for _, grokFieldName := range template.ReferencedGrokFields() {
-			if description, ok := additionalFieldDefinitions[grokFieldName]; ok {
-				if regex.HasCaptureGroup(grokFieldName) {
-					return fmt.Errorf("%v: field name %v is ambigous, as this field is defined in the grok pattern but is also a global field provided by grok_exporter for the %v", metricName, grokFieldName, description)
-				}
-			} else {
-				numGroups := regex.NumberOfCaptureGroups(grokFieldName)
-				if numGroups == 0 {
-					return fmt.Errorf("%v: grok field %v not found in match pattern", metricName, grokFieldName)
-				} else if numGroups > 1 {
-					return fmt.Errorf("%v: grok field %v found %d times in match pattern: this is ambiguous, the pattern should define each grok field exactly once", metricName, grokFieldName, numGroups)
-				}
+			err := matcher.verifyFieldName(metricName, grokFieldName, additionalFieldDefinitions)
+			if err != nil {
+				return err
 			}
 		}
 	}
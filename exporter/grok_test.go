@@ -15,7 +15,7 @@
 package exporter
 
 import (
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"gopkg.in/yaml.v2"
 	"strings"
@@ -132,7 +132,7 @@ func expect(t *testing.T, regex *oniguruma.Regex, config string, isErrorExpected
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = VerifyFieldNames(cfg, regex, nil, additionalFieldDefinitions)
+	err = VerifyFieldNames(cfg, NewGrokMatcher(regex), nil, additionalFieldDefinitions)
 	if isErrorExpected && err == nil {
 		t.Fatal("Expected error, but got no error.")
 	}
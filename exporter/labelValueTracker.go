@@ -24,6 +24,9 @@ type LabelValueTracker interface {
 	Observe(labels map[string]string) (bool, error)
 	DeleteByLabels(labels map[string]string) ([]map[string]string, error)
 	DeleteByRetention(retention time.Duration) []map[string]string
+	LastUpdate(labels map[string]string) (time.Time, bool)
+	// Like Observe(), but with a given timestamp. Used when label values are restored from the state file.
+	Restore(labels map[string]string, lastUpdate time.Time) error
 }
 
 // Represents the label values for a single time series, i.e. if a time series was created with
@@ -50,17 +53,44 @@ func NewLabelValueTracker(labelNames []string) LabelValueTracker {
 }
 
 func (observed *observedLabels) Observe(labels map[string]string) (bool, error) {
+	err := observed.assertLabelsValid(labels)
+	if err != nil {
+		return false, fmt.Errorf("error observing label values: %v", err)
+	}
+	values := observed.makeLabelValues(labels)
+	return observed.addOrUpdate(values, time.Now()), nil
+}
+
+func (observed *observedLabels) Restore(labels map[string]string, lastUpdate time.Time) error {
+	err := observed.assertLabelsValid(labels)
+	if err != nil {
+		return fmt.Errorf("error restoring label values: %v", err)
+	}
+	observed.addOrUpdate(observed.makeLabelValues(labels), lastUpdate)
+	return nil
+}
+
+func (observed *observedLabels) LastUpdate(labels map[string]string) (time.Time, bool) {
+	values := observed.makeLabelValues(labels)
+	for _, observedValues := range observed.values {
+		if equals(values, observedValues.values) {
+			return observedValues.lastUpdate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (observed *observedLabels) assertLabelsValid(labels map[string]string) error {
 	for _, err := range []error{
 		observed.assertLabelNamesExist(labels),
 		observed.assertLabelNamesComplete(labels),
 		observed.assertLabelValuesNotEmpty(labels),
 	} {
 		if err != nil {
-			return false, fmt.Errorf("error observing label values: %v", err)
+			return err
 		}
 	}
-	values := observed.makeLabelValues(labels)
-	return observed.addOrUpdate(values), nil
+	return nil
 }
 
 func (observed *observedLabels) DeleteByLabels(labels map[string]string) ([]map[string]string, error) {
@@ -145,16 +175,16 @@ func (observed *observedLabels) makeLabelValues(labels map[string]string) []stri
 	return result
 }
 
-func (observed *observedLabels) addOrUpdate(values []string) bool {
+func (observed *observedLabels) addOrUpdate(values []string, timestamp time.Time) bool {
 	for _, observedValues := range observed.values {
 		if equals(values, observedValues.values) {
-			observedValues.lastUpdate = time.Now()
+			observedValues.lastUpdate = timestamp
 			return false
 		}
 	}
 	observed.values = append(observed.values, &observedLabelValues{
 		values:     values,
-		lastUpdate: time.Now(),
+		lastUpdate: timestamp,
 	})
 	return true
 }
@@ -0,0 +1,94 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses a logfmt line like 'level=info msg="hello \"world\"" duration=12ms'.
+// Keys without value, like 'debug' in 'level=info debug', have an empty value. If a key occurs more than once, the last value wins.
+func parseLogfmt(line string) (map[string]string, error) {
+	result := make(map[string]string)
+	i := 0
+	for {
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return result, nil
+		}
+		start := i
+		for i < len(line) && !isLogfmtSpace(line[i]) && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		key := line[start:i]
+		if len(key) == 0 {
+			return nil, fmt.Errorf("column %v: expected key", i+1)
+		}
+		if i >= len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil, fmt.Errorf("column %v: unexpected '\"' in key %v", i+1, key)
+			}
+			result[key] = ""
+			continue
+		}
+		i++ // '='
+		if i < len(line) && line[i] == '"' {
+			start = i
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("column %v: unterminated quoted value for key %v", start+1, key)
+			}
+			i++ // closing quote
+			result[key] = unquoteLogfmt(line[start:i])
+		} else {
+			start = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				i++
+			}
+			result[key] = line[start:i]
+		}
+	}
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// Most logfmt libraries quote values like Go's strconv.Quote(). Other libraries only escape '"' and '\',
+// so if the value is not a valid Go string literal, only these two escapes are resolved.
+func unquoteLogfmt(quoted string) string {
+	value, err := strconv.Unquote(quoted)
+	if err == nil {
+		return value
+	}
+	var sb strings.Builder
+	for i := 1; i < len(quoted)-1; i++ {
+		if quoted[i] == '\\' && (quoted[i+1] == '"' || quoted[i+1] == '\\') {
+			i++
+		}
+		sb.WriteByte(quoted[i])
+	}
+	return sb.String()
+}
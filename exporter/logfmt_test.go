@@ -0,0 +1,46 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	for line, expected := range map[string]map[string]string{
+		`level=info duration=12ms path=/api`:                        {"level": "info", "duration": "12ms", "path": "/api"},
+		`msg="hello world" user=alice`:                              {"msg": "hello world", "user": "alice"},
+		`msg="she said \"hi\"\n" empty="" x=`:                       {"msg": "she said \"hi\"\n", "empty": "", "x": ""},
+		`msg="C:\path\to \"file\""`:                                 {"msg": `C:\path\to "file"`},
+		"  level=warn\tdebug  at=2020-06-01T10:00:00Z level=error ": {"level": "error", "debug": "", "at": "2020-06-01T10:00:00Z"},
+		`url=/search?q=a=b`:                                         {"url": "/search?q=a=b"},
+		``:                                                          {},
+	} {
+		fields, err := parseLogfmt(line)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", line, err)
+		}
+		if !reflect.DeepEqual(fields, expected) {
+			t.Fatalf("%v: expected %v, but got %v", line, expected, fields)
+		}
+	}
+	for _, line := range []string{`msg="unterminated`, `=value`, `a"b=c`} {
+		_, err := parseLogfmt(line)
+		if err == nil {
+			t.Fatalf("%v: expected error, but got nil", line)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	encodingJson "encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	json "github.com/bitly/go-simplejson"
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/jsonselector"
+)
+
+// A Matcher decides if a log line matches a metric, and provides the field values for the label and value templates.
+// With format grok, the fields are the capture groups of the match pattern.
+// With format json, the fields are the fields of the JSON object.
+// With format logfmt, the fields are the keys of the logfmt line.
+type Matcher interface {
+	// Returns nil if the line does not match.
+	match(line string) (fieldValues, error)
+	// Returns an error if the field cannot be used in label or value templates.
+	verifyFieldName(metricName, fieldName string, additionalFieldDefinitions map[string]string) error
+	// Frees the regular expressions. The matcher must not be used afterwards.
+	Free()
+}
+
+type fieldValues interface {
+	get(fieldName string) (interface{}, error)
+	free()
+}
+
+// DecodingError is returned by ProcessMatch if the log line cannot be decoded, like invalid JSON for format json.
+type DecodingError struct {
+	metricName string
+	err        error
+}
+
+func (e *DecodingError) Error() string {
+	return fmt.Sprintf("error processing metric %v: failed to decode log line: %v", e.metricName, e.err)
+}
+
+// Creates the Matcher for the metric's format.
+func NewMatcher(cfg *configuration.MetricConfig, patterns *Patterns) (Matcher, error) {
+	switch cfg.Format {
+	case "json":
+		return newJsonMatcher(cfg.MatchFields, patterns)
+	case "logfmt":
+		return newLogfmtMatcher(cfg.MatchFields, cfg.RequiredFields, patterns)
+	default:
+		regex, err := Compile(cfg.Match, patterns)
+		if err != nil {
+			return nil, err
+		}
+		return NewGrokMatcher(regex), nil
+	}
+}
+
+type grokMatcher struct {
+	regex *oniguruma.Regex
+}
+
+type grokValues struct {
+	searchResult *oniguruma.SearchResult
+}
+
+func NewGrokMatcher(regex *oniguruma.Regex) Matcher {
+	return &grokMatcher{regex: regex}
+}
+
+func (m *grokMatcher) match(line string) (fieldValues, error) {
+	searchResult, err := m.regex.Search(line)
+	if err != nil {
+		return nil, err
+	}
+	if !searchResult.IsMatch() {
+		searchResult.Free()
+		return nil, nil
+	}
+	return &grokValues{searchResult: searchResult}, nil
+}
+
+func (m *grokMatcher) verifyFieldName(metricName, fieldName string, additionalFieldDefinitions map[string]string) error {
+	if description, ok := additionalFieldDefinitions[fieldName]; ok {
+		if m.regex.HasCaptureGroup(fieldName) {
+			return fmt.Errorf("%v: field name %v is ambigous, as this field is defined in the grok pattern but is also a global field provided by grok_exporter for the %v", metricName, fieldName, description)
+		}
+		return nil
+	}
+	numGroups := m.regex.NumberOfCaptureGroups(fieldName)
+	if numGroups == 0 {
+		return fmt.Errorf("%v: grok field %v not found in match pattern", metricName, fieldName)
+	} else if numGroups > 1 {
+		return fmt.Errorf("%v: grok field %v found %d times in match pattern: this is ambiguous, the pattern should define each grok field exactly once", metricName, fieldName, numGroups)
+	}
+	return nil
+}
+
+func (m *grokMatcher) Free() {
+	m.regex.Free()
+}
+
+func (v *grokValues) get(fieldName string) (interface{}, error) {
+	return v.searchResult.GetCaptureGroupByName(fieldName)
+}
+
+func (v *grokValues) free() {
+	v.searchResult.Free()
+}
+
+// A line matches if it is a JSON object, and if each selected value matches the corresponding grok pattern.
+type jsonMatcher struct {
+	conditions []jsonCondition
+}
+
+type jsonCondition struct {
+	selector *jsonselector.Selector
+	regex    *oniguruma.Regex
+}
+
+type jsonValues map[string]interface{}
+
+func newJsonMatcher(matchFields map[string]string, patterns *Patterns) (Matcher, error) {
+	result := &jsonMatcher{}
+	for path, pattern := range matchFields {
+		selector, err := jsonselector.Parse(path)
+		if err != nil {
+			result.Free()
+			return nil, err
+		}
+		regex, err := Compile(pattern, patterns)
+		if err != nil {
+			result.Free()
+			return nil, err
+		}
+		result.conditions = append(result.conditions, jsonCondition{selector: selector, regex: regex})
+	}
+	// deterministic order, so that error messages don't change randomly
+	sort.Slice(result.conditions, func(i, j int) bool {
+		return result.conditions[i].selector.String() < result.conditions[j].selector.String()
+	})
+	return result, nil
+}
+
+func (m *jsonMatcher) match(line string) (fieldValues, error) {
+	j, err := json.NewJson([]byte(line))
+	if err != nil {
+		return nil, &DecodingError{err: err}
+	}
+	object, err := j.Map()
+	if err != nil {
+		return nil, &DecodingError{err: fmt.Errorf("not a JSON object")}
+	}
+	for _, condition := range m.conditions {
+		value, ok := jsonString(condition.selector.Find(j).Interface())
+		if !ok {
+			return nil, nil
+		}
+		searchResult, err := condition.regex.Search(value)
+		if err != nil {
+			return nil, err
+		}
+		isMatch := searchResult.IsMatch()
+		searchResult.Free()
+		if !isMatch {
+			return nil, nil
+		}
+	}
+	return jsonValues(object), nil
+}
+
+// Any field may be present in a JSON object.
+func (m *jsonMatcher) verifyFieldName(metricName, fieldName string, additionalFieldDefinitions map[string]string) error {
+	return nil
+}
+
+func (m *jsonMatcher) Free() {
+	for _, condition := range m.conditions {
+		condition.regex.Free()
+	}
+}
+
+// Missing fields are empty. Nested fields like .http.status are resolved by the template.
+func (v jsonValues) get(fieldName string) (interface{}, error) {
+	value, ok := v[fieldName]
+	if !ok || value == nil {
+		return "", nil
+	}
+	return value, nil
+}
+
+func (v jsonValues) free() {}
+
+// A line matches if all required fields are present, and if each value in match_fields matches the corresponding grok pattern.
+type logfmtMatcher struct {
+	requiredFields []string // including the fields from match_fields
+	conditions     []logfmtCondition
+}
+
+type logfmtCondition struct {
+	field string
+	regex *oniguruma.Regex
+}
+
+type logfmtValues map[string]string
+
+func newLogfmtMatcher(matchFields map[string]string, requiredFields []string, patterns *Patterns) (Matcher, error) {
+	result := &logfmtMatcher{}
+	for field, pattern := range matchFields {
+		regex, err := Compile(pattern, patterns)
+		if err != nil {
+			result.Free()
+			return nil, err
+		}
+		result.conditions = append(result.conditions, logfmtCondition{field: field, regex: regex})
+		result.requiredFields = append(result.requiredFields, field)
+	}
+	sort.Slice(result.conditions, func(i, j int) bool {
+		return result.conditions[i].field < result.conditions[j].field
+	})
+	result.requiredFields = append(result.requiredFields, requiredFields...)
+	return result, nil
+}
+
+func (m *logfmtMatcher) match(line string) (fieldValues, error) {
+	fields, err := parseLogfmt(line)
+	if err != nil {
+		return nil, &DecodingError{err: err}
+	}
+	for _, field := range m.requiredFields {
+		if _, exists := fields[field]; !exists {
+			return nil, nil
+		}
+	}
+	for _, condition := range m.conditions {
+		searchResult, err := condition.regex.Search(fields[condition.field])
+		if err != nil {
+			return nil, err
+		}
+		isMatch := searchResult.IsMatch()
+		searchResult.Free()
+		if !isMatch {
+			return nil, nil
+		}
+	}
+	return logfmtValues(fields), nil
+}
+
+// Only fields that are guaranteed to be present can be used in templates.
+func (m *logfmtMatcher) verifyFieldName(metricName, fieldName string, additionalFieldDefinitions map[string]string) error {
+	_, isAdditionalField := additionalFieldDefinitions[fieldName]
+	for _, field := range m.requiredFields {
+		if field == fieldName {
+			if isAdditionalField {
+				return fmt.Errorf("%v: field name %v is ambigous, as this field is a required field but is also a global field provided by grok_exporter for the %v", metricName, fieldName, additionalFieldDefinitions[fieldName])
+			}
+			return nil
+		}
+	}
+	if isAdditionalField {
+		return nil
+	}
+	return fmt.Errorf("%v: field %v must be declared in required_fields or match_fields", metricName, fieldName)
+}
+
+func (m *logfmtMatcher) Free() {
+	for _, condition := range m.conditions {
+		condition.regex.Free()
+	}
+}
+
+func (v logfmtValues) get(fieldName string) (interface{}, error) {
+	return v[fieldName], nil
+}
+
+func (v logfmtValues) free() {}
+
+// Converts the selected JSON value to the string that is matched against the grok pattern.
+// Returns false if the value does not exist.
+func jsonString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case encodingJson.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default: // objects and arrays
+		data, err := encodingJson.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	}
+}
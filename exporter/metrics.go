@@ -16,12 +16,13 @@ package exporter
 
 import (
 	"fmt"
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/fstab/grok_exporter/template"
 	"github.com/prometheus/client_golang/prometheus"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -35,19 +36,29 @@ type Metric interface {
 	Collector() prometheus.Collector
 
 	PathMatches(logfilePath string) bool
+	InputMatches(inputName string) bool
 	// Returns the match if the line matched, and nil if the line didn't match.
 	ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error)
 	// Returns the match if the delete pattern matched, nil otherwise.
 	ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error)
 	// Remove old metrics
 	ProcessRetention() error
+
+	// Current values, see WriteStateFile()
+	Snapshot() (*MetricState, error)
+	// Restore the values from the state file. Returns an error if the stored metric does not match the configuration.
+	Restore(state *MetricState) error
+	// Frees the regular expressions when the metric is removed or replaced. The metric must not be used afterwards.
+	Free()
 }
 
 // Common values for incMetric and observeMetric
 type metric struct {
 	name        string
 	globs       []glob.Glob
-	regex       *oniguruma.Regex
+	excludes    []glob.Glob
+	inputs      []string
+	matcher     Matcher
 	deleteRegex *oniguruma.Regex
 	retention   time.Duration
 }
@@ -93,22 +104,28 @@ type gaugeVecMetric struct {
 
 type histogramMetric struct {
 	observeMetric
+	buckets   []float64
 	histogram prometheus.Histogram
+	collector *restoringCollector
 }
 
 type histogramVecMetric struct {
 	observeMetricWithLabels
+	buckets      []float64
 	histogramVec *prometheus.HistogramVec
+	collector    *restoringCollector
 }
 
 type summaryMetric struct {
 	observeMetric
-	summary prometheus.Summary
+	summary   prometheus.Summary
+	collector *restoringCollector
 }
 
 type summaryVecMetric struct {
 	observeMetricWithLabels
 	summaryVec *prometheus.SummaryVec
+	collector  *restoringCollector
 }
 
 type deleterMetric interface {
@@ -120,6 +137,11 @@ func (m *metric) Name() string {
 }
 
 func (m *metric) PathMatches(logfilePath string) bool {
+	for _, g := range m.excludes {
+		if g.Match(logfilePath) {
+			return false
+		}
+	}
 	if len(m.globs) == 0 {
 		return true
 	}
@@ -131,6 +153,18 @@ func (m *metric) PathMatches(logfilePath string) bool {
 	return false
 }
 
+func (m *metric) InputMatches(inputName string) bool {
+	if len(m.inputs) == 0 {
+		return true
+	}
+	for _, input := range m.inputs {
+		if input == inputName {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *counterMetric) Collector() prometheus.Collector {
 	return m.counter
 }
@@ -148,29 +182,41 @@ func (m *gaugeVecMetric) Collector() prometheus.Collector {
 }
 
 func (m *histogramMetric) Collector() prometheus.Collector {
-	return m.histogram
+	return m.collector
 }
 
 func (m *histogramVecMetric) Collector() prometheus.Collector {
-	return m.histogramVec
+	return m.collector
 }
 
 func (m *summaryMetric) Collector() prometheus.Collector {
-	return m.summary
+	return m.collector
 }
 
 func (m *summaryVecMetric) Collector() prometheus.Collector {
-	return m.summaryVec
+	return m.collector
 }
 
-func (m *observeMetric) processMatch(line string, callback func(value float64) (bool, error)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *metric) match(line string) (fieldValues, error) {
+	values, err := m.matcher.match(line)
 	if err != nil {
+		if decodingErr, ok := err.(*DecodingError); ok {
+			decodingErr.metricName = m.Name()
+			return nil, decodingErr
+		}
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, nil)
+	return values, nil
+}
+
+func (m *observeMetric) processMatch(line string, callback func(value float64) (bool, error)) (*Match, error) {
+	values, err := m.match(line)
+	if err != nil {
+		return nil, err
+	}
+	if values != nil {
+		defer values.free()
+		floatVal, err := floatValue(m.Name(), values, m.valueTemplate, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -188,17 +234,17 @@ func (m *observeMetric) processMatch(line string, callback func(value float64) (
 }
 
 func (m *observeMetricWithLabels) processMatch(line string, additionalFields map[string]interface{}, callback func(value float64, labels map[string]string) (bool, error)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+	values, err := m.match(line)
 	if err != nil {
-		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
+		return nil, err
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, additionalFields)
+	if values != nil {
+		defer values.free()
+		floatVal, err := floatValue(m.Name(), values, m.valueTemplate, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates, additionalFields)
+		labels, err := labelValues(m.Name(), values, m.labelTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
@@ -224,6 +270,13 @@ func (m *metric) ProcessDeleteMatch(line string, additionalFields map[string]int
 	return nil, fmt.Errorf("error processing metric %v: delete_match is currently only supported for metrics with labels.", m.Name())
 }
 
+func (m *metric) Free() {
+	m.matcher.Free()
+	if m.deleteRegex != nil {
+		m.deleteRegex.Free()
+	}
+}
+
 func (m *metric) ProcessRetention() error {
 	if m.retention == 0 {
 		return nil
@@ -241,7 +294,7 @@ func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric, ad
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		deleteLabels, err := labelValues(m.Name(), searchResult, m.deleteLabelTemplates, additionalFields)
+		deleteLabels, err := labelValues(m.Name(), &grokValues{searchResult: searchResult}, m.deleteLabelTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
@@ -342,11 +395,11 @@ func (m *histogramVecMetric) ProcessMatch(line string, additionalFields map[stri
 }
 
 func (m *histogramVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processDeleteMatch(line, m.histogramVec, additionalFields)
+	return m.processDeleteMatch(line, m.collector, additionalFields)
 }
 
 func (m *histogramVecMetric) ProcessRetention() error {
-	return m.processRetention(m.histogramVec)
+	return m.processRetention(m.collector)
 }
 
 func (m *summaryMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
@@ -364,106 +417,116 @@ func (m *summaryVecMetric) ProcessMatch(line string, additionalFields map[string
 }
 
 func (m *summaryVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processDeleteMatch(line, m.summaryVec, additionalFields)
+	return m.processDeleteMatch(line, m.collector, additionalFields)
 }
 
 func (m *summaryVecMetric) ProcessRetention() error {
-	return m.processRetention(m.summaryVec)
+	return m.processRetention(m.collector)
 }
 
-func newMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metric {
+func newMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) metric {
 	return metric{
 		name:        cfg.Name,
 		globs:       cfg.Globs,
-		regex:       regex,
+		excludes:    cfg.ExcludeGlobs,
+		inputs:      cfg.Inputs,
+		matcher:     matcher,
 		deleteRegex: deleteRegex,
 		retention:   cfg.Retention,
 	}
 }
 
-func newMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metricWithLabels {
+func newMetricWithLabels(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) metricWithLabels {
 	return metricWithLabels{
-		metric:               newMetric(cfg, regex, deleteRegex),
+		metric:               newMetric(cfg, matcher, deleteRegex),
 		labelTemplates:       cfg.LabelTemplates,
 		deleteLabelTemplates: cfg.DeleteLabelTemplates,
 		labelValueTracker:    NewLabelValueTracker(prometheusLabels(cfg.LabelTemplates)),
 	}
 }
 
-func newObserveMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetric {
+func newObserveMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) observeMetric {
 	return observeMetric{
-		metric:        newMetric(cfg, regex, deleteRegex),
+		metric:        newMetric(cfg, matcher, deleteRegex),
 		valueTemplate: cfg.ValueTemplate,
 	}
 }
 
-func newObserveMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetricWithLabels {
+func newObserveMetricWithLabels(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) observeMetricWithLabels {
 	return observeMetricWithLabels{
-		metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
+		metricWithLabels: newMetricWithLabels(cfg, matcher, deleteRegex),
 		valueTemplate:    cfg.ValueTemplate,
 	}
 }
 
-func NewCounterMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewCounterMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) Metric {
 	counterOpts := prometheus.CounterOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
 	}
 	if len(cfg.Labels) == 0 {
 		return &counterMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			observeMetric: newObserveMetric(cfg, matcher, deleteRegex),
 			counter:       prometheus.NewCounter(counterOpts),
 		}
 	} else {
 		return &counterVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteRegex),
 			counterVec:              prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates)),
 		}
 	}
 }
 
-func NewGaugeMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewGaugeMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) Metric {
 	gaugeOpts := prometheus.GaugeOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
 	}
 	if len(cfg.Labels) == 0 {
 		return &gaugeMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			observeMetric: newObserveMetric(cfg, matcher, deleteRegex),
 			cumulative:    cfg.Cumulative,
 			gauge:         prometheus.NewGauge(gaugeOpts),
 		}
 	} else {
 		return &gaugeVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteRegex),
 			cumulative:              cfg.Cumulative,
 			gaugeVec:                prometheus.NewGaugeVec(gaugeOpts, prometheusLabels(cfg.LabelTemplates)),
 		}
 	}
 }
 
-func NewHistogramMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewHistogramMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) Metric {
 	histogramOpts := prometheus.HistogramOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
 	}
 	if len(cfg.Buckets) > 0 {
 		histogramOpts.Buckets = cfg.Buckets
+	} else {
+		histogramOpts.Buckets = prometheus.DefBuckets
 	}
 	if len(cfg.Labels) == 0 {
+		histogram := prometheus.NewHistogram(histogramOpts)
 		return &histogramMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
-			histogram:     prometheus.NewHistogram(histogramOpts),
+			observeMetric: newObserveMetric(cfg, matcher, deleteRegex),
+			buckets:       histogramOpts.Buckets,
+			histogram:     histogram,
+			collector:     newRestoringCollector(histogram, nil),
 		}
 	} else {
+		histogramVec := prometheus.NewHistogramVec(histogramOpts, prometheusLabels(cfg.LabelTemplates))
 		return &histogramVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
-			histogramVec:            prometheus.NewHistogramVec(histogramOpts, prometheusLabels(cfg.LabelTemplates)),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteRegex),
+			buckets:                 histogramOpts.Buckets,
+			histogramVec:            histogramVec,
+			collector:               newRestoringCollector(histogramVec, prometheusLabels(cfg.LabelTemplates)),
 		}
 	}
 }
 
-func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewSummaryMetric(cfg *configuration.MetricConfig, matcher Matcher, deleteRegex *oniguruma.Regex) Metric {
 	summaryOpts := prometheus.SummaryOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
@@ -475,32 +538,37 @@ func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 		summaryOpts.MaxAge = cfg.MaxAge
 	}
 	if len(cfg.Labels) == 0 {
+		summary := prometheus.NewSummary(summaryOpts)
 		return &summaryMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
-			summary:       prometheus.NewSummary(summaryOpts),
+			observeMetric: newObserveMetric(cfg, matcher, deleteRegex),
+			summary:       summary,
+			collector:     newRestoringCollector(summary, nil),
 		}
 	} else {
+		summaryVec := prometheus.NewSummaryVec(summaryOpts, prometheusLabels(cfg.LabelTemplates))
 		return &summaryVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
-			summaryVec:              prometheus.NewSummaryVec(summaryOpts, prometheusLabels(cfg.LabelTemplates)),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteRegex),
+			summaryVec:              summaryVec,
+			collector:               newRestoringCollector(summaryVec, prometheusLabels(cfg.LabelTemplates)),
 		}
 	}
 }
 
-func labelValues(metricName string, searchResult *oniguruma.SearchResult, templates []template.Template, additionalFields map[string]interface{}) (map[string]string, error) {
+func labelValues(metricName string, values fieldValues, templates []template.Template, additionalFields map[string]interface{}) (map[string]string, error) {
 	result := make(map[string]string, len(templates))
 	for _, t := range templates {
-		value, err := evalTemplate(searchResult, t, additionalFields)
+		value, err := evalTemplate(values, t, additionalFields)
 		if err != nil {
 			return nil, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 		}
-		result[t.Name()] = value
+		// Prometheus requires valid UTF-8, but lines may contain invalid bytes if the input's 'encoding' is wrong.
+		result[t.Name()] = strings.ToValidUTF8(value, "\ufffd")
 	}
 	return result, nil
 }
 
-func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTemplate template.Template, additionalFields map[string]interface{}) (float64, error) {
-	stringVal, err := evalTemplate(searchResult, valueTemplate, additionalFields)
+func floatValue(metricName string, values fieldValues, valueTemplate template.Template, additionalFields map[string]interface{}) (float64, error) {
+	stringVal, err := evalTemplate(values, valueTemplate, additionalFields)
 	if err != nil {
 		return 0, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 	}
@@ -511,7 +579,7 @@ func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTe
 	return floatVal, nil
 }
 
-func evalTemplate(searchResult *oniguruma.SearchResult, t template.Template, additionalFields map[string]interface{}) (string, error) {
+func evalTemplate(fields fieldValues, t template.Template, additionalFields map[string]interface{}) (string, error) {
 	var (
 		values = make(map[string]interface{}, len(t.ReferencedGrokFields()))
 		value  interface{}
@@ -521,7 +589,7 @@ func evalTemplate(searchResult *oniguruma.SearchResult, t template.Template, add
 	)
 	for _, field = range t.ReferencedGrokFields() {
 		if value, ok = additionalFields[field]; !ok {
-			value, err = searchResult.GetCaptureGroupByName(field)
+			value, err = fields.get(field)
 			if err != nil {
 				return "", err
 			}
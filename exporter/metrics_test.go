@@ -15,7 +15,7 @@
 package exporter
 
 import (
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
@@ -31,7 +31,7 @@ func TestCounterVec(t *testing.T) {
 			"error_message": "{{.message}}",
 		},
 	})
-	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
 	counter.ProcessMatch("some unrelated line", nil)
 	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
 	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address", nil)
@@ -58,7 +58,7 @@ func TestCounter(t *testing.T) {
 	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
 		Name: "exim_rejected_rcpt_total",
 	})
-	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
 
 	counter.ProcessMatch("some unrelated line", nil)
 	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
@@ -83,7 +83,7 @@ func TestCounterValue(t *testing.T) {
 		Name:  "rainfall",
 		Value: "{{.rainfall}}",
 	})
-	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
 
 	counter.ProcessMatch("Rainfall in Berlin: 32", nil)
 	counter.ProcessMatch("Rainfall in Berlin: 5", nil)
@@ -115,7 +115,7 @@ func TestLogfileLabel(t *testing.T) {
 	logfile2 := map[string]interface{}{
 		"logfile": "/var/log/exim-2.log",
 	}
-	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
 	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", logfile1)
 	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address", logfile1)
 	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", logfile2)
@@ -149,6 +149,155 @@ func TestLogfileLabel(t *testing.T) {
 	}
 }
 
+func TestInputMatches(t *testing.T) {
+	allInputs := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name: "all_inputs_total",
+	}), nil, nil)
+	someInputs := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "some_inputs_total",
+		Inputs: []string{"access_log", "webhook"},
+	}), nil, nil)
+	for _, input := range []string{"access_log", "webhook", "stdin"} {
+		if !allInputs.InputMatches(input) {
+			t.Errorf("%v: expected metric without inputs to match input %v", allInputs.Name(), input)
+		}
+	}
+	if !someInputs.InputMatches("access_log") || !someInputs.InputMatches("webhook") {
+		t.Errorf("%v: expected metric to match its configured inputs", someInputs.Name())
+	}
+	if someInputs.InputMatches("stdin") {
+		t.Errorf("%v: expected metric not to match input stdin", someInputs.Name())
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	patterns := InitPatterns()
+	err := patterns.AddPattern("ERROR_STATUS 5[0-9][0-9]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "http_errors_total",
+		Format: "json",
+		MatchFields: map[string]string{
+			".level":       "^error$",
+			".http.status": "^%{ERROR_STATUS}$",
+		},
+		Labels: map[string]string{
+			"path":   "{{.http.path}}",
+			"status": "{{.http.status}}",
+		},
+		Value: "{{.http.bytes}}",
+	})
+	matcher, err := NewMatcher(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyFieldNames(cfg, matcher, nil, map[string]string{"logfile": "full path of the log file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`{"http": {"status": 503, "path": "/api", "bytes": 12}, "level": "error"}`,
+		`{"level": "error", "http": {"bytes": 30, "path": "/api", "status": 503}}`,
+		`{"level": "error", "http": {"bytes": 1, "path": "/api", "status": 200}}`,
+		`{"level": "info", "http": {"bytes": 1, "path": "/api", "status": 503}}`,
+		`{"level": "error"}`,
+	} {
+		_, err = counter.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", line, err)
+		}
+	}
+	_, err = counter.ProcessMatch("not json", nil)
+	if _, ok := err.(*DecodingError); !ok {
+		t.Fatalf("expected decoding error, but got %v", err)
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).WithLabelValues("/api", "503").Write(&m)
+	if *m.Counter.Value != float64(42) {
+		t.Fatalf("Expected 42, but got %v.", *m.Counter.Value)
+	}
+}
+
+func TestLogfmtFormat(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:           "request_duration_seconds_total",
+		Format:         "logfmt",
+		MatchFields:    map[string]string{"msg": "^request done$"},
+		RequiredFields: []string{"path", "duration"},
+		Labels: map[string]string{
+			"path": "{{.path}}",
+		},
+		Value: "{{.duration}}",
+	})
+	matcher, err := NewMatcher(cfg, InitPatterns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyFieldNames(cfg, matcher, nil, map[string]string{"logfile": "full path of the log file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`level=info msg="request done" path=/api duration=0.5`,
+		`duration=1.5 path="/api" msg="request done"`,
+		`level=info msg="request started" path=/api duration=0`,
+		`level=info msg="request done" path=/api`,
+	} {
+		_, err = counter.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", line, err)
+		}
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).WithLabelValues("/api").Write(&m)
+	if *m.Counter.Value != float64(2) {
+		t.Fatalf("Expected 2, but got %v.", *m.Counter.Value)
+	}
+	undeclared := newMetricConfig(t, &configuration.MetricConfig{
+		Name:           "undeclared_total",
+		Format:         "logfmt",
+		RequiredFields: []string{"path"},
+		Labels:         map[string]string{"level": "{{.level}}"},
+	})
+	matcher, err = NewMatcher(undeclared, InitPatterns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyFieldNames(undeclared, matcher, nil, nil)
+	if err == nil {
+		t.Fatal("Expected error for field that is not declared in required_fields.")
+	}
+}
+
+func TestInvalidUtf8LabelValue(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:           "requests_total",
+		Format:         "logfmt",
+		RequiredFields: []string{"path"},
+		Labels: map[string]string{
+			"path": "{{.path}}",
+		},
+	})
+	matcher, err := NewMatcher(cfg, InitPatterns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(cfg, matcher, nil)
+	_, err = counter.ProcessMatch("path=/caf\xe9", nil) // iso-8859-1 encoded line read as utf-8
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).WithLabelValues("/caf\ufffd").Write(&m)
+	if *m.Counter.Value != float64(1) {
+		t.Fatalf("Expected 1, but got %v.", *m.Counter.Value)
+	}
+}
+
 func initCounterRegex(t *testing.T) *oniguruma.Regex {
 	patterns := loadPatternDir(t)
 	err := patterns.AddPattern("EXIM_MESSAGE [a-zA-Z ]*")
@@ -168,7 +317,7 @@ func TestGauge(t *testing.T) {
 		Name:  "temperature",
 		Value: "{{.temperature}}",
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
 	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
 	gauge.ProcessMatch("Temperature in Moscow: -5", nil)
@@ -192,7 +341,7 @@ func TestGaugeCumulative(t *testing.T) {
 		Value:      "{{.rainfall}}",
 		Cumulative: true,
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
 	gauge.ProcessMatch("Rainfall in Berlin: 32", nil)
 	gauge.ProcessMatch("Rainfall in Moscow: 5", nil)
@@ -218,7 +367,7 @@ func TestGaugeVec(t *testing.T) {
 			"city": "{{.city}}",
 		},
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
 	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
 	gauge.ProcessMatch("Temperature in Moscow: -5", nil)
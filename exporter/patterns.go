@@ -53,6 +53,9 @@ func (p *Patterns) AddGlob(globString string) error {
 	if err != nil {
 		return err
 	}
+	if g.BaseDir() != g.Dir() {
+		return fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", globString)
+	}
 	fileInfos, err := ioutil.ReadDir(g.Dir())
 	if err != nil {
 		return fmt.Errorf("failed to read patterns from directory %v: %v", g.Dir(), err)
@@ -0,0 +1,494 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+// The state file contains the values of all metrics, so that counters are not reset when grok_exporter is restarted.
+type stateFileContent struct {
+	Metrics []*MetricState `json:"metrics"`
+}
+
+// MetricState is the snapshot of a metric in the state file.
+// The type, label names, and buckets are stored in order to detect if the metric definition changed incompatibly.
+type MetricState struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	LabelNames []string     `json:"label_names,omitempty"`
+	Buckets    []float64    `json:"buckets,omitempty"`
+	Values     []ValueState `json:"values"`
+}
+
+// ValueState is the snapshot of a single time series.
+type ValueState struct {
+	Labels     []string   `json:"labels,omitempty"`      // label values, in the same order as MetricState.LabelNames
+	LastUpdate *time.Time `json:"last_update,omitempty"` // used for retention, only for metrics with labels
+	Value      StateFloat `json:"value,omitempty"`       // counter and gauge
+	Count      uint64     `json:"count,omitempty"`       // histogram and summary
+	Sum        StateFloat `json:"sum,omitempty"`         // histogram and summary
+	Buckets    []uint64   `json:"buckets,omitempty"`     // histogram, cumulative count for each upper bound in MetricState.Buckets
+}
+
+// StateFloat is a float64 that can be NaN or ±Inf, like a gauge set from a log line with the value "NaN".
+// JSON has no representation for these, so they are written as the strings "NaN", "+Inf", and "-Inf",
+// as in the Prometheus text format. Other values are written as JSON numbers.
+type StateFloat float64
+
+func (f StateFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func (f *StateFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		switch s {
+		case "NaN":
+			*f = StateFloat(math.NaN())
+		case "+Inf":
+			*f = StateFloat(math.Inf(1))
+		case "-Inf":
+			*f = StateFloat(math.Inf(-1))
+		default:
+			return fmt.Errorf("invalid value %q", s)
+		}
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = StateFloat(v)
+	return nil
+}
+
+// Returns the metric states by metric name. A missing state file is not an error, it is created when the state is written for the first time.
+func LoadStateFile(path string) (map[string]*MetricState, error) {
+	result := make(map[string]*MetricState)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, fmt.Errorf("%v: failed to read state file: %v", path, err)
+	}
+	var content stateFileContent
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return nil, fmt.Errorf("%v: failed to parse state file: %v", path, err)
+	}
+	for _, state := range content.Metrics {
+		result[state.Name] = state
+	}
+	return result, nil
+}
+
+// The state file is replaced atomically, so it is never left in an inconsistent state if grok_exporter is killed.
+func WriteStateFile(path string, metrics []Metric) error {
+	content := stateFileContent{
+		Metrics: make([]*MetricState, 0, len(metrics)),
+	}
+	for _, m := range metrics {
+		state, err := m.Snapshot()
+		if err != nil {
+			return fmt.Errorf("%v: failed to write state file: %v", path, err)
+		}
+		content.Metrics = append(content.Metrics, state)
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%v: failed to write state file: %v", path, err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%v: failed to write state file: %v", path, err)
+	}
+	_, err = tmpFile.Write(append(data, '\n'))
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("%v: failed to write state file: %v", path, err)
+	}
+	return nil
+}
+
+func (m *counterMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "counter", nil, nil, m.counter, nil, func(d *io_prometheus_client.Metric) ValueState {
+		return ValueState{Value: StateFloat(d.GetCounter().GetValue())}
+	})
+}
+
+func (m *counterVecMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "counter", prometheusLabels(m.labelTemplates), nil, m.counterVec, m.labelValueTracker, func(d *io_prometheus_client.Metric) ValueState {
+		return ValueState{Value: StateFloat(d.GetCounter().GetValue())}
+	})
+}
+
+func (m *gaugeMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "gauge", nil, nil, m.gauge, nil, func(d *io_prometheus_client.Metric) ValueState {
+		return ValueState{Value: StateFloat(d.GetGauge().GetValue())}
+	})
+}
+
+func (m *gaugeVecMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "gauge", prometheusLabels(m.labelTemplates), nil, m.gaugeVec, m.labelValueTracker, func(d *io_prometheus_client.Metric) ValueState {
+		return ValueState{Value: StateFloat(d.GetGauge().GetValue())}
+	})
+}
+
+func (m *histogramMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "histogram", nil, m.buckets, m.collector, nil, histogramValue)
+}
+
+func (m *histogramVecMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "histogram", prometheusLabels(m.labelTemplates), m.buckets, m.collector, m.labelValueTracker, histogramValue)
+}
+
+func (m *summaryMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "summary", nil, nil, m.collector, nil, summaryValue)
+}
+
+func (m *summaryVecMetric) Snapshot() (*MetricState, error) {
+	return snapshot(&m.metric, "summary", prometheusLabels(m.labelTemplates), nil, m.collector, m.labelValueTracker, summaryValue)
+}
+
+func (m *counterMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "counter", nil, nil, nil, func(_ map[string]string, value ValueState) {
+		m.counter.Add(float64(value.Value))
+	})
+}
+
+func (m *counterVecMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "counter", prometheusLabels(m.labelTemplates), nil, m.labelValueTracker, func(labels map[string]string, value ValueState) {
+		m.counterVec.With(labels).Add(float64(value.Value))
+	})
+}
+
+func (m *gaugeMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "gauge", nil, nil, nil, func(_ map[string]string, value ValueState) {
+		m.gauge.Set(float64(value.Value))
+	})
+}
+
+func (m *gaugeVecMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "gauge", prometheusLabels(m.labelTemplates), nil, m.labelValueTracker, func(labels map[string]string, value ValueState) {
+		m.gaugeVec.With(labels).Set(float64(value.Value))
+	})
+}
+
+func (m *histogramMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "histogram", nil, m.buckets, nil, func(_ map[string]string, value ValueState) {
+		m.collector.add(nil, value)
+	})
+}
+
+func (m *histogramVecMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "histogram", prometheusLabels(m.labelTemplates), m.buckets, m.labelValueTracker, func(labels map[string]string, value ValueState) {
+		m.histogramVec.With(labels) // create the time series, so that it is exported even if there are no new observations
+		m.collector.add(value.Labels, value)
+	})
+}
+
+func (m *summaryMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "summary", nil, nil, nil, func(_ map[string]string, value ValueState) {
+		m.collector.add(nil, value)
+	})
+}
+
+func (m *summaryVecMetric) Restore(state *MetricState) error {
+	return restore(&m.metric, state, "summary", prometheusLabels(m.labelTemplates), nil, m.labelValueTracker, func(labels map[string]string, value ValueState) {
+		m.summaryVec.With(labels) // create the time series, so that it is exported even if there are no new observations
+		m.collector.add(value.Labels, value)
+	})
+}
+
+func histogramValue(d *io_prometheus_client.Metric) ValueState {
+	result := ValueState{
+		Count:   d.GetHistogram().GetSampleCount(),
+		Sum:     StateFloat(d.GetHistogram().GetSampleSum()),
+		Buckets: make([]uint64, 0, len(d.GetHistogram().GetBucket())),
+	}
+	for _, bucket := range d.GetHistogram().GetBucket() {
+		result.Buckets = append(result.Buckets, bucket.GetCumulativeCount())
+	}
+	return result
+}
+
+func summaryValue(d *io_prometheus_client.Metric) ValueState {
+	return ValueState{
+		Count: d.GetSummary().GetSampleCount(),
+		Sum:   StateFloat(d.GetSummary().GetSampleSum()),
+	}
+}
+
+// tracker is nil for metrics without labels.
+func snapshot(m *metric, metricType string, labelNames []string, buckets []float64, collector prometheus.Collector, tracker LabelValueTracker, value func(*io_prometheus_client.Metric) ValueState) (*MetricState, error) {
+	result := &MetricState{
+		Name:       m.name,
+		Type:       metricType,
+		LabelNames: labelNames,
+		Buckets:    buckets,
+		Values:     []ValueState{},
+	}
+	collected, err := collect(collector)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the current value of metric %v: %v", m.name, err)
+	}
+	for _, d := range collected {
+		v := value(d)
+		if tracker != nil {
+			v.Labels = labelValuesFromDto(d, labelNames)
+			if lastUpdate, ok := tracker.LastUpdate(labelMap(labelNames, v.Labels)); ok {
+				v.LastUpdate = &lastUpdate
+			}
+		}
+		result.Values = append(result.Values, v)
+	}
+	sort.Slice(result.Values, func(i, j int) bool {
+		return labelKey(result.Values[i].Labels) < labelKey(result.Values[j].Labels)
+	})
+	return result, nil
+}
+
+// tracker is nil for metrics without labels.
+func restore(m *metric, state *MetricState, metricType string, labelNames []string, buckets []float64, tracker LabelValueTracker, apply func(labels map[string]string, value ValueState)) error {
+	switch {
+	case state.Type != metricType:
+		return fmt.Errorf("metric %v: the stored metric is a %v, but the metric is configured as a %v", m.name, state.Type, metricType)
+	case !equals(state.LabelNames, labelNames):
+		return fmt.Errorf("metric %v: the stored labels %v do not match the configured labels %v", m.name, state.LabelNames, labelNames)
+	case !equalFloats(state.Buckets, buckets):
+		return fmt.Errorf("metric %v: the stored buckets %v do not match the configured buckets %v", m.name, state.Buckets, buckets)
+	}
+	// validate all values before restoring anything, so that the state is restored either completely or not at all.
+	for _, value := range state.Values {
+		if len(value.Labels) != len(labelNames) {
+			return fmt.Errorf("metric %v: invalid label values %v", m.name, value.Labels)
+		}
+		if len(buckets) > 0 && len(value.Buckets) != len(buckets) {
+			return fmt.Errorf("metric %v: invalid bucket values %v", m.name, value.Buckets)
+		}
+		// prometheus.Counter.Add() panics if the value is negative.
+		if metricType == "counter" && (value.Value < 0 || math.IsNaN(float64(value.Value))) {
+			return fmt.Errorf("metric %v: invalid counter value %v", m.name, float64(value.Value))
+		}
+	}
+	for _, value := range state.Values {
+		labels := labelMap(labelNames, value.Labels)
+		if tracker != nil {
+			lastUpdate := time.Now()
+			if value.LastUpdate != nil {
+				lastUpdate = *value.LastUpdate
+			}
+			err := tracker.Restore(labels, lastUpdate)
+			if err != nil {
+				return fmt.Errorf("metric %v: %v", m.name, err)
+			}
+		}
+		apply(labels, value)
+	}
+	return nil
+}
+
+// The prometheus client library cannot initialize histograms and summaries with previous observations.
+// The restoringCollector wraps a histogram or summary (with or without labels),
+// and adds the count, sum, and buckets restored from the state file to the values of the wrapped collector.
+type restoringCollector struct {
+	collector  prometheus.Collector
+	labelNames []string
+	mutex      sync.Mutex
+	restored   map[string]ValueState // key is the joined label values, see labelKey()
+}
+
+func newRestoringCollector(collector prometheus.Collector, labelNames []string) *restoringCollector {
+	return &restoringCollector{
+		collector:  collector,
+		labelNames: labelNames,
+		restored:   make(map[string]ValueState),
+	}
+}
+
+func (c *restoringCollector) add(labelValues []string, value ValueState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.restored[labelKey(labelValues)] = value
+}
+
+func (c *restoringCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c *restoringCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.restored) == 0 {
+		c.collector.Collect(ch)
+		return
+	}
+	collected := make(chan prometheus.Metric)
+	go func() {
+		c.collector.Collect(collected)
+		close(collected)
+	}()
+	for m := range collected {
+		ch <- c.addRestored(m)
+	}
+}
+
+// Delete implements deleterMetric for histograms and summaries with labels.
+func (c *restoringCollector) Delete(labels prometheus.Labels) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make([]string, 0, len(c.labelNames))
+	for _, name := range c.labelNames {
+		values = append(values, labels[name])
+	}
+	delete(c.restored, labelKey(values))
+	return c.collector.(deleterMetric).Delete(labels)
+}
+
+func (c *restoringCollector) addRestored(m prometheus.Metric) prometheus.Metric {
+	d := &io_prometheus_client.Metric{}
+	if m.Write(d) != nil {
+		return m
+	}
+	labelValues := labelValuesFromDto(d, c.labelNames)
+	restored, exists := c.restored[labelKey(labelValues)]
+	if !exists {
+		return m
+	}
+	var (
+		result prometheus.Metric
+		err    error
+	)
+	switch {
+	case d.Histogram != nil:
+		buckets := make(map[float64]uint64, len(d.Histogram.GetBucket()))
+		for i, bucket := range d.Histogram.GetBucket() {
+			buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+			if i < len(restored.Buckets) {
+				buckets[bucket.GetUpperBound()] += restored.Buckets[i]
+			}
+		}
+		result, err = prometheus.NewConstHistogram(m.Desc(), d.Histogram.GetSampleCount()+restored.Count, d.Histogram.GetSampleSum()+float64(restored.Sum), buckets, labelValues...)
+	case d.Summary != nil:
+		// Quantiles cannot be restored, they are calculated from the observations since the restart.
+		quantiles := make(map[float64]float64, len(d.Summary.GetQuantile()))
+		for _, quantile := range d.Summary.GetQuantile() {
+			quantiles[quantile.GetQuantile()] = quantile.GetValue()
+		}
+		result, err = prometheus.NewConstSummary(m.Desc(), d.Summary.GetSampleCount()+restored.Count, d.Summary.GetSampleSum()+float64(restored.Sum), quantiles, labelValues...)
+	default:
+		return m
+	}
+	if err != nil {
+		return m
+	}
+	return result
+}
+
+func collect(collector prometheus.Collector) ([]*io_prometheus_client.Metric, error) {
+	var (
+		result    []*io_prometheus_client.Metric
+		firstErr  error
+		collected = make(chan prometheus.Metric)
+	)
+	go func() {
+		collector.Collect(collected)
+		close(collected)
+	}()
+	for m := range collected {
+		d := &io_prometheus_client.Metric{}
+		err := m.Write(d)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		result = append(result, d)
+	}
+	return result, firstErr
+}
+
+// The label pairs in the dto are sorted by name, the result is in the order of labelNames.
+func labelValuesFromDto(d *io_prometheus_client.Metric, labelNames []string) []string {
+	result := make([]string, 0, len(labelNames))
+	for _, name := range labelNames {
+		value := ""
+		for _, pair := range d.GetLabel() {
+			if pair.GetName() == name {
+				value = pair.GetValue()
+			}
+		}
+		result = append(result, value)
+	}
+	return result
+}
+
+func labelMap(labelNames, labelValues []string) map[string]string {
+	result := make(map[string]string, len(labelNames))
+	for i := range labelNames {
+		result[labelNames[i]] = labelValues[i]
+	}
+	return result
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	states, err := LoadStateFile(stateFile)
+	if err != nil || len(states) != 0 {
+		t.Fatalf("expected empty state for missing state file, but got %v, %v", states, err)
+	}
+
+	before := createStateTestMetrics(t)
+	for _, line := range []string{"Temperature in Berlin: 32", "Temperature in Moscow: 5", "Temperature in Berlin: 31"} {
+		for _, m := range before {
+			_, err = m.ProcessMatch(line, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = WriteStateFile(stateFile, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err = LoadStateFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := createStateTestMetrics(t)
+	for _, m := range after {
+		err = m.Restore(states[m.Name()])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range before {
+		expected := snapshotToJson(t, before[i])
+		actual := snapshotToJson(t, after[i])
+		if expected != actual {
+			t.Fatalf("restored state of %v differs from the original state.\nexpected: %v\nactual: %v", before[i].Name(), expected, actual)
+		}
+	}
+
+	// New observations are added to the restored values.
+	_, err = after[2].ProcessMatch("Temperature in Berlin: 33", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := after[2].Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range state.Values {
+		if value.Labels[0] == "Berlin" && (value.Count != 3 || value.Sum != 96) {
+			t.Fatalf("expected count 3 and sum 96 for Berlin, but got count %v and sum %v", value.Count, value.Sum)
+		}
+	}
+}
+
+// NaN and ±Inf cannot be represented as JSON numbers, see StateFloat.
+func TestStateFileNaN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	before := createStateTestMetrics(t)
+	before[1].(*gaugeMetric).gauge.Set(math.NaN())
+	before[3].(*summaryMetric).summary.Observe(math.Inf(-1))
+	err = WriteStateFile(stateFile, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := LoadStateFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := createStateTestMetrics(t)
+	for _, m := range after {
+		err = m.Restore(states[m.Name()])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	gauge, err := after[1].Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gauge.Values) != 1 || !math.IsNaN(float64(gauge.Values[0].Value)) {
+		t.Fatalf("expected restored gauge value NaN, but got %v", gauge.Values)
+	}
+	summary, err := after[3].Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Values) != 1 || !math.IsInf(float64(summary.Values[0].Sum), -1) {
+		t.Fatalf("expected restored summary sum -Inf, but got %v", summary.Values)
+	}
+}
+
+func TestStateFileRetention(t *testing.T) {
+	m := createStateTestMetrics(t)[2]
+	lastUpdate := time.Now().Add(-2 * time.Hour)
+	err := m.Restore(&MetricState{
+		Name:       "temperature_histogram",
+		Type:       "histogram",
+		LabelNames: []string{"city"},
+		Buckets:    []float64{0, 10, 20, 30},
+		Values: []ValueState{{
+			Labels:     []string{"Berlin"},
+			LastUpdate: &lastUpdate,
+			Count:      1,
+			Sum:        32,
+			Buckets:    []uint64{0, 0, 0, 0},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.ProcessRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Values) != 0 {
+		t.Fatalf("expected restored value to be deleted by retention, but found %v", state.Values)
+	}
+}
+
+func TestStateFileIncompatible(t *testing.T) {
+	m := createStateTestMetrics(t)[2]
+	for _, data := range []struct {
+		state       *MetricState
+		expectedErr string
+	}{
+		{
+			state:       &MetricState{Name: "temperature_histogram", Type: "summary", LabelNames: []string{"city"}},
+			expectedErr: "configured as a histogram",
+		},
+		{
+			state:       &MetricState{Name: "temperature_histogram", Type: "histogram", LabelNames: []string{"country"}, Buckets: []float64{0, 10, 20, 30}},
+			expectedErr: "do not match the configured labels",
+		},
+		{
+			state:       &MetricState{Name: "temperature_histogram", Type: "histogram", LabelNames: []string{"city"}, Buckets: []float64{0, 10}},
+			expectedErr: "do not match the configured buckets",
+		},
+	} {
+		err := m.Restore(data.state)
+		if err == nil || !strings.Contains(err.Error(), data.expectedErr) {
+			t.Fatalf("expected error containing %q, but got %v", data.expectedErr, err)
+		}
+	}
+	// Invalid counter values are rejected before anything is restored, because prometheus.Counter.Add() panics on negative values.
+	counter := createStateTestMetrics(t)[0]
+	for _, value := range []float64{-1, math.NaN()} {
+		err := counter.Restore(&MetricState{
+			Name:       "temperature_counter",
+			Type:       "counter",
+			LabelNames: []string{"city"},
+			Values: []ValueState{
+				{Labels: []string{"Berlin"}, Value: 3},
+				{Labels: []string{"Moscow"}, Value: StateFloat(value)},
+			},
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid counter value") {
+			t.Fatalf("expected error for counter value %v, but got %v", value, err)
+		}
+	}
+	state, err := counter.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Values) != 0 {
+		t.Fatalf("expected no restored values, but got %v", state.Values)
+	}
+}
+
+func createStateTestMetrics(t *testing.T) []Metric {
+	patterns := InitPatterns()
+	for _, pattern := range []string{"CITY [a-zA-Z]+", "TEMPERATURE -?[0-9]+"} {
+		err := patterns.AddPattern(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	regex, err := Compile("Temperature in %{CITY:city}: %{TEMPERATURE:temperature}", patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []Metric{
+		NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+			Name:      "temperature_counter",
+			Labels:    map[string]string{"city": "{{.city}}"},
+			Retention: time.Hour,
+		}), NewGrokMatcher(regex), nil),
+		NewGaugeMetric(newMetricConfig(t, &configuration.MetricConfig{
+			Name:  "temperature_gauge",
+			Value: "{{.temperature}}",
+		}), NewGrokMatcher(regex), nil),
+		NewHistogramMetric(newMetricConfig(t, &configuration.MetricConfig{
+			Name:      "temperature_histogram",
+			Value:     "{{.temperature}}",
+			Buckets:   []float64{0, 10, 20, 30},
+			Labels:    map[string]string{"city": "{{.city}}"},
+			Retention: time.Hour,
+		}), NewGrokMatcher(regex), nil),
+		NewSummaryMetric(newMetricConfig(t, &configuration.MetricConfig{
+			Name:  "temperature_summary",
+			Value: "{{.temperature}}",
+		}), NewGrokMatcher(regex), nil),
+	}
+}
+
+func snapshotToJson(t *testing.T, m Metric) string {
+	state, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(result)
+}
@@ -17,12 +17,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fstab/grok_exporter/config"
-	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/exporter"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/tailer"
@@ -79,14 +83,19 @@ func main() {
 	}
 	patterns, err := initPatterns(cfg)
 	exitOnError(err)
-	metrics, err := createMetrics(cfg, patterns)
+	metrics, definitions, err := createMetrics(cfg, patterns)
 	exitOnError(err)
 	for _, m := range metrics {
 		registry.MustRegister(m.Collector())
 	}
-	nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric := initSelfMonitoring(metrics, registry)
+	selfMonitoring := initSelfMonitoring(metrics, registry)
+	if len(cfg.Global.StateFile) > 0 {
+		exitOnError(restoreState(cfg.Global.StateFile, metrics))
+	}
 
-	tail, err := startTailer(cfg, registry)
+	// The multiline patterns are matched on the main loop, because the Oniguruma library is not thread safe.
+	multilineMatches := make(chan *tailer.MultilineMatch)
+	inputs, tail, err := startTailer(cfg, patterns, multilineMatches, registry, selfMonitoring)
 	exitOnError(err)
 
 	// gather up the handlers with which to start the webserver
@@ -99,17 +108,39 @@ func main() {
 		Path:    cfg.Server.Path,
 		Handler: metricsHandler,
 	})
-	if cfg.Input.Type == "webhook" {
-		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
-			Path:    cfg.Input.WebhookPath,
-			Handler: tailer.WebhookHandler(),
-		})
+	for _, input := range cfg.Inputs {
+		if input.Type == "webhook" {
+			httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+				Path:    input.WebhookPath,
+				Handler: tailer.WebhookHandler(input.WebhookPath),
+			})
+		}
 	}
+	reloadRequests := make(chan chan error)
+	httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+		Path:    reloadPath,
+		Handler: reloadHandler(reloadRequests),
+	})
 
 	fmt.Print(startMsg(cfg, httpHandlers))
 	serverErrors := startServer(cfg.Server, httpHandlers)
 
-	retentionTicker := time.NewTicker(cfg.Global.RetentionCheckInterval)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// Shut down the inputs on termination, so that file inputs can write their position files,
+	// and write the state file, so that metric values are restored on restart.
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+
+	current := &runningConfig{
+		cfg:             cfg,
+		patterns:        patterns,
+		metrics:         metrics,
+		definitions:     definitions,
+		retentionTicker: time.NewTicker(cfg.Global.RetentionCheckInterval),
+		stateTicker:     newStateTicker(cfg),
+	}
 
 	for {
 		select {
@@ -123,45 +154,105 @@ func main() {
 			}
 		case line := <-tail.Lines():
 			matched := false
-			for _, metric := range metrics {
+			for _, metric := range current.metrics {
 				start := time.Now()
-				if !metric.PathMatches(line.File) {
+				if !metric.InputMatches(line.Input) || !metric.PathMatches(line.File) {
 					continue
 				}
 				match, err := metric.ProcessMatch(line.Line, makeAdditionalFields(line))
-				if err != nil {
+				if _, isDecodingError := err.(*exporter.DecodingError); isDecodingError {
+					// Not logged, because a log file might contain some lines in other formats, like JSON logs with plain text stack traces.
+					selfMonitoring.nDecodingErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+				} else if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
 					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 				} else if match != nil {
-					nMatchesByMetric.WithLabelValues(metric.Name()).Inc()
-					procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
+					selfMonitoring.nMatchesByMetric.WithLabelValues(metric.Name()).Inc()
+					selfMonitoring.procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
 					matched = true
 				}
 				_, err = metric.ProcessDeleteMatch(line.Line, makeAdditionalFields(line))
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
 					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 				}
 				// TODO: create metric to monitor number of matching delete_patterns
 			}
 			if matched {
-				nLinesTotal.WithLabelValues(number_of_lines_matched_label).Inc()
+				selfMonitoring.nLinesTotal.WithLabelValues(number_of_lines_matched_label).Inc()
 			} else {
-				nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Inc()
+				selfMonitoring.nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Inc()
 			}
-		case <-retentionTicker.C:
-			for _, metric := range metrics {
+			line.Processed()
+		case match := <-multilineMatches:
+			match.Run()
+		case <-current.retentionTicker.C:
+			for _, metric := range current.metrics {
 				err = metric.ProcessRetention()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: error while processing retention on metric %v: %v", metric.Name(), err)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					selfMonitoring.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 				}
 			}
 			// TODO: create metric to monitor number of metrics cleaned up via retention
+		case <-hangup:
+			err = reload(current, inputs, multilineMatches, registry, selfMonitoring)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to reload configuration: %v\n", err)
+			}
+		case result := <-reloadRequests:
+			err = reload(current, inputs, multilineMatches, registry, selfMonitoring)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to reload configuration: %v\n", err)
+			}
+			result <- err
+		case <-current.stateSync():
+			writeState(current)
+		case <-terminate:
+			inputs.Close()
+			writeState(current)
+			return
+		}
+	}
+}
+
+// Metrics that changed incompatibly since the state file was written are not restored, they start with empty values.
+func restoreState(path string, metrics []exporter.Metric) error {
+	states, err := exporter.LoadStateFile(path)
+	if err != nil {
+		return err
+	}
+	for _, metric := range metrics {
+		state, exists := states[metric.Name()]
+		if !exists {
+			continue
 		}
+		err = metric.Restore(state)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v: not restoring the stored values: %v\n", path, err)
+		}
+	}
+	return nil
+}
+
+func writeState(current *runningConfig) {
+	if len(current.cfg.Global.StateFile) == 0 {
+		return
+	}
+	err := exporter.WriteStateFile(current.cfg.Global.StateFile, current.metrics)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+}
+
+// Returns nil if no state file is configured.
+func newStateTicker(cfg *v4.Config) *time.Ticker {
+	if len(cfg.Global.StateFile) == 0 {
+		return nil
 	}
+	return time.NewTicker(cfg.Global.StateSyncInterval)
 }
 
 func makeAdditionalFields(line *fswatcher.Line) map[string]interface{} {
@@ -171,7 +262,7 @@ func makeAdditionalFields(line *fswatcher.Line) map[string]interface{} {
 	}
 }
 
-func startMsg(cfg *v3.Config, httpHandlers []exporter.HttpServerPathHandler) string {
+func startMsg(cfg *v4.Config, httpHandlers []exporter.HttpServerPathHandler) string {
 	host := "localhost"
 	if len(cfg.Server.Host) > 0 {
 		host = cfg.Server.Host
@@ -210,7 +301,7 @@ func validateCommandLineOrExit() {
 	}
 }
 
-func initPatterns(cfg *v3.Config) (*exporter.Patterns, error) {
+func initPatterns(cfg *v4.Config) (*exporter.Patterns, error) {
 	patterns := exporter.InitPatterns()
 	for _, importedPatterns := range cfg.Imports {
 		if importedPatterns.Type == "grok_patterns" {
@@ -236,84 +327,260 @@ func initPatterns(cfg *v3.Config) (*exporter.Patterns, error) {
 	return patterns, nil
 }
 
-func createMetrics(cfg *v3.Config, patterns *exporter.Patterns) ([]exporter.Metric, error) {
+func createMetrics(cfg *v4.Config, patterns *exporter.Patterns) ([]exporter.Metric, map[string]string, error) {
 	result := make([]exporter.Metric, 0, len(cfg.AllMetrics))
+	definitions := make(map[string]string, len(cfg.AllMetrics))
 	for _, m := range cfg.AllMetrics {
-		var (
-			regex, deleteRegex *oniguruma.Regex
-			err                error
-		)
-		regex, err = exporter.Compile(m.Match, patterns)
+		metric, definition, err := createMetric(&m, patterns)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+			freeMetrics(result)
+			return nil, nil, err
 		}
-		if len(m.DeleteMatch) > 0 {
-			deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
-			if err != nil {
-				return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
-			}
+		result = append(result, metric)
+		definitions[m.Name] = definition
+	}
+	return result, definitions, nil
+}
+
+// The regular expressions are freed if the metric cannot be created.
+func createMetric(m *v4.MetricConfig, patterns *exporter.Patterns) (result exporter.Metric, definition string, err error) {
+	var (
+		matcher     exporter.Matcher
+		deleteRegex *oniguruma.Regex
+	)
+	defer func() {
+		if err != nil && matcher != nil {
+			matcher.Free()
 		}
-		err = exporter.VerifyFieldNames(&m, regex, deleteRegex, additionalFieldDefinitions)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		if err != nil && deleteRegex != nil {
+			deleteRegex.Free()
 		}
-		switch m.Type {
-		case "counter":
-			result = append(result, exporter.NewCounterMetric(&m, regex, deleteRegex))
-		case "gauge":
-			result = append(result, exporter.NewGaugeMetric(&m, regex, deleteRegex))
-		case "histogram":
-			result = append(result, exporter.NewHistogramMetric(&m, regex, deleteRegex))
-		case "summary":
-			result = append(result, exporter.NewSummaryMetric(&m, regex, deleteRegex))
-		default:
-			return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+	}()
+	matcher, err = exporter.NewMatcher(m, patterns)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	if len(m.DeleteMatch) > 0 {
+		deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
 		}
 	}
-	return result, nil
+	err = exporter.VerifyFieldNames(m, matcher, deleteRegex, additionalFieldDefinitions)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	definition, err = metricDefinition(m, patterns)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+	}
+	switch m.Type {
+	case "counter":
+		return exporter.NewCounterMetric(m, matcher, deleteRegex), definition, nil
+	case "gauge":
+		return exporter.NewGaugeMetric(m, matcher, deleteRegex), definition, nil
+	case "histogram":
+		return exporter.NewHistogramMetric(m, matcher, deleteRegex), definition, nil
+	case "summary":
+		return exporter.NewSummaryMetric(m, matcher, deleteRegex), definition, nil
+	default:
+		return nil, "", fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+	}
 }
 
-func initSelfMonitoring(metrics []exporter.Metric, registry prometheus.Registerer) (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec) {
+func freeMetrics(metrics []exporter.Metric) {
+	for _, m := range metrics {
+		m.Free()
+	}
+}
+
+type selfMonitoringMetrics struct {
+	nLinesTotal                      *prometheus.CounterVec
+	nMatchesByMetric                 *prometheus.CounterVec
+	procTimeMicrosecondsByMetric     *prometheus.CounterVec
+	nErrorsByMetric                  *prometheus.CounterVec
+	nDecodingErrorsByMetric          *prometheus.CounterVec
+	nFileRotationsByInput            *prometheus.CounterVec
+	nFileTruncationsByInput          *prometheus.CounterVec
+	nOversizedLinesByInput           *prometheus.CounterVec
+	nWebhookRejectedByInput          *prometheus.CounterVec
+	nWebhookRequestsByInput          *prometheus.CounterVec
+	webhookRequestBytesByInput       *prometheus.HistogramVec
+	webhookRequestLinesByInput       *prometheus.HistogramVec
+	nGelfDroppedByInput              *prometheus.CounterVec
+	nExecExitsByInput                *prometheus.CounterVec
+	nExecRestartsByInput             *prometheus.CounterVec
+	configLastReloadSuccessful       prometheus.Gauge
+	configLastReloadSuccessTimestamp prometheus.Gauge
+}
+
+func initSelfMonitoring(metrics []exporter.Metric, registry prometheus.Registerer) *selfMonitoringMetrics {
 	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "grok_exporter_build_info",
 		Help: "A metric with a constant '1' value labeled by version, builddate, branch, revision, goversion, and platform on which grok_exporter was built.",
 	}, []string{"version", "builddate", "branch", "revision", "goversion", "platform"})
-	nLinesTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_total",
-		Help: "Total number of log lines processed by grok_exporter.",
-	}, []string{"status"})
-	nMatchesByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_matching_total",
-		Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
-	}, []string{"metric"})
-	procTimeMicrosecondsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_processing_time_microseconds_total",
-		Help: "Processing time in microseconds for each metric. Divide by grok_exporter_lines_matching_total to get the averge processing time for one log line.",
-	}, []string{"metric"})
-	nErrorsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_line_processing_errors_total",
-		Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
-	}, []string{"metric"})
+	result := &selfMonitoringMetrics{
+		nLinesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_total",
+			Help: "Total number of log lines processed by grok_exporter.",
+		}, []string{"status"}),
+		nMatchesByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_matching_total",
+			Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
+		}, []string{"metric"}),
+		procTimeMicrosecondsByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_processing_time_microseconds_total",
+			Help: "Processing time in microseconds for each metric. Divide by grok_exporter_lines_matching_total to get the averge processing time for one log line.",
+		}, []string{"metric"}),
+		nErrorsByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_line_processing_errors_total",
+			Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
+		}, []string{"metric"}),
+		nDecodingErrorsByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_line_decoding_errors_total",
+			Help: "Number of log lines that could not be decoded for each metric, like lines that are not valid JSON for metrics with format json.",
+		}, []string{"metric"}),
+		nFileRotationsByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_file_rotations_total",
+			Help: "Number of times a log file was moved or removed, like when it was rotated by logrotate.",
+		}, []string{"input"}),
+		nFileTruncationsByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_file_truncations_total",
+			Help: "Number of times a log file was truncated, like when it was rotated by logrotate with copytruncate.",
+		}, []string{"input"}),
+		nOversizedLinesByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_oversized_total",
+			Help: "Number of log lines that were truncated or dropped, because they were longer than max_line_bytes.",
+		}, []string{"input"}),
+		nWebhookRejectedByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_webhook_requests_rejected_total",
+			Help: "Number of webhook requests that were rejected, because authentication failed.",
+		}, []string{"input", "reason"}),
+		nWebhookRequestsByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_webhook_requests_total",
+			Help: "Number of webhook requests by HTTP status code.",
+		}, []string{"input", "code"}),
+		webhookRequestBytesByInput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grok_exporter_webhook_request_size_bytes",
+			Help:    "Size of the accepted webhook request bodies.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"input"}),
+		webhookRequestLinesByInput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grok_exporter_webhook_request_lines",
+			Help:    "Number of log lines in the accepted webhook requests.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"input"}),
+		nGelfDroppedByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_gelf_messages_dropped_total",
+			Help: "Number of GELF messages that were dropped, because chunks were missing or the message was invalid.",
+		}, []string{"input", "reason"}),
+		nExecExitsByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_exec_exits_total",
+			Help: "Number of times the command of an exec input exited, by exit code. The exit code is -1 if the command was terminated by a signal or could not be started.",
+		}, []string{"input", "exit_code"}),
+		nExecRestartsByInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_exec_restarts_total",
+			Help: "Number of times the command of an exec input was restarted after it exited.",
+		}, []string{"input"}),
+		configLastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "grok_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		configLastReloadSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "grok_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		}),
+	}
 
 	registry.MustRegister(buildInfo)
-	registry.MustRegister(nLinesTotal)
-	registry.MustRegister(nMatchesByMetric)
-	registry.MustRegister(procTimeMicrosecondsByMetric)
-	registry.MustRegister(nErrorsByMetric)
+	registry.MustRegister(result.nLinesTotal)
+	registry.MustRegister(result.nMatchesByMetric)
+	registry.MustRegister(result.procTimeMicrosecondsByMetric)
+	registry.MustRegister(result.nErrorsByMetric)
+	registry.MustRegister(result.nDecodingErrorsByMetric)
+	registry.MustRegister(result.nFileRotationsByInput)
+	registry.MustRegister(result.nFileTruncationsByInput)
+	registry.MustRegister(result.nOversizedLinesByInput)
+	registry.MustRegister(result.nWebhookRejectedByInput)
+	registry.MustRegister(result.nWebhookRequestsByInput)
+	registry.MustRegister(result.webhookRequestBytesByInput)
+	registry.MustRegister(result.webhookRequestLinesByInput)
+	registry.MustRegister(result.nGelfDroppedByInput)
+	registry.MustRegister(result.nExecExitsByInput)
+	registry.MustRegister(result.nExecRestartsByInput)
+	registry.MustRegister(result.configLastReloadSuccessful)
+	registry.MustRegister(result.configLastReloadSuccessTimestamp)
 
 	buildInfo.WithLabelValues(exporter.Version, exporter.BuildDate, exporter.Branch, exporter.Revision, exporter.GoVersion, exporter.Platform).Set(1)
 	// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
-	nLinesTotal.WithLabelValues(number_of_lines_matched_label).Add(0)
-	nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(0)
+	result.nLinesTotal.WithLabelValues(number_of_lines_matched_label).Add(0)
+	result.nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(0)
 	for _, metric := range metrics {
-		nMatchesByMetric.WithLabelValues(metric.Name()).Add(0)
-		procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(0)
-		nErrorsByMetric.WithLabelValues(metric.Name()).Add(0)
+		result.addMetric(metric.Name())
+	}
+	// The initial configuration counts as successfully loaded.
+	result.configLastReloadSuccessful.Set(1)
+	result.configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return result
+}
+
+func (s *selfMonitoringMetrics) addMetric(name string) {
+	s.nMatchesByMetric.WithLabelValues(name).Add(0)
+	s.procTimeMicrosecondsByMetric.WithLabelValues(name).Add(0)
+	s.nErrorsByMetric.WithLabelValues(name).Add(0)
+	s.nDecodingErrorsByMetric.WithLabelValues(name).Add(0)
+}
+
+func (s *selfMonitoringMetrics) removeMetric(name string) {
+	s.nMatchesByMetric.DeleteLabelValues(name)
+	s.procTimeMicrosecondsByMetric.DeleteLabelValues(name)
+	s.nErrorsByMetric.DeleteLabelValues(name)
+	s.nDecodingErrorsByMetric.DeleteLabelValues(name)
+}
+
+// implements fswatcher.Metrics, tailer.WebhookMetrics, tailer.GelfMetrics, and tailer.ExecMetrics
+type inputMetrics struct {
+	input          string
+	selfMonitoring *selfMonitoringMetrics
+}
+
+func (m *inputMetrics) FileRotated(_ string) {
+	m.selfMonitoring.nFileRotationsByInput.WithLabelValues(m.input).Inc()
+}
+
+func (m *inputMetrics) FileTruncated(_ string) {
+	m.selfMonitoring.nFileTruncationsByInput.WithLabelValues(m.input).Inc()
+}
+
+func (m *inputMetrics) LineOversized(_ string) {
+	m.selfMonitoring.nOversizedLinesByInput.WithLabelValues(m.input).Inc()
+}
+
+func (m *inputMetrics) WebhookRequestRejected(reason string) {
+	m.selfMonitoring.nWebhookRejectedByInput.WithLabelValues(m.input, reason).Inc()
+}
+
+func (m *inputMetrics) WebhookRequestServed(status, nBytes, nLines int) {
+	m.selfMonitoring.nWebhookRequestsByInput.WithLabelValues(m.input, strconv.Itoa(status)).Inc()
+	if status == http.StatusOK {
+		m.selfMonitoring.webhookRequestBytesByInput.WithLabelValues(m.input).Observe(float64(nBytes))
+		m.selfMonitoring.webhookRequestLinesByInput.WithLabelValues(m.input).Observe(float64(nLines))
 	}
-	return nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric
 }
 
-func startServer(cfg v3.ServerConfig, httpHandlers []exporter.HttpServerPathHandler) chan error {
+func (m *inputMetrics) GelfMessageDropped(reason string) {
+	m.selfMonitoring.nGelfDroppedByInput.WithLabelValues(m.input, reason).Inc()
+}
+
+func (m *inputMetrics) CommandExited(exitCode int) {
+	m.selfMonitoring.nExecExitsByInput.WithLabelValues(m.input, strconv.Itoa(exitCode)).Inc()
+}
+
+func (m *inputMetrics) CommandRestarted() {
+	m.selfMonitoring.nExecRestartsByInput.WithLabelValues(m.input).Inc()
+}
+
+func startServer(cfg v4.ServerConfig, httpHandlers []exporter.HttpServerPathHandler) chan error {
 	serverErrors := make(chan error)
 	go func() {
 		switch {
@@ -329,35 +596,104 @@ func startServer(cfg v3.ServerConfig, httpHandlers []exporter.HttpServerPathHand
 	return serverErrors
 }
 
-func startTailer(cfg *v3.Config, registry prometheus.Registerer) (fswatcher.FileTailer, error) {
-	var (
-		tail fswatcher.FileTailer
-		err  error
-	)
+func startTailer(cfg *v4.Config, patterns *exporter.Patterns, multilineMatches chan<- *tailer.MultilineMatch, registry prometheus.Registerer, selfMonitoring *selfMonitoringMetrics) (*tailer.MultiInputTailer, fswatcher.FileTailer, error) {
 	logger := logrus.New()
 	logger.Level = logrus.WarnLevel
+	// Inputs can be added, replaced, and removed when the configuration is reloaded, the buffer remains the same.
+	inputs := tailer.NewMultiInputTailer()
+	for i := range cfg.Inputs {
+		tail, err := startInput(&cfg.Inputs[i], cfg.Inputs[i].Readall, patterns, multilineMatches, selfMonitoring, logger)
+		if err != nil {
+			inputs.Close()
+			return nil, nil, err
+		}
+		inputs.Add(cfg.Inputs[i].Name, tail)
+	}
+	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.Global.MaxLinesInBuffer > 0, registry)
+	return inputs, tailer.BufferedTailerWithMetrics(inputs, bufferLoadMetric, logger, cfg.Global.MaxLinesInBuffer), nil
+}
+
+func startInput(cfg *v4.InputConfig, readall bool, patterns *exporter.Patterns, multilineMatches chan<- *tailer.MultilineMatch, selfMonitoring *selfMonitoringMetrics, logger logrus.FieldLogger) (fswatcher.FileTailer, error) {
+	if cfg.Multiline == nil {
+		return runContainerInput(cfg, readall, selfMonitoring, logger)
+	}
+	pattern := cfg.Multiline.StartPattern
+	if len(pattern) == 0 {
+		pattern = cfg.Multiline.ContinuationPattern
+	}
+	regex, err := exporter.Compile(pattern, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize multiline pattern for input %v: %v", cfg.Name, err)
+	}
+	tail, err := runContainerInput(cfg, readall, selfMonitoring, logger)
+	if err != nil {
+		regex.Free()
+		return nil, err
+	}
+	return tailer.MultilineTailer(tail, cfg.Multiline, regex, multilineMatches), nil
+}
+
+// Container log lines are unwrapped before multiline events are joined, so that multiline patterns match the original log lines.
+func runContainerInput(cfg *v4.InputConfig, readall bool, selfMonitoring *selfMonitoringMetrics, logger logrus.FieldLogger) (fswatcher.FileTailer, error) {
+	tail, err := runInput(cfg, readall, selfMonitoring, logger)
+	if err != nil || len(cfg.ContainerFormat) == 0 {
+		return tail, err
+	}
+	return tailer.ContainerTailer(tail, cfg.ContainerFormat), nil
+}
+
+func runInput(cfg *v4.InputConfig, readall bool, selfMonitoring *selfMonitoringMetrics, logger logrus.FieldLogger) (fswatcher.FileTailer, error) {
+	metrics := &inputMetrics{input: cfg.Name, selfMonitoring: selfMonitoring}
+	if cfg.MaxLineBytes > 0 {
+		// Initializing a value with zero makes the label appear.
+		selfMonitoring.nOversizedLinesByInput.WithLabelValues(cfg.Name).Add(0)
+	}
 	switch {
-	case cfg.Input.Type == "file":
-		if cfg.Input.PollInterval == 0 {
-			tail, err = fswatcher.RunFileTailer(cfg.Input.Globs, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, logger)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			tail, err = fswatcher.RunPollingFileTailer(cfg.Input.Globs, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, cfg.Input.PollInterval, logger)
-			if err != nil {
-				return nil, err
+	case cfg.Type == "file":
+		selfMonitoring.nFileRotationsByInput.WithLabelValues(cfg.Name).Add(0)
+		selfMonitoring.nFileTruncationsByInput.WithLabelValues(cfg.Name).Add(0)
+		return fswatcher.RunFileTailerWithOptions(cfg.Globs, readall, cfg.FailOnMissingLogfile, fswatcher.Options{
+			PollInterval:         cfg.PollInterval,
+			PositionFile:         cfg.PositionFile,
+			PositionSyncInterval: cfg.PositionSyncInterval,
+			ExcludeGlobs:         cfg.ExcludeGlobs,
+			RotationGracePeriod:  cfg.RotationGracePeriod,
+			Encoding:             cfg.Encoding,
+			MaxLineBytes:         cfg.MaxLineBytes,
+			DropOversizedLines:   cfg.OversizedLines == "drop",
+			Metrics:              metrics,
+		}, logger)
+	case cfg.Type == "stdin":
+		return tailer.RunStdinTailer(cfg, metrics), nil
+	case cfg.Type == "webhook":
+		selfMonitoring.nWebhookRequestsByInput.WithLabelValues(cfg.Name, "200").Add(0)
+		selfMonitoring.webhookRequestBytesByInput.WithLabelValues(cfg.Name)
+		selfMonitoring.webhookRequestLinesByInput.WithLabelValues(cfg.Name)
+		if cfg.WebhookAuth != nil {
+			for _, reason := range tailer.WebhookRejectReasons {
+				selfMonitoring.nWebhookRejectedByInput.WithLabelValues(cfg.Name, reason).Add(0)
 			}
 		}
-	case cfg.Input.Type == "stdin":
-		tail = tailer.RunStdinTailer()
-	case cfg.Input.Type == "webhook":
-		tail = tailer.InitWebhookTailer(&cfg.Input)
-	case cfg.Input.Type == "kafka":
-		tail = tailer.RunKafkaTailer(&cfg.Input)
+		return tailer.InitWebhookTailer(cfg, metrics)
+	case cfg.Type == "kafka":
+		return tailer.RunKafkaTailer(cfg, metrics), nil
+	case cfg.Type == "syslog":
+		return tailer.RunSyslogTailer(cfg)
+	case cfg.Type == "journald":
+		return tailer.RunJournaldTailer(cfg), nil
+	case cfg.Type == "fluent_forward":
+		return tailer.RunFluentForwardTailer(cfg)
+	case cfg.Type == "gelf":
+		for _, reason := range tailer.GelfDropReasons {
+			selfMonitoring.nGelfDroppedByInput.WithLabelValues(cfg.Name, reason).Add(0)
+		}
+		return tailer.RunGelfTailer(cfg, metrics)
+	case cfg.Type == "tcp" || cfg.Type == "unix":
+		return tailer.RunSocketTailer(cfg, metrics)
+	case cfg.Type == "exec":
+		selfMonitoring.nExecRestartsByInput.WithLabelValues(cfg.Name).Add(0)
+		return tailer.RunExecTailer(cfg, metrics)
 	default:
-		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Input.Type)
+		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Type)
 	}
-	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.Input.MaxLinesInBuffer > 0, registry)
-	return tailer.BufferedTailerWithMetrics(tail, bufferLoadMetric, logger, cfg.Input.MaxLinesInBuffer), nil
 }
@@ -0,0 +1,399 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const reloadPath = "/-/reload"
+
+// The part of the exporter's state that is replaced when the configuration is reloaded.
+type runningConfig struct {
+	cfg             *v4.Config
+	patterns        *exporter.Patterns // needed to restart inputs if a reload fails, see restartInputs()
+	metrics         []exporter.Metric
+	definitions     map[string]string // metric name -> definition, see metricDefinition()
+	retentionTicker *time.Ticker
+	stateTicker     *time.Ticker // nil if no state file is configured
+}
+
+// Selecting on the nil channel blocks forever, so the state is never written if no state file is configured.
+func (c *runningConfig) stateSync() <-chan time.Time {
+	if c.stateTicker == nil {
+		return nil
+	}
+	return c.stateTicker.C
+}
+
+// The reload handler does not reload the configuration itself, it sends a request to the main loop
+// and waits for the result. That way, the configuration is never changed while a log line is being processed.
+func reloadHandler(reloadRequests chan chan error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		result := make(chan error)
+		reloadRequests <- result
+		err := <-result
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Reload the configuration file. If the new configuration cannot be applied, the current configuration remains active.
+func reload(current *runningConfig, inputs *tailer.MultiInputTailer, multilineMatches chan<- *tailer.MultilineMatch, registry prometheus.Registerer, selfMonitoring *selfMonitoringMetrics) error {
+	err := applyConfig(current, inputs, multilineMatches, registry, selfMonitoring)
+	if err != nil {
+		selfMonitoring.configLastReloadSuccessful.Set(0)
+		return err
+	}
+	selfMonitoring.configLastReloadSuccessful.Set(1)
+	selfMonitoring.configLastReloadSuccessTimestamp.SetToCurrentTime()
+	fmt.Printf("Reloaded configuration from %v\n", *configPath)
+	return nil
+}
+
+func applyConfig(current *runningConfig, inputs *tailer.MultiInputTailer, multilineMatches chan<- *tailer.MultilineMatch, registry prometheus.Registerer, selfMonitoring *selfMonitoringMetrics) error {
+	cfg, warn, err := config.LoadConfigFile(*configPath)
+	if len(warn) > 0 {
+		fmt.Fprintf(os.Stderr, "%v\n", warn)
+	}
+	if err != nil {
+		return err
+	}
+	err = verifyReloadable(current.cfg, cfg)
+	if err != nil {
+		return err
+	}
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		return err
+	}
+	metrics, definitions, err := createMetrics(cfg, patterns)
+	if err != nil {
+		return err
+	}
+
+	// Inputs are only replaced if their configuration changed.
+	// On reload, files are always tailed from the end, because 'readall' would process lines that were already processed.
+	// The new inputs are not used before they are added to the MultiInputTailer below, and shared tailers like the
+	// webhook tailer apply the new settings only then. So if the reload fails, the current inputs keep running unchanged.
+	// The only exception are changed file inputs, and removed file inputs with a position file: They are stopped before
+	// the new inputs are started, so that lines appended while both tailers run are not counted twice, a new input using
+	// the same position file resumes at the old input's last processed line, and the position file is not written by
+	// two tailers. If the reload fails, these inputs are restarted.
+	logger := logrus.New()
+	logger.Level = logrus.WarnLevel
+	var stoppedInputs []*v4.InputConfig
+	for i, oldInput := range current.cfg.Inputs {
+		newInput := findInput(cfg, oldInput.Name)
+		changed := newInput != nil && !equalYaml(oldInput, newInput)
+		removedWithPositionFile := newInput == nil && len(oldInput.PositionFile) > 0
+		if oldInput.Type == "file" && (changed || removedWithPositionFile) {
+			inputs.Remove(oldInput.Name)
+			stoppedInputs = append(stoppedInputs, &current.cfg.Inputs[i])
+		}
+	}
+	// Inputs reading webhook secrets from files are restarted on each reload, so that rotated secrets are read again.
+	startedInputs := make(map[string]fswatcher.FileTailer)
+	for i, newInput := range cfg.Inputs {
+		oldInput := findInput(current.cfg, newInput.Name)
+		if oldInput != nil && equalYaml(oldInput, newInput) && !readsSecretFiles(&newInput) {
+			continue
+		}
+		tail, err := startInput(&cfg.Inputs[i], false, patterns, multilineMatches, selfMonitoring, logger)
+		if err != nil {
+			closeInputs(startedInputs)
+			restartInputs(stoppedInputs, inputs, current.patterns, multilineMatches, selfMonitoring, logger)
+			freeMetrics(metrics)
+			return err
+		}
+		startedInputs[newInput.Name] = tail
+	}
+
+	// Metrics with unchanged definitions are kept, so that their values are not reset.
+	// Metrics that are removed or changed are unregistered, new and changed metrics are registered.
+	// The regular expressions of the metrics that are not used anymore are freed when the reload was successful.
+	oldMetrics := make(map[string]exporter.Metric, len(current.metrics))
+	for _, m := range current.metrics {
+		oldMetrics[m.Name()] = m
+	}
+	var added, removed, discarded []exporter.Metric
+	for i, m := range metrics {
+		old, exists := oldMetrics[m.Name()]
+		if exists && current.definitions[m.Name()] == definitions[m.Name()] {
+			discarded = append(discarded, m)
+			metrics[i] = old
+			delete(oldMetrics, m.Name())
+		} else {
+			added = append(added, m)
+		}
+	}
+	for _, m := range oldMetrics {
+		removed = append(removed, m)
+	}
+	err = replaceCollectors(registry, removed, added)
+	if err != nil {
+		closeInputs(startedInputs)
+		restartInputs(stoppedInputs, inputs, current.patterns, multilineMatches, selfMonitoring, logger)
+		freeMetrics(added)
+		freeMetrics(discarded)
+		return err
+	}
+
+	for _, oldInput := range current.cfg.Inputs {
+		if findInput(cfg, oldInput.Name) == nil {
+			inputs.Remove(oldInput.Name)
+		}
+	}
+	for name, tail := range startedInputs {
+		inputs.Add(name, tail)
+	}
+
+	for _, m := range removed {
+		selfMonitoring.removeMetric(m.Name())
+	}
+	freeMetrics(removed)
+	freeMetrics(discarded)
+	for _, m := range added {
+		selfMonitoring.addMetric(m.Name())
+	}
+	if current.cfg.Global.RetentionCheckInterval != cfg.Global.RetentionCheckInterval {
+		current.retentionTicker.Stop()
+		current.retentionTicker = time.NewTicker(cfg.Global.RetentionCheckInterval)
+	}
+	if current.cfg.Global.StateFile != cfg.Global.StateFile || current.cfg.Global.StateSyncInterval != cfg.Global.StateSyncInterval {
+		if current.stateTicker != nil {
+			current.stateTicker.Stop()
+		}
+		current.stateTicker = newStateTicker(cfg)
+	}
+	current.cfg = cfg
+	current.patterns = patterns
+	current.metrics = metrics
+	current.definitions = definitions
+	return nil
+}
+
+// Some configuration changes cannot be applied while grok_exporter is running,
+// because the HTTP server is not restarted when the configuration is reloaded.
+func verifyReloadable(oldCfg, newCfg *v4.Config) error {
+	if !equalYaml(oldCfg.Server, newCfg.Server) {
+		return fmt.Errorf("the server configuration changed: this requires a restart of grok_exporter")
+	}
+	if oldCfg.Global.MaxLinesInBuffer != newCfg.Global.MaxLinesInBuffer {
+		return fmt.Errorf("the max_lines_in_buffer configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(webhookPaths(oldCfg), webhookPaths(newCfg)) {
+		return fmt.Errorf("the webhook_path configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(syslogAddresses(oldCfg), syslogAddresses(newCfg)) {
+		return fmt.Errorf("the syslog address configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(fluentForwardAddresses(oldCfg), fluentForwardAddresses(newCfg)) {
+		return fmt.Errorf("the fluent_forward_address configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(gelfAddresses(oldCfg), gelfAddresses(newCfg)) {
+		return fmt.Errorf("the GELF address configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(socketListeners(oldCfg), socketListeners(newCfg)) {
+		return fmt.Errorf("the tcp_address, unix_socket_path, or TLS configuration changed: this requires a restart of grok_exporter")
+	}
+	if !equalYaml(journaldConfig(oldCfg), journaldConfig(newCfg)) {
+		return fmt.Errorf("the journald configuration changed: this requires a restart of grok_exporter")
+	}
+	return nil
+}
+
+func webhookPaths(cfg *v4.Config) map[string]bool {
+	result := make(map[string]bool)
+	for _, input := range cfg.Inputs {
+		if input.Type == "webhook" {
+			result[input.WebhookPath] = true
+		}
+	}
+	return result
+}
+
+// The syslog listeners are kept open when the configuration is reloaded, see tailer.RunSyslogTailer().
+func syslogAddresses(cfg *v4.Config) map[string]bool {
+	result := make(map[string]bool)
+	for _, input := range cfg.Inputs {
+		if input.Type == "syslog" {
+			result[input.SyslogUdpAddress+" "+input.SyslogTcpAddress] = true
+		}
+	}
+	return result
+}
+
+// The fluent forward listeners are kept open when the configuration is reloaded, see tailer.RunFluentForwardTailer().
+func fluentForwardAddresses(cfg *v4.Config) map[string]bool {
+	result := make(map[string]bool)
+	for _, input := range cfg.Inputs {
+		if input.Type == "fluent_forward" {
+			result[input.FluentForwardAddress] = true
+		}
+	}
+	return result
+}
+
+// The GELF listeners are kept open when the configuration is reloaded, see tailer.RunGelfTailer().
+func gelfAddresses(cfg *v4.Config) map[string]bool {
+	result := make(map[string]bool)
+	for _, input := range cfg.Inputs {
+		if input.Type == "gelf" {
+			result[input.GelfUdpAddress+" "+input.GelfTcpAddress] = true
+		}
+	}
+	return result
+}
+
+// The tcp and unix listeners are kept open when the configuration is reloaded, see tailer.RunSocketTailer().
+// The TLS certificates are loaded when the listener is created, so changing them also requires a restart.
+func socketListeners(cfg *v4.Config) map[string]bool {
+	result := make(map[string]bool)
+	for _, input := range cfg.Inputs {
+		if input.Type == "tcp" || input.Type == "unix" {
+			result[input.Type+" "+input.TcpAddress+input.UnixSocketPath+" "+input.TlsCert+" "+input.TlsKey+" "+input.TlsClientCA] = true
+		}
+	}
+	return result
+}
+
+// The go-routine reading the journal from stdin is kept running when the configuration is reloaded, see tailer.RunJournaldTailer().
+func journaldConfig(cfg *v4.Config) map[string]string {
+	for _, input := range cfg.Inputs {
+		if input.Type == "journald" {
+			return map[string]string{
+				"journald_format":      input.JournaldFormat,
+				"journald_cursor_file": input.JournaldCursorFile,
+			}
+		}
+	}
+	return nil
+}
+
+func closeInputs(inputs map[string]fswatcher.FileTailer) {
+	for _, tail := range inputs {
+		tail.Close()
+	}
+}
+
+// Restart inputs that were stopped for a reload that failed. They resume at the positions in their position files.
+// If an input cannot be restarted, the previous configuration remains active without that input.
+func restartInputs(stopped []*v4.InputConfig, inputs *tailer.MultiInputTailer, patterns *exporter.Patterns, multilineMatches chan<- *tailer.MultilineMatch, selfMonitoring *selfMonitoringMetrics, logger logrus.FieldLogger) {
+	for _, cfg := range stopped {
+		tail, err := startInput(cfg, false, patterns, multilineMatches, selfMonitoring, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: failed to restart input %v: %v\n", cfg.Name, err)
+			continue
+		}
+		inputs.Add(cfg.Name, tail)
+	}
+}
+
+func readsSecretFiles(input *v4.InputConfig) bool {
+	auth := input.WebhookAuth
+	return auth != nil && (len(auth.BearerTokenFile) > 0 || len(auth.PasswordHashFile) > 0 || len(auth.HmacSecretFile) > 0)
+}
+
+func findInput(cfg *v4.Config, name string) *v4.InputConfig {
+	for i := range cfg.Inputs {
+		if cfg.Inputs[i].Name == name {
+			return &cfg.Inputs[i]
+		}
+	}
+	return nil
+}
+
+// Unregister the removed metrics and register the added metrics.
+// If a metric cannot be registered, the previous state of the registry is restored.
+func replaceCollectors(registry prometheus.Registerer, removed, added []exporter.Metric) error {
+	for _, m := range removed {
+		registry.Unregister(m.Collector())
+	}
+	for i, m := range added {
+		err := registry.Register(m.Collector())
+		if err != nil {
+			for _, a := range added[:i] {
+				registry.Unregister(a.Collector())
+			}
+			for _, r := range removed {
+				_ = registry.Register(r.Collector())
+			}
+			return fmt.Errorf("failed to register metric %v: %v", m.Name(), err)
+		}
+	}
+	return nil
+}
+
+// The definition of a metric is its configuration, with the grok patterns expanded.
+// If a grok pattern that is used by a metric changes, the metric changes as well.
+func metricDefinition(m *v4.MetricConfig, patterns *exporter.Patterns) (string, error) {
+	var (
+		match, deleteMatch string
+		err                error
+	)
+	cfg, err := yaml.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	match, err = exporter.Expand(m.Match, patterns)
+	if err != nil {
+		return "", err
+	}
+	if len(m.DeleteMatch) > 0 {
+		deleteMatch, err = exporter.Expand(m.DeleteMatch, patterns)
+		if err != nil {
+			return "", err
+		}
+	}
+	// yaml.Marshal() sorts map keys, so the result is deterministic
+	matchFields := make(map[string]string, len(m.MatchFields))
+	for selector, pattern := range m.MatchFields {
+		matchFields[selector], err = exporter.Expand(pattern, patterns)
+		if err != nil {
+			return "", err
+		}
+	}
+	expandedMatchFields, err := yaml.Marshal(matchFields)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\nexpanded_match: %q\nexpanded_delete_match: %q\nexpanded_match_fields: %q\n", cfg, match, deleteMatch, expandedMatchFields), nil
+}
+
+func equalYaml(a, b interface{}) bool {
+	yamlA, errA := yaml.Marshal(a)
+	yamlB, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(yamlA, yamlB)
+}
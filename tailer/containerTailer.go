@@ -0,0 +1,270 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// Partial lines are joined up to this size. If a log line is longer, it is split.
+const maxContainerLineBytes = 1024 * 1024
+
+// implements fswatcher.FileTailer
+type containerTailer struct {
+	out  chan *fswatcher.Line
+	orig fswatcher.FileTailer
+	done chan struct{}
+}
+
+func (c *containerTailer) Lines() chan *fswatcher.Line {
+	return c.out
+}
+
+func (c *containerTailer) Errors() chan fswatcher.Error {
+	return c.orig.Errors()
+}
+
+func (c *containerTailer) Close() {
+	c.orig.Close()
+	close(c.done)
+}
+
+func (c *containerTailer) activate() {
+	activate(c.orig)
+}
+
+// Wrapper around a file tailer that unwraps container log lines, see container_format in CONFIG.md.
+// The format is "docker" for Docker's json-file log driver, "cri" for the Kubernetes CRI log format,
+// or "auto" for detecting the format for each line. Partial lines are joined, the stream, the container
+// timestamp, and the Kubernetes pod, namespace, and container parsed from the file name are provided as extra fields.
+func ContainerTailer(orig fswatcher.FileTailer, format string) fswatcher.FileTailer {
+	out := make(chan *fswatcher.Line)
+	done := make(chan struct{})
+	decoder := &containerLogDecoder{format: format}
+	go func() {
+		for {
+			select {
+			case line, ok := <-orig.Lines():
+				if !ok {
+					for _, complete := range decoder.flush() {
+						select {
+						case out <- complete:
+						case <-done:
+							return
+						}
+					}
+					close(out)
+					return
+				}
+				complete := decoder.add(line)
+				if complete == nil {
+					continue
+				}
+				select {
+				case out <- complete:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &containerTailer{
+		out:  out,
+		orig: orig,
+		done: done,
+	}
+}
+
+type containerLogDecoder struct {
+	format  string
+	partial []*partialContainerLine // at most one per file and stream
+}
+
+type partialContainerLine struct {
+	first    *fswatcher.Line     // the file, input, and timestamp are taken from the first part
+	position *fswatcher.Position // of the last part, see fswatcher.Line.Processed()
+	extra    map[string]interface{}
+	parts    []string
+	size     int
+}
+
+type dockerLogLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// Returns the complete line, or nil if the line is partial.
+func (d *containerLogDecoder) add(line *fswatcher.Line) *fswatcher.Line {
+	msg, stream, timestamp, isPartial, ok := d.decode(line.Line)
+	if !ok {
+		// Lines that cannot be decoded are passed on as they are.
+		return d.holdBackPosition(&fswatcher.Line{Line: line.Line, File: line.File, Input: line.Input, Extra: containerExtra(line.File, "", ""), Position: line.Position})
+	}
+	p := d.find(line.File, stream)
+	if p == nil {
+		if !isPartial {
+			return d.holdBackPosition(&fswatcher.Line{Line: msg, File: line.File, Input: line.Input, Extra: containerExtra(line.File, stream, timestamp), Position: line.Position})
+		}
+		p = &partialContainerLine{
+			first: line,
+			extra: containerExtra(line.File, stream, timestamp),
+		}
+		d.partial = append(d.partial, p)
+	}
+	p.parts = append(p.parts, msg)
+	p.size += len(msg)
+	p.position = line.Position
+	if isPartial && p.size < maxContainerLineBytes {
+		return nil
+	}
+	return d.holdBackPosition(d.remove(p))
+}
+
+// When stdout and stderr are interleaved, a line of one stream may be complete while a partial line of the other stream
+// is still pending. The position of the file must not move past the pending partial line, otherwise it would be lost when
+// grok_exporter is restarted with a position file. Therefore, lines of a file with pending partial lines have no position.
+// The line that completes the last pending partial line has the position of its last part, which is after all these lines.
+func (d *containerLogDecoder) holdBackPosition(line *fswatcher.Line) *fswatcher.Line {
+	for _, p := range d.partial {
+		if p.first.File == line.File {
+			line.Position = nil
+			break
+		}
+	}
+	return line
+}
+
+// Called when the source tailer is closed, returns the pending partial lines.
+func (d *containerLogDecoder) flush() []*fswatcher.Line {
+	var result []*fswatcher.Line
+	for len(d.partial) > 0 {
+		result = append(result, d.holdBackPosition(d.remove(d.partial[0])))
+	}
+	return result
+}
+
+func (d *containerLogDecoder) decode(line string) (msg, stream, timestamp string, isPartial, ok bool) {
+	format := d.format
+	if format == "auto" {
+		if strings.HasPrefix(line, "{") {
+			format = "docker"
+		} else {
+			format = "cri"
+		}
+	}
+	if format == "docker" {
+		return decodeDockerLogLine(line)
+	}
+	return decodeCriLogLine(line)
+}
+
+// Docker's json-file log driver writes lines like {"log":"message\n","stream":"stdout","time":"2020-06-01T10:00:00.000000000Z"}.
+// Long lines are split into multiple partial lines, the last part is terminated with "\n".
+func decodeDockerLogLine(line string) (msg, stream, timestamp string, isPartial, ok bool) {
+	var decoded dockerLogLine
+	if json.Unmarshal([]byte(line), &decoded) != nil {
+		return "", "", "", false, false
+	}
+	msg = strings.TrimSuffix(decoded.Log, "\n")
+	isPartial = msg == decoded.Log
+	return strings.TrimSuffix(msg, "\r"), decoded.Stream, decoded.Time, isPartial, true
+}
+
+// The CRI log format has lines like "2020-06-01T10:00:00.000000000Z stdout F message".
+// The tag is "P" for partial lines and "F" for full lines or the last part of a partial line.
+func decodeCriLogLine(line string) (msg, stream, timestamp string, isPartial, ok bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return "", "", "", false, false
+	}
+	timestamp, stream = fields[0], fields[1]
+	tags := strings.Split(fields[2], ":") // future versions of CRI may add more tags
+	if tags[0] != "P" && tags[0] != "F" {
+		return "", "", "", false, false
+	}
+	if len(fields) == 4 {
+		msg = fields[3]
+	}
+	return msg, stream, timestamp, tags[0] == "P", true
+}
+
+// The pod, namespace, and container are parsed from the file name:
+//
+//	/var/log/containers/<pod>_<namespace>_<container>-<container_id>.log
+//	/var/log/pods/<namespace>_<pod>_<pod_uid>/<container>/<restart_count>.log
+//	/var/lib/docker/containers/<container_id>/<container_id>-json.log
+//
+// Fields that cannot be parsed from the file name are empty.
+func containerExtra(path, stream, timestamp string) map[string]interface{} {
+	result := map[string]interface{}{
+		"stream":       stream,
+		"timestamp":    timestamp,
+		"pod":          "",
+		"namespace":    "",
+		"container":    "",
+		"container_id": "",
+	}
+	dir, file := filepath.Split(path)
+	parentDir := filepath.Base(dir)
+	grandParentDir := filepath.Base(filepath.Dir(filepath.Clean(dir)))
+	switch {
+	case strings.HasSuffix(file, "-json.log") && strings.TrimSuffix(file, "-json.log") == parentDir:
+		result["container_id"] = parentDir
+	case grandParentDir != "" && strings.Count(grandParentDir, "_") == 2 && strings.HasSuffix(file, ".log"):
+		parts := strings.Split(grandParentDir, "_")
+		result["namespace"], result["pod"], result["container"] = parts[0], parts[1], parentDir
+	case strings.Count(file, "_") == 2 && strings.HasSuffix(file, ".log"):
+		parts := strings.Split(strings.TrimSuffix(file, ".log"), "_")
+		result["pod"], result["namespace"] = parts[0], parts[1]
+		if dash := strings.LastIndexByte(parts[2], '-'); dash > 0 {
+			result["container"], result["container_id"] = parts[2][:dash], parts[2][dash+1:]
+		} else {
+			result["container"] = parts[2]
+		}
+	}
+	return result
+}
+
+func (d *containerLogDecoder) find(file, stream string) *partialContainerLine {
+	for _, p := range d.partial {
+		if p.first.File == file && p.extra["stream"] == stream {
+			return p
+		}
+	}
+	return nil
+}
+
+func (d *containerLogDecoder) remove(p *partialContainerLine) *fswatcher.Line {
+	for i := range d.partial {
+		if d.partial[i] == p {
+			d.partial = append(d.partial[:i], d.partial[i+1:]...)
+			break
+		}
+	}
+	return &fswatcher.Line{
+		Line:     strings.Join(p.parts, ""),
+		File:     p.first.File,
+		Input:    p.first.Input,
+		Extra:    p.extra,
+		Position: p.position,
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+const (
+	criLogFile    = "/var/log/pods/default_web-7d4b9c_0a1b2c3d/nginx/0.log"
+	dockerLogFile = "/var/log/containers/web-7d4b9c_default_nginx-4f5e6d.log"
+)
+
+func TestContainerTailerCri(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := ContainerTailer(src, "cri")
+	defer tail.Close()
+	go func() {
+		for _, line := range []string{
+			"2020-06-01T10:00:00.000000001Z stdout F GET /index.html 200",
+			"2020-06-01T10:00:01.000000001Z stderr P a very ",
+			"2020-06-01T10:00:01.000000002Z stdout F interleaved",
+			"2020-06-01T10:00:01.000000003Z stderr P long ",
+			"2020-06-01T10:00:01.000000004Z stderr F line",
+			"not a cri line",
+		} {
+			src.lines <- &fswatcher.Line{Line: line, File: criLogFile, Input: "k8s"}
+		}
+	}()
+	expectContainerLine(t, tail, "GET /index.html 200", map[string]string{"stream": "stdout", "timestamp": "2020-06-01T10:00:00.000000001Z", "namespace": "default", "pod": "web-7d4b9c", "container": "nginx"})
+	expectContainerLine(t, tail, "interleaved", map[string]string{"stream": "stdout", "timestamp": "2020-06-01T10:00:01.000000002Z"})
+	expectContainerLine(t, tail, "a very long line", map[string]string{"stream": "stderr", "timestamp": "2020-06-01T10:00:01.000000001Z"})
+	expectContainerLine(t, tail, "not a cri line", map[string]string{"stream": "", "namespace": "default", "container": "nginx"})
+}
+
+func TestContainerTailerDocker(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := ContainerTailer(src, "auto")
+	go func() {
+		for _, line := range []string{
+			`{"log":"first part, ","stream":"stdout","time":"2020-06-01T10:00:00.1Z"}`,
+			`{"log":"second part\n","stream":"stdout","time":"2020-06-01T10:00:00.2Z"}`,
+			"2020-06-01T10:00:01Z stderr F cri line",
+			`{"log":"unterminated","stream":"stdout","time":"2020-06-01T10:00:02Z"}`,
+		} {
+			src.lines <- &fswatcher.Line{Line: line, File: dockerLogFile, Input: "k8s"}
+		}
+		close(src.lines)
+	}()
+	expectContainerLine(t, tail, "first part, second part", map[string]string{"stream": "stdout", "timestamp": "2020-06-01T10:00:00.1Z", "namespace": "default", "pod": "web-7d4b9c", "container": "nginx", "container_id": "4f5e6d"})
+	expectContainerLine(t, tail, "cri line", map[string]string{"stream": "stderr"})
+	// pending partial lines are flushed when the source is closed
+	expectContainerLine(t, tail, "unterminated", map[string]string{"stream": "stdout"})
+}
+
+func TestContainerPositionWithPendingPartialLine(t *testing.T) {
+	decoder := &containerLogDecoder{format: "cri"}
+	cursor := &fswatcher.Cursor{}
+	add := func(line, position string) *fswatcher.Line {
+		return decoder.add(&fswatcher.Line{Line: line, File: criLogFile, Position: fswatcher.NewCursorPosition(cursor, position)})
+	}
+	add("2020-06-01T10:00:00Z stdout F first", "1").Processed()
+	if add("2020-06-01T10:00:01Z stderr P a long ", "2") != nil {
+		t.Fatal("Expected a partial line.")
+	}
+	add("2020-06-01T10:00:02Z stdout F interleaved", "3").Processed()
+	// the position must not move past the pending partial line
+	if cursor.Load() != "1" {
+		t.Fatalf("Expected position 1, but got %q.", cursor.Load())
+	}
+	add("2020-06-01T10:00:03Z stderr F line", "4").Processed()
+	if cursor.Load() != "4" {
+		t.Fatalf("Expected position 4, but got %q.", cursor.Load())
+	}
+}
+
+func TestContainerExtraDocker(t *testing.T) {
+	extra := containerExtra("/var/lib/docker/containers/4f5e6d/4f5e6d-json.log", "stdout", "")
+	if extra["container_id"] != "4f5e6d" || extra["pod"] != "" {
+		t.Fatalf("unexpected extra fields: %v", extra)
+	}
+}
+
+func expectContainerLine(t *testing.T, tail fswatcher.FileTailer, expected string, expectedExtra map[string]string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expected {
+			t.Fatalf("Expected %q, but got %q.", expected, line.Line)
+		}
+		if line.Input != "k8s" {
+			t.Fatalf("Expected line %q from input k8s, but got input %q.", expected, line.Input)
+		}
+		extra := line.Extra.(map[string]interface{})
+		for name, value := range expectedExtra {
+			if extra[name] != value {
+				t.Fatalf("Expected %v=%q for line %q, but got %q.", name, value, expected, extra[name])
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while waiting for %q.", expected)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// When the tailer is closed, the command gets SIGTERM. If it is still running after this timeout, it is killed.
+const execStopTimeout = 10 * time.Second
+
+// ExecMetrics is implemented by the caller to count the exits and restarts of the command for self-monitoring.
+type ExecMetrics interface {
+	fswatcher.Metrics
+	CommandExited(exitCode int) // exitCode is -1 if the command was terminated by a signal or could not be started
+	CommandRestarted()
+}
+
+// The exec tailer runs a command and reads the lines from its stdout, and optionally from its stderr.
+// The command is restarted when it exits, see run().
+type execTailer struct {
+	lines              chan *fswatcher.Line
+	errors             chan fswatcher.Error
+	command            []string
+	readStderr         bool
+	restartDelay       time.Duration
+	maxRestartDelay    time.Duration
+	maxLineBytes       int
+	dropOversizedLines bool
+	metrics            ExecMetrics
+	closeOnce          sync.Once
+	done               chan struct{} // closed when Close() is called
+	stopped            chan struct{} // closed when the command is terminated and will not be restarted
+}
+
+func (t *execTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *execTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+// Unlike the stdin tailer, the exec tailer can be stopped: Close() terminates the command and waits until it exited.
+func (t *execTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		<-t.stopped
+	})
+}
+
+// The first start of the command must succeed, so that configuration errors like a typo in the command are reported on startup.
+func RunExecTailer(cfg *configuration.InputConfig, metrics ExecMetrics) (fswatcher.FileTailer, error) {
+	t := &execTailer{
+		lines:              make(chan *fswatcher.Line),
+		errors:             make(chan fswatcher.Error),
+		command:            cfg.ExecCommand,
+		readStderr:         cfg.ExecStderr,
+		restartDelay:       cfg.ExecRestartDelay,
+		maxRestartDelay:    cfg.ExecMaxRestartDelay,
+		maxLineBytes:       cfg.MaxLineBytes,
+		dropOversizedLines: cfg.OversizedLines == "drop",
+		metrics:            metrics,
+		done:               make(chan struct{}),
+		stopped:            make(chan struct{}),
+	}
+	cmd, pipes, err := t.start()
+	if err != nil {
+		return nil, err
+	}
+	go t.run(cmd, pipes)
+	return t, nil
+}
+
+// Restarts the command with exponential backoff: The delay doubles with each restart up to maxRestartDelay,
+// and is reset when the command was running for at least maxRestartDelay.
+func (t *execTailer) run(cmd *exec.Cmd, pipes map[string]io.Reader) {
+	defer close(t.stopped)
+	delay := t.restartDelay
+	for {
+		started := time.Now()
+		exitCode := t.wait(cmd, pipes)
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		t.metrics.CommandExited(exitCode)
+		if time.Since(started) >= t.maxRestartDelay {
+			delay = t.restartDelay
+		}
+		logrus.Warnf("%v exited with code %v, restarting in %v", t, exitCode, delay)
+		for {
+			select {
+			case <-time.After(delay):
+			case <-t.done:
+				return
+			}
+			if delay *= 2; delay > t.maxRestartDelay {
+				delay = t.maxRestartDelay
+			}
+			t.metrics.CommandRestarted()
+			var err error
+			cmd, pipes, err = t.start()
+			if err == nil {
+				break
+			}
+			t.metrics.CommandExited(-1)
+			logrus.Warnf("%v, restarting in %v", err, delay)
+		}
+	}
+}
+
+// Returns the pipes by stream name, the stream name is available as extra field.
+// If stderr is not read, it is passed through to grok_exporter's stderr.
+func (t *execTailer) start() (*exec.Cmd, map[string]io.Reader, error) {
+	cmd := exec.Command(t.command[0], t.command[1:]...)
+	pipes := make(map[string]io.Reader)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start %v: %v", t, err)
+	}
+	pipes["stdout"] = stdout
+	if t.readStderr {
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to start %v: %v", t, err)
+		}
+		pipes["stderr"] = stderr
+	} else {
+		cmd.Stderr = os.Stderr
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start %v: %v", t, err)
+	}
+	return cmd, pipes, nil
+}
+
+// Reads the lines until the command exits, and returns the exit code.
+// The pipes must be read to the end before calling cmd.Wait(), because Wait() closes them.
+func (t *execTailer) wait(cmd *exec.Cmd, pipes map[string]io.Reader) int {
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-t.done:
+			t.terminate(cmd.Process, exited)
+		case <-exited:
+		}
+	}()
+	var wg sync.WaitGroup
+	for stream, pipe := range pipes {
+		wg.Add(1)
+		go func(stream string, pipe io.Reader) {
+			defer wg.Done()
+			t.read(stream, pipe)
+		}(stream, pipe)
+	}
+	wg.Wait()
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		logrus.Warnf("%v: %v", t, err)
+		return -1
+	}
+	return 0
+}
+
+// Lines that are still in the pipe when the tailer is closed are discarded, but the pipe is read until
+// the command exits, so that the command is not blocked writing its output while it is shutting down.
+func (t *execTailer) read(stream string, pipe io.Reader) {
+	reader := fswatcher.NewLineReader()
+	if t.maxLineBytes > 0 {
+		reader.LimitLineLength(t.maxLineBytes, t.dropOversizedLines, func() {
+			t.metrics.LineOversized("")
+		})
+	}
+	extra := map[string]interface{}{"stream": stream}
+	r := &newlineTerminatedReader{Reader: pipe}
+	for {
+		line, eof, err := reader.ReadLine(r)
+		if eof {
+			return
+		}
+		if err != nil {
+			logrus.Warnf("%v: failed to read %v: %v", t, stream, err)
+			return
+		}
+		select {
+		case t.lines <- &fswatcher.Line{Line: line, Extra: extra}:
+		case <-t.done:
+		}
+	}
+}
+
+// On Windows, SIGTERM cannot be sent to a process, so the process is killed right away.
+func (t *execTailer) terminate(process *os.Process, exited chan struct{}) {
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		process.Kill()
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(execStopTimeout):
+		logrus.Warnf("%v did not terminate within %v, killing it", t, execStopTimeout)
+		process.Kill()
+	}
+}
+
+func (t *execTailer) String() string {
+	return fmt.Sprintf("command '%v'", strings.Join(t.command, " "))
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// implements ExecMetrics
+type execMetrics struct {
+	countingMetrics
+	mutex     sync.Mutex
+	exitCodes []int
+	restarts  int
+}
+
+func (m *execMetrics) CommandExited(exitCode int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.exitCodes = append(m.exitCodes, exitCode)
+}
+
+func (m *execMetrics) CommandRestarted() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.restarts++
+}
+
+func TestExecTailer(t *testing.T) {
+	skipWithoutShell(t)
+	metrics := &execMetrics{}
+	tail, err := RunExecTailer(&configuration.InputConfig{
+		Type:                "exec",
+		ExecCommand:         []string{"sh", "-c", "echo out; echo err >&2; printf unterminated; exit 3"},
+		ExecStderr:          true,
+		ExecRestartDelay:    10 * time.Millisecond,
+		ExecMaxRestartDelay: time.Minute,
+	}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	// The command is restarted after it exits, so we get the same lines again.
+	for i := 0; i < 2; i++ {
+		received := make(map[string]bool)
+		for j := 0; j < 3; j++ {
+			line := expectExecLine(t, tail)
+			received[fmt.Sprintf("%v %v", line.Extra.(map[string]interface{})["stream"], line.Line)] = true
+		}
+		for _, expected := range []string{"stdout out", "stderr err", "stdout unterminated"} {
+			if !received[expected] {
+				t.Fatalf("expected %q, but got %v", expected, received)
+			}
+		}
+	}
+	tail.Close()
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if len(metrics.exitCodes) == 0 || metrics.exitCodes[0] != 3 || metrics.restarts == 0 {
+		t.Fatalf("expected exit code 3 and a restart, but got exit codes %v and %v restarts", metrics.exitCodes, metrics.restarts)
+	}
+}
+
+func TestExecTailerClose(t *testing.T) {
+	skipWithoutShell(t)
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	terminated := filepath.Join(dir, "terminated")
+	tail, err := RunExecTailer(&configuration.InputConfig{
+		Type:                "exec",
+		ExecCommand:         []string{"sh", "-c", fmt.Sprintf("trap 'touch %v; exit 0' TERM; echo started; while true; do sleep 0.1; done", terminated)},
+		ExecRestartDelay:    time.Second,
+		ExecMaxRestartDelay: time.Minute,
+	}, &execMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := expectExecLine(t, tail); line.Line != "started" {
+		t.Fatalf("expected \"started\", but got %q", line.Line)
+	}
+	start := time.Now()
+	tail.Close()
+	if time.Since(start) >= execStopTimeout {
+		t.Fatalf("the command was killed, but it should have terminated on SIGTERM")
+	}
+	if _, err = os.Stat(terminated); err != nil {
+		t.Fatalf("the command did not receive SIGTERM: %v", err)
+	}
+}
+
+func TestExecTailerCommandNotFound(t *testing.T) {
+	_, err := RunExecTailer(&configuration.InputConfig{
+		Type:        "exec",
+		ExecCommand: []string{"grok_exporter_no_such_command"},
+	}, &execMetrics{})
+	if err == nil {
+		t.Fatalf("expected error for unknown command")
+	}
+}
+
+func skipWithoutShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+}
+
+func expectExecLine(t *testing.T, tail fswatcher.FileTailer) *fswatcher.Line {
+	select {
+	case line := <-tail.Lines():
+		return line
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for a line")
+	}
+	return nil
+}
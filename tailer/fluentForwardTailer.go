@@ -0,0 +1,266 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum size of a forward protocol message, and of the entries of a compressed message after decompression.
+// Fluent Bit and Fluentd send chunks of a few MiB by default.
+const maxFluentForwardMessageSize = 64 * 1024 * 1024
+
+// A connection is closed if the next message is not received completely within this time, so that idle or stalled clients
+// do not occupy one of the max_connections forever. This is a variable so that it can be changed in tests.
+var fluentForwardIdleTimeout = 5 * time.Minute
+
+type fluentForwardTailer struct {
+	*listenerTailer
+	ln        net.Listener
+	mutex     sync.Mutex // protects recordKey, which may change when the configuration is reloaded
+	recordKey string
+}
+
+// There is one fluent forward tailer per address, see listenerTailer.
+var fluentForwardTailers = make(map[string]*sharedTailer)
+
+func RunFluentForwardTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	shared, err := runSharedListener(fluentForwardTailers, cfg.FluentForwardAddress, func() (fswatcher.FileTailer, error) {
+		return runFluentForwardTailer(cfg.FluentForwardAddress, cfg.FluentForwardRecordKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := shared.tailer.(*fluentForwardTailer)
+	return shared.newRef(func() {
+		t.setMaxConnections(cfg.MaxConnections)
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.recordKey = cfg.FluentForwardRecordKey
+	}), nil
+}
+
+func runFluentForwardTailer(address, recordKey string) (*fluentForwardTailer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for fluent forward messages on TCP address %v: %v", address, err)
+	}
+	t := &fluentForwardTailer{
+		listenerTailer: newListenerTailer(fluentForwardTailers, address),
+		ln:             ln,
+		recordKey:      recordKey,
+	}
+	t.addListener(ln)
+	go t.accept(ln, "fluent forward", t.read)
+	return t, nil
+}
+
+// Errors on a single connection are logged, because they should not terminate grok_exporter.
+// The client will reconnect and re-send the chunks that were not acknowledged.
+func (t *fluentForwardTailer) read(conn net.Conn) {
+	decoder := newMsgpackDecoder(bufio.NewReader(conn))
+	for {
+		conn.SetDeadline(time.Now().Add(fluentForwardIdleTimeout))
+		msg, err := decoder.decode(maxFluentForwardMessageSize)
+		if err != nil {
+			// Clients like Fluent Bit keep idle connections open, closing them after fluentForwardIdleTimeout is expected.
+			if err != io.EOF && !isTimeout(err) && !isStopped(t.stopped) {
+				logrus.Warnf("closing fluent forward connection from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		chunk, err := t.process(msg)
+		if err != nil {
+			logrus.Warnf("closing fluent forward connection from %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		// The ack is sent after the lines were passed on, so that the client re-sends the chunk if grok_exporter terminates before.
+		if isStopped(t.stopped) {
+			return
+		}
+		if len(chunk) > 0 {
+			if _, err = conn.Write(encodeMsgpackStringMap("ack", chunk)); err != nil {
+				logrus.Warnf("closing fluent forward connection from %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// Processes a message in one of the modes of the forward protocol, see
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+//
+//	Message:        [tag, time, record, option]
+//	Forward:        [tag, [[time, record], [time, record], ...], option]
+//	PackedForward:  [tag, <msgpack stream of [time, record] entries as bin or str>, option]
+//
+// The option is optional. If the option's "compressed" is "gzip", the PackedForward entries are gzip compressed.
+// Returns the option's "chunk", which must be acknowledged.
+func (t *fluentForwardTailer) process(msg interface{}) (string, error) {
+	array, ok := msg.([]interface{})
+	if !ok || len(array) < 2 {
+		return "", errors.New("invalid message: expected an array with the tag and the entries")
+	}
+	tag, ok := msgpackString(array[0])
+	if !ok {
+		return "", errors.New("invalid message: the tag is not a string")
+	}
+	var (
+		records []interface{}
+		option  interface{}
+		err     error
+	)
+	switch entries := array[1].(type) {
+	case []interface{}: // Forward
+		for _, entry := range entries {
+			timeAndRecord, ok := entry.([]interface{})
+			if !ok || len(timeAndRecord) < 2 {
+				return "", errors.New("invalid message: expected entries [time, record]")
+			}
+			records = append(records, timeAndRecord[1])
+		}
+		option = optionalElement(array, 2)
+	case string, []byte: // PackedForward
+		option = optionalElement(array, 2)
+		records, err = unpackFluentForwardEntries(entries, option)
+		if err != nil {
+			return "", err
+		}
+	default: // Message
+		if len(array) < 3 {
+			return "", errors.New("invalid message: expected [tag, time, record]")
+		}
+		records = append(records, array[2])
+		option = optionalElement(array, 3)
+	}
+	t.mutex.Lock()
+	recordKey := t.recordKey
+	t.mutex.Unlock()
+	for _, record := range records {
+		t.processRecord(tag, record, recordKey)
+	}
+	chunk, _ := msgpackString(optionValue(option, "chunk"))
+	return chunk, nil
+}
+
+func unpackFluentForwardEntries(entries interface{}, option interface{}) ([]interface{}, error) {
+	var packed []byte
+	switch e := entries.(type) {
+	case string:
+		packed = []byte(e)
+	case []byte:
+		packed = e
+	}
+	if compressed, _ := msgpackString(optionValue(option, "compressed")); compressed == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, fmt.Errorf("invalid message: failed to decompress entries: %v", err)
+		}
+		packed, err = ioutil.ReadAll(io.LimitReader(gz, maxFluentForwardMessageSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid message: failed to decompress entries: %v", err)
+		}
+		if len(packed) > maxFluentForwardMessageSize {
+			return nil, fmt.Errorf("invalid message: decompressed entries are larger than %v bytes", maxFluentForwardMessageSize)
+		}
+	}
+	var records []interface{}
+	decoder := newMsgpackDecoder(bytes.NewReader(packed))
+	for {
+		entry, err := decoder.decode(len(packed))
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid message: failed to decode entries: %v", err)
+		}
+		timeAndRecord, ok := entry.([]interface{})
+		if !ok || len(timeAndRecord) < 2 {
+			return nil, errors.New("invalid message: expected entries [time, record]")
+		}
+		records = append(records, timeAndRecord[1])
+	}
+}
+
+// The value of the record key is the log line. The tag and the other fields of the record are the extra fields.
+// Records without the record key are skipped.
+func (t *fluentForwardTailer) processRecord(tag string, record interface{}, recordKey string) {
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		logrus.Warnf("skipping fluent forward record with tag %v: the record is not a map", tag)
+		return
+	}
+	value, ok := fields[recordKey]
+	if !ok {
+		logrus.Warnf("skipping fluent forward record with tag %v: the record has no field %q", tag, recordKey)
+		return
+	}
+	line, ok := msgpackString(value)
+	if !ok {
+		line = fmt.Sprintf("%v", value)
+	}
+	extra := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if name == recordKey {
+			continue
+		}
+		if b, isBytes := value.([]byte); isBytes {
+			value = string(b)
+		}
+		extra[name] = value
+	}
+	extra["tag"] = tag
+	// Docker's "log" field ends with a newline.
+	t.sendLine(&fswatcher.Line{Line: strings.TrimRight(line, "\r\n"), Extra: extra})
+}
+
+func msgpackString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	default:
+		return "", false
+	}
+}
+
+func optionalElement(array []interface{}, i int) interface{} {
+	if len(array) > i {
+		return array[i]
+	}
+	return nil
+}
+
+func optionValue(option interface{}, key string) interface{} {
+	if m, ok := option.(map[string]interface{}); ok {
+		return m[key]
+	}
+	return nil
+}
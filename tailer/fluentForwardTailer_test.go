@@ -0,0 +1,234 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+)
+
+func TestFluentForwardTailer(t *testing.T) {
+	tail, err := runFluentForwardTailer("127.0.0.1:0", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.stop()
+	conn, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	eventTime := msgpackExt{Type: 0, Data: []byte{0x5f, 0x5e, 0x10, 0x00, 0x00, 0x00, 0x00, 0x01}}
+	record := func(line string) map[string]interface{} {
+		return map[string]interface{}{"log": line + "\n", "stream": "stdout", "container_id": []byte("abc")}
+	}
+	entries := encodeMsgpack(
+		[]interface{}{1600000000, record("packed 1")},
+		[]interface{}{eventTime, record("packed 2")},
+	)
+
+	// Message
+	writeFluentForwardMessage(t, conn, []interface{}{"app.message", 1600000000, record("message")})
+	expectLineWithExtra(t, tail, "message", "map[container_id:abc stream:stdout tag:app.message]")
+
+	// Forward
+	writeFluentForwardMessage(t, conn, []interface{}{"app.forward", []interface{}{
+		[]interface{}{eventTime, record("forward 1")},
+		[]interface{}{eventTime, map[string]interface{}{"message": "no log field"}},
+		[]interface{}{eventTime, record("forward 2")},
+	}})
+	expectLineWithExtra(t, tail, "forward 1", "map[container_id:abc stream:stdout tag:app.forward]")
+	expectLineWithExtra(t, tail, "forward 2", "map[container_id:abc stream:stdout tag:app.forward]")
+
+	// PackedForward, as bin and as str like older Fluentd versions
+	writeFluentForwardMessage(t, conn, []interface{}{"app.packed", entries})
+	expectLineWithExtra(t, tail, "packed 1", "map[container_id:abc stream:stdout tag:app.packed]")
+	expectLineWithExtra(t, tail, "packed 2", "map[container_id:abc stream:stdout tag:app.packed]")
+	writeFluentForwardMessage(t, conn, []interface{}{"app.packed", string(entries), map[string]interface{}{"size": 2}})
+	expectLineWithExtra(t, tail, "packed 1", "map[container_id:abc stream:stdout tag:app.packed]")
+	expectLineWithExtra(t, tail, "packed 2", "map[container_id:abc stream:stdout tag:app.packed]")
+
+	// CompressedPackedForward with ack
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(entries)
+	gz.Close()
+	writeFluentForwardMessage(t, conn, []interface{}{"app.compressed", compressed.Bytes(), map[string]interface{}{"size": 2, "compressed": "gzip", "chunk": "cGxlYXNlIGFjaw=="}})
+	expectLineWithExtra(t, tail, "packed 1", "map[container_id:abc stream:stdout tag:app.compressed]")
+	expectLineWithExtra(t, tail, "packed 2", "map[container_id:abc stream:stdout tag:app.compressed]")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack, err := newMsgpackDecoder(bufio.NewReader(conn)).decode(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", ack) != "map[ack:cGxlYXNlIGFjaw==]" {
+		t.Fatalf("unexpected ack %v", ack)
+	}
+
+	// The record key may change when the configuration is reloaded.
+	tail.mutex.Lock()
+	tail.recordKey = "message"
+	tail.mutex.Unlock()
+	writeFluentForwardMessage(t, conn, []interface{}{"app.message", 1600000000, map[string]interface{}{"message": "hello", "level": 3}})
+	expectLineWithExtra(t, tail, "hello", "map[level:3 tag:app.message]")
+}
+
+func TestFluentForwardInvalidMessage(t *testing.T) {
+	tail, err := runFluentForwardTailer("127.0.0.1:0", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.stop()
+	for _, msg := range [][]byte{
+		encodeMsgpack("not an array"),
+		encodeMsgpack([]interface{}{1, 2, 3}),
+		encodeMsgpack([]interface{}{"tag", []interface{}{"not an entry"}}),
+		encodeMsgpack([]interface{}{"tag", []byte{0xc1}}),
+		encodeMsgpack([]interface{}{"tag", []byte("not gzip"), map[string]interface{}{"compressed": "gzip"}}),
+		{0xc1},
+	} {
+		conn, err := net.Dial("tcp", tail.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		// The connection is closed by grok_exporter.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("%x: expected the connection to be closed", msg)
+		}
+		conn.Close()
+	}
+	select {
+	case line := <-tail.Lines():
+		t.Fatalf("unexpected line %v", line.Line)
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestFluentForwardMaxConnections(t *testing.T) {
+	defer func(timeout time.Duration) {
+		fluentForwardIdleTimeout = timeout
+	}(fluentForwardIdleTimeout)
+	fluentForwardIdleTimeout = 500 * time.Millisecond
+	tail, err := runFluentForwardTailer("127.0.0.1:0", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.stop()
+	tail.setMaxConnections(1)
+	conn, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeFluentForwardMessage(t, conn, []interface{}{"app.message", 1600000000, map[string]interface{}{"log": "hello"}})
+	expectLineWithExtra(t, tail, "hello", "map[tag:app.message]")
+
+	// The first connection is still open, so the second connection exceeds max_connections.
+	rejected, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := rejected.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+
+	// The first connection is closed after fluentForwardIdleTimeout, so that a new connection can be accepted.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the idle connection to be closed, but got %v bytes: %v", n, err)
+	}
+	for i := 0; ; i++ {
+		conn, err = net.Dial("tcp", tail.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		writeFluentForwardMessage(t, conn, []interface{}{"app.message", 1600000000, map[string]interface{}{"log": "hello again"}})
+		select {
+		case line := <-tail.Lines():
+			if line.Line != "hello again" {
+				t.Fatalf("expected %q, but got %q", "hello again", line.Line)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+			// The counter is decremented after the idle connection was closed, so the new connection may have been rejected.
+			if i > 50 {
+				t.Fatalf("timeout while waiting for a new connection to be accepted")
+			}
+		}
+	}
+}
+
+// The listener is closed when the last input using it is closed.
+func TestFluentForwardTailerClose(t *testing.T) {
+	cfg := &configuration.InputConfig{
+		Type:                   "fluent_forward",
+		FluentForwardAddress:   "127.0.0.1:0",
+		FluentForwardRecordKey: "log",
+	}
+	oldTail, err := RunFluentForwardTailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTail, err := RunFluentForwardTailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := fluentForwardTailers["127.0.0.1:0"].tailer.(*fluentForwardTailer).ln.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	activate(newTail)
+	oldTail.Close()
+	writeFluentForwardMessage(t, conn, []interface{}{"app.message", 1600000000, map[string]interface{}{"log": "hello"}})
+	expectLineWithExtra(t, newTail, "hello", "map[tag:app.message]")
+
+	newTail.Close()
+	if len(fluentForwardTailers) != 0 {
+		t.Fatalf("expected the fluent forward tailer to be removed, but got %v", fluentForwardTailers)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+	if conn, err = net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatalf("expected the listener to be closed")
+	}
+}
+
+func writeFluentForwardMessage(t *testing.T, conn net.Conn, msg []interface{}) {
+	if _, err := conn.Write(encodeMsgpack(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
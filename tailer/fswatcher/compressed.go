@@ -0,0 +1,160 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// Compressed log files, like access.log.2.gz created by logrotate, are detected by their magic bytes.
+// They are immutable: If readall is true, they are read once on startup, but they are never watched.
+var compressionMagicBytes = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// File name extensions of compressed files. These are only used for empty files, because
+// the magic bytes are not written yet while a compressed file is being created.
+var compressionExtensions = map[string]string{
+	".gz":  "gzip",
+	".bz2": "bzip2",
+	".zst": "zstd",
+}
+
+// Returns the name of the compression, or "" if the file is not compressed.
+func detectCompression(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, 4)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if n == 0 {
+		return compressionExtensions[filepath.Ext(path)], nil
+	}
+	for _, c := range compressionMagicBytes {
+		if bytes.HasPrefix(header[:n], c.magic) {
+			return c.name, nil
+		}
+	}
+	return "", nil
+}
+
+// Reads all lines of a compressed file. Errors decompressing the file are logged but not returned,
+// because a corrupt rotated file should not stop grok_exporter from processing the current log file.
+func (t *fileTailer) readCompressedFile(path, compression string, log logrus.FieldLogger) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Warnf("failed to read compressed file: %v", err)
+		return
+	}
+	defer file.Close()
+	var in io.Reader
+	switch compression {
+	case "gzip":
+		in, err = gzip.NewReader(file)
+	case "bzip2":
+		in = bzip2.NewReader(file)
+	case "zstd":
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(file)
+		if err == nil {
+			defer decoder.Close()
+			in = decoder
+		}
+	}
+	if err != nil {
+		log.Warnf("failed to read %v compressed file: %v", compression, err)
+		return
+	}
+	log.Infof("reading %v compressed file", compression)
+	// The first read returns the complete BOM, so that the encoding is detected correctly, see lineReader.readFromStart().
+	buffered := bufio.NewReader(in)
+	buffered.Peek(3) // errors are returned again when reading
+	reader := t.newLineReader(path)
+	reader.readFromStart()
+	for {
+		line, eof, err := reader.ReadLine(buffered)
+		if err != nil {
+			log.Warnf("failed to read %v compressed file: %v", compression, err)
+			return
+		}
+		if eof {
+			// The last line is complete, because compressed files are never appended.
+			if reader.Buffered() == 0 || reader.skippingOversizedLine {
+				return
+			}
+			line = string(reader.stripByteOrderMark(stripWindowsLineEnding(reader.remainingBytesFromLastRead)))
+			reader.Clear()
+		}
+		select {
+		case <-t.done:
+			return
+		case t.lines <- &Line{Line: line, File: path}:
+		}
+	}
+}
+
+// Defines the rotation order, i.e. oldest first, like access.log.2.gz, access.log.1, access.log
+func isRotatedBefore(a, b string) bool {
+	a, b = trimCompressionExtension(a), trimCompressionExtension(b)
+	baseA, numberA, isNumberedA := splitRotationNumber(a)
+	baseB, numberB, isNumberedB := splitRotationNumber(b)
+	switch {
+	case baseA == baseB && isNumberedA && isNumberedB:
+		return numberA > numberB // access.log.2 is older than access.log.1
+	case baseA == baseB:
+		return isNumberedA // access.log.1 is older than access.log
+	case strings.HasPrefix(a, b) || strings.HasPrefix(b, a):
+		return len(a) > len(b) // access.log-20200601 is older than access.log
+	default:
+		return a < b // access.log-20200601 is older than access.log-20200602
+	}
+}
+
+func trimCompressionExtension(name string) string {
+	if _, ok := compressionExtensions[filepath.Ext(name)]; ok {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+func splitRotationNumber(name string) (string, int, bool) {
+	ext := filepath.Ext(name)
+	number, err := strconv.Atoi(strings.TrimPrefix(ext, "."))
+	if len(ext) < 2 || err != nil {
+		return name, 0, false
+	}
+	return strings.TrimSuffix(name, ext), number, true
+}
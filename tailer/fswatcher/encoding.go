@@ -0,0 +1,157 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Supported values for the 'encoding' input configuration. The empty string means UTF-8.
+const (
+	EncodingUtf8        = "utf-8"
+	EncodingUtf16       = "utf-16" // byte order is taken from the BOM, little endian if there is no BOM
+	EncodingUtf16le     = "utf-16le"
+	EncodingUtf16be     = "utf-16be"
+	EncodingIso88591    = "iso-8859-1"
+	EncodingWindows1252 = "windows-1252"
+)
+
+var byteOrderMarks = []struct {
+	encoding string
+	bom      []byte
+}{
+	{EncodingUtf8, []byte{0xef, 0xbb, 0xbf}},
+	{EncodingUtf16le, []byte{0xff, 0xfe}},
+	{EncodingUtf16be, []byte{0xfe, 0xff}},
+}
+
+// Characters 0x80 - 0x9f in windows-1252. The other characters are the same as in iso-8859-1.
+// Undefined characters are mapped to the corresponding control characters, like in the WHATWG encoding standard.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// If the file starts with a byte order mark, the encoding is taken from the BOM.
+// Otherwise, the configured encoding is used. The BOM itself is removed in lineReader.stripByteOrderMark().
+func detectEncoding(header []byte, configured string) string {
+	for _, b := range byteOrderMarks {
+		if bytes.HasPrefix(header, b.bom) {
+			return b.encoding
+		}
+	}
+	if configured == EncodingUtf16 {
+		return EncodingUtf16le
+	}
+	return configured
+}
+
+// Like detectEncoding(), but reads the header from the tailed file. This is used if the tailer starts reading after the BOM,
+// ReadAt() does not change the offset of the file.
+func detectFileEncoding(file io.ReaderAt, configured string) (string, error) {
+	header := make([]byte, 3)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return detectEncoding(header[:n], configured), nil
+}
+
+// Converts the bytes read from a file to UTF-8, so that lines can be split on '\n'.
+type decoder struct {
+	encoding string
+	pending  []byte // incomplete character at the end of the last read
+}
+
+func newDecoder(encoding string) *decoder {
+	if encoding == "" || encoding == EncodingUtf8 {
+		return nil // UTF-8 is not converted, see lineReader
+	}
+	return &decoder{encoding: encoding}
+}
+
+func (d *decoder) decode(src []byte) []byte {
+	switch d.encoding {
+	case EncodingUtf16le, EncodingUtf16be:
+		return d.decodeUtf16(src)
+	default:
+		result := make([]byte, 0, 2*len(src))
+		for _, b := range src {
+			r := rune(b)
+			if d.encoding == EncodingWindows1252 && b >= 0x80 && b < 0xa0 {
+				r = windows1252[b-0x80]
+			}
+			result = appendRune(result, r)
+		}
+		return result
+	}
+}
+
+func (d *decoder) decodeUtf16(src []byte) []byte {
+	data := append(d.pending, src...)
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if d.encoding == EncodingUtf16le {
+			units = append(units, uint16(data[i])|uint16(data[i+1])<<8)
+		} else {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		}
+	}
+	nPending := len(data) % 2
+	if len(units) > 0 && utf16.IsSurrogate(rune(units[len(units)-1])) && units[len(units)-1] < 0xdc00 {
+		// high surrogate, wait for the low surrogate in the next read
+		units = units[:len(units)-1]
+		nPending += 2
+	}
+	d.pending = append([]byte{}, data[len(data)-nPending:]...)
+	result := make([]byte, 0, len(data))
+	for _, r := range utf16.Decode(units) {
+		result = appendRune(result, r)
+	}
+	return result
+}
+
+// Number of bytes in the original encoding for the UTF-8 bytes returned by decode().
+func (d *decoder) encodedLength(decoded []byte) int {
+	switch d.encoding {
+	case EncodingUtf16le, EncodingUtf16be:
+		result := 0
+		for _, r := range string(decoded) {
+			if r >= 0x10000 {
+				result += 4 // surrogate pair
+			} else {
+				result += 2
+			}
+		}
+		return result
+	default:
+		return utf8.RuneCount(decoded)
+	}
+}
+
+func (d *decoder) clear() {
+	d.pending = d.pending[:0]
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	var tmp [utf8.UTFMax]byte
+	n := utf8.EncodeRune(tmp[:], r)
+	return append(buf, tmp[:n]...)
+}
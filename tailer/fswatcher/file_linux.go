@@ -70,3 +70,16 @@ func open(path string) (*os.File, Error) {
 	}
 	return file, nil
 }
+
+// Device and inode of the file, used to identify the file in the position file.
+func fileIdentity(file *os.File) (uint64, uint64, Error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, NewErrorf(NotSpecified, err, "%v: stat failed", file.Name())
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, NewErrorf(NotSpecified, nil, "%v: failed to get device and inode", file.Name())
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), nil
+}
@@ -125,6 +125,16 @@ func (f *File) Seek(offset int64, whence int) (int64, Error) {
 	return ret, nil
 }
 
+// Does not change the current position, see detectFileEncoding().
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	file, Err := f.reopen()
+	if Err != nil {
+		return 0, Err
+	}
+	defer file.Close()
+	return file.ReadAt(b, off)
+}
+
 // TODO: error handling is confusing.
 // in case of EOF must return io.EOF, because linereader expects that.
 // in case of WinFileMoved, must return special error to trigger sync dir.
@@ -233,3 +243,9 @@ func (f *File) reopen() (*os.File, Error) {
 	}
 	return file, Err
 }
+
+// Like device and inode on Linux, used to identify the file in the position file.
+// The file index is unique per volume. We don't keep the volume serial number, so the device is always 0.
+func fileIdentity(file *File) (uint64, uint64, Error) {
+	return 0, uint64(file.fileIndexHigh)<<32 | uint64(file.fileIndexLow), nil
+}
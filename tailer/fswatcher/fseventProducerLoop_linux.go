@@ -20,8 +20,13 @@ import (
 	"syscall"
 	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
+// Watched subdirectories may be removed, so we cannot rely on an IN_IGNORED event on shutdown.
+const inotifyPollTimeout = 500 * time.Millisecond
+
 type inotifyloop struct {
 	fd     int
 	events chan fsevent
@@ -43,9 +48,9 @@ func (l *inotifyloop) Errors() chan Error {
 }
 
 // Terminate the inotify loop.
-// If the loop hangs in syscall.Read(), it will keep hanging there until the next event is read.
-// Therefore, after the consumer called Close(), it should generate an artificial IN_IGNORE event to
-// interrupt syscall.Read(). This can be done by calling inotify_rm_watch() on one of the watched directories.
+// The loop waits for events with a timeout, so it terminates within inotifyPollTimeout after Close().
+// In order to terminate immediately, the consumer should generate an artificial IN_IGNORE event after calling Close().
+// This can be done by calling inotify_rm_watch() on one of the watched directories.
 func (l *inotifyloop) Close() {
 	close(l.done)
 }
@@ -70,7 +75,19 @@ func runInotifyLoop(fd int) *inotifyloop {
 			close(result.events)
 		}()
 		for {
-			n, err = syscall.Read(l.fd, buf)
+			var ready int
+			ready, err = unix.Poll([]unix.PollFd{{Fd: int32(l.fd), Events: unix.POLLIN}}, int(inotifyPollTimeout/time.Millisecond))
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			if err == unix.EINTR || (err == nil && ready == 0) {
+				continue
+			}
+			if err == nil {
+				n, err = syscall.Read(l.fd, buf)
+			}
 			if err != nil {
 				// Getting an err might be part of the shutdown, when l.fd is closed.
 				// We decide whether it is an actual error or not by checking if l.done is closed.
@@ -102,14 +119,7 @@ func runInotifyLoop(fd int) *inotifyloop {
 				case <-l.done:
 					return
 				}
-				if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
-					// IN_IGNORED event can have two reasons:
-					// 1) The consumer loop is shutting down and called inotify_rm_watch() to interrupt syscall.Read()
-					// 2) The watched directory was deleted. fswatcher will report an error and terminate if that happens.
-					// In both cases, we should terminate here and not call syscall.Read() again, as the next
-					// call might block forever as we don't receive events anymore.
-					return
-				}
+				// IN_IGNORED events are not the end of the loop: They are also generated when a watched subdirectory is removed.
 				offset += syscall.SizeofInotifyEvent + int(event.Len)
 			}
 		}
@@ -22,6 +22,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,9 +35,24 @@ type FileTailer interface {
 }
 
 type Line struct {
-	Line  string
-	File  string
-	Extra interface{}
+	Line     string
+	File     string
+	Input    string // name of the input, set when lines of multiple inputs are merged, see tailer.MultiInputTailer
+	Extra    interface{}
+	Position *Position // set by file tailers with a position file and by the journald tailer, see Processed()
+}
+
+// Must be called by the consumer when the line was processed, because the position file only covers processed lines.
+// Lines that were read but not processed when grok_exporter terminates are read again after a restart.
+func (l *Line) Processed() {
+	if l.Position == nil {
+		return
+	}
+	if l.Position.cursor != nil {
+		l.Position.cursor.value.Store(l.Position.value)
+	} else {
+		atomic.StoreInt64(&l.Position.processed.offset, l.Position.offset)
+	}
 }
 
 // ideas how this might look like in the config file:
@@ -48,13 +66,53 @@ type Line struct {
 // Moreover, we should provide vars {{.filename}} and {{.filepath}} for labels.
 
 type fileTailer struct {
-	globs        []glob.Glob
-	watchedDirs  []*Dir
-	watchedFiles map[string]*fileWithReader // path -> fileWithReader
-	osSpecific   fswatcher
-	lines        chan *Line
-	errors       chan Error
-	done         chan struct{}
+	globs          []glob.Glob
+	excludes       []glob.Glob // files matching one of the excludes are never opened
+	baseDirs       []string    // directories from the globs, see uniqueDirs(). Subdirectories are watched and un-watched as they appear and disappear.
+	watchedDirs    []*Dir
+	watchedFiles   map[string]*fileWithReader // path -> fileWithReader
+	osSpecific     fswatcher
+	lines          chan *Line
+	errors         chan Error
+	done           chan struct{}
+	stopped        chan struct{}  // closed when the shutdown is complete
+	positions      *positionFile  // nil if no position file is configured
+	readCompressed bool           // compressed files are only read on startup with readall, see compressed.go
+	rotatedFiles   []*rotatedFile // files that were moved or removed, but are still read until the grace period expires
+	gracePeriod    time.Duration  // see Options.RotationGracePeriod
+	encoding       string         // see Options.Encoding
+	maxLineBytes   int            // see Options.MaxLineBytes
+	dropOversized  bool           // see Options.DropOversizedLines
+	metrics        Metrics        // nil if no metrics are configured
+}
+
+// After logrotate moved a file, the logger might still append a few lines before it re-opens the log file.
+type rotatedFile struct {
+	*fileWithReader
+	closeAt time.Time
+}
+
+// How often rotated files are checked for new lines during the grace period.
+const rotatedFileReadInterval = 250 * time.Millisecond
+
+// Options for the file tailer. The zero value means no polling and no position file.
+type Options struct {
+	PollInterval         time.Duration // if > 0, poll the files instead of using file system notifications
+	PositionFile         string        // if set, read offsets are stored in this file, see positionFile
+	PositionSyncInterval time.Duration // how often the position file is written
+	ExcludeGlobs         []glob.Glob   // files matching one of these globs are ignored
+	RotationGracePeriod  time.Duration // files that were moved or removed are read until the grace period expires
+	Metrics              Metrics       // optional, counts rotations, truncations, and oversized lines for self-monitoring
+	Encoding             string        // one of the Encoding constants, the empty string means UTF-8
+	MaxLineBytes         int           // if > 0, longer lines are truncated or dropped
+	DropOversizedLines   bool          // drop lines longer than MaxLineBytes instead of truncating them
+}
+
+// Metrics is implemented by the caller to count events for self-monitoring. It is also used by other inputs than files.
+type Metrics interface {
+	FileRotated(path string)   // a watched file was moved or removed
+	FileTruncated(path string) // a watched file was truncated, like with logrotate's copytruncate
+	LineOversized(path string) // a line longer than MaxLineBytes was truncated or dropped, path is empty for other inputs than files
 }
 
 type fswatcher interface {
@@ -94,20 +152,29 @@ func (t *fileTailer) Close() {
 	// Closing the done channel will stop the consumer loop.
 	// Deferred functions within the consumer loop will close the producer loop.
 	close(t.done)
+	// Wait until the position file is written and all files are closed.
+	<-t.stopped
 }
 
 func RunFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
-	return runFileTailer(initWatcher, globs, readall, failOnMissingFile, log)
+	return RunFileTailerWithOptions(globs, readall, failOnMissingFile, Options{}, log)
 }
 
 func RunPollingFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, pollInterval time.Duration, log logrus.FieldLogger) (FileTailer, error) {
-	initFunc := func() (fswatcher, Error) {
-		return initPollingWatcher(pollInterval)
+	return RunFileTailerWithOptions(globs, readall, failOnMissingFile, Options{PollInterval: pollInterval}, log)
+}
+
+func RunFileTailerWithOptions(globs []glob.Glob, readall bool, failOnMissingFile bool, options Options, log logrus.FieldLogger) (FileTailer, error) {
+	initFunc := initWatcher
+	if options.PollInterval > 0 {
+		initFunc = func() (fswatcher, Error) {
+			return initPollingWatcher(options.PollInterval)
+		}
 	}
-	return runFileTailer(initFunc, globs, readall, failOnMissingFile, log)
+	return runFileTailer(initFunc, globs, readall, failOnMissingFile, options, log)
 }
 
-func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
+func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readall bool, failOnMissingFile bool, options Options, log logrus.FieldLogger) (FileTailer, error) {
 
 	var (
 		t   *fileTailer
@@ -115,11 +182,25 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 	)
 
 	t = &fileTailer{
-		globs:        globs,
-		watchedFiles: make(map[string]*fileWithReader),
-		lines:        make(chan *Line),
-		errors:       make(chan Error),
-		done:         make(chan struct{}),
+		globs:         globs,
+		excludes:      options.ExcludeGlobs,
+		watchedFiles:  make(map[string]*fileWithReader),
+		gracePeriod:   options.RotationGracePeriod,
+		encoding:      options.Encoding,
+		maxLineBytes:  options.MaxLineBytes,
+		dropOversized: options.DropOversizedLines,
+		metrics:       options.Metrics,
+		lines:         make(chan *Line),
+		errors:        make(chan Error),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	if len(options.PositionFile) > 0 {
+		t.positions, Err = loadPositionFile(options.PositionFile)
+		if Err != nil {
+			return nil, Err
+		}
 	}
 
 	t.osSpecific, Err = initFunc()
@@ -129,7 +210,8 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 
 	go func() {
 
-		defer t.shutdown()
+		defer close(t.stopped)
+		defer t.shutdown(log)
 
 		Err = t.watchDirs(log)
 		if Err != nil {
@@ -143,6 +225,9 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 		eventProducerLoop := t.osSpecific.runFseventProducerLoop()
 		defer eventProducerLoop.Close()
 
+		// Compressed files are immutable, so they are only read on startup. If the position file has
+		// stored positions, we don't know which compressed files were already read, so we skip them.
+		t.readCompressed = readall && (t.positions == nil || len(t.positions.stored) == 0)
 		for _, dir := range t.watchedDirs {
 			dirLogger := log.WithField("directory", dir.Path())
 			dirLogger.Debugf("initializing directory")
@@ -156,6 +241,26 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 			}
 		}
 
+		t.readCompressed = false
+
+		// Stored positions are only used for files that exist on startup.
+		// Files created later are always read from the beginning.
+		var syncPositions <-chan time.Time
+		if t.positions != nil {
+			t.positions.stored = nil
+			t.writePositions(log)
+			ticker := time.NewTicker(options.PositionSyncInterval)
+			defer ticker.Stop()
+			syncPositions = ticker.C
+		}
+
+		var readRotatedFiles <-chan time.Time
+		if t.gracePeriod > 0 {
+			ticker := time.NewTicker(rotatedFileReadInterval)
+			defer ticker.Stop()
+			readRotatedFiles = ticker.C
+		}
+
 		// make sure at least one logfile was found for each glob
 		if failOnMissingFile {
 			missingFileError := t.checkMissingFile()
@@ -193,19 +298,27 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 				case t.errors <- NewError(NotSpecified, err, "error reading file system events"):
 				}
 				return
+			case <-syncPositions:
+				t.writePositions(log)
+			case <-readRotatedFiles:
+				t.readRotatedFiles(log)
 			}
 		}
 	}()
 	return t, nil
 }
 
-func (t *fileTailer) shutdown() {
+func (t *fileTailer) shutdown(logger logrus.FieldLogger) {
 
 	close(t.lines)
 	close(t.errors)
 
 	warnf := func(format string, args ...interface{}) {
-		log.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args))
+		log.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args...))
+	}
+
+	if t.positions != nil {
+		t.writePositions(logger)
 	}
 
 	for _, dir := range t.watchedDirs {
@@ -226,6 +339,13 @@ func (t *fileTailer) shutdown() {
 			warnf("close(%q) failed: %v", file.file.Name(), err)
 		}
 	}
+
+	for _, file := range t.rotatedFiles {
+		err = file.file.Close()
+		if err != nil {
+			warnf("close(%q) failed: %v", file.file.Name(), err)
+		}
+	}
 }
 
 func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
@@ -238,6 +358,7 @@ func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
 	if Err != nil {
 		return Err
 	}
+	t.baseDirs = dirPaths
 	for _, dirPath = range dirPaths {
 		log.Debugf("watching directory %v", dirPath)
 		dir, Err := t.osSpecific.watchDir(dirPath)
@@ -250,6 +371,9 @@ func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
 }
 
 func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogger) Error {
+	if findDirByPath(t.watchedDirs, dir.Path()) != dir {
+		return nil // dir was un-watched while processing an event for its parent directory
+	}
 	watchedFilesAfter := make(map[string]*fileWithReader)
 	for path, file := range t.watchedFiles {
 		if filepath.Dir(path) != dir.Path() {
@@ -258,17 +382,34 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 	}
 	fileInfos, Err := dir.ls()
 	if Err != nil {
+		if !containsString(t.baseDirs, dir.Path()) && !isDir(dir.Path()) {
+			log.Info("directory was removed, un-watching")
+			t.unwatchDirRecursively(dir.Path(), log)
+			return nil
+		}
 		return Err
 	}
+	sort.SliceStable(fileInfos, func(i, j int) bool {
+		return isRotatedBefore(fileInfos[i].Name(), fileInfos[j].Name())
+	})
+	var subDirs []string
 	for _, fileInfo := range fileInfos {
 		filePath := filepath.Join(dir.Path(), fileInfo.Name())
 		fileLogger := log.WithField("file", fileInfo.Name())
+		if fileInfo.IsDir() {
+			if anyGlobMatchesDir(t.globs, filePath) {
+				subDirs = append(subDirs, filePath)
+			} else {
+				fileLogger.Debug("skipping, because it is a directory")
+			}
+			continue
+		}
 		if !anyGlobMatches(t.globs, filePath) {
 			fileLogger.Debug("skipping file, because file name does not match")
 			continue
 		}
-		if fileInfo.IsDir() {
-			fileLogger.Debug("skipping, because it is a directory")
+		if anyGlobMatches(t.excludes, filePath) {
+			fileLogger.Debug("skipping file, because it is excluded")
 			continue
 		}
 		alreadyWatched, Err := findSameFile(t, fileInfo, filePath)
@@ -282,6 +423,7 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 					return NewErrorf(NotSpecified, err, "%v: failed to follow moved file", filePath)
 				}
 				fileLogger.WithField("fd", renamedFile.Fd()).Infof("file with old_fd=%v was moved from old_path=%v", alreadyWatched.file.Fd(), alreadyWatched.file.Name())
+				t.countRotation(alreadyWatched.file.Name())
 				alreadyWatched.file.Close()
 				Err = t.osSpecific.watchFile(renamedFile)
 				if Err != nil {
@@ -301,6 +443,22 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 			}
 			continue
 		}
+		compression, err := detectCompression(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fileLogger.Debug("skipping, because file does no longer exist")
+				continue
+			}
+			return NewErrorf(NotSpecified, err, "%v: failed to read file header", filePath)
+		}
+		if len(compression) > 0 {
+			if t.readCompressed {
+				t.readCompressedFile(filePath, compression, fileLogger)
+			} else {
+				fileLogger.Debugf("skipping, because file is %v compressed", compression)
+			}
+			continue
+		}
 		newFile, Err := open(filePath)
 		if Err != nil {
 			if Err.Type() == FileNotFound {
@@ -310,13 +468,57 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 				return Err
 			}
 		}
-		if !readall {
-			_, err := newFile.Seek(0, io.SeekEnd)
+		var offset int64
+		resumed := false
+		if t.positions != nil && t.positions.stored != nil {
+			device, inode, Err := fileIdentity(newFile)
+			if Err != nil {
+				newFile.Close()
+				return Err
+			}
+			if stored := t.positions.find(device, inode); stored != nil {
+				size, err := newFile.Seek(0, io.SeekEnd)
+				if err != nil {
+					newFile.Close()
+					return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
+				}
+				if stored.Offset <= size {
+					_, err = newFile.Seek(stored.Offset, io.SeekStart)
+					if err != nil {
+						newFile.Close()
+						return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
+					}
+					fileLogger.Infof("resuming at offset %v from position file", stored.Offset)
+					offset = stored.Offset
+					resumed = true
+				} else {
+					fileLogger.Infof("file was truncated, ignoring offset %v from position file", stored.Offset)
+				}
+			}
+		}
+		if !resumed {
+			whence := io.SeekEnd
+			if readall {
+				whence = io.SeekStart
+			}
+			offset, err = newFile.Seek(0, whence)
 			if err != nil {
 				newFile.Close()
 				return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
 			}
 		}
+		// The encoding is detected from the tailed file, because the file might have been replaced since detectCompression().
+		reader := t.newLineReader(filePath)
+		if offset == 0 {
+			reader.readFromStart()
+		} else {
+			encoding, err := detectFileEncoding(newFile, t.encoding)
+			if err != nil {
+				newFile.Close()
+				return NewErrorf(NotSpecified, err, "%v: failed to read file header", filePath)
+			}
+			reader.setEncoding(encoding)
+		}
 		fileLogger = fileLogger.WithField("fd", newFile.Fd())
 		fileLogger.Info("watching new file")
 
@@ -326,7 +528,7 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 			return Err
 		}
 
-		newFileWithReader := &fileWithReader{file: newFile, reader: NewLineReader()}
+		newFileWithReader := &fileWithReader{file: newFile, reader: reader, processed: &processedOffset{offset: offset}}
 		Err = t.readNewLines(newFileWithReader, fileLogger)
 		if Err != nil {
 			newFile.Close()
@@ -337,22 +539,102 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 	for _, f := range t.watchedFiles {
 		if !contains(watchedFilesAfter, f) {
 			fileLogger := log.WithField("file", filepath.Base(f.file.Name())).WithField("fd", f.file.Fd())
-			fileLogger.Info("file was removed, closing and un-watching")
-			f.file.Close()
+			t.countRotation(f.file.Name())
+			// Lines that were written before the file was moved or removed are not lost.
+			Err = t.readNewLines(f, fileLogger)
+			if Err != nil {
+				fileLogger.Warnf("failed to read remaining lines: %v", Err)
+			}
+			if Err == nil && t.gracePeriod > 0 {
+				fileLogger.Infof("file was moved or removed, reading new lines for %v before closing", t.gracePeriod)
+				t.rotatedFiles = append(t.rotatedFiles, &rotatedFile{fileWithReader: f, closeAt: time.Now().Add(t.gracePeriod)})
+			} else {
+				fileLogger.Info("file was removed, closing and un-watching")
+				f.file.Close()
+			}
 		}
 	}
 	t.watchedFiles = watchedFilesAfter
+	return t.syncSubDirs(dir, subDirs, readall, log)
+}
+
+// Watches new subdirectories that may contain matching files, and un-watches subdirectories that were removed.
+func (t *fileTailer) syncSubDirs(dir *Dir, subDirs []string, readall bool, log logrus.FieldLogger) Error {
+	// Un-watch first: If a directory was moved, inotify would re-use the old watch descriptor for the new path.
+	for _, watchedDir := range t.watchedDirs {
+		path := watchedDir.Path()
+		if filepath.Dir(path) == dir.Path() && !containsString(subDirs, path) && !containsString(t.baseDirs, path) {
+			log.WithField("subdirectory", filepath.Base(path)).Info("directory was removed, un-watching")
+			t.unwatchDirRecursively(path, log)
+		}
+	}
+	for _, path := range subDirs {
+		if findDirByPath(t.watchedDirs, path) != nil {
+			continue
+		}
+		subDirLogger := log.WithField("directory", path)
+		subDir, Err := t.osSpecific.watchDir(path)
+		if Err != nil {
+			if !isDir(path) {
+				continue // removed in the meantime
+			}
+			return Err
+		}
+		subDirLogger.Info("watching new directory")
+		t.watchedDirs = append(t.watchedDirs, subDir)
+		Err = t.syncFilesInDir(subDir, readall, subDirLogger)
+		if Err != nil {
+			return Err
+		}
+	}
 	return nil
 }
 
+// Un-watches the directory and its subdirectories, and closes the files in these directories.
+func (t *fileTailer) unwatchDirRecursively(path string, log logrus.FieldLogger) {
+	isRemoved := func(p string) bool {
+		return p == path || strings.HasPrefix(p, path+string(filepath.Separator))
+	}
+	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs))
+	for _, dir := range t.watchedDirs {
+		if !isRemoved(dir.Path()) {
+			watchedDirsAfter = append(watchedDirsAfter, dir)
+			continue
+		}
+		err := t.osSpecific.unwatchDir(dir)
+		if err != nil {
+			log.Debugf("%v", err) // expected if the directory does no longer exist
+		}
+	}
+	t.watchedDirs = watchedDirsAfter
+	for filePath, file := range t.watchedFiles {
+		if isRemoved(filepath.Dir(filePath)) {
+			log.WithField("file", filePath).WithField("fd", file.file.Fd()).Info("closing and un-watching file in removed directory")
+			file.file.Close()
+			delete(t.watchedFiles, filePath)
+		}
+	}
+}
+
+// With a position file, each line gets its offset, see Line.Processed(). The offset is calculated from the bytes
+// read in this call, so that the file is not seeked for each line.
 func (t *fileTailer) readNewLines(file *fileWithReader, log logrus.FieldLogger) Error {
 	var (
-		line string
-		eof  bool
-		err  error
+		line     string
+		eof      bool
+		err      error
+		position *Position
+		start    int64 // file offset when this function was called
 	)
+	in := &countingReader{Reader: file.file}
+	if t.positions != nil {
+		start, err = file.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
+		}
+	}
 	for {
-		line, eof, err = file.reader.ReadLine(file.file)
+		line, eof, err = file.reader.ReadLine(in)
 		if err != nil {
 			return NewErrorf(NotSpecified, err, "%v: read() failed", file.file.Name())
 		}
@@ -360,14 +642,96 @@ func (t *fileTailer) readNewLines(file *fileWithReader, log logrus.FieldLogger)
 			return nil
 		}
 		log.Debugf("read line %q", line)
+		if t.positions != nil {
+			position = &Position{processed: file.processed, offset: start + in.n - int64(file.reader.Buffered())}
+		}
 		select {
 		case <-t.done:
 			return nil
-		case t.lines <- &Line{Line: line, File: file.file.Name()}:
+		case t.lines <- &Line{Line: line, File: file.file.Name(), Position: position}:
 		}
 	}
 }
 
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Reads lines that were appended to rotated files, and closes the files when the grace period expires.
+// Read errors are not fatal, because the rotated file is no longer the current log file.
+func (t *fileTailer) readRotatedFiles(log logrus.FieldLogger) {
+	var remaining []*rotatedFile
+	for _, f := range t.rotatedFiles {
+		fileLogger := log.WithField("file", f.file.Name()).WithField("fd", f.file.Fd())
+		Err := t.readNewLines(f.fileWithReader, fileLogger)
+		if Err != nil {
+			fileLogger.Warnf("failed to read rotated file: %v", Err)
+		}
+		if Err != nil || time.Now().After(f.closeAt) {
+			fileLogger.Info("grace period for rotated file expired, closing")
+			f.file.Close()
+		} else {
+			remaining = append(remaining, f)
+		}
+	}
+	t.rotatedFiles = remaining
+}
+
+func (t *fileTailer) newLineReader(path string) *lineReader {
+	reader := newLineReaderWithEncoding(t.encoding)
+	if t.maxLineBytes > 0 {
+		reader.LimitLineLength(t.maxLineBytes, t.dropOversized, func() {
+			if t.metrics != nil {
+				t.metrics.LineOversized(path)
+			}
+		})
+	}
+	return reader
+}
+
+func (t *fileTailer) countRotation(path string) {
+	if t.metrics != nil {
+		t.metrics.FileRotated(path)
+	}
+}
+
+// Must be called after a truncated file was reset to the beginning.
+func (t *fileTailer) countTruncation(path string, log logrus.FieldLogger) {
+	log.Info("file was truncated, reading from the beginning")
+	if t.metrics != nil {
+		t.metrics.FileTruncated(path)
+	}
+}
+
+// Errors writing the position file are not fatal, because the next attempt might succeed.
+func (t *fileTailer) writePositions(log logrus.FieldLogger) {
+	positions := make([]filePosition, 0, len(t.watchedFiles))
+	for path, file := range t.watchedFiles {
+		device, inode, Err := fileIdentity(file.file)
+		if Err != nil {
+			log.Warnf("failed to update position file: %v", Err)
+			return
+		}
+		positions = append(positions, filePosition{
+			Path:   path,
+			Device: device,
+			Inode:  inode,
+			Offset: atomic.LoadInt64(&file.processed.offset),
+		})
+	}
+	Err := t.positions.write(positions)
+	if Err != nil {
+		log.Warnf("failed to update position file: %v", Err)
+	}
+}
+
 func (t *fileTailer) checkMissingFile() Error {
 OUTER:
 	for _, g := range t.globs {
@@ -383,7 +747,7 @@ OUTER:
 	return nil
 }
 
-// Gets the directory paths from the glob expressions,
+// Gets the base directory paths from the glob expressions,
 // and makes sure these directories exist.
 func uniqueDirs(globs []glob.Glob) ([]string, Error) {
 	var (
@@ -393,24 +757,38 @@ func uniqueDirs(globs []glob.Glob) ([]string, Error) {
 		err     error
 	)
 	for _, g = range globs {
-		if containsString(result, g.Dir()) {
+		if containsString(result, g.BaseDir()) {
 			continue
 		}
-		dirInfo, err = os.Stat(g.Dir())
+		dirInfo, err = os.Stat(g.BaseDir())
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.Dir())
+				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.BaseDir())
 			}
-			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Dir())
+			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.BaseDir())
 		}
 		if !dirInfo.IsDir() {
-			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Dir())
+			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.BaseDir())
 		}
-		result = append(result, g.Dir())
+		result = append(result, g.BaseDir())
 	}
 	return result, nil
 }
 
+func isDir(path string) bool {
+	dirInfo, err := os.Stat(path)
+	return err == nil && dirInfo.IsDir()
+}
+
+func findDirByPath(dirs []*Dir, path string) *Dir {
+	for _, dir := range dirs {
+		if dir.Path() == path {
+			return dir
+		}
+	}
+	return nil
+}
+
 func anyGlobMatches(globs []glob.Glob, path string) bool {
 	for _, pattern := range globs {
 		if pattern.Match(path) {
@@ -420,6 +798,15 @@ func anyGlobMatches(globs []glob.Glob, path string) bool {
 	return false
 }
 
+func anyGlobMatchesDir(globs []glob.Glob, path string) bool {
+	for _, pattern := range globs {
+		if pattern.MatchDir(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func containsString(list []string, s string) bool {
 	for _, existing := range list {
 		if existing == s {
@@ -27,8 +27,9 @@ type watcher struct {
 }
 
 type fileWithReader struct {
-	file   *os.File
-	reader *lineReader
+	file      *os.File
+	reader    *lineReader
+	processed *processedOffset // see Line.Processed()
 }
 
 func (w *watcher) unwatchDir(dir *Dir) error {
@@ -147,6 +148,12 @@ func (w *watcher) processDirEvent(t *fileTailer, kevent syscall.Kevent_t, dir *D
 			return NewErrorf(NotSpecified, err, "%v: failed to update list of files in directory", dir.file.Name())
 		}
 	}
+	if !containsString(t.baseDirs, dir.Path()) && (kevent.Fflags&syscall.NOTE_DELETE == syscall.NOTE_DELETE || kevent.Fflags&syscall.NOTE_RENAME == syscall.NOTE_RENAME) {
+		// Subdirectories matching a glob like /var/log/*/current.log may come and go.
+		dirLogger.Info("directory was removed, un-watching")
+		t.unwatchDirRecursively(dir.Path(), dirLogger)
+		return nil
+	}
 	if kevent.Fflags&syscall.NOTE_DELETE == syscall.NOTE_DELETE {
 		return NewErrorf(NotSpecified, nil, "%v: directory was deleted", dir.file.Name())
 	}
@@ -179,6 +186,8 @@ func (w *watcher) processFileEvent(t *fileTailer, kevent syscall.Kevent_t, file
 				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
 			}
 			file.reader.Clear()
+			file.processed = &processedOffset{}
+			t.countTruncation(file.file.Name(), log)
 		}
 	}
 
@@ -25,17 +25,20 @@ import (
 )
 
 type watcher struct {
-	fd int
+	fd        int
+	unwatched map[int]bool // watch descriptors of removed subdirectories, pending events for these are ignored until IN_IGNORED
 }
 
 type fileWithReader struct {
-	file   *os.File
-	reader *lineReader
+	file      *os.File
+	reader    *lineReader
+	processed *processedOffset // see Line.Processed()
 }
 
 func (w *watcher) unwatchDir(dir *Dir) error {
 	// After calling eventProducerLoop.Close(), we need to call inotify_rm_watch()
 	// in order to terminate the inotify loop. See eventProducerLoop.Close().
+	w.unwatched[dir.wd] = true
 	success, err := syscall.InotifyRmWatch(w.fd, uint32(dir.wd))
 	if success != 0 || err != nil {
 		return fmt.Errorf("inotify_rm_watch(%q) failed: status=%v, err=%v", dir.path, success, err)
@@ -72,7 +75,7 @@ func initWatcher() (fswatcher, Error) {
 	if err != nil {
 		return nil, NewError(NotSpecified, err, "inotify_init1() failed")
 	}
-	return &watcher{fd: fd}, nil
+	return &watcher{fd: fd, unwatched: make(map[int]bool)}, nil
 }
 
 func (w *watcher) watchDir(path string) (*Dir, Error) {
@@ -132,6 +135,14 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 	if !ok {
 		return NewErrorf(NotSpecified, nil, "received a file system event of unknown type %T", event)
 	}
+	if w.unwatched[int(event.Wd)] {
+		log.Debugf("ignoring event for un-watched directory: %v", event)
+		if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
+			// IN_IGNORED is the last event for a watch descriptor, afterwards the kernel may re-use it.
+			delete(w.unwatched, int(event.Wd))
+		}
+		return nil
+	}
 	dir, Err := findDir(t, event)
 	if Err != nil {
 		return Err
@@ -139,6 +150,13 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 	dirLogger := log.WithField("directory", dir.path)
 	dirLogger.Debugf("received event: %v", event)
 	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
+		if !containsString(t.baseDirs, dir.path) {
+			// Subdirectories matching a glob like /var/log/*/current.log may come and go.
+			dirLogger.Info("directory was removed, un-watching")
+			t.unwatchDirRecursively(dir.path, dirLogger)
+			delete(w.unwatched, dir.wd) // this was the last event for the watch descriptor, see above
+			return nil
+		}
 		unwatchDirByEvent(t, event) // need to remove it from watchedDirs, because otherwise we close the removed dir on shutdown which causes an error
 		return NewErrorf(NotSpecified, nil, "%s: directory was removed while being watched", dir.path)
 	}
@@ -157,6 +175,8 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
 			}
 			file.reader.Clear()
+			file.processed = &processedOffset{}
+			t.countTruncation(file.file.Name(), dirLogger)
 		}
 		readErr := t.readNewLines(file, dirLogger)
 		if readErr != nil {
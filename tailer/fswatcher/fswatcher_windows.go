@@ -30,8 +30,9 @@ type watcher struct {
 }
 
 type fileWithReader struct {
-	file   *File
-	reader *lineReader
+	file      *File
+	reader    *lineReader
+	processed *processedOffset // see Line.Processed()
 }
 
 type fileInfo struct {
@@ -128,6 +129,8 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 				return NewError(NotSpecified, os.NewSyscallError("seek", err), file.file.Name())
 			}
 			file.reader.Clear()
+			file.processed = &processedOffset{}
+			t.countTruncation(file.file.Name(), log)
 		}
 		Err = t.readNewLines(file, log)
 		if Err != nil {
@@ -183,5 +186,8 @@ func dirAndFile(t *fileTailer, fileOrDir string) (*Dir, string) {
 			}
 		}
 	}
+	if found == nil {
+		return nil, ""
+	}
 	return found, strings.TrimLeft(fileOrDir[len(found.path):], "\\/")
 }
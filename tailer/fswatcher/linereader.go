@@ -17,15 +17,57 @@ package fswatcher
 import (
 	"bytes"
 	"io"
+	"unicode/utf8"
 )
 
 type lineReader struct {
-	remainingBytesFromLastRead []byte
+	remainingBytesFromLastRead []byte   // always UTF-8
+	decoder                    *decoder // nil for UTF-8 files
+	configuredEncoding         string   // the encoding may be detected again, see readFromStart()
+	detectEncoding             bool     // the encoding is detected from the next bytes that are read
+	atStart                    bool     // the next line is the first line, which may start with a BOM
+	maxLineBytes               int      // 0 means no limit, see LimitLineLength()
+	dropOversizedLines         bool
+	oversized                  func() // called for each line longer than maxLineBytes
+	skippingOversizedLine      bool   // the beginning of the current line was already truncated or dropped
 }
 
 func NewLineReader() *lineReader {
 	return &lineReader{
 		remainingBytesFromLastRead: []byte{},
+		atStart:                    true,
+	}
+}
+
+// The configured encoding is one of the Encoding constants, see encoding.go. A BOM in the file takes precedence,
+// so readFromStart() or setEncoding() must be called depending on where the file is read.
+func newLineReaderWithEncoding(configured string) *lineReader {
+	return &lineReader{
+		remainingBytesFromLastRead: []byte{},
+		configuredEncoding:         configured,
+	}
+}
+
+// The encoding is detected from the first bytes that are read, and the BOM is removed from the first line.
+// If the file is empty, the encoding is detected when the first bytes are written, like after logrotate's create.
+func (r *lineReader) readFromStart() {
+	r.detectEncoding = true
+	r.atStart = true
+}
+
+// For files that are read from an offset after the BOM. The encoding was detected with detectFileEncoding().
+func (r *lineReader) setEncoding(encoding string) {
+	r.decoder = newDecoder(encoding)
+}
+
+// Lines longer than maxBytes are truncated, or dropped if drop is true. Without a limit, the line
+// reader keeps all bytes until the next newline in memory, which might be a lot for binary files.
+func (r *lineReader) LimitLineLength(maxBytes int, drop bool, oversized func()) {
+	r.maxLineBytes = maxBytes
+	r.dropOversizedLines = drop
+	r.oversized = oversized
+	if r.oversized == nil {
+		r.oversized = func() {}
 	}
 }
 
@@ -44,14 +86,36 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 	)
 	for {
 		newlinePos := bytes.IndexByte(r.remainingBytesFromLastRead, '\n')
-		if newlinePos >= 0 {
-			l := len(r.remainingBytesFromLastRead)
-			result := make([]byte, newlinePos)
-			copy(result, r.remainingBytesFromLastRead[:newlinePos])
-			copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[newlinePos+1:])
-			r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-(newlinePos+1)]
-			return string(stripWindowsLineEnding(result)), false, nil
-		} else if err != nil {
+		if r.skippingOversizedLine {
+			if newlinePos < 0 {
+				r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:0]
+			} else {
+				r.skippingOversizedLine = false
+				r.consume(newlinePos)
+				continue
+			}
+		} else if newlinePos >= 0 {
+			result := r.stripByteOrderMark(stripWindowsLineEnding(r.consume(newlinePos)))
+			if r.maxLineBytes > 0 && len(result) > r.maxLineBytes {
+				r.oversized()
+				if r.dropOversizedLines {
+					continue
+				}
+				result = truncate(result, r.maxLineBytes)
+			}
+			return string(result), false, nil
+		} else if r.maxLineBytes > 0 && len(r.remainingBytesFromLastRead) > r.maxLineBytes+1 { // +1 for a trailing '\r'
+			// Don't wait for the newline, because the line might be arbitrarily long.
+			r.oversized()
+			r.skippingOversizedLine = true
+			result := truncate(r.stripByteOrderMark(r.remainingBytesFromLastRead), r.maxLineBytes)
+			r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:0]
+			if !r.dropOversizedLines {
+				return string(result), false, nil
+			}
+			continue
+		}
+		if err != nil {
 			if err == io.EOF {
 				return "", true, nil
 			} else {
@@ -59,14 +123,49 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 			}
 		} else {
 			n, err = file.Read(buf)
+			if n > 0 && r.detectEncoding {
+				r.decoder = newDecoder(detectEncoding(buf[0:n], r.configuredEncoding))
+				r.detectEncoding = false
+			}
 			if n > 0 {
 				// io.Reader: Callers should always process the n > 0 bytes returned before considering the error err.
-				r.remainingBytesFromLastRead = append(r.remainingBytesFromLastRead, buf[0:n]...)
+				if r.decoder != nil {
+					r.remainingBytesFromLastRead = append(r.remainingBytesFromLastRead, r.decoder.decode(buf[0:n])...)
+				} else {
+					r.remainingBytesFromLastRead = append(r.remainingBytesFromLastRead, buf[0:n]...)
+				}
 			}
 		}
 	}
 }
 
+// Returns a copy of the bytes before the newline, and removes the line including the newline from the buffer.
+func (r *lineReader) consume(newlinePos int) []byte {
+	l := len(r.remainingBytesFromLastRead)
+	result := make([]byte, newlinePos)
+	copy(result, r.remainingBytesFromLastRead[:newlinePos])
+	copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[newlinePos+1:])
+	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-(newlinePos+1)]
+	return result
+}
+
+// Truncates the UTF-8 string to at most maxBytes without splitting a multi-byte character.
+func truncate(s []byte, maxBytes int) []byte {
+	if len(s) <= maxBytes {
+		return s
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// Like truncate() for strings, for inputs that don't use a line reader.
+func TruncateLine(line string, maxBytes int) string {
+	return string(truncate([]byte(line), maxBytes))
+}
+
 func stripWindowsLineEnding(s []byte) []byte {
 	if len(s) > 0 && s[len(s)-1] == '\r' {
 		return s[:len(s)-1]
@@ -75,6 +174,29 @@ func stripWindowsLineEnding(s []byte) []byte {
 	}
 }
 
+// The BOM is only removed at the beginning of the file. If the file is truncated, the BOM is expected again, see Clear().
+func (r *lineReader) stripByteOrderMark(line []byte) []byte {
+	if !r.atStart {
+		return line
+	}
+	r.atStart = false
+	return bytes.TrimPrefix(line, []byte("\ufeff"))
+}
+
+// Called when a truncated file is read again from the start.
 func (r *lineReader) Clear() {
 	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:0]
+	r.skippingOversizedLine = false
+	if r.decoder != nil {
+		r.decoder.clear()
+	}
+	r.readFromStart()
+}
+
+// Number of bytes that were read from the file but not returned as a line yet.
+func (r *lineReader) Buffered() int {
+	if r.decoder != nil {
+		return r.decoder.encodedLength(r.remainingBytesFromLastRead) + len(r.decoder.pending)
+	}
+	return len(r.remainingBytesFromLastRead)
 }
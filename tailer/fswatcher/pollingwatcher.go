@@ -52,6 +52,8 @@ func (w *pollingWatcher) processEvent(t *fileTailer, fsevent fsevent, log logrus
 				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
 			}
 			file.reader.Clear()
+			file.processed = &processedOffset{}
+			t.countTruncation(file.file.Name(), log)
 		}
 		readErr := t.readNewLines(file, log)
 		if readErr != nil {
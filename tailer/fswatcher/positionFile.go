@@ -0,0 +1,140 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// The position file stores the offset after the last processed line of each watched file, so that the tailer
+// can resume where it left off when grok_exporter is restarted.
+// Files are identified by device and inode, because log files might have been rotated
+// (i.e. renamed) while grok_exporter was not running.
+type positionFile struct {
+	path   string
+	stored []filePosition // positions read on startup, nil after the initial directory sync.
+}
+
+type filePosition struct {
+	Path   string `json:"path"` // informational only, files are identified by device and inode.
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Position of a line in a file, see Line.Processed().
+// Inputs other than files use a cursor instead of an offset, see NewCursorPosition().
+type Position struct {
+	processed *processedOffset
+	offset    int64 // offset after the line
+	cursor    *Cursor
+	value     string // cursor value of the line
+}
+
+// The cursor of the last processed entry of an input that is not a file, like the journald cursor.
+type Cursor struct {
+	value atomic.Value // string, because lines are processed in another goroutine
+}
+
+// The line is the entry identified by value. When the line is processed, the cursor is set to value.
+func NewCursorPosition(cursor *Cursor, value string) *Position {
+	return &Position{cursor: cursor, value: value}
+}
+
+// Returns the value of the last processed entry, or the empty string if no entry was processed yet.
+func (c *Cursor) Load() string {
+	value, _ := c.value.Load().(string)
+	return value
+}
+
+// The offset after the last processed line of a file. It is replaced when the file is truncated,
+// so that lines read before the truncation do not change the offset of the truncated file.
+type processedOffset struct {
+	offset int64 // accessed atomically, because lines are processed in another goroutine
+}
+
+type positionFileContent struct {
+	Files []filePosition `json:"files"`
+}
+
+// A missing position file is not an error, it will be created when the positions are written for the first time.
+func loadPositionFile(path string) (*positionFile, Error) {
+	result := &positionFile{
+		path:   path,
+		stored: []filePosition{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, NewErrorf(NotSpecified, err, "%v: failed to read position file", path)
+	}
+	var content positionFileContent
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return nil, NewErrorf(NotSpecified, err, "%v: failed to parse position file", path)
+	}
+	if content.Files != nil {
+		result.stored = content.Files
+	}
+	return result, nil
+}
+
+// Returns the stored position of the file with the given device and inode, or nil if there is no stored position.
+func (p *positionFile) find(device, inode uint64) *filePosition {
+	for i := range p.stored {
+		if p.stored[i].Device == device && p.stored[i].Inode == inode {
+			return &p.stored[i]
+		}
+	}
+	return nil
+}
+
+// The position file is replaced atomically, so it is never left in an inconsistent state if grok_exporter is killed.
+func (p *positionFile) write(positions []filePosition) Error {
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Path < positions[j].Path
+	})
+	data, err := json.MarshalIndent(positionFileContent{Files: positions}, "", "  ")
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: failed to write position file", p.path)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".*.tmp")
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: failed to write position file", p.path)
+	}
+	_, err = tmpFile.Write(append(data, '\n'))
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), p.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return NewErrorf(NotSpecified, err, "%v: failed to write position file", p.path)
+	}
+	return nil
+}
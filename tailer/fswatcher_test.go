@@ -15,11 +15,14 @@
 package tailer
 
 import (
+	"compress/gzip"
 	"fmt"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -28,8 +31,10 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf16"
 )
 
 const tests = `
@@ -152,6 +157,62 @@ const tests = `
   - [log, file 1 line 2, logdir/logfile1.log]
   - [expect, file 1 line 2, logdir/logfile1.log]
   - [expect, file 2 line 2, logdir/logfile2.log]
+
+- name: wildcard in directory name
+  commands:
+  - [mkdir, apps]
+  - [mkdir, apps/app1]
+  - [log, app 1 line 1, apps/app1/current.log]
+  - [log, not matching, apps/app1/other.log]
+  - [start file tailer, readall=true, fail_on_missing_logfile=false, apps/*/current.log]
+  - [expect, app 1 line 1, apps/app1/current.log]
+  - [mkdir, apps/app2]
+  - [log, app 2 line 1, apps/app2/current.log]
+  - [expect, app 2 line 1, apps/app2/current.log]
+  - [log, app 1 line 2, apps/app1/current.log]
+  - [expect, app 1 line 2, apps/app1/current.log]
+  - [logrotate, apps/app1/current.log, apps/app1/current.log.1]
+  - [log, app 1 line 3, apps/app1/current.log]
+  - [expect, app 1 line 3, apps/app1/current.log]
+  - [rmdir, apps/app2]
+  - [log, app 1 line 4, apps/app1/current.log]
+  - [expect, app 1 line 4, apps/app1/current.log]
+  - [mkdir, apps/app3]
+  - [log, app 3 line 1, apps/app3/current.log]
+  - [expect, app 3 line 1, apps/app3/current.log]
+
+- name: exclude paths
+  commands:
+  - [mkdir, logdir]
+  - [log, excluded line 1, logdir/error.log]
+  - [log, access line 1, logdir/access.log]
+  - [start file tailer, readall=true, fail_on_missing_logfile=false, exclude=logdir/error.log, exclude=logdir/*.gz, logdir/*]
+  - [expect, access line 1, logdir/access.log]
+  - [log, excluded line 2, logdir/error.log]
+  - [log, excluded line 1, logdir/access.log.gz]
+  - [log, access line 2, logdir/access.log]
+  - [expect, access line 2, logdir/access.log]
+  - [expect no lines, logdir/error.log]
+  - [expect no lines, logdir/access.log.gz]
+
+- name: recursive glob
+  commands:
+  - [mkdir, logs]
+  - [log, top line 1, logs/top.log]
+  - [start file tailer, readall=true, fail_on_missing_logfile=false, logs/**/*.log]
+  - [expect, top line 1, logs/top.log]
+  - [mkdir, logs/a]
+  - [mkdir, logs/a/b]
+  - [log, nested line 1, logs/a/b/nested.log]
+  - [expect, nested line 1, logs/a/b/nested.log]
+  - [log, nested line 2, logs/a/b/nested.log]
+  - [expect, nested line 2, logs/a/b/nested.log]
+  - [logrotate, logs/a/b/nested.log, logs/a/b/nested.log.1]
+  - [log, nested line 3, logs/a/b/nested.log]
+  - [expect, nested line 3, logs/a/b/nested.log]
+  - [rmdir, logs/a]
+  - [log, top line 2, logs/top.log]
+  - [expect, top line 2, logs/top.log]
 `
 
 // // The following test fails on Windows in tearDown() when removing logdir.
@@ -248,6 +309,250 @@ func TestFileMissingOnStartup(t *testing.T) {
 	runTest(t, "fail on missing startup", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
 }
 
+// test the "position_file" configuration: after a restart, the tailer resumes where it left off.
+func TestPositionFile(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"stop file tailer"},
+		{"log", "line 2", "logdir/test.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 2", "logdir/test.log"},
+		{"log", "line 3", "logdir/test.log"},
+		{"expect", "line 3", "logdir/test.log"},
+	}
+	runTest(t, "position file", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "position file", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+}
+
+// Lines that were read but not processed when the tailer is stopped are read again after a restart.
+func TestPositionFileUnprocessedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	if err = ioutil.WriteFile(logfile, []byte("line 1\nline 2\nline 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := glob.Parse(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fswatcher.Options{
+		PositionFile:         filepath.Join(dir, "positions.json"),
+		PositionSyncInterval: time.Second,
+	}
+	// Each run processes the first line and reads the second line without processing it.
+	for _, expected := range [][]string{{"line 1", "line 2"}, {"line 2", "line 3"}, {"line 3"}} {
+		tail, err := fswatcher.RunFileTailerWithOptions([]glob.Glob{g}, true, true, options, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, expectedLine := range expected {
+			select {
+			case line := <-tail.Lines():
+				if line.Line != expectedLine {
+					t.Fatalf("expected %q, but got %q", expectedLine, line.Line)
+				}
+				if i == 0 {
+					line.Processed()
+				}
+			case err := <-tail.Errors():
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout while waiting for %q", expectedLine)
+			}
+		}
+		tail.Close()
+	}
+}
+
+// If the logfile was rotated while the tailer was stopped, the stored position is not used.
+func TestPositionFileAfterLogrotate(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"stop file tailer"},
+		{"logrotate", "logdir/test.log", "logdir/test.log.1"},
+		{"log", "line 2", "logdir/test.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 2", "logdir/test.log"},
+	}
+	runTest(t, "position file after logrotate", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+}
+
+// Output of "printf 'line 1\n' | bzip2". There is no bzip2 encoder in the Go standard library.
+var bzip2Line1 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x89, 0xe3,
+	0x64, 0x1e, 0x00, 0x00, 0x02, 0xd9, 0x00, 0x00, 0x10, 0x40, 0x00, 0x20,
+	0x00, 0x02, 0x25, 0x20, 0x00, 0x22, 0x0c, 0x9b, 0x42, 0x18, 0x04, 0xd8,
+	0x42, 0x8b, 0xb9, 0x22, 0x9c, 0x28, 0x48, 0x44, 0xf1, 0xb2, 0x0f, 0x00,
+}
+
+// With readall, compressed rotated files are read on startup in rotation order, oldest first.
+// Compressed files created later are not read, because they contain lines that were already read.
+func TestCompressedFiles(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"write bzip2 line 1", "logdir/access.log.3.bz2"},
+		{"log", "line 2", "logdir/access.log.2"},
+		{"compress", "logdir/access.log.2", "logdir/access.log.2.zst"},
+		{"log", "line 3", "logdir/access.log.1"},
+		{"compress", "logdir/access.log.1", "logdir/access.log.1.gz"},
+		{"log", "line 4", "logdir/access.log"},
+		{"start file tailer", "readall=true", "logdir/*"},
+		{"expect next", "line 1", "logdir/access.log.3.bz2"},
+		{"expect next", "line 2", "logdir/access.log.2.zst"},
+		{"expect next", "line 3", "logdir/access.log.1.gz"},
+		{"expect next", "line 4", "logdir/access.log"},
+		{"compress", "logdir/access.log", "logdir/access.log.4.gz"},
+		{"log", "line 5", "logdir/access.log"},
+		{"expect next", "line 5", "logdir/access.log"},
+	}
+	runTest(t, "compressed files", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "compressed files", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+}
+
+// If the position file does not exist yet, compressed files are read on startup. After a restart, they are not read again.
+func TestCompressedFilesWithPositionFile(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/access.log.1"},
+		{"compress", "logdir/access.log.1", "logdir/access.log.1.gz"},
+		{"log", "line 2", "logdir/access.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/*"},
+		{"expect next", "line 1", "logdir/access.log.1.gz"},
+		{"expect next", "line 2", "logdir/access.log"},
+		{"stop file tailer"},
+		{"log", "line 3", "logdir/access.log"},
+		{"start file tailer", "readall=true", "position_file=positions.json", "logdir/*"},
+		{"expect next", "line 3", "logdir/access.log"},
+	}
+	runTest(t, "compressed files with position file", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "compressed files with position file", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+}
+
+// Lines that are appended to a file after logrotate moved it are read during the grace period.
+func TestRotationGracePeriod(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"start file tailer", "readall=true", "rotation_grace_period=5s", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"logrotate", "logdir/test.log", "logdir/test.log.1"},
+		{"sleep", "500"},
+		{"log", "line 2", "logdir/test.log"}, // the logger keeps the file open, so this is written to test.log.1
+		{"expect", "line 2", "logdir/test.log"},
+		{"expect rotations", "1"},
+		{"expect truncations", "0"},
+	}
+	runTest(t, "rotation grace period", keepOpen, fseventTailer, _create, mv, test)
+	runTest(t, "rotation grace period", keepOpen, pollingTailer, _create, mv, test)
+}
+
+func TestTruncationMetric(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"start file tailer", "readall=true", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"logrotate", "logdir/test.log", "logdir/test.log.1"},
+		{"sleep", "500"},
+		{"log", "line 2", "logdir/test.log"},
+		{"expect", "line 2", "logdir/test.log"},
+		{"expect rotations", "0"},
+		{"expect truncations", "1"},
+	}
+	runTest(t, "truncation metric", keepOpen, fseventTailer, _copytruncate, none, test)
+	runTest(t, "truncation metric", keepOpen, pollingTailer, _copytruncate, none, test)
+}
+
+// Log files are converted to UTF-8. If the file starts with a BOM, the BOM defines the encoding.
+func TestEncoding(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"append", "utf-16be", "\ufeffline 1 äöü\n", "logdir/be.log"},
+		{"append", "utf-16le", "line 1 \U0001F600\r\n", "logdir/le.log"},
+		{"start file tailer", "readall=true", "encoding=utf-16", "logdir/*.log"},
+		{"expect", "line 1 äöü", "logdir/be.log"},
+		{"expect", "line 1 \U0001F600", "logdir/le.log"},
+		{"append", "utf-16be", "line 2\n", "logdir/be.log"},
+		{"expect", "line 2", "logdir/be.log"},
+	}
+	runTest(t, "utf-16", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "utf-16", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+	test = [][]string{
+		{"mkdir", "logdir"},
+		{"append", "windows-1252", "Größe: 3 €\n", "logdir/test.log"},
+		{"start file tailer", "readall=true", "encoding=windows-1252", "logdir/test.log"},
+		{"expect", "Größe: 3 €", "logdir/test.log"},
+	}
+	runTest(t, "windows-1252", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	// If the file is empty, the encoding is detected when the first bytes are written, like after logrotate's create.
+	// The BOM is only removed at the beginning of the file.
+	test = [][]string{
+		{"mkdir", "logdir"},
+		{"append", "utf-16be", "", "logdir/test.log"},
+		{"start file tailer", "readall=false", "encoding=utf-16", "logdir/test.log"},
+		{"sleep", "200"}, // wait until the empty file is opened
+		{"append", "utf-16be", "\ufeffline 1\n\ufeffline 2\n", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"expect", "\ufeffline 2", "logdir/test.log"},
+	}
+	runTest(t, "utf-16 empty file", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "utf-16 empty file", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+	// The position file stores the offset in the original encoding.
+	test = [][]string{
+		{"mkdir", "logdir"},
+		{"append", "utf-16le", "\ufeffline 1\nline 2 ", "logdir/test.log"},
+		{"start file tailer", "readall=true", "encoding=utf-16", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"stop file tailer"},
+		{"append", "utf-16le", "äöü\n", "logdir/test.log"},
+		{"start file tailer", "readall=true", "encoding=utf-16", "position_file=positions.json", "logdir/test.log"},
+		{"expect", "line 2 äöü", "logdir/test.log"},
+	}
+	runTest(t, "utf-16 position file", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+}
+
+// Lines longer than max_line_bytes are truncated or dropped. Lines longer than the read buffer are never kept in memory.
+func TestMaxLineBytes(t *testing.T) {
+	veryLongLine := strings.Repeat("x", 5000)
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"log", "line 2 is too long", "logdir/test.log"},
+		{"log", veryLongLine, "logdir/test.log"},
+		{"log", "line 4", "logdir/test.log"},
+		{"start file tailer", "readall=true", "max_line_bytes=10", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"expect", "line 2 is ", "logdir/test.log"},
+		{"expect", "xxxxxxxxxx", "logdir/test.log"},
+		{"expect", "line 4", "logdir/test.log"},
+		{"expect oversized", "2"},
+	}
+	runTest(t, "truncate oversized lines", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+	runTest(t, "truncate oversized lines", closeFileAfterEachLine, pollingTailer, _nocreate, mv, test)
+	test = [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"log", "line 2 is too long", "logdir/test.log"},
+		{"log", veryLongLine, "logdir/test.log"},
+		{"log", "line 4", "logdir/test.log"},
+		{"start file tailer", "readall=true", "max_line_bytes=10", "oversized_lines=drop", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"expect", "line 4", "logdir/test.log"},
+		{"expect oversized", "2"},
+	}
+	runTest(t, "drop oversized lines", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
+}
+
 func skip(config testConfigType, loggerCfg loggerConfig, logrotateCfg logrotateConfig, logrotateMvCfg logrotateMoveConfig) bool {
 	if len(config.ParamFilters["loggerCfg"]) > 0 && !containsAsString(loggerCfg, config.ParamFilters["loggerCfg"]) {
 		return true
@@ -284,7 +589,7 @@ func runTest(t *testing.T, testName string, loggerCfg loggerConfig, tailerCfg fi
 func executeCommands(t *testing.T, ctx *context, cmds [][]string) {
 	nGoroutinesBefore := runtime.NumGoroutine()
 	for _, cmd := range cmds {
-		exec(t, ctx, cmd)
+		execCommand(t, ctx, cmd)
 	}
 	// The "watch after logrotate" test watches logdir/* and rotates logdir/logfile.log
 	// to logdir/logfile.log.1. As a result, the file is still watched after it is rotated.
@@ -373,13 +678,33 @@ type context struct {
 	log             logrus.FieldLogger
 	tailer          fswatcher.FileTailer
 	linesFromTailer *linesFromTailer
+	metrics         *countingMetrics
+}
+
+// implements fswatcher.Metrics
+type countingMetrics struct {
+	rotations, truncations, oversized int64
 }
 
-func exec(t *testing.T, ctx *context, cmd []string) {
+func (m *countingMetrics) FileRotated(_ string) {
+	atomic.AddInt64(&m.rotations, 1)
+}
+
+func (m *countingMetrics) FileTruncated(_ string) {
+	atomic.AddInt64(&m.truncations, 1)
+}
+
+func (m *countingMetrics) LineOversized(_ string) {
+	atomic.AddInt64(&m.oversized, 1)
+}
+
+func execCommand(t *testing.T, ctx *context, cmd []string) {
 	ctx.log.Debug(printCmd(cmd))
 	switch cmd[0] {
 	case "mkdir":
 		mkdir(t, ctx, cmd[1])
+	case "rmdir":
+		deleteRecursively(t, ctx, filepath.Join(ctx.basedir, cmd[1]))
 	case "log":
 		writer, exists := ctx.logFileWriters[cmd[2]]
 		if !exists {
@@ -389,8 +714,30 @@ func exec(t *testing.T, ctx *context, cmd []string) {
 		writer.writeLine(t, ctx, cmd[1])
 	case "start file tailer":
 		startFileTailer(t, ctx, cmd[1:])
+	case "stop file tailer":
+		closeTailer(t, ctx, false)
+		ctx.tailer = nil
 	case "expect":
 		expect(t, ctx, cmd[1], cmd[2])
+	case "expect no lines":
+		expectNoLines(t, ctx, cmd[1])
+	case "expect next":
+		expectNext(t, ctx, cmd[1], cmd[2])
+	case "expect rotations":
+		expectCount(t, ctx, "rotations", &ctx.metrics.rotations, cmd[1])
+	case "expect truncations":
+		expectCount(t, ctx, "truncations", &ctx.metrics.truncations, cmd[1])
+	case "expect oversized":
+		expectCount(t, ctx, "oversized lines", &ctx.metrics.oversized, cmd[1])
+	case "append":
+		appendEncoded(t, ctx, cmd[1], cmd[2], cmd[3])
+	case "compress":
+		compressOrFail(t, ctx, cmd[1], cmd[2])
+	case "write bzip2 line 1":
+		err := ioutil.WriteFile(filepath.Join(ctx.basedir, cmd[1]), bzip2Line1, 0644)
+		if err != nil {
+			fatalf(t, ctx, "%v: write failed: %v", cmd[1], err)
+		}
 	case "logrotate":
 		rotate(t, ctx, cmd[1], cmd[2])
 	case "sleep":
@@ -522,6 +869,75 @@ func rmOrFail(t *testing.T, ctx *context, from string) {
 	}
 }
 
+// Appends text without adding a newline, converted to the encoding.
+func appendEncoded(t *testing.T, ctx *context, encoding, text, file string) {
+	var data []byte
+	switch encoding {
+	case "utf-16le", "utf-16be":
+		for _, unit := range utf16.Encode([]rune(text)) {
+			if encoding == "utf-16le" {
+				data = append(data, byte(unit), byte(unit>>8))
+			} else {
+				data = append(data, byte(unit>>8), byte(unit))
+			}
+		}
+	case "windows-1252":
+		for _, r := range text {
+			if r == '€' {
+				data = append(data, 0x80)
+			} else if r < 0x100 {
+				data = append(data, byte(r))
+			} else {
+				fatalf(t, ctx, "syntax error in test: %q cannot be encoded in %v", r, encoding)
+			}
+		}
+	default:
+		fatalf(t, ctx, "syntax error in test: unsupported encoding %v", encoding)
+	}
+	f, err := os.OpenFile(filepath.Join(ctx.basedir, file), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		fatalf(t, ctx, "%v: failed to open file for writing: %v", file, err)
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		fatalf(t, ctx, "%v: failed to write to file: %v", file, err)
+	}
+}
+
+// Like logrotate's compress option: Write a compressed copy of the file, then remove the original file.
+func compressOrFail(t *testing.T, ctx *context, from, to string) {
+	data, err := ioutil.ReadFile(filepath.Join(ctx.basedir, from))
+	if err != nil {
+		fatalf(t, ctx, "%v: compress failed, cannot read file: %v", from, err)
+	}
+	f, err := os.Create(filepath.Join(ctx.basedir, to))
+	if err != nil {
+		fatalf(t, ctx, "%v: compress failed, cannot create file: %v", to, err)
+	}
+	var w io.WriteCloser
+	switch filepath.Ext(to) {
+	case ".gz":
+		w = gzip.NewWriter(f)
+	case ".zst":
+		w, err = zstd.NewWriter(f)
+		if err != nil {
+			fatalf(t, ctx, "%v: compress failed: %v", to, err)
+		}
+	default:
+		fatalf(t, ctx, "%v: compress failed: unsupported file extension", to)
+	}
+	if _, err = w.Write(data); err != nil {
+		fatalf(t, ctx, "%v: compress failed: %v", to, err)
+	}
+	if err = w.Close(); err != nil {
+		fatalf(t, ctx, "%v: compress failed: %v", to, err)
+	}
+	if err = f.Close(); err != nil {
+		fatalf(t, ctx, "%v: failed to close file: %v", to, err)
+	}
+	rmOrFail(t, ctx, from)
+}
+
 func createOrFail(t *testing.T, ctx *context, from string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	dir := filepath.Dir(fromPath)
@@ -601,14 +1017,45 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 		readall           = false
 		failOnMissingFile = true
 		globs             []string
+		excludes          []string
+		options           fswatcher.Options
 		err               error
 	)
 	for _, p := range params {
+		if strings.HasPrefix(p, "position_file=") {
+			options.PositionFile = filepath.Join(ctx.basedir, strings.TrimPrefix(p, "position_file="))
+			options.PositionSyncInterval = time.Second
+			continue
+		}
+		if strings.HasPrefix(p, "rotation_grace_period=") {
+			options.RotationGracePeriod, err = time.ParseDuration(strings.TrimPrefix(p, "rotation_grace_period="))
+			if err != nil {
+				fatalf(t, ctx, "syntax error in test: %v: %v", p, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(p, "encoding=") {
+			options.Encoding = strings.TrimPrefix(p, "encoding=")
+			continue
+		}
+		if strings.HasPrefix(p, "max_line_bytes=") {
+			options.MaxLineBytes, err = strconv.Atoi(strings.TrimPrefix(p, "max_line_bytes="))
+			if err != nil {
+				fatalf(t, ctx, "syntax error in test: %v: %v", p, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(p, "exclude=") {
+			excludes = append(excludes, strings.TrimPrefix(p, "exclude="))
+			continue
+		}
 		switch p {
 		case "readall=true":
 			readall = true
 		case "readall=false":
 			readall = false
+		case "oversized_lines=drop":
+			options.DropOversizedLines = true
 		case "fail_on_missing_logfile=true":
 			failOnMissingFile = true
 		case "fail_on_missing_logfile=false":
@@ -624,11 +1071,19 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 		}
 		parsedGlobs = append(parsedGlobs, parsedGlob)
 	}
-	if ctx.tailerCfg == fseventTailer {
-		tailer, err = fswatcher.RunFileTailer(parsedGlobs, readall, failOnMissingFile, ctx.log)
-	} else {
-		tailer, err = fswatcher.RunPollingFileTailer(parsedGlobs, readall, failOnMissingFile, 10*time.Millisecond, ctx.log)
+	for _, g := range excludes {
+		parsedGlob, err := glob.Parse(filepath.Join(ctx.basedir, g))
+		if err != nil {
+			fatalf(t, ctx, "%v", err)
+		}
+		options.ExcludeGlobs = append(options.ExcludeGlobs, parsedGlob)
 	}
+	if ctx.tailerCfg == pollingTailer {
+		options.PollInterval = 10 * time.Millisecond
+	}
+	ctx.metrics = &countingMetrics{}
+	options.Metrics = ctx.metrics
+	tailer, err = fswatcher.RunFileTailerWithOptions(parsedGlobs, readall, failOnMissingFile, options, ctx.log)
 	if err != nil {
 		fatalf(t, ctx, "%v", err)
 	}
@@ -647,6 +1102,29 @@ func expect(t *testing.T, ctx *context, line string, file string) {
 	}
 }
 
+// Lines from other files are buffered in linesFromTailer, so lines that were read before the last expected line are found.
+func expectNoLines(t *testing.T, ctx *context, file string) {
+	if lines := ctx.linesFromTailer.buf[filepath.Join(ctx.basedir, file)]; len(lines) > 0 {
+		fatalf(t, ctx, "%v: expected no lines but got %q", file, lines)
+	}
+}
+
+// Like expect(), but also checks that no lines from other files were read before.
+func expectNext(t *testing.T, ctx *context, line string, file string) {
+	for bufferedFile, lines := range ctx.linesFromTailer.buf {
+		if len(lines) > 0 {
+			fatalf(t, ctx, "%v: expected line %q but got line %q from %v", file, line, lines[0], bufferedFile)
+		}
+	}
+	expect(t, ctx, line, file)
+}
+
+func expectCount(t *testing.T, ctx *context, name string, counter *int64, expected string) {
+	if actual := strconv.FormatInt(atomic.LoadInt64(counter), 10); actual != expected {
+		fatalf(t, ctx, "expected %v %v but got %v", expected, name, actual)
+	}
+}
+
 func fatalf(t *testing.T, ctx *context, format string, args ...interface{}) {
 	ctx.log.Errorf(format, args...) // Don't use ctx.log.Fatalf() here because this calls logger.Exit()
 	t.Fatalf(format, args...)
@@ -848,11 +1326,11 @@ func deleteRecursively(t *testing.T, ctx *context, file string) {
 		}
 	}
 	ctx.log.Debugf("tearDown: removing %q", file)
-	delete(t, ctx, file)
+	removeFile(t, ctx, file)
 }
 
 // Verbose implementation of os.Remove() to debug a Windows "Access is denied" issue.
-func delete(t *testing.T, ctx *context, file string) {
+func removeFile(t *testing.T, ctx *context, file string) {
 	var (
 		err, statErr error
 		timeout      = 5 * time.Second
@@ -1007,6 +1485,7 @@ func (l *linesFromTailer) nextLine(file string, timeout time.Duration) (string,
 		for {
 			select {
 			case line := <-l.tailer.Lines():
+				line.Processed()
 				if line.File == file {
 					return line.Line, nil
 				} else {
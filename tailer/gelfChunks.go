@@ -0,0 +1,161 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GELF messages that don't fit into a UDP datagram are split into chunks, see "GELF via UDP" in the Graylog documentation:
+//
+//	2 bytes magic 0x1e 0x0f, 8 bytes message id, 1 byte sequence number, 1 byte sequence count, payload
+const (
+	gelfChunkHeaderSize = 12
+	maxGelfChunks       = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// Maximum size of the chunks waiting for the remaining chunks of their message, so that clients
+// sending incomplete messages cannot make grok_exporter run out of memory.
+const maxGelfPendingBytes = 64 * 1024 * 1024
+
+// Maximum number of incomplete messages. Each message allocates a slice for its chunks, even if the chunks are empty.
+// If the limit is reached, the oldest incomplete message is dropped.
+const maxGelfPendingMessages = 1024
+
+// Returned when a message cannot be reassembled, because chunks were missing or had to be discarded.
+var errGelfIncomplete = errors.New("incomplete chunked message")
+
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	nReceived int
+	nBytes    int
+	firstSeen time.Time
+	discarded bool          // chunks were discarded because maxGelfPendingBytes was exceeded
+	element   *list.Element // position in gelfChunkAssembler.order
+}
+
+type gelfChunkAssembler struct {
+	mutex    sync.Mutex
+	timeout  time.Duration
+	messages map[string]*gelfChunkedMessage // by message id
+	nBytes   int                            // total size of the pending chunks
+	order    *list.List                     // message ids, oldest first
+}
+
+func newGelfChunkAssembler(timeout time.Duration) *gelfChunkAssembler {
+	return &gelfChunkAssembler{
+		timeout:  timeout,
+		messages: make(map[string]*gelfChunkedMessage),
+		order:    list.New(),
+	}
+}
+
+func isGelfChunk(datagram []byte) bool {
+	return bytes.HasPrefix(datagram, gelfChunkMagic)
+}
+
+// Adds a chunk, and returns the reassembled payload if this was the last missing chunk of the message.
+// Returns nil if chunks are still missing. The chunk is copied, so the caller may re-use the datagram.
+// evicted is true if the oldest incomplete message was dropped to make room for a new message, see maxGelfPendingMessages.
+func (a *gelfChunkAssembler) add(datagram []byte, now time.Time) (payload []byte, evicted bool, err error) {
+	if len(datagram) < gelfChunkHeaderSize {
+		return nil, false, errors.New("invalid GELF chunk: header too short")
+	}
+	id := string(datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxGelfChunks || seq >= count {
+		return nil, false, fmt.Errorf("invalid GELF chunk: sequence number %v of %v", seq, count)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	msg, exists := a.messages[id]
+	if !exists {
+		if len(a.messages) >= maxGelfPendingMessages {
+			oldest := a.order.Front().Value.(string)
+			a.remove(oldest, a.messages[oldest])
+			evicted = true
+		}
+		msg = &gelfChunkedMessage{chunks: make([][]byte, count), firstSeen: now}
+		msg.element = a.order.PushBack(id)
+		a.messages[id] = msg
+	}
+	if len(msg.chunks) != count {
+		return nil, evicted, fmt.Errorf("invalid GELF chunk: sequence count %v, but previous chunks had %v", count, len(msg.chunks))
+	}
+	if msg.chunks[seq] != nil {
+		return nil, evicted, nil // duplicate
+	}
+	chunk := datagram[gelfChunkHeaderSize:]
+	msg.nReceived++
+	if msg.discarded || a.nBytes+len(chunk) > maxGelfPendingBytes {
+		// The chunks are not stored, but they are still counted, so that the message is removed when its last chunk arrives.
+		if !msg.discarded {
+			msg.discarded = true
+			for i := range msg.chunks {
+				if msg.chunks[i] != nil {
+					msg.chunks[i] = []byte{}
+				}
+			}
+			a.nBytes -= msg.nBytes
+			msg.nBytes = 0
+		}
+		msg.chunks[seq] = []byte{}
+	} else {
+		msg.chunks[seq] = append([]byte{}, chunk...) // not nil for empty chunks, because nil marks missing chunks
+		msg.nBytes += len(chunk)
+		a.nBytes += len(chunk)
+	}
+	if msg.nReceived < count {
+		return nil, evicted, nil
+	}
+	a.remove(id, msg)
+	if msg.discarded {
+		return nil, evicted, errGelfIncomplete
+	}
+	return bytes.Join(msg.chunks, nil), evicted, nil
+}
+
+// Removes the messages that were not completed within the timeout, and returns how many were removed.
+func (a *gelfChunkAssembler) expire(now time.Time) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	nExpired := 0
+	for id, msg := range a.messages {
+		if now.Sub(msg.firstSeen) >= a.timeout {
+			a.remove(id, msg)
+			nExpired++
+		}
+	}
+	return nExpired
+}
+
+func (a *gelfChunkAssembler) setTimeout(timeout time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.timeout = timeout
+}
+
+func (a *gelfChunkAssembler) remove(id string, msg *gelfChunkedMessage) {
+	delete(a.messages, id)
+	a.order.Remove(msg.element)
+	a.nBytes -= msg.nBytes
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum size of a GELF message after reassembly and decompression. A chunked message has at most 128 UDP datagrams.
+const maxGelfMessageSize = maxGelfChunks * 64 * 1024
+
+// Incomplete chunked messages are removed when they are older than gelf_chunk_timeout. This is how often we check.
+const gelfChunkExpiryInterval = time.Second
+
+// Reasons for dropping a GELF message, used as label values for the dropped messages metric.
+const (
+	GelfDroppedIncomplete = "incomplete" // chunks were missing after gelf_chunk_timeout
+	GelfDroppedInvalid    = "invalid"    // the message could not be decompressed or parsed, or it has no message field
+)
+
+var GelfDropReasons = []string{GelfDroppedIncomplete, GelfDroppedInvalid}
+
+// GelfMetrics is implemented by the caller to count dropped GELF messages for self-monitoring.
+type GelfMetrics interface {
+	GelfMessageDropped(reason string) // reason is one of GelfDropReasons
+}
+
+type gelfTailer struct {
+	*listenerTailer
+	udpConn      net.PacketConn
+	tcpLn        net.Listener
+	chunks       *gelfChunkAssembler
+	mutex        sync.Mutex // protects messageField and metrics, which may change when the configuration is reloaded
+	messageField string
+	metrics      GelfMetrics
+}
+
+// There is one GELF tailer per combination of UDP and TCP address, see listenerTailer.
+var gelfTailers = make(map[string]*sharedTailer)
+
+func RunGelfTailer(cfg *configuration.InputConfig, metrics GelfMetrics) (fswatcher.FileTailer, error) {
+	shared, err := runSharedListener(gelfTailers, gelfTailerKey(cfg.GelfUdpAddress, cfg.GelfTcpAddress), func() (fswatcher.FileTailer, error) {
+		return runGelfTailer(cfg.GelfUdpAddress, cfg.GelfTcpAddress, cfg.GelfMessageField, cfg.GelfChunkTimeout, metrics)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := shared.tailer.(*gelfTailer)
+	return shared.newRef(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.messageField = cfg.GelfMessageField
+		t.metrics = metrics
+		t.chunks.setTimeout(cfg.GelfChunkTimeout)
+	}), nil
+}
+
+func gelfTailerKey(udpAddress, tcpAddress string) string {
+	return udpAddress + " " + tcpAddress
+}
+
+func runGelfTailer(udpAddress, tcpAddress, messageField string, chunkTimeout time.Duration, metrics GelfMetrics) (*gelfTailer, error) {
+	var err error
+	t := &gelfTailer{
+		listenerTailer: newListenerTailer(gelfTailers, gelfTailerKey(udpAddress, tcpAddress)),
+		chunks:         newGelfChunkAssembler(chunkTimeout),
+		messageField:   messageField,
+		metrics:        metrics,
+	}
+	if len(udpAddress) > 0 {
+		t.udpConn, err = net.ListenPacket("udp", udpAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for GELF messages on UDP address %v: %v", udpAddress, err)
+		}
+		t.addListener(t.udpConn)
+	}
+	if len(tcpAddress) > 0 {
+		t.tcpLn, err = net.Listen("tcp", tcpAddress)
+		if err != nil {
+			t.stop()
+			return nil, fmt.Errorf("failed to listen for GELF messages on TCP address %v: %v", tcpAddress, err)
+		}
+		t.addListener(t.tcpLn)
+	}
+	if t.udpConn != nil {
+		go t.readUdp()
+		go t.expireChunks()
+	}
+	if t.tcpLn != nil {
+		go t.accept(t.tcpLn, "GELF", t.readTcp)
+	}
+	return t, nil
+}
+
+// Each UDP datagram contains a message, which may be compressed, or a chunk of a message.
+func (t *gelfTailer) readUdp() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := t.udpConn.ReadFrom(buf)
+		if err != nil {
+			if isTemporary(err) {
+				continue
+			}
+			t.sendError(fswatcher.NewErrorf(fswatcher.NotSpecified, err, "failed to read GELF message from %v", t.udpConn.LocalAddr()))
+			return
+		}
+		payload := buf[:n]
+		if isGelfChunk(payload) {
+			var evicted bool
+			payload, evicted, err = t.chunks.add(payload, time.Now())
+			if evicted {
+				t.drop(errGelfIncomplete)
+			}
+			if err != nil {
+				t.drop(err)
+				continue
+			}
+			if payload == nil {
+				continue // waiting for more chunks
+			}
+		}
+		t.process(payload)
+	}
+}
+
+func (t *gelfTailer) expireChunks() {
+	ticker := time.NewTicker(gelfChunkExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for i := t.chunks.expire(now); i > 0; i-- {
+				t.drop(errGelfIncomplete)
+			}
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+// Messages on a TCP connection are uncompressed and terminated by a null byte.
+// Errors on a single connection are logged, because they should not terminate grok_exporter.
+func (t *gelfTailer) readTcp(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readGelfFrame(reader)
+		if err != nil {
+			if err != io.EOF && !isStopped(t.stopped) {
+				logrus.Warnf("closing GELF connection from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(bytes.TrimSpace(msg)) > 0 {
+			t.process(msg)
+		}
+	}
+}
+
+func readGelfFrame(reader *bufio.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		fragment, err := reader.ReadSlice(0)
+		if len(msg)+len(fragment) > maxGelfMessageSize+1 {
+			return nil, fmt.Errorf("message larger than %v bytes", maxGelfMessageSize)
+		}
+		msg = append(msg, fragment...)
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(msg) > 0:
+			return msg, nil // last message without trailing null byte
+		case err != nil:
+			return nil, err
+		default:
+			return msg[:len(msg)-1], nil
+		}
+	}
+}
+
+// The message field is the log line, the other fields are the extra fields.
+func (t *gelfTailer) process(payload []byte) {
+	t.mutex.Lock()
+	messageField := t.messageField
+	t.mutex.Unlock()
+	line, extra, err := parseGelfMessage(payload, messageField)
+	if err != nil {
+		t.drop(err)
+		return
+	}
+	t.sendLine(&fswatcher.Line{Line: line, Extra: extra})
+}
+
+func (t *gelfTailer) drop(err error) {
+	reason := GelfDroppedInvalid
+	if errors.Is(err, errGelfIncomplete) {
+		reason = GelfDroppedIncomplete
+	}
+	logrus.Warnf("dropping GELF message: %v", err)
+	t.mutex.Lock()
+	metrics := t.metrics
+	t.mutex.Unlock()
+	metrics.GelfMessageDropped(reason)
+}
+
+func parseGelfMessage(payload []byte, messageField string) (string, map[string]interface{}, error) {
+	decompressed, err := decompressGelfPayload(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(decompressed))
+	decoder.UseNumber() // keep timestamps like 1385053862.3072 as they are
+	if err = decoder.Decode(&fields); err != nil {
+		return "", nil, fmt.Errorf("invalid GELF message: %v", err)
+	}
+	value, ok := fields[messageField]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid GELF message: field %q is missing", messageField)
+	}
+	line, ok := value.(string)
+	if !ok {
+		line = fmt.Sprintf("%v", value)
+	}
+	delete(fields, messageField)
+	return line, fields, nil
+}
+
+// Messages sent via UDP may be gzip or zlib compressed, which is detected by the first bytes.
+func decompressGelfPayload(payload []byte) ([]byte, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+	switch {
+	case bytes.HasPrefix(payload, []byte{0x1f, 0x8b}):
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 8 && (uint(payload[0])<<8|uint(payload[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid GELF message: failed to decompress: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxGelfMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GELF message: failed to decompress: %v", err)
+	}
+	if len(decompressed) > maxGelfMessageSize {
+		return nil, fmt.Errorf("invalid GELF message: decompressed message is larger than %v bytes", maxGelfMessageSize)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+)
+
+const gelfTestMessage = `{"version": "1.1", "host": "example.org", "short_message": "A short message", "full_message": "Backtrace here\n\nmore stuff", "timestamp": 1385053862.3072, "level": 1, "_user_id": 9001, "_some_info": "foo"}`
+
+const gelfTestExtra = "map[_some_info:foo _user_id:9001 full_message:Backtrace here\n\nmore stuff host:example.org level:1 timestamp:1385053862.3072 version:1.1]"
+
+type gelfDrops struct {
+	mutex   sync.Mutex
+	reasons []string
+}
+
+func (d *gelfDrops) GelfMessageDropped(reason string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.reasons = append(d.reasons, reason)
+}
+
+func (d *gelfDrops) String() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return fmt.Sprintf("%v", d.reasons)
+}
+
+func TestGelfTailer(t *testing.T) {
+	drops := &gelfDrops{}
+	tail, err := runGelfTailer("127.0.0.1:0", "127.0.0.1:0", "short_message", time.Minute, drops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.stop()
+
+	udpConn, err := net.Dial("udp", tail.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(gelfTestMessage))
+	gz.Close()
+	for _, datagram := range [][]byte{[]byte(gelfTestMessage), gzipped.Bytes()} {
+		writeGelf(t, udpConn, datagram)
+		expectLineWithExtra(t, tail, "A short message", gelfTestExtra)
+	}
+
+	// zlib compressed message in three chunks, sent out of order
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write([]byte(`{"version": "1.1", "host": "example.org", "short_message": "chunked message"}`))
+	zw.Close()
+	chunks := gelfChunks("msgid001", zlibbed.Bytes(), 3)
+	for _, i := range []int{2, 0, 0, 1} { // the duplicate is ignored
+		writeGelf(t, udpConn, chunks[i])
+	}
+	expectLineWithExtra(t, tail, "chunked message", "map[host:example.org version:1.1]")
+
+	tcpConn, err := net.Dial("tcp", tail.tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	writeGelf(t, tcpConn, []byte(gelfTestMessage+"\x00"+`{"short_message": "second message", "_tag": "tcp"}`+"\x00"))
+	expectLineWithExtra(t, tail, "A short message", gelfTestExtra)
+	expectLineWithExtra(t, tail, "second message", "map[_tag:tcp]")
+
+	writeGelf(t, udpConn, []byte(`{"host": "no short message"}`))
+	writeGelf(t, udpConn, []byte(`not json`))
+	writeGelf(t, udpConn, []byte(`{"short_message": "after the invalid messages"}`))
+	expectLineWithExtra(t, tail, "after the invalid messages", "map[]")
+	if drops.String() != "[invalid invalid]" {
+		t.Fatalf("expected two invalid messages, but got %v", drops)
+	}
+}
+
+func TestGelfMessageField(t *testing.T) {
+	line, extra, err := parseGelfMessage([]byte(gelfTestMessage), "full_message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "Backtrace here\n\nmore stuff" || fmt.Sprintf("%v", extra["short_message"]) != "A short message" {
+		t.Fatalf("unexpected line %q with extra %v", line, extra)
+	}
+	line, _, err = parseGelfMessage([]byte(gelfTestMessage), "_user_id")
+	if err != nil || line != "9001" {
+		t.Fatalf("expected line \"9001\", but got %q: %v", line, err)
+	}
+}
+
+func TestGelfChunkAssembler(t *testing.T) {
+	assembler := newGelfChunkAssembler(5 * time.Second)
+	start := time.Unix(1600000000, 0)
+
+	a := gelfChunks("message1", []byte("abcdef"), 2)
+	b := gelfChunks("message2", []byte("ghijkl"), 2)
+	for _, chunk := range [][]byte{a[1], b[0]} {
+		if payload, _, err := assembler.add(chunk, start); payload != nil || err != nil {
+			t.Fatalf("expected no payload, but got %q: %v", payload, err)
+		}
+	}
+	if payload, _, err := assembler.add(a[0], start.Add(time.Second)); string(payload) != "abcdef" || err != nil {
+		t.Fatalf("expected \"abcdef\", but got %q: %v", payload, err)
+	}
+	if n := assembler.expire(start.Add(4 * time.Second)); n != 0 {
+		t.Fatalf("expected no expired messages, but got %v", n)
+	}
+	if n := assembler.expire(start.Add(5 * time.Second)); n != 1 {
+		t.Fatalf("expected one expired message, but got %v", n)
+	}
+	if assembler.nBytes != 0 || len(assembler.messages) != 0 {
+		t.Fatalf("expected no pending chunks, but got %v messages with %v bytes", len(assembler.messages), assembler.nBytes)
+	}
+	// the second chunk of the expired message starts a new incomplete message
+	if payload, _, err := assembler.add(b[1], start.Add(6*time.Second)); payload != nil || err != nil {
+		t.Fatalf("expected no payload, but got %q: %v", payload, err)
+	}
+
+	// repeated empty chunks are duplicates, they don't complete the message
+	empty := []byte("\x1e\x0fmessage4\x00\x03")
+	for _, chunk := range [][]byte{empty, empty, empty, []byte("\x1e\x0fmessage4\x01\x03ab")} {
+		if payload, _, err := assembler.add(chunk, start); payload != nil || err != nil {
+			t.Fatalf("expected no payload, but got %q: %v", payload, err)
+		}
+	}
+	if payload, _, err := assembler.add([]byte("\x1e\x0fmessage4\x02\x03cd"), start); string(payload) != "abcd" || err != nil {
+		t.Fatalf("expected \"abcd\", but got %q: %v", payload, err)
+	}
+
+	for _, invalid := range [][]byte{
+		[]byte("\x1e\x0fmessage3"),                  // header too short
+		[]byte("\x1e\x0fmessage3\x00\x00"),          // sequence count 0
+		[]byte("\x1e\x0fmessage3\x02\x02"),          // sequence number too large
+		[]byte("\x1e\x0fmessage3\x00\x81"),          // more than 128 chunks
+		gelfChunks("message2", []byte("abc"), 3)[0], // sequence count differs from previous chunk
+	} {
+		if _, _, err := assembler.add(invalid, start); err == nil {
+			t.Fatalf("%q: expected error", invalid)
+		}
+	}
+}
+
+func TestGelfPendingBytesLimit(t *testing.T) {
+	assembler := newGelfChunkAssembler(5 * time.Second)
+	now := time.Now()
+	payload := make([]byte, 96*1024)
+	nBytes := 0
+	// fill the buffer with incomplete messages
+	for i := 0; nBytes+len(payload) <= maxGelfPendingBytes; i++ {
+		chunks := gelfChunks(fmt.Sprintf("%08d", i), append(payload, payload...), 2)
+		if _, _, err := assembler.add(chunks[0], now); err != nil {
+			t.Fatal(err)
+		}
+		nBytes += len(payload)
+	}
+	discarded := gelfChunks("discard1", append(payload, payload...), 2)
+	for i, chunk := range discarded {
+		result, _, err := assembler.add(chunk, now)
+		if i == 0 && (result != nil || err != nil) {
+			t.Fatalf("expected no payload, but got %v bytes: %v", len(result), err)
+		}
+		if i == 1 && err != errGelfIncomplete {
+			t.Fatalf("expected %v, but got %v", errGelfIncomplete, err)
+		}
+	}
+	if assembler.nBytes != nBytes {
+		t.Fatalf("expected %v pending bytes, but got %v", nBytes, assembler.nBytes)
+	}
+	// expired messages free their chunks
+	assembler.expire(now.Add(5 * time.Second))
+	chunks := gelfChunks("message1", append(payload, payload...), 2)
+	for i, chunk := range chunks {
+		result, _, err := assembler.add(chunk, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && len(result) != 2*len(payload) {
+			t.Fatalf("expected %v bytes, but got %v", 2*len(payload), len(result))
+		}
+	}
+	if assembler.nBytes != 0 {
+		t.Fatalf("expected no pending bytes, but got %v", assembler.nBytes)
+	}
+}
+
+func TestGelfPendingMessagesLimit(t *testing.T) {
+	assembler := newGelfChunkAssembler(5 * time.Second)
+	now := time.Now()
+	for i := 0; i <= maxGelfPendingMessages; i++ {
+		chunks := gelfChunks(fmt.Sprintf("%08d", i), []byte("abcdef"), 2)
+		_, evicted, err := assembler.add(chunks[0], now.Add(time.Duration(i)*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evicted != (i == maxGelfPendingMessages) {
+			t.Fatalf("message %v: expected evicted to be %v, but got %v", i, i == maxGelfPendingMessages, evicted)
+		}
+	}
+	if len(assembler.messages) != maxGelfPendingMessages || assembler.order.Len() != maxGelfPendingMessages {
+		t.Fatalf("expected %v pending messages, but got %v", maxGelfPendingMessages, len(assembler.messages))
+	}
+	// the oldest message was dropped, so its last chunk starts a new message, which drops the next oldest message
+	if payload, _, err := assembler.add(gelfChunks("00000000", []byte("abcdef"), 2)[1], now); payload != nil || err != nil {
+		t.Fatalf("expected no payload, but got %q: %v", payload, err)
+	}
+	// the following messages can still be completed
+	if payload, _, err := assembler.add(gelfChunks("00000002", []byte("abcdef"), 2)[1], now); string(payload) != "abcdef" || err != nil {
+		t.Fatalf("expected \"abcdef\", but got %q: %v", payload, err)
+	}
+}
+
+// Splits the payload into n chunks with the given 8 byte message id.
+func gelfChunks(id string, payload []byte, n int) [][]byte {
+	var result [][]byte
+	size := (len(payload) + n - 1) / n
+	for i := 0; i < n; i++ {
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(i), byte(n))
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		result = append(result, append(chunk, payload[i*size:end]...))
+	}
+	return result
+}
+
+// The listeners are closed when the last input using them is closed.
+func TestGelfTailerClose(t *testing.T) {
+	cfg := &configuration.InputConfig{
+		Type:             "gelf",
+		GelfTcpAddress:   "127.0.0.1:0",
+		GelfMessageField: "short_message",
+		GelfChunkTimeout: time.Minute,
+	}
+	oldTail, err := RunGelfTailer(cfg, &gelfDrops{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTail, err := RunGelfTailer(cfg, &gelfDrops{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := gelfTailers[" 127.0.0.1:0"].tailer.(*gelfTailer).tcpLn.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	activate(newTail)
+	oldTail.Close()
+	writeGelf(t, conn, append([]byte(gelfTestMessage), 0))
+	expectLineWithExtra(t, newTail, "A short message", gelfTestExtra)
+
+	newTail.Close()
+	if len(gelfTailers) != 0 {
+		t.Fatalf("expected the GELF tailer to be removed, but got %v", gelfTailers)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+	if conn, err = net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatalf("expected the listener to be closed")
+	}
+}
+
+func writeGelf(t *testing.T, conn net.Conn, b []byte) {
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -18,10 +18,16 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
+// A Glob is an absolute path pattern. Wildcards may be used in the file name and in directory names,
+// and "**" as a directory name matches zero or more directories, like in /var/log/**/*.log
 type Glob string
 
+// The directory name "**" matches zero or more directories.
+const recursiveWildcard = "**"
+
 func Parse(pattern string) (Glob, error) {
 	var (
 		result  Glob
@@ -36,8 +42,13 @@ func Parse(pattern string) (Glob, error) {
 		return "", fmt.Errorf("%q: failed to find absolute path for glob pattern: %v", pattern, err)
 	}
 	result = Glob(absglob)
-	if containsWildcards(result.Dir()) {
-		return "", fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", pattern)
+	for _, element := range result.elements() {
+		if element != recursiveWildcard && strings.Contains(element, recursiveWildcard) {
+			return "", fmt.Errorf("%q: '**' must be a complete directory name, like in /var/log/**/*.log", pattern)
+		}
+	}
+	if result.elements()[len(result.elements())-1] == recursiveWildcard {
+		return "", fmt.Errorf("%q: '**' matches directories, it must be followed by a file name pattern, like in /var/log/**/*.log", pattern)
 	}
 	return result, nil
 }
@@ -46,9 +57,47 @@ func (g Glob) Dir() string {
 	return filepath.Dir(string(g))
 }
 
+// The longest directory path without wildcards. All matching files are in this directory or its subdirectories.
+// If the file name is the only part of the glob containing wildcards, BaseDir() is the same as Dir().
+func (g Glob) BaseDir() string {
+	result := g.Dir()
+	for containsWildcards(result) {
+		result = filepath.Dir(result)
+	}
+	return result
+}
+
 func (g Glob) Match(path string) bool {
-	matched, _ := filepath.Match(string(g), path)
-	return matched
+	return matchElements(g.elements(), splitPath(path), false)
+}
+
+// MatchDir is true if files in dir or in one of its subdirectories may match the glob.
+func (g Glob) MatchDir(dir string) bool {
+	dirElements := g.elements()
+	return matchElements(dirElements[:len(dirElements)-1], splitPath(dir), true)
+}
+
+func (g Glob) elements() []string {
+	return splitPath(string(g))
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.Clean(path), string(filepath.Separator))
+}
+
+// If prefixOnly is true, the path elements may match only the beginning of the pattern elements.
+func matchElements(pattern, path []string, prefixOnly bool) bool {
+	if len(path) == 0 {
+		return len(pattern) == 0 || prefixOnly
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == recursiveWildcard {
+		return matchElements(pattern[1:], path, prefixOnly) || matchElements(pattern, path[1:], prefixOnly)
+	}
+	matched, _ := filepath.Match(pattern[0], path[0])
+	return matched && matchElements(pattern[1:], path[1:], prefixOnly)
 }
 
 func containsWildcards(pattern string) bool {
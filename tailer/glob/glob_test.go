@@ -0,0 +1,108 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package glob
+
+import (
+	"runtime"
+	"testing"
+)
+
+type globTest struct {
+	pattern, path string
+	match         bool
+}
+
+var globTests = []globTest{
+	{"/var/log/*.log", "/var/log/syslog.log", true},
+	{"/var/log/*.log", "/var/log/nginx/access.log", false},
+	{"/var/log/apps/*/current.log", "/var/log/apps/app1/current.log", true},
+	{"/var/log/apps/*/current.log", "/var/log/apps/current.log", false},
+	{"/var/log/apps/*/current.log", "/var/log/apps/app1/sub/current.log", false},
+	{"/var/log/**/*.log", "/var/log/syslog.log", true},
+	{"/var/log/**/*.log", "/var/log/nginx/access.log", true},
+	{"/var/log/**/*.log", "/var/log/a/b/c/test.log", true},
+	{"/var/log/**/*.log", "/var/log/a/b/c/test.txt", false},
+	{"/var/log/**/nginx/*.log", "/var/log/nginx/access.log", true},
+	{"/var/log/**/nginx/*.log", "/var/log/web/nginx/access.log", true},
+	{"/var/log/**/nginx/*.log", "/var/log/web/apache/access.log", false},
+}
+
+type globDirTest struct {
+	pattern, dir string
+	match        bool
+}
+
+var globDirTests = []globDirTest{
+	{"/var/log/*.log", "/var/log", true},
+	{"/var/log/*.log", "/var/log/nginx", false},
+	{"/var/log/apps/*/current.log", "/var/log/apps", true},
+	{"/var/log/apps/*/current.log", "/var/log/apps/app1", true},
+	{"/var/log/apps/*/current.log", "/var/log/apps/app1/sub", false},
+	{"/var/log/**/nginx/*.log", "/var/log/a/b/c", true},
+	{"/var/log/[ab]*/*.log", "/var/log/cd", false},
+}
+
+func TestMatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test paths are unix paths")
+	}
+	for _, test := range globTests {
+		g, err := Parse(test.pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.pattern, err)
+		}
+		if g.Match(test.path) != test.match {
+			t.Errorf("Glob(%#q).Match(%#q) should be %t", test.pattern, test.path, test.match)
+		}
+	}
+	for _, test := range globDirTests {
+		g, err := Parse(test.pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.pattern, err)
+		}
+		if g.MatchDir(test.dir) != test.match {
+			t.Errorf("Glob(%#q).MatchDir(%#q) should be %t", test.pattern, test.dir, test.match)
+		}
+	}
+}
+
+func TestBaseDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test paths are unix paths")
+	}
+	for pattern, expected := range map[string]string{
+		"/var/log/*.log":              "/var/log",
+		"/var/log/apps/*/current.log": "/var/log/apps",
+		"/var/log/**/*.log":           "/var/log",
+		"/var/*/apps/*/current.log":   "/var",
+	} {
+		g, err := Parse(pattern)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", pattern, err)
+		}
+		if g.BaseDir() != expected {
+			t.Errorf("Glob(%#q).BaseDir() should be %q, but got %q", pattern, expected, g.BaseDir())
+		}
+	}
+}
+
+func TestInvalidRecursiveWildcard(t *testing.T) {
+	for _, pattern := range []string{"/var/log/a**/*.log", "/var/log/**"} {
+		_, err := Parse(pattern)
+		if err == nil {
+			t.Errorf("%v: expected error", pattern)
+		}
+	}
+}
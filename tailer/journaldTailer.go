@@ -0,0 +1,289 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	journaldCursorSyncInterval = 1 * time.Second
+	maxJournalFieldSize        = 64 * 1024 * 1024 // sanity check for binary fields in the export format
+)
+
+// The journald tailer reads the output of 'journalctl -o export' or 'journalctl -o json' from stdin.
+// The MESSAGE field is the log line, all fields of the journal entry are available as extra fields.
+type journaldTailer struct {
+	lines      chan *fswatcher.Line
+	errors     chan fswatcher.Error
+	cursorFile string
+	cursor     fswatcher.Cursor // cursor of the last processed entry, see fswatcher.Line.Processed()
+	lock       sync.Mutex
+	written    string // cursor that was last written to the cursor file
+}
+
+var journaldTailerSingleton *sharedTailer
+
+func (t *journaldTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *journaldTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+// The go-routine reading stdin cannot be stopped, see stdinTailer. However, the cursor is written,
+// so that 'journalctl --after-cursor' can resume where we stopped when grok_exporter is restarted.
+func (t *journaldTailer) Close() {
+	err := t.writeCursor()
+	if err != nil {
+		logrus.Warn(err)
+	}
+}
+
+func RunJournaldTailer(cfg *configuration.InputConfig) fswatcher.FileTailer {
+	// There is only one stdin, see RunStdinTailer().
+	if journaldTailerSingleton == nil {
+		journaldTailerSingleton = newSharedTailer(runJournaldTailer(os.Stdin, cfg.JournaldFormat, cfg.JournaldCursorFile))
+	}
+	return journaldTailerSingleton.newRef(nil)
+}
+
+func runJournaldTailer(in io.Reader, format, cursorFile string) *journaldTailer {
+	t := &journaldTailer{
+		lines:      make(chan *fswatcher.Line),
+		errors:     make(chan fswatcher.Error),
+		cursorFile: cursorFile,
+	}
+	readEntry := readJournalExportEntry
+	if format == "json" {
+		readEntry = readJournalJsonEntry
+	}
+	done := make(chan struct{})
+	if len(cursorFile) > 0 {
+		// The cursor is written independently of reading, because it changes when entries are processed.
+		go func() {
+			ticker := time.NewTicker(journaldCursorSyncInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if writeErr := t.writeCursor(); writeErr != nil {
+						logrus.Warn(writeErr)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		reader := bufio.NewReader(in)
+		for {
+			fields, err := readEntry(reader)
+			if err != nil {
+				close(done)
+				if writeErr := t.writeCursor(); writeErr != nil {
+					logrus.Warn(writeErr)
+				}
+				t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "failed to read journal entry")
+				return
+			}
+			if fields == nil {
+				continue // invalid entry, already logged
+			}
+			line := &fswatcher.Line{Line: journalMessage(fields), Extra: fields}
+			if cursor, ok := fields["__CURSOR"].(string); ok {
+				line.Position = fswatcher.NewCursorPosition(&t.cursor, cursor)
+			}
+			t.lines <- line
+		}
+	}()
+	return t
+}
+
+// The cursor file contains nothing but the cursor, so it can be used as: journalctl --after-cursor="$(cat cursor_file)"
+// It is replaced atomically, so it is never left in an inconsistent state if grok_exporter is killed.
+func (t *journaldTailer) writeCursor() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cursor := t.cursor.Load()
+	if len(t.cursorFile) == 0 || cursor == t.written {
+		return nil
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(t.cursorFile), filepath.Base(t.cursorFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%v: failed to write cursor file: %v", t.cursorFile, err)
+	}
+	_, err = tmpFile.WriteString(cursor + "\n")
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), t.cursorFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("%v: failed to write cursor file: %v", t.cursorFile, err)
+	}
+	t.written = cursor
+	return nil
+}
+
+// In the export format, each field is either "NAME=value\n", or for values that are not printable text,
+// "NAME\n" followed by the length as 64 bit little endian integer, the binary value, and "\n".
+// Entries are separated by an empty line. See https://systemd.io/JOURNAL_EXPORT_FORMATS/
+func readJournalExportEntry(reader *bufio.Reader) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil // last field without trailing newline
+		}
+		if err != nil {
+			if err == io.EOF && len(fields) > 0 {
+				return fields, nil // last entry without trailing empty line
+			}
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			if len(fields) == 0 {
+				continue
+			}
+			return fields, nil
+		}
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			addJournalField(fields, line[:eq], line[eq+1:])
+			continue
+		}
+		var size uint64
+		err = binary.Read(reader, binary.LittleEndian, &size)
+		if err != nil {
+			return nil, fmt.Errorf("field %v: failed to read length of binary value: %v", line, err)
+		}
+		if size > maxJournalFieldSize {
+			return nil, fmt.Errorf("field %v: binary value too large: %v bytes", line, size)
+		}
+		value := make([]byte, size+1)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return nil, fmt.Errorf("field %v: failed to read binary value: %v", line, err)
+		}
+		if value[size] != '\n' {
+			return nil, fmt.Errorf("field %v: binary value is not terminated by a newline", line)
+		}
+		addJournalField(fields, line, string(value[:size]))
+	}
+}
+
+// Fields occurring more than once are represented as a list of values, like with 'journalctl -o json'.
+func addJournalField(fields map[string]interface{}, name, value string) {
+	switch existing := fields[name].(type) {
+	case nil:
+		fields[name] = value
+	case []interface{}:
+		fields[name] = append(existing, value)
+	default:
+		fields[name] = []interface{}{existing, value}
+	}
+}
+
+// In the json format, each line is a JSON object. Values are strings, or arrays of numbers for values
+// that are not printable text, or arrays of these for fields occurring more than once.
+// Lines that are not valid JSON are logged and skipped, i.e. nil is returned without error.
+func readJournalJsonEntry(reader *bufio.Reader) (map[string]interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil // last line without trailing newline
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, nil
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal([]byte(line), &fields)
+	if err != nil {
+		logrus.Warnf("skipping invalid journal entry: %v: %v", err, line)
+		return nil, nil
+	}
+	for name, value := range fields {
+		fields[name] = normalizeJournalJsonValue(value)
+	}
+	return fields, nil
+}
+
+// Binary values are converted to strings, so that they can be used like text values in label templates.
+func normalizeJournalJsonValue(value interface{}) interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	if bytes, isBinary := journalJsonBytes(list); isBinary {
+		return string(bytes)
+	}
+	for i := range list {
+		list[i] = normalizeJournalJsonValue(list[i])
+	}
+	return list
+}
+
+func journalJsonBytes(list []interface{}) ([]byte, bool) {
+	result := make([]byte, 0, len(list))
+	for _, elem := range list {
+		n, ok := elem.(float64)
+		if !ok || n < 0 || n > 255 {
+			return nil, false
+		}
+		result = append(result, byte(n))
+	}
+	return result, true
+}
+
+// If MESSAGE occurs more than once, the first value is used.
+func journalMessage(fields map[string]interface{}) string {
+	switch msg := fields["MESSAGE"].(type) {
+	case string:
+		return msg
+	case []interface{}:
+		if len(msg) > 0 {
+			if s, ok := msg[0].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// output of 'journalctl -o export', the second entry has a binary MESSAGE and a field occurring twice.
+var journalExport = "__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8674e7a\n" +
+	"__REALTIME_TIMESTAMP=1342540861416351\n" +
+	"_SYSTEMD_UNIT=sshd.service\n" +
+	"_PID=4242\n" +
+	"PRIORITY=6\n" +
+	"MESSAGE=Accepted publickey for alice\n" +
+	"\n" +
+	"__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8;b=6c7c6013a8674e7a\n" +
+	"_SYSTEMD_UNIT=app.service\n" +
+	"TAG=a\n" +
+	"TAG=b\n" +
+	"MESSAGE\n" +
+	"\x0c\x00\x00\x00\x00\x00\x00\x00" + "first\nsecond" + "\n" +
+	"\n"
+
+var journalJson = `{"__CURSOR":"s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8674e7a","_SYSTEMD_UNIT":"sshd.service","_PID":"4242","PRIORITY":"6","MESSAGE":"Accepted publickey for alice"}
+this is not json
+{"__CURSOR":"s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8;b=6c7c6013a8674e7a","_SYSTEMD_UNIT":"app.service","TAG":["a","b"],"MESSAGE":[102,105,114,115,116,10,115,101,99,111,110,100]}
+`
+
+func TestJournaldTailer(t *testing.T) {
+	for format, input := range map[string]string{"export": journalExport, "json": journalJson} {
+		t.Run(format, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "grok_exporter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			cursorFile := filepath.Join(tmpDir, "journal.cursor")
+			tail := runJournaldTailer(strings.NewReader(input), format, cursorFile)
+			first := expectJournalEntry(t, tail, "Accepted publickey for alice", map[string]string{"_SYSTEMD_UNIT": "sshd.service", "_PID": "4242", "PRIORITY": "6"})
+			second := expectJournalEntry(t, tail, "first\nsecond", map[string]string{"_SYSTEMD_UNIT": "app.service"})
+			extra := second.Extra.(map[string]interface{})
+			if tags, ok := extra["TAG"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+				t.Fatalf("Expected TAG to be [a b], but got %v.", extra["TAG"])
+			}
+			select {
+			case err := <-tail.Errors():
+				if err.Cause() != io.EOF {
+					t.Fatalf("Expected EOF, but got %v.", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout while waiting for EOF.")
+			}
+			// The cursor file covers the processed entries, not the entries that were read.
+			first.Processed()
+			tail.Close()
+			expectCursorFile(t, cursorFile, "s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8674e7a\n")
+			second.Processed()
+			tail.Close()
+			expectCursorFile(t, cursorFile, "s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8;b=6c7c6013a8674e7a\n")
+		})
+	}
+}
+
+func expectJournalEntry(t *testing.T, tail *journaldTailer, expectedLine string, expectedFields map[string]string) *fswatcher.Line {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expectedLine {
+			t.Fatalf("Expected %q, but got %q.", expectedLine, line.Line)
+		}
+		extra := line.Extra.(map[string]interface{})
+		for name, expected := range expectedFields {
+			if extra[name] != expected {
+				t.Fatalf("Expected %v=%q, but got %q.", name, expected, extra[name])
+			}
+		}
+		return line
+	case err := <-tail.Errors():
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout while waiting for %q.", expectedLine)
+	}
+	return nil
+}
+
+func expectCursorFile(t *testing.T, cursorFile string, expected string) {
+	cursor, err := ioutil.ReadFile(cursorFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cursor) != expected {
+		t.Fatalf("Unexpected cursor file content: %q", cursor)
+	}
+}
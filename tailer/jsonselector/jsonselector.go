@@ -0,0 +1,84 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonselector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	json "github.com/bitly/go-simplejson"
+)
+
+// A Selector is a path to a value in a JSON object, like ".message" or ".messages[0].text".
+// It is used for the webhook_json_selector of the webhook input, and for the match_fields of metrics with format json.
+type Selector struct {
+	path     string
+	elements []element
+}
+
+type element struct {
+	name  string
+	index int // -1 if the element has no array index
+}
+
+func Parse(path string) (*Selector, error) {
+	if len(path) <= 1 || path[0] != '.' {
+		return nil, fmt.Errorf("%q: invalid json selector: must start with '.'", path)
+	}
+	result := &Selector{path: path}
+	for _, pathElement := range strings.Split(path[1:], ".") {
+		elem, err := parseElement(pathElement)
+		if err != nil {
+			return nil, fmt.Errorf("%q: invalid json selector: %v", path, err)
+		}
+		result.elements = append(result.elements, elem)
+	}
+	return result, nil
+}
+
+// pathElement is a string like "message" or "messages[0]".
+func parseElement(pathElement string) (element, error) {
+	if len(pathElement) == 0 {
+		return element{}, fmt.Errorf("empty path element")
+	}
+	if !strings.HasSuffix(pathElement, "]") {
+		return element{name: pathElement, index: -1}, nil
+	}
+	start := strings.LastIndexByte(pathElement, '[')
+	if start < 1 {
+		return element{}, fmt.Errorf("%q: path element ends with ']' but has no name and array index", pathElement)
+	}
+	index, err := strconv.Atoi(pathElement[start+1 : len(pathElement)-1])
+	if err != nil || index < 0 {
+		return element{}, fmt.Errorf("%q: path element ends with ']' but array index is invalid", pathElement)
+	}
+	return element{name: pathElement[:start], index: index}, nil
+}
+
+// Find returns the selected value. If the value does not exist, the result's Interface() is nil.
+func (s *Selector) Find(j *json.Json) *json.Json {
+	for _, elem := range s.elements {
+		j = j.Get(elem.name)
+		if elem.index >= 0 {
+			j = j.GetIndex(elem.index)
+		}
+	}
+	return j
+}
+
+func (s *Selector) String() string {
+	return s.path
+}
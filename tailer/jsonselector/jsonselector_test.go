@@ -0,0 +1,67 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonselector
+
+import (
+	"testing"
+
+	json "github.com/bitly/go-simplejson"
+)
+
+func TestFind(t *testing.T) {
+	j, err := json.NewJson([]byte(`{"message": "hello", "http": {"status": 500}, "messages": [{"text": "first"}, {"text": "second"}], "a": [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]interface{}{
+		".message":          "hello",
+		".http.status":      "500",
+		".messages[1].text": "second",
+		".a[12]":            "12",
+		".missing":          nil,
+		".http.missing":     nil,
+		".messages[2].text": nil,
+	} {
+		selector, err := Parse(path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		value := selector.Find(j).Interface()
+		if expected == nil && value != nil {
+			t.Fatalf("%v: expected nil, but got %v", path, value)
+		} else if expected != nil && (value == nil || expected != toString(value)) {
+			t.Fatalf("%v: expected %v, but got %v", path, expected, value)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, path := range []string{"", ".", "message", ".messages[x]", ".[0]", ".http..status"} {
+		_, err := Parse(path)
+		if err == nil {
+			t.Fatalf("%q: expected error, but got nil", path)
+		}
+	}
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case interface{ String() string }:
+		return v.String()
+	}
+	return ""
+}
@@ -5,7 +5,7 @@ import (
 	"sync"
 
 	"github.com/Shopify/sarama"
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/sirupsen/logrus"
 )
@@ -13,12 +13,15 @@ import (
 type KafkaTailer struct {
 	lines  chan *fswatcher.Line
 	errors chan fswatcher.Error
+	cancel ctx.CancelFunc
 }
 
 type consumer struct {
 	ready     chan bool
 	lineChan  chan *fswatcher.Line
 	errorChan chan fswatcher.Error
+	cfg       *configuration.InputConfig
+	metrics   fswatcher.Metrics
 }
 
 func (t KafkaTailer) Lines() chan *fswatcher.Line {
@@ -31,25 +34,28 @@ func (t KafkaTailer) Errors() chan fswatcher.Error {
 
 func (t KafkaTailer) Close() {
 	logrus.Info("Close method called")
-
+	t.cancel()
 }
 
 // RunKafkaTailer runs the kafka tailer
-func RunKafkaTailer(cfg *configuration.InputConfig) fswatcher.FileTailer {
+func RunKafkaTailer(cfg *configuration.InputConfig, metrics fswatcher.Metrics) fswatcher.FileTailer {
 	lineChan := make(chan *fswatcher.Line)
 	errorChan := make(chan fswatcher.Error)
 
+	ctx, cancel := ctx.WithCancel(ctx.Background())
+
 	tailer := &KafkaTailer{
 		lines:  lineChan,
 		errors: errorChan,
+		cancel: cancel,
 	}
 
-	go initKafkaConsumer(lineChan, errorChan, cfg)
+	go initKafkaConsumer(ctx, lineChan, errorChan, cfg, metrics)
 
 	return *tailer
 }
 
-func initKafkaConsumer(lineChan chan *fswatcher.Line, errorChan chan fswatcher.Error, cfg *configuration.InputConfig) {
+func initKafkaConsumer(ctx ctx.Context, lineChan chan *fswatcher.Line, errorChan chan fswatcher.Error, cfg *configuration.InputConfig, metrics fswatcher.Metrics) {
 
 	version, err := sarama.ParseKafkaVersion(cfg.KafkaVersion)
 	if err != nil {
@@ -65,6 +71,8 @@ func initKafkaConsumer(lineChan chan *fswatcher.Line, errorChan chan fswatcher.E
 		ready:     make(chan bool),
 		lineChan:  lineChan,
 		errorChan: errorChan,
+		cfg:       cfg,
+		metrics:   metrics,
 	}
 
 	kafkaConfig := sarama.NewConfig()
@@ -89,7 +97,6 @@ func initKafkaConsumer(lineChan chan *fswatcher.Line, errorChan chan fswatcher.E
 	 * Setup a new Sarama consumer group
 	 */
 
-	ctx, cancel := ctx.WithCancel(ctx.Background())
 	client, err := sarama.NewConsumerGroup(cfg.KafkaBrokers, cfg.KafkaConsumerGroupName, kafkaConfig)
 	if err != nil {
 		consumer.errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "[Kafka] Error creating client")
@@ -123,7 +130,6 @@ func initKafkaConsumer(lineChan chan *fswatcher.Line, errorChan chan fswatcher.E
 		logrus.Info("[Kafka] Consumer terminating: context cancelled")
 	}
 
-	cancel()
 	wg.Wait()
 
 	if err = client.Close(); err != nil {
@@ -152,8 +158,18 @@ func (consumer *consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 
 	for message := range claim.Messages() {
 		logrus.Debugf("[Kafka] Message content: %s", string(message.Value))
-		session.MarkMessage(message, "")
-		consumer.lineChan <- &fswatcher.Line{Line: string(message.Value)}
+		line, ok := limitLineLength(string(message.Value), consumer.cfg, consumer.metrics)
+		if !ok {
+			session.MarkMessage(message, "")
+			continue
+		}
+		select {
+		case consumer.lineChan <- &fswatcher.Line{Line: line}:
+			session.MarkMessage(message, "")
+		case <-session.Context().Done():
+			// The tailer was closed, the message will be consumed again by the next consumer.
+			return nil
+		}
 	}
 
 	return nil
@@ -103,7 +103,7 @@ func TestLineBufferBlockingPop(t *testing.T) {
 	go func() {
 		l := buf.BlockingPop()
 		if l.Line != "hello" {
-			t.Fatalf("expected to read \"hello\" but got %q.", l.Line)
+			t.Errorf("expected to read \"hello\" but got %q.", l.Line)
 		}
 		close(done)
 	}()
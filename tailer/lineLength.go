@@ -0,0 +1,36 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// Applies max_line_bytes to inputs that receive complete lines, like webhook and kafka.
+// The file and stdin inputs use fswatcher's line reader instead, so that they never keep oversized lines in memory.
+// Returns false if the line should be dropped.
+func limitLineLength(line string, cfg *configuration.InputConfig, metrics fswatcher.Metrics) (string, bool) {
+	if cfg.MaxLineBytes <= 0 || len(line) <= cfg.MaxLineBytes {
+		return line, true
+	}
+	if metrics != nil {
+		metrics.LineOversized("")
+	}
+	if cfg.OversizedLines == "drop" {
+		return "", false
+	}
+	return fswatcher.TruncateLine(line, cfg.MaxLineBytes), true
+}
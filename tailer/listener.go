@@ -0,0 +1,191 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Common part of the tailers that receive log lines on network listeners, i.e. the syslog, GELF, fluent_forward, tcp, and unix inputs.
+//
+// There is one tailer per address, see runSharedListener(). The listeners are not closed when the configuration is reloaded,
+// because the new listeners could not bind to the addresses while the old listeners are open. They are closed when the last input
+// using them is closed, see sharedTailer.
+type listenerTailer struct {
+	lines          chan *fswatcher.Line
+	errors         chan fswatcher.Error
+	listeners      []io.Closer // net.Listener or net.PacketConn
+	registry       map[string]*sharedTailer
+	key            string     // key in registry
+	mutex          sync.Mutex // protects maxConnections and nConnections
+	maxConnections int        // 0 means unlimited
+	nConnections   int
+	stopped        chan struct{} // closed when the listeners are closed, see stop()
+}
+
+func newListenerTailer(registry map[string]*sharedTailer, key string) *listenerTailer {
+	return &listenerTailer{
+		lines:    make(chan *fswatcher.Line),
+		errors:   make(chan fswatcher.Error),
+		registry: registry,
+		key:      key,
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Returns the tailer listening on the address given by key. If there is none, run() creates it.
+func runSharedListener(registry map[string]*sharedTailer, key string, run func() (fswatcher.FileTailer, error)) (*sharedTailer, error) {
+	shared, exists := registry[key]
+	if !exists {
+		t, err := run()
+		if err != nil {
+			return nil, err
+		}
+		shared = newSharedTailer(t)
+		registry[key] = shared
+	}
+	return shared, nil
+}
+
+func (t *listenerTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *listenerTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+// Called when the last input using the listeners is closed.
+func (t *listenerTailer) Close() {
+	delete(t.registry, t.key)
+	t.stop()
+}
+
+// The listener is closed in stop().
+func (t *listenerTailer) addListener(ln io.Closer) {
+	t.listeners = append(t.listeners, ln)
+}
+
+// The new limit applies to connections accepted after the configuration was reloaded.
+func (t *listenerTailer) setMaxConnections(maxConnections int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.maxConnections = maxConnections
+}
+
+// Each connection is read in its own goroutine. Errors on a single connection should be logged by read(), because they should
+// not terminate grok_exporter. The connection is closed when read() returns, or when the listener is stopped, see closeWhenStopped().
+// Connections exceeding max_connections are closed right away, so that the client can try again later.
+func (t *listenerTailer) accept(ln net.Listener, description string, read func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isTemporary(err) {
+				continue
+			}
+			t.sendError(fswatcher.NewErrorf(fswatcher.NotSpecified, err, "failed to accept %v connection on %v", description, ln.Addr()))
+			return
+		}
+		t.mutex.Lock()
+		maxConnections := t.maxConnections
+		accepted := maxConnections == 0 || t.nConnections < maxConnections
+		if accepted {
+			t.nConnections++
+		}
+		t.mutex.Unlock()
+		if !accepted {
+			logrus.Warnf("rejecting %v connection on %v: max_connections %v reached", description, ln.Addr(), maxConnections)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() {
+				conn.Close()
+				t.mutex.Lock()
+				t.nConnections--
+				t.mutex.Unlock()
+			}()
+			defer closeWhenStopped(conn, t.stopped)()
+			read(conn)
+		}()
+	}
+}
+
+// Returns false if the listeners were stopped before the line was taken.
+func (t *listenerTailer) sendLine(line *fswatcher.Line) bool {
+	select {
+	case t.lines <- line:
+		return true
+	case <-t.stopped:
+		return false
+	}
+}
+
+// Errors after stop() are expected, because they are caused by closing the listeners.
+func (t *listenerTailer) sendError(err fswatcher.Error) {
+	select {
+	case t.errors <- err:
+	case <-t.stopped:
+	}
+}
+
+// Open connections are closed as well, see closeWhenStopped().
+func (t *listenerTailer) stop() {
+	close(t.stopped)
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+}
+
+// Closes the connection when the listener is stopped, so that the client gets an error instead of waiting forever.
+// The returned function must be called when the connection is no longer read.
+func closeWhenStopped(conn net.Conn, stopped chan struct{}) func() {
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-stopped:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	return func() {
+		close(closed)
+	}
+}
+
+// Read errors after the listener was stopped are expected, because the connections are closed, see closeWhenStopped().
+func isStopped(stopped chan struct{}) bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func isTemporary(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Temporary()
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Parses the body of a request to Loki's push API (/loki/api/v1/push), as sent by Promtail.
+// Like Loki, the body is snappy compressed protobuf unless the Content-Type is application/json.
+// Each entry is a log line, and the labels of the entry's stream are the extra fields.
+func parseLokiPush(b []byte, contentType string, maxBytes int, emit func(context_string) error) error {
+	if isJsonContentType(contentType) {
+		return parseLokiPushJson(b, emit)
+	}
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return fmt.Errorf("failed to decode snappy compressed loki push request: %v", err)
+	}
+	if n > maxBytes {
+		return fmt.Errorf("%w: request body exceeds webhook_max_body_bytes", errWebhookRequestTooLarge)
+	}
+	decoded, err := snappy.Decode(nil, b)
+	if err != nil {
+		return fmt.Errorf("failed to decode snappy compressed loki push request: %v", err)
+	}
+	return parseLokiPushProtobuf(decoded, emit)
+}
+
+// {"streams": [{"stream": {"job": "varlogs"}, "values": [["1600000000000000000", "log line"], ...]}, ...]}
+func parseLokiPushJson(b []byte, emit func(context_string) error) error {
+	var request struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"` // timestamp, line, and optional structured metadata
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(b, &request); err != nil {
+		return fmt.Errorf("unable to parse loki push request: %v", err)
+	}
+	for _, stream := range request.Streams {
+		extra := lokiExtra(stream.Stream)
+		for _, value := range stream.Values {
+			var line string
+			if len(value) < 2 || json.Unmarshal(value[1], &line) != nil {
+				return errors.New("unable to parse loki push request: values must be [\"<timestamp>\", \"<line>\"]")
+			}
+			if err := emit(context_string{line: line, extra: extra}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decodes the PushRequest message, see pkg/push/push.proto in the Loki repository:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func parseLokiPushProtobuf(b []byte, emit func(context_string) error) error {
+	type stream struct {
+		labels string
+		lines  []string
+	}
+	var streams []stream
+	err := forEachProtobufBytesField(b, 1, func(streamBytes []byte) error {
+		var s stream
+		err := forEachProtobufField(streamBytes, func(field protobufField) error {
+			switch {
+			case field.num == 1 && field.typ == protowire.BytesType:
+				s.labels = string(field.bytes)
+			case field.num == 2 && field.typ == protowire.BytesType:
+				return forEachProtobufBytesField(field.bytes, 2, func(line []byte) error {
+					s.lines = append(s.lines, string(line))
+					return nil
+				})
+			}
+			return nil
+		})
+		streams = append(streams, s)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to parse loki push request: %v", err)
+	}
+	// The labels are parsed after all fields are read, because protobuf does not guarantee the order of the fields.
+	for _, s := range streams {
+		labels, err := parseLokiLabels(s.labels)
+		if err != nil {
+			return err
+		}
+		extra := lokiExtra(labels)
+		for _, line := range s.lines {
+			if err = emit(context_string{line: line, extra: extra}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Parses labels in Prometheus format, like {job="varlogs", filename="/var/log/syslog"}.
+func parseLokiLabels(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	rest := strings.TrimSpace(s)
+	if !strings.HasPrefix(rest, "{") || !strings.HasSuffix(rest, "}") {
+		return nil, fmt.Errorf("unable to parse loki stream labels %v", s)
+	}
+	rest = strings.TrimSpace(rest[1 : len(rest)-1])
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("unable to parse loki stream labels %v", s)
+		}
+		name := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimSpace(rest[eq+1:])
+		quoted := quotedPrefix(rest)
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse loki stream labels %v", s)
+		}
+		result[name] = value
+		rest = strings.TrimSpace(rest[len(quoted):])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("unable to parse loki stream labels %v", s)
+		}
+	}
+	return result, nil
+}
+
+// Returns the double-quoted string at the beginning of s, or "" if s does not start with a double-quoted string.
+func quotedPrefix(s string) string {
+	if !strings.HasPrefix(s, "\"") {
+		return ""
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			return s[:i+1]
+		}
+	}
+	return ""
+}
+
+// The extra fields are shared by all lines of a stream, they are never modified.
+func lokiExtra(stream map[string]string) map[string]interface{} {
+	result := make(map[string]interface{}, len(stream))
+	for name, value := range stream {
+		result[name] = value
+	}
+	return result
+}
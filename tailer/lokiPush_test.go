@@ -0,0 +1,139 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestLokiPush(t *testing.T) {
+	tail, err := InitWebhookTailer(&configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/loki/api/v1/push",
+		WebhookFormat:       "loki_push",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+	}, &webhookRequests{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protobufBody := snappy.Encode(nil, lokiPushRequest(
+		lokiStream(`{job="varlogs", filename="/var/log/syslog"}`, "line 1", "line 2"),
+		lokiStream(`{job="nginx",msg="say \"hi\""}`, "line 3"),
+	))
+	jsonBody := []byte(`{"streams": [
+		{"stream": {"job": "varlogs", "filename": "/var/log/syslog"}, "values": [["1600000000000000000", "line 1"], ["1600000000000000001", "line 2"]]},
+		{"stream": {"job": "nginx", "msg": "say \"hi\""}, "values": [["1600000000000000002", "line 3", {"trace_id": "abc"}]]}
+	]}`)
+	for _, test := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/x-protobuf", protobufBody},
+		{"", protobufBody},
+		{"application/json; charset=utf-8", jsonBody},
+	} {
+		req := httptest.NewRequest("POST", "/loki/api/v1/push", bytes.NewReader(test.body))
+		if len(test.contentType) > 0 {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		WebhookHandler(req.URL.Path).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected status 200, but got %v: %v", test.contentType, w.Code, w.Body.String())
+		}
+		expectLineWithExtra(t, tail, "line 1", "map[filename:/var/log/syslog job:varlogs]")
+		expectLineWithExtra(t, tail, "line 2", "map[filename:/var/log/syslog job:varlogs]")
+		expectLineWithExtra(t, tail, "line 3", `map[job:nginx msg:say "hi"]`)
+	}
+	for _, test := range []struct {
+		contentType    string
+		body           []byte
+		expectedStatus int
+	}{
+		{"application/x-protobuf", lokiPushRequest(lokiStream(`{job="varlogs"}`, "line 1")), http.StatusBadRequest}, // not snappy compressed
+		{"application/x-protobuf", snappy.Encode(nil, lokiPushRequest(lokiStream(`job="varlogs"`, "line 1"))), http.StatusBadRequest},
+		{"application/x-protobuf", snappy.Encode(nil, make([]byte, 1025)), http.StatusRequestEntityTooLarge},
+		{"application/json", []byte(`{"streams": [{"stream": {}, "values": [["1600000000000000000"]]}]}`), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/loki/api/v1/push", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		WebhookHandler(req.URL.Path).ServeHTTP(w, req)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%q: expected status %v, but got %v", test.body, test.expectedStatus, w.Code)
+		}
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels, expected string
+	}{
+		{`{}`, "map[]"},
+		{`{job="varlogs"}`, "map[job:varlogs]"},
+		{` { job = "varlogs" , host="a,b=c" } `, "map[host:a,b=c job:varlogs]"},
+		{`{path="C:\\logs", msg="\"quoted\"\n"}`, "map[msg:\"quoted\"\n path:C:\\logs]"},
+		{`job="varlogs"`, "error"},
+		{`{job=varlogs}`, "error"},
+		{`{job="varlogs" host="a"}`, "error"},
+		{`{job="varlogs}`, "error"},
+	} {
+		result, err := parseLokiLabels(test.labels)
+		actual := fmt.Sprintf("%v", result)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Fatalf("%v: expected %q, but got %q", test.labels, test.expected, actual)
+		}
+	}
+}
+
+func lokiPushRequest(streams ...[]byte) []byte {
+	var result []byte
+	for _, stream := range streams {
+		result = protowire.AppendTag(result, 1, protowire.BytesType)
+		result = protowire.AppendBytes(result, stream)
+	}
+	return result
+}
+
+// The entries are written before the labels and contain a timestamp, to test that fields are read in any order.
+func lokiStream(labels string, lines ...string) []byte {
+	var result []byte
+	for i, line := range lines {
+		var timestamp, entry []byte
+		timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+		timestamp = protowire.AppendVarint(timestamp, uint64(1600000000+i))
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, timestamp)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, line)
+		result = protowire.AppendTag(result, 2, protowire.BytesType)
+		result = protowire.AppendBytes(result, entry)
+	}
+	result = protowire.AppendTag(result, 1, protowire.BytesType)
+	result = protowire.AppendString(result, labels)
+	return result
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Minimal MessagePack decoder for the fluent forward protocol, see https://github.com/msgpack/msgpack/blob/master/spec.md
+// Values are decoded as nil, bool, int64, uint64, float64, string, []byte (bin), msgpackExt,
+// []interface{}, or map[string]interface{} (keys are converted to strings).
+
+// Nesting is limited, because a small message like [[[[...]]]] would otherwise exhaust the stack.
+const maxMsgpackDepth = 100
+
+// Arrays and maps are pre-allocated with at most this many elements. The claimed length is not trusted,
+// because a header of a few bytes may claim billions of elements, see decodeArray() and decodeMap().
+const maxMsgpackPreallocated = 16
+
+// Strings and binary data up to this size are read into a pre-allocated buffer. Larger data is read step by step,
+// so that memory is only allocated for the bytes that were actually received, see readBytes().
+const maxMsgpackPreallocatedBytes = 64 * 1024
+
+var errMsgpackTooLarge = errors.New("message too large")
+
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+type msgpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type msgpackDecoder struct {
+	r      msgpackReader
+	budget int // number of bytes that may still be read, so that claimed lengths cannot make us allocate arbitrary memory
+}
+
+func newMsgpackDecoder(r msgpackReader) *msgpackDecoder {
+	return &msgpackDecoder{r: r}
+}
+
+// Decodes the next value. Returns io.EOF if there are no more values, and io.ErrUnexpectedEOF if the input ends within a value.
+// Each call may read up to maxBytes, i.e. the limit applies per value.
+func (d *msgpackDecoder) decode(maxBytes int) (interface{}, error) {
+	d.budget = maxBytes
+	first, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decodeValue(first, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackDecoder) decodeValue(first byte, depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("more than %v nested arrays or maps", maxMsgpackDepth)
+	}
+	switch {
+	case first <= 0x7f: // positive fixint
+		return int64(first), nil
+	case first >= 0xe0: // negative fixint
+		return int64(int8(first)), nil
+	case first >= 0x80 && first <= 0x8f:
+		return d.decodeMap(int(first&0x0f), depth)
+	case first >= 0x90 && first <= 0x9f:
+		return d.decodeArray(int(first&0x0f), depth)
+	case first >= 0xa0 && first <= 0xbf:
+		return d.readString(int(first & 0x1f))
+	}
+	switch first {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.readLength(first - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.readLength(first - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.readExt(n)
+	case 0xca:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		u, err := d.readUint(1 << (first - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (first - 0xd0)
+		u, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extension: shift the value to the top of the uint64, then shift it back as int64
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.readExt(1 << (first - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.readLength(first - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.readLength(first - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.readLength(first - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	default:
+		return nil, fmt.Errorf("invalid msgpack type 0x%x", first)
+	}
+}
+
+// The slice grows while the elements are read, so memory is only allocated for elements that were actually sent.
+func (d *msgpackDecoder) decodeArray(n int, depth int) ([]interface{}, error) {
+	result := make([]interface{}, 0, minInt(n, maxMsgpackPreallocated))
+	for i := 0; i < n; i++ {
+		first, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decodeValue(first, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, minInt(n, maxMsgpackPreallocated))
+	for i := 0; i < n; i++ {
+		first, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		key, err := d.decodeValue(first, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		first, err = d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeValue(first, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case string:
+			result[k] = value
+		case []byte:
+			result[string(k)] = value
+		default:
+			result[fmt.Sprintf("%v", k)] = value
+		}
+	}
+	return result, nil
+}
+
+func (d *msgpackDecoder) readExt(n int) (msgpackExt, error) {
+	typ, err := d.readByte()
+	if err != nil {
+		return msgpackExt{}, err
+	}
+	data, err := d.readBytes(n)
+	if err != nil {
+		return msgpackExt{}, err
+	}
+	return msgpackExt{Type: int8(typ), Data: data}, nil
+}
+
+// sizeExponent is 0, 1, or 2 for 8, 16, or 32 bit lengths.
+func (d *msgpackDecoder) readLength(sizeExponent byte) (int, error) {
+	u, err := d.readUint(1 << sizeExponent)
+	if u > math.MaxInt32 {
+		return 0, errMsgpackTooLarge // int might be 32 bit
+	}
+	return int(u), err
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var result uint64
+	for _, c := range b {
+		result = result<<8 | uint64(c)
+	}
+	return result, nil
+}
+
+func (d *msgpackDecoder) readString(n int) (string, error) {
+	b, err := d.readBytes(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	if d.budget < 1 {
+		return 0, errMsgpackTooLarge
+	}
+	d.budget--
+	return d.r.ReadByte()
+}
+
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	if n > d.budget {
+		return nil, errMsgpackTooLarge
+	}
+	d.budget -= n
+	if n <= maxMsgpackPreallocatedBytes {
+		result := make([]byte, n)
+		_, err := io.ReadFull(d.r, result)
+		return result, err
+	}
+	var result bytes.Buffer
+	_, err := io.CopyN(&result, d.r, int64(n))
+	return result.Bytes(), err
+}
+
+// Encodes a map with a single string value, like {"ack": "<chunk id>"}.
+func encodeMsgpackStringMap(key, value string) []byte {
+	result := []byte{0x81}
+	result = appendMsgpackString(result, key)
+	return appendMsgpackString(result, value)
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
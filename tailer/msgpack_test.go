@@ -0,0 +1,190 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackDecoder(t *testing.T) {
+	for _, test := range []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte{0x00}, "int64(0)"},
+		{[]byte{0x7f}, "int64(127)"},
+		{[]byte{0xff}, "int64(-1)"},
+		{[]byte{0xe0}, "int64(-32)"},
+		{[]byte{0xcc, 0xff}, "uint64(255)"},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "uint64(18446744073709551615)"},
+		{[]byte{0xd0, 0x80}, "int64(-128)"},
+		{[]byte{0xd1, 0xff, 0x00}, "int64(-256)"},
+		{[]byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}, "int64(-9223372036854775808)"},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, "float64(1.5)"},
+		{append([]byte{0xcb}, float64Bytes(-2.25)...), "float64(-2.25)"},
+		{[]byte{0xc0}, "<nil>"},
+		{[]byte{0xc2}, "bool(false)"},
+		{[]byte{0xc3}, "bool(true)"},
+		{[]byte{0xa3, 'a', 'b', 'c'}, `string("abc")`},
+		{[]byte{0xd9, 0x03, 'a', 'b', 'c'}, `string("abc")`},
+		{[]byte{0xda, 0x00, 0x03, 'a', 'b', 'c'}, `string("abc")`},
+		{[]byte{0xc4, 0x02, 0x01, 0x02}, `[]uint8([]byte{0x1, 0x2})`},
+		{[]byte{0xd7, 0x00, 0x5f, 0x5e, 0x10, 0x00, 0x00, 0x00, 0x00, 0x01}, "tailer.msgpackExt(tailer.msgpackExt{Type:0, Data:[]uint8{0x5f, 0x5e, 0x10, 0x0, 0x0, 0x0, 0x0, 0x1}})"},
+		{[]byte{0xc7, 0x01, 0x05, 0xaa}, "tailer.msgpackExt(tailer.msgpackExt{Type:5, Data:[]uint8{0xaa}})"},
+		{[]byte{0x92, 0x01, 0xa1, 'x'}, `[]interface {}([]interface {}{1, "x"})`},
+		{[]byte{0xdc, 0x00, 0x01, 0xc0}, `[]interface {}([]interface {}{interface {}(nil)})`},
+		{[]byte{0x82, 0xa1, 'a', 0x01, 0x02, 0xc3}, `map[string]interface {}(map[string]interface {}{"2":true, "a":1})`},
+		{[]byte{0xde, 0x00, 0x01, 0xc4, 0x01, 'k', 0x90}, `map[string]interface {}(map[string]interface {}{"k":[]interface {}{}})`},
+		{[]byte{}, "error: EOF"},
+		{[]byte{0xc1}, "error: invalid msgpack type 0xc1"},
+		{[]byte{0x92, 0x01}, "error: unexpected EOF"},
+		{[]byte{0xa3, 'a'}, "error: unexpected EOF"},
+		{[]byte{0xdb, 0xff, 0xff, 0xff, 0xff}, "error: message too large"},
+		{[]byte{0xdd, 0x7f, 0xff, 0xff, 0xff}, "error: unexpected EOF"}, // must not allocate 2^31 elements
+		{bytes.Repeat([]byte{0x91}, maxMsgpackDepth+2), "error: more than 100 nested arrays or maps"},
+	} {
+		v, err := newMsgpackDecoder(bytes.NewReader(test.input)).decode(1024)
+		actual := fmt.Sprintf("%T(%#v)", v, v)
+		if v == nil {
+			actual = "<nil>"
+		}
+		if _, isInt := v.(int64); isInt {
+			actual = fmt.Sprintf("%T(%v)", v, v)
+		}
+		if _, isUint := v.(uint64); isUint {
+			actual = fmt.Sprintf("%T(%v)", v, v)
+		}
+		if err != nil {
+			actual = "error: " + err.Error()
+		}
+		actual = strings.Replace(actual, "int64(1)", "1", -1)
+		if actual != test.expected {
+			t.Fatalf("%x: expected %v, but got %v", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestMsgpackLargeHeader(t *testing.T) {
+	for _, header := range [][]byte{
+		{0xdd, 0x7f, 0xff, 0xff, 0xff}, // array 32 with 2^31-1 elements
+		{0xdf, 0x7f, 0xff, 0xff, 0xff}, // map 32 with 2^31-1 elements
+		{0xc6, 0x03, 0xff, 0xff, 0x00}, // bin 32 with almost 64 MiB
+		{0xdb, 0x03, 0xff, 0xff, 0x00}, // str 32 with almost 64 MiB
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := newMsgpackDecoder(bytes.NewReader(header)).decode(maxFluentForwardMessageSize)
+		runtime.ReadMemStats(&after)
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("%x: expected %v, but got %v", header, io.ErrUnexpectedEOF, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+			t.Fatalf("%x: header without elements allocated %v bytes", header, allocated)
+		}
+	}
+}
+
+func TestMsgpackStream(t *testing.T) {
+	decoder := newMsgpackDecoder(bytes.NewReader(encodeMsgpack("a", 1, []interface{}{"b"})))
+	var values []interface{}
+	for {
+		v, err := decoder.decode(1024)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	if fmt.Sprintf("%v", values) != "[a 1 [b]]" {
+		t.Fatalf("unexpected values %v", values)
+	}
+	_, err := newMsgpackDecoder(bytes.NewReader(encodeMsgpack(strings.Repeat("x", 100)))).decode(100)
+	if err != errMsgpackTooLarge {
+		t.Fatalf("expected %v, but got %v", errMsgpackTooLarge, err)
+	}
+}
+
+func TestEncodeMsgpackStringMap(t *testing.T) {
+	for _, value := range []string{"", "abc", strings.Repeat("x", 31), strings.Repeat("x", 32), strings.Repeat("x", 256), strings.Repeat("x", 65536)} {
+		v, err := newMsgpackDecoder(bytes.NewReader(encodeMsgpackStringMap("ack", value))).decode(100000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.(map[string]interface{})["ack"] != value {
+			t.Fatalf("failed to encode string with length %v", len(value))
+		}
+	}
+}
+
+func float64Bytes(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+// Encodes the values, as far as needed for the tests. Maps are encoded with sorted keys.
+func encodeMsgpack(values ...interface{}) []byte {
+	var result []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			result = append(result, 0xc0)
+		case bool:
+			if v {
+				result = append(result, 0xc3)
+			} else {
+				result = append(result, 0xc2)
+			}
+		case int:
+			result = append(result, 0xd3)
+			result = append(result, float64Bytes(0)...)
+			binary.BigEndian.PutUint64(result[len(result)-8:], uint64(v))
+		case string:
+			result = appendMsgpackString(result, v)
+		case []byte:
+			result = append(result, 0xc6, byte(len(v)>>24), byte(len(v)>>16), byte(len(v)>>8), byte(len(v)))
+			result = append(result, v...)
+		case msgpackExt:
+			result = append(result, 0xc7, byte(len(v.Data)), byte(v.Type))
+			result = append(result, v.Data...)
+		case []interface{}:
+			result = append(result, 0xdd, byte(len(v)>>24), byte(len(v)>>16), byte(len(v)>>8), byte(len(v)))
+			result = append(result, encodeMsgpack(v...)...)
+		case map[string]interface{}:
+			result = append(result, 0xdf, byte(len(v)>>24), byte(len(v)>>16), byte(len(v)>>8), byte(len(v)))
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				result = append(result, encodeMsgpack(key, v[key])...)
+			}
+		default:
+			panic(fmt.Sprintf("cannot encode %T", value))
+		}
+	}
+	return result
+}
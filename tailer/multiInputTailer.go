@@ -0,0 +1,134 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"sync"
+)
+
+// MultiInputTailer merges the lines and errors of multiple named inputs into a single tailer.
+// Each line is tagged with the name of the input it was read from, see fswatcher.Line.Input.
+// Inputs can be added, replaced, and removed while the exporter is running. This is used when
+// the configuration is reloaded: The buffer and the channels consumed by the main loop remain the same,
+// only the sources of the lines change.
+type MultiInputTailer struct {
+	lines  chan *fswatcher.Line
+	errors chan fswatcher.Error
+	mutex  sync.Mutex
+	inputs []*namedInput
+	closed bool
+}
+
+type namedInput struct {
+	name   string
+	tailer fswatcher.FileTailer
+	stop   chan struct{} // closed when the input is removed or replaced
+}
+
+func NewMultiInputTailer() *MultiInputTailer {
+	return &MultiInputTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+	}
+}
+
+func (t *MultiInputTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *MultiInputTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+// Add an input. If there is already an input with the same name, the old tailer is replaced and closed.
+// Lines that are read by the old tailer after Add() was called are discarded.
+// References to shared tailers are activated here, see sharedTailer.
+func (t *MultiInputTailer) Add(name string, newTailer fswatcher.FileTailer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		newTailer.Close()
+		return
+	}
+	t.remove(name)
+	activate(newTailer)
+	input := &namedInput{
+		name:   name,
+		tailer: newTailer,
+		stop:   make(chan struct{}),
+	}
+	t.inputs = append(t.inputs, input)
+	go t.forward(input)
+}
+
+// Remove an input and close its tailer.
+func (t *MultiInputTailer) Remove(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.remove(name)
+}
+
+func (t *MultiInputTailer) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for len(t.inputs) > 0 {
+		t.remove(t.inputs[0].name)
+	}
+}
+
+// must be called while holding the mutex.
+func (t *MultiInputTailer) remove(name string) {
+	for i, input := range t.inputs {
+		if input.name == name {
+			close(input.stop)
+			input.tailer.Close()
+			t.inputs = append(t.inputs[:i], t.inputs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *MultiInputTailer) forward(input *namedInput) {
+	for {
+		select {
+		case line, ok := <-input.tailer.Lines():
+			if !ok {
+				return
+			}
+			line.Input = input.name
+			select {
+			case t.lines <- line:
+			case <-input.stop:
+				return
+			}
+		case err, ok := <-input.tailer.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case t.errors <- err:
+			case <-input.stop:
+				return
+			}
+		case <-input.stop:
+			return
+		}
+	}
+}
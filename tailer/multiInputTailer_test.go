@@ -0,0 +1,113 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMultiInputTailer(t *testing.T) {
+	src1 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	src2 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	src3 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	multi := NewMultiInputTailer()
+	multi.Add("a", src1)
+	multi.Add("b", src2)
+	src1.lines <- &fswatcher.Line{Line: "line 1"}
+	expectLine(t, multi, "line 1", "a")
+	src2.lines <- &fswatcher.Line{Line: "line 2"}
+	expectLine(t, multi, "line 2", "b")
+	// replace input a
+	multi.Add("a", src3)
+	_, stillOpen := <-src1.Lines()
+	if stillOpen {
+		t.Error("Replaced source tailer was not closed.")
+	}
+	src3.lines <- &fswatcher.Line{Line: "line 3"}
+	expectLine(t, multi, "line 3", "a")
+	multi.Remove("b")
+	_, stillOpen = <-src2.Lines()
+	if stillOpen {
+		t.Error("Removed source tailer was not closed.")
+	}
+	multi.Close()
+	_, stillOpen = <-src3.Lines()
+	if stillOpen {
+		t.Error("Source tailer was not closed.")
+	}
+}
+
+// When the configuration is reloaded, the new input is added before the old input is closed. The webhook tailer is shared
+// by the old and the new input, it must not be closed when the old input is closed, even if it is wrapped.
+func TestMultiInputTailerReplaceWrappedWebhook(t *testing.T) {
+	cfg := &configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/multiline",
+		WebhookFormat:       "text_single",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+	}
+	multilineCfg := &configuration.MultilineConfig{
+		ContinuationPattern: `^\s`,
+		MaxLines:            500,
+		MaxBytes:            1024,
+		FlushTimeout:        100 * time.Millisecond,
+	}
+	multi := NewMultiInputTailer()
+	defer multi.Close()
+	for i := 1; i <= 3; i++ {
+		tail, err := InitWebhookTailer(cfg, &webhookRequests{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		multi.Add("webhook", runMultilineTailer(t, tail, multilineCfg))
+		line := fmt.Sprintf("line %v", i)
+		postWebhookLines(t, WebhookHandler("/multiline"), "/multiline", line, http.StatusOK)
+		expectLine(t, multi, line, "webhook")
+	}
+}
+
+func expectLine(t *testing.T, tail fswatcher.FileTailer, expected string, expectedInput string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expected {
+			t.Fatalf("Expected %q, but got %q.", expected, line.Line)
+		}
+		if line.Input != expectedInput {
+			t.Fatalf("Expected line %q from input %q, but got input %q.", expected, expectedInput, line.Input)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while waiting for %q.", expected)
+	}
+}
+
+// The extra fields are compared in their fmt representation, which has sorted map keys.
+func expectLineWithExtra(t *testing.T, tail fswatcher.FileTailer, expectedLine, expectedExtra string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expectedLine || fmt.Sprintf("%v", line.Extra) != expectedExtra {
+			t.Fatalf("expected %q with extra %v, but got %q with extra %v", expectedLine, expectedExtra, line.Line, line.Extra)
+		}
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", expectedLine)
+	}
+}
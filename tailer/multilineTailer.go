@@ -0,0 +1,274 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"strings"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// implements fswatcher.FileTailer
+type multilineTailer struct {
+	out   chan *fswatcher.Line
+	orig  fswatcher.FileTailer
+	regex *multilineRegex
+	done  chan struct{}
+}
+
+func (m *multilineTailer) Lines() chan *fswatcher.Line {
+	return m.out
+}
+
+func (m *multilineTailer) Errors() chan fswatcher.Error {
+	return m.orig.Errors()
+}
+
+// Must be called on the goroutine that runs MultilineMatch.Run(), because the regex is freed here.
+func (m *multilineTailer) Close() {
+	m.orig.Close()
+	close(m.done)
+	m.regex.free()
+}
+
+func (m *multilineTailer) activate() {
+	activate(m.orig)
+}
+
+// Wrapper around a tailer that joins multiple lines into a single log event, like Java stack traces or Python tracebacks.
+// With cfg.StartPattern, a line matching the regex starts a new event, and all other lines are appended to the current event.
+// With cfg.ContinuationPattern, a line matching the regex is appended to the current event, and all other lines start a new event.
+// The lines of an event are joined with "\n". Lines from different files are never joined.
+// An event is complete when the next event starts, when cfg.MaxLines or cfg.MaxBytes is reached,
+// or when no line was appended for cfg.FlushTimeout.
+// The Oniguruma library is not thread safe, so the regex is not used on the tailer's goroutine. For each line, a MultilineMatch
+// is sent to the matches channel, and the receiver must call MultilineMatch.Run() on the goroutine that uses the other regexes.
+// The regex is freed when the tailer is closed.
+func MultilineTailer(orig fswatcher.FileTailer, cfg *configuration.MultilineConfig, regex *oniguruma.Regex, matches chan<- *MultilineMatch) fswatcher.FileTailer {
+	out := make(chan *fswatcher.Line)
+	done := make(chan struct{})
+	joiner := &multilineJoiner{
+		cfg:           cfg,
+		regex:         &multilineRegex{regex: regex},
+		matchRequests: matches,
+		done:          done,
+	}
+	go func() {
+		ticker := time.NewTicker(flushCheckInterval(cfg.FlushTimeout))
+		defer ticker.Stop()
+		for {
+			var complete []*fswatcher.Line
+			select {
+			case line, ok := <-orig.Lines():
+				if !ok {
+					for _, event := range joiner.flush(nil) {
+						select {
+						case out <- event:
+						case <-done:
+							return
+						}
+					}
+					close(out)
+					return
+				}
+				complete = joiner.add(line, time.Now())
+			case now := <-ticker.C:
+				complete = joiner.flush(func(event *multilineEvent) bool {
+					return now.Sub(event.lastUpdate) >= cfg.FlushTimeout
+				})
+			case <-done:
+				return
+			}
+			for _, event := range complete {
+				select {
+				case out <- event:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return &multilineTailer{
+		out:   out,
+		orig:  orig,
+		regex: joiner.regex,
+		done:  done,
+	}
+}
+
+// A request to match a line against the start or continuation pattern of a multiline tailer, see MultilineTailer().
+type MultilineMatch struct {
+	regex  *multilineRegex
+	line   string
+	result chan bool // buffered, so Run() does not block if the multiline tailer was closed in the meantime
+}
+
+// Must be called on the goroutine that closes the multiline tailer.
+func (m *MultilineMatch) Run() {
+	m.result <- m.regex.matches(m.line)
+}
+
+// Only used on the goroutine that runs MultilineMatch.Run() and closes the multiline tailer.
+type multilineRegex struct {
+	regex *oniguruma.Regex // nil after the multiline tailer was closed
+}
+
+// Search errors are treated like lines that do not match.
+func (r *multilineRegex) matches(line string) bool {
+	if r.regex == nil {
+		return false
+	}
+	searchResult, err := r.regex.Search(line)
+	if err != nil {
+		return false
+	}
+	defer searchResult.Free()
+	return searchResult.IsMatch()
+}
+
+func (r *multilineRegex) free() {
+	if r.regex != nil {
+		r.regex.Free()
+		r.regex = nil
+	}
+}
+
+// The flush timeout is checked periodically, so an event is flushed at most 25% later than the configured timeout.
+func flushCheckInterval(flushTimeout time.Duration) time.Duration {
+	if flushTimeout < 40*time.Millisecond {
+		return 10 * time.Millisecond
+	}
+	return flushTimeout / 4
+}
+
+type multilineJoiner struct {
+	cfg           *configuration.MultilineConfig
+	regex         *multilineRegex
+	matchRequests chan<- *MultilineMatch
+	done          chan struct{}
+	pending       []*multilineEvent // at most one event per file
+}
+
+type multilineEvent struct {
+	first      *fswatcher.Line     // the file, input, and extra fields are taken from the first line
+	position   *fswatcher.Position // of the last line, see fswatcher.Line.Processed()
+	lines      []string
+	nBytes     int
+	lastUpdate time.Time
+}
+
+// Returns the events that are complete after the line was added.
+func (j *multilineJoiner) add(line *fswatcher.Line, now time.Time) []*fswatcher.Line {
+	var complete []*fswatcher.Line
+	event := j.find(line.File)
+	if event != nil && (j.startsNewEvent(line.Line) || event.nBytes+1+len(line.Line) > j.cfg.MaxBytes) {
+		complete = append(complete, j.remove(event))
+		event = nil
+	}
+	if event == nil {
+		event = &multilineEvent{
+			first:  line,
+			lines:  []string{line.Line},
+			nBytes: len(line.Line),
+		}
+		j.pending = append(j.pending, event)
+	} else {
+		event.lines = append(event.lines, line.Line)
+		event.nBytes += 1 + len(line.Line)
+	}
+	event.position = line.Position
+	event.lastUpdate = now
+	if len(event.lines) >= j.cfg.MaxLines {
+		complete = append(complete, j.remove(event))
+	}
+	return complete
+}
+
+// Removes and returns the pending events for which the filter returns true. If filter is nil, all pending events are returned.
+func (j *multilineJoiner) flush(filter func(*multilineEvent) bool) []*fswatcher.Line {
+	var (
+		complete  []*fswatcher.Line
+		remaining []*multilineEvent
+	)
+	for _, event := range j.pending {
+		if filter == nil || filter(event) {
+			complete = append(complete, event.join())
+		} else {
+			remaining = append(remaining, event)
+		}
+	}
+	j.pending = remaining
+	return complete
+}
+
+func (j *multilineJoiner) startsNewEvent(line string) bool {
+	if len(j.cfg.StartPattern) > 0 {
+		return j.matches(line)
+	} else {
+		return !j.matches(line)
+	}
+}
+
+// If the tailer is closed while waiting for the result, the line is treated as not matching. It is discarded anyway.
+func (j *multilineJoiner) matches(line string) bool {
+	match := &MultilineMatch{
+		regex:  j.regex,
+		line:   line,
+		result: make(chan bool, 1),
+	}
+	select {
+	case j.matchRequests <- match:
+	case <-j.done:
+		return false
+	}
+	select {
+	case result := <-match.result:
+		return result
+	case <-j.done:
+		return false
+	}
+}
+
+func (j *multilineJoiner) find(file string) *multilineEvent {
+	for _, event := range j.pending {
+		if event.first.File == file {
+			return event
+		}
+	}
+	return nil
+}
+
+func (j *multilineJoiner) remove(event *multilineEvent) *fswatcher.Line {
+	for i := range j.pending {
+		if j.pending[i] == event {
+			j.pending = append(j.pending[:i], j.pending[i+1:]...)
+			break
+		}
+	}
+	return event.join()
+}
+
+func (event *multilineEvent) join() *fswatcher.Line {
+	return &fswatcher.Line{
+		Line:     strings.Join(event.lines, "\n"),
+		File:     event.first.File,
+		Input:    event.first.Input,
+		Extra:    event.first.Extra,
+		Position: event.position,
+	}
+}
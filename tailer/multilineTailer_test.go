@@ -0,0 +1,152 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+func TestMultilineStartPattern(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	multiline := runMultilineTailer(t, src, &configuration.MultilineConfig{
+		StartPattern: `^\d{4}-\d{2}-\d{2} `,
+		MaxLines:     500,
+		MaxBytes:     1024,
+		FlushTimeout: 100 * time.Millisecond,
+	})
+	defer multiline.Close()
+	src.lines <- &fswatcher.Line{Line: "2020-06-01 ERROR java.lang.NullPointerException"}
+	src.lines <- &fswatcher.Line{Line: "    at com.example.A.a(A.java:10)"}
+	src.lines <- &fswatcher.Line{Line: "    at com.example.B.b(B.java:20)"}
+	src.lines <- &fswatcher.Line{Line: "2020-06-01 INFO done"}
+	expectLine(t, multiline, "2020-06-01 ERROR java.lang.NullPointerException\n    at com.example.A.a(A.java:10)\n    at com.example.B.b(B.java:20)", "")
+	// the last event is flushed after the timeout
+	expectLine(t, multiline, "2020-06-01 INFO done", "")
+}
+
+func TestMultilineContinuationPattern(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	multiline := runMultilineTailer(t, src, &configuration.MultilineConfig{
+		ContinuationPattern: `^\s`,
+		MaxLines:            500,
+		MaxBytes:            1024,
+		FlushTimeout:        100 * time.Millisecond,
+	})
+	defer multiline.Close()
+	src.lines <- &fswatcher.Line{Line: "Traceback (most recent call last):"}
+	src.lines <- &fswatcher.Line{Line: "  File \"test.py\", line 1, in <module>"}
+	src.lines <- &fswatcher.Line{Line: "ZeroDivisionError: division by zero"}
+	expectLine(t, multiline, "Traceback (most recent call last):\n  File \"test.py\", line 1, in <module>", "")
+	expectLine(t, multiline, "ZeroDivisionError: division by zero", "")
+}
+
+func TestMultilineLimits(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	multiline := runMultilineTailer(t, src, &configuration.MultilineConfig{
+		ContinuationPattern: `^\s`,
+		MaxLines:            2,
+		MaxBytes:            10,
+		FlushTimeout:        time.Hour,
+	})
+	defer multiline.Close()
+	src.lines <- &fswatcher.Line{Line: "a"}
+	src.lines <- &fswatcher.Line{Line: " b"}
+	expectLine(t, multiline, "a\n b", "") // max_lines reached
+	src.lines <- &fswatcher.Line{Line: "c"}
+	src.lines <- &fswatcher.Line{Line: " 123456789"}
+	expectLine(t, multiline, "c", "") // max_bytes would be exceeded
+	src.lines <- &fswatcher.Line{Line: "d"}
+	expectLine(t, multiline, " 123456789", "")
+}
+
+func TestMultilineFiles(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	multiline := runMultilineTailer(t, src, &configuration.MultilineConfig{
+		ContinuationPattern: `^\s`,
+		MaxLines:            500,
+		MaxBytes:            1024,
+		FlushTimeout:        time.Hour,
+	})
+	src.lines <- &fswatcher.Line{Line: "a1", File: "a.log"}
+	src.lines <- &fswatcher.Line{Line: "b1", File: "b.log"}
+	src.lines <- &fswatcher.Line{Line: " a2", File: "a.log"}
+	src.lines <- &fswatcher.Line{Line: " b2", File: "b.log"}
+	src.lines <- &fswatcher.Line{Line: "a3", File: "a.log"}
+	expectLine(t, multiline, "a1\n a2", "")
+	// when the source tailer is closed, the pending events are flushed.
+	close(src.lines)
+	for _, expected := range []string{"b1\n b2", "a3"} {
+		line, ok := <-multiline.Lines()
+		if !ok || line.Line != expected {
+			t.Fatalf("Expected %q, but got %v.", expected, line)
+		}
+	}
+	_, ok := <-multiline.Lines()
+	if ok {
+		t.Fatal("Expected the multiline tailer to be closed after the source tailer was closed.")
+	}
+}
+
+// The test tailer runs the multiline matches on its own goroutine, like the main loop of grok_exporter does.
+type multilineTestTailer struct {
+	fswatcher.FileTailer
+	stop       chan struct{}
+	serverDone chan struct{}
+}
+
+// The goroutine running the matches is stopped before the regex is freed.
+func (m *multilineTestTailer) Close() {
+	close(m.stop)
+	<-m.serverDone
+	m.FileTailer.Close()
+}
+
+func (m *multilineTestTailer) activate() {
+	activate(m.FileTailer)
+}
+
+func runMultilineTailer(t *testing.T, src fswatcher.FileTailer, cfg *configuration.MultilineConfig) fswatcher.FileTailer {
+	pattern := cfg.StartPattern
+	if len(pattern) == 0 {
+		pattern = cfg.ContinuationPattern
+	}
+	regex, err := oniguruma.Compile(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := make(chan *MultilineMatch)
+	result := &multilineTestTailer{
+		FileTailer: MultilineTailer(src, cfg, regex, matches),
+		stop:       make(chan struct{}),
+		serverDone: make(chan struct{}),
+	}
+	go func() {
+		defer close(result.serverDone)
+		for {
+			select {
+			case match := <-matches:
+				match.Run()
+			case <-result.stop:
+				return
+			}
+		}
+	}()
+	return result
+}
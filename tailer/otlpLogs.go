@@ -0,0 +1,329 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ExportLogsServiceRequest of the OpenTelemetry protocol, see opentelemetry/proto/collector/logs/v1/logs_service.proto
+// and opentelemetry/proto/logs/v1/logs.proto in https://github.com/open-telemetry/opentelemetry-proto.
+// The JSON tags follow the OTLP/JSON encoding. Protobuf requests are decoded into the same structs.
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name       string         `json:"name"`
+		Version    string         `json:"version"`
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	SeverityNumber int64          `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes"`
+	TraceId        string         `json:"traceId"` // hex, in protobuf requests this is converted from bytes
+	SpanId         string         `json:"spanId"`  // hex, in protobuf requests this is converted from bytes
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// Exactly one of the values is set, or none if the value is empty.
+type otlpAnyValue struct {
+	StringValue *string           `json:"stringValue"`
+	BoolValue   *bool             `json:"boolValue"`
+	IntValue    *json.Number      `json:"intValue"` // int64 values are strings in OTLP/JSON
+	DoubleValue *float64          `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue   `json:"arrayValue"`
+	KvlistValue *otlpKeyValueList `json:"kvlistValue"`
+	BytesValue  *string           `json:"bytesValue"` // base64, in protobuf requests this is converted from bytes
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValueList struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// Nesting of array and kvlist values is limited, because a small request could otherwise exhaust the stack.
+const maxOtlpValueDepth = 100
+
+// Parses an OTLP/HTTP logs export request. The body is protobuf unless the Content-Type is application/json.
+// Each log record is a log line, the other fields of the log record are the extra fields.
+func parseOtlpLogs(b []byte, contentType string, emit func(context_string) error) error {
+	var (
+		request otlpLogsRequest
+		err     error
+	)
+	if isJsonContentType(contentType) {
+		err = json.Unmarshal(b, &request)
+	} else {
+		err = request.unmarshalProtobuf(b)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse OTLP logs request: %v", err)
+	}
+	for _, resourceLogs := range request.ResourceLogs {
+		resource := otlpAttributes(resourceLogs.Resource.Attributes)
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			scope := map[string]interface{}{
+				"name":       scopeLogs.Scope.Name,
+				"version":    scopeLogs.Scope.Version,
+				"attributes": otlpAttributes(scopeLogs.Scope.Attributes),
+			}
+			for _, record := range scopeLogs.LogRecords {
+				extra := map[string]interface{}{
+					"resource":        resource,
+					"scope":           scope,
+					"attributes":      otlpAttributes(record.Attributes),
+					"severity_number": record.SeverityNumber,
+					"severity_text":   record.SeverityText,
+					"trace_id":        strings.ToLower(record.TraceId),
+					"span_id":         strings.ToLower(record.SpanId),
+				}
+				if err = emit(context_string{line: otlpBody(record.Body), extra: extra}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The response is an empty ExportLogsServiceResponse, encoded like the request.
+func writeOtlpLogsResponse(w http.ResponseWriter, contentType string) {
+	if isJsonContentType(contentType) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+}
+
+func isJsonContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json"
+}
+
+// String bodies are the log line as they are, structured bodies are converted to JSON.
+func otlpBody(body otlpAnyValue) string {
+	value := body.value()
+	if s, ok := value.(string); ok {
+		return s
+	}
+	if value == nil {
+		return ""
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value) // NaN and Inf cannot be represented in JSON
+	}
+	return string(b)
+}
+
+func otlpAttributes(attributes []otlpKeyValue) map[string]interface{} {
+	result := make(map[string]interface{}, len(attributes))
+	for _, attribute := range attributes {
+		result[attribute.Key] = attribute.Value.value()
+	}
+	return result
+}
+
+// Converts the value to string, bool, int64, float64, []interface{}, or map[string]interface{}. Bytes are base64 strings.
+func (v otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		i, err := v.IntValue.Int64()
+		if err != nil {
+			return v.IntValue.String()
+		}
+		return i
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		result := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			result = append(result, value.value())
+		}
+		return result
+	case v.KvlistValue != nil:
+		return otlpAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	default:
+		return nil
+	}
+}
+
+// The field numbers are from the .proto files referenced above. Unknown fields are skipped.
+
+func (r *otlpLogsRequest) unmarshalProtobuf(b []byte) error {
+	return forEachProtobufBytesField(b, 1, func(value []byte) error {
+		var resourceLogs otlpResourceLogs
+		err := resourceLogs.unmarshalProtobuf(value)
+		r.ResourceLogs = append(r.ResourceLogs, resourceLogs)
+		return err
+	})
+}
+
+func (r *otlpResourceLogs) unmarshalProtobuf(b []byte) error {
+	return forEachProtobufField(b, func(field protobufField) error {
+		switch {
+		case field.num == 1 && field.typ == protowire.BytesType: // Resource resource
+			return forEachProtobufBytesField(field.bytes, 1, func(value []byte) error {
+				return appendOtlpKeyValue(&r.Resource.Attributes, value, 0)
+			})
+		case field.num == 2 && field.typ == protowire.BytesType: // repeated ScopeLogs scope_logs
+			var scopeLogs otlpScopeLogs
+			err := scopeLogs.unmarshalProtobuf(field.bytes)
+			r.ScopeLogs = append(r.ScopeLogs, scopeLogs)
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *otlpScopeLogs) unmarshalProtobuf(b []byte) error {
+	return forEachProtobufField(b, func(field protobufField) error {
+		switch {
+		case field.num == 1 && field.typ == protowire.BytesType: // InstrumentationScope scope
+			return forEachProtobufField(field.bytes, func(field protobufField) error {
+				if field.typ != protowire.BytesType {
+					return nil
+				}
+				switch field.num {
+				case 1:
+					s.Scope.Name = string(field.bytes)
+				case 2:
+					s.Scope.Version = string(field.bytes)
+				case 3:
+					return appendOtlpKeyValue(&s.Scope.Attributes, field.bytes, 0)
+				}
+				return nil
+			})
+		case field.num == 2 && field.typ == protowire.BytesType: // repeated LogRecord log_records
+			var record otlpLogRecord
+			err := record.unmarshalProtobuf(field.bytes)
+			s.LogRecords = append(s.LogRecords, record)
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *otlpLogRecord) unmarshalProtobuf(b []byte) error {
+	return forEachProtobufField(b, func(field protobufField) error {
+		switch {
+		case field.num == 2 && field.typ == protowire.VarintType: // SeverityNumber severity_number
+			r.SeverityNumber = int64(field.number)
+		case field.num == 3 && field.typ == protowire.BytesType: // string severity_text
+			r.SeverityText = string(field.bytes)
+		case field.num == 5 && field.typ == protowire.BytesType: // AnyValue body
+			return r.Body.unmarshalProtobuf(field.bytes, 0)
+		case field.num == 6 && field.typ == protowire.BytesType: // repeated KeyValue attributes
+			return appendOtlpKeyValue(&r.Attributes, field.bytes, 0)
+		case field.num == 9 && field.typ == protowire.BytesType: // bytes trace_id
+			r.TraceId = hex.EncodeToString(field.bytes)
+		case field.num == 10 && field.typ == protowire.BytesType: // bytes span_id
+			r.SpanId = hex.EncodeToString(field.bytes)
+		}
+		return nil
+	})
+}
+
+func appendOtlpKeyValue(keyValues *[]otlpKeyValue, b []byte, depth int) error {
+	var keyValue otlpKeyValue
+	err := forEachProtobufField(b, func(field protobufField) error {
+		switch {
+		case field.num == 1 && field.typ == protowire.BytesType: // string key
+			keyValue.Key = string(field.bytes)
+		case field.num == 2 && field.typ == protowire.BytesType: // AnyValue value
+			return keyValue.Value.unmarshalProtobuf(field.bytes, depth)
+		}
+		return nil
+	})
+	*keyValues = append(*keyValues, keyValue)
+	return err
+}
+
+func (v *otlpAnyValue) unmarshalProtobuf(b []byte, depth int) error {
+	if depth >= maxOtlpValueDepth {
+		return fmt.Errorf("more than %v nested values", maxOtlpValueDepth)
+	}
+	return forEachProtobufField(b, func(field protobufField) error {
+		switch {
+		case field.num == 1 && field.typ == protowire.BytesType:
+			s := string(field.bytes)
+			v.StringValue = &s
+		case field.num == 2 && field.typ == protowire.VarintType:
+			b := field.number != 0
+			v.BoolValue = &b
+		case field.num == 3 && field.typ == protowire.VarintType:
+			i := json.Number(strconv.FormatInt(int64(field.number), 10))
+			v.IntValue = &i
+		case field.num == 4 && field.typ == protowire.Fixed64Type:
+			f := math.Float64frombits(field.number)
+			v.DoubleValue = &f
+		case field.num == 5 && field.typ == protowire.BytesType:
+			v.ArrayValue = &otlpArrayValue{}
+			return forEachProtobufBytesField(field.bytes, 1, func(value []byte) error {
+				var element otlpAnyValue
+				err := element.unmarshalProtobuf(value, depth+1)
+				v.ArrayValue.Values = append(v.ArrayValue.Values, element)
+				return err
+			})
+		case field.num == 6 && field.typ == protowire.BytesType:
+			v.KvlistValue = &otlpKeyValueList{}
+			return forEachProtobufBytesField(field.bytes, 1, func(value []byte) error {
+				return appendOtlpKeyValue(&v.KvlistValue.Values, value, depth+1)
+			})
+		case field.num == 7 && field.typ == protowire.BytesType:
+			s := base64.StdEncoding.EncodeToString(field.bytes)
+			v.BytesValue = &s
+		}
+		return nil
+	})
+}
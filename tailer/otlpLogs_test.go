@@ -0,0 +1,175 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpExtra1 = "map[attributes:map[http.status:404 user:alice] resource:map[service.name:nginx] scope:map[attributes:map[] name:access version:1.0] severity_number:9 severity_text:INFO span_id:0102030405060708 trace_id:0102030405060708090a0b0c0d0e0f10]"
+	otlpExtra2 = "map[attributes:map[ratio:0.5 tags:[a true] valid:false] resource:map[service.name:nginx] scope:map[attributes:map[] name:access version:1.0] severity_number:17 severity_text:ERROR span_id: trace_id:]"
+)
+
+func TestOtlpLogs(t *testing.T) {
+	tail, err := InitWebhookTailer(&configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/v1/logs",
+		WebhookFormat:       "otlp_logs",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+	}, &webhookRequests{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protobufBody := otlpMessage(
+		otlpBytesField(1, otlpMessage( // ResourceLogs
+			otlpBytesField(1, otlpBytesField(1, otlpKeyValueField("service.name", otlpStringValue("nginx")))), // Resource
+			otlpBytesField(2, otlpMessage( // ScopeLogs
+				otlpBytesField(1, otlpMessage(otlpStringField(1, "access"), otlpStringField(2, "1.0"))), // InstrumentationScope
+				otlpBytesField(2, otlpMessage( // LogRecord
+					otlpVarintField(2, 9),
+					otlpStringField(3, "INFO"),
+					otlpBytesField(5, otlpStringValue("GET /index.html 404")),
+					otlpBytesField(6, otlpKeyValueField("user", otlpStringValue("alice"))),
+					otlpBytesField(6, otlpKeyValueField("http.status", otlpVarintField(3, 404))),
+					otlpBytesField(9, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}),
+					otlpBytesField(10, []byte{1, 2, 3, 4, 5, 6, 7, 8}),
+				)),
+				otlpBytesField(2, otlpMessage( // LogRecord
+					otlpVarintField(2, 17),
+					otlpStringField(3, "ERROR"),
+					otlpBytesField(5, otlpBytesField(6, otlpBytesField(1, otlpKeyValueField("msg", otlpStringValue("failed"))))), // kvlist body
+					otlpBytesField(6, otlpKeyValueField("valid", otlpVarintField(2, 0))),
+					otlpBytesField(6, otlpKeyValueField("ratio", protowire.AppendFixed64(protowire.AppendTag(nil, 4, protowire.Fixed64Type), math.Float64bits(0.5)))),
+					otlpBytesField(6, otlpKeyValueField("tags", otlpBytesField(5, otlpMessage(otlpBytesField(1, otlpStringValue("a")), otlpBytesField(1, otlpVarintField(2, 1)))))),
+					otlpStringField(99, "unknown fields are skipped"),
+				)),
+			)),
+		)),
+	)
+	jsonBody := []byte(`{"resourceLogs": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "nginx"}}]},
+		"scopeLogs": [{
+			"scope": {"name": "access", "version": "1.0"},
+			"logRecords": [{
+				"timeUnixNano": "1600000000000000000",
+				"severityNumber": 9,
+				"severityText": "INFO",
+				"body": {"stringValue": "GET /index.html 404"},
+				"attributes": [{"key": "user", "value": {"stringValue": "alice"}}, {"key": "http.status", "value": {"intValue": "404"}}],
+				"traceId": "0102030405060708090A0B0C0D0E0F10",
+				"spanId": "0102030405060708"
+			}, {
+				"severityNumber": 17,
+				"severityText": "ERROR",
+				"body": {"kvlistValue": {"values": [{"key": "msg", "value": {"stringValue": "failed"}}]}},
+				"attributes": [{"key": "valid", "value": {"boolValue": false}}, {"key": "ratio", "value": {"doubleValue": 0.5}},
+					{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"boolValue": true}]}}}]
+			}]
+		}]
+	}]}`)
+	for _, test := range []struct {
+		contentType, expectedContentType, expectedResponse string
+		body                                               []byte
+	}{
+		{"application/x-protobuf", "application/x-protobuf", "", protobufBody},
+		{"application/json", "application/json", "{}", jsonBody},
+	} {
+		req := httptest.NewRequest("POST", "/v1/logs", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		WebhookHandler(req.URL.Path).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected status 200, but got %v: %v", test.contentType, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != test.expectedContentType || w.Body.String() != test.expectedResponse {
+			t.Fatalf("%v: unexpected response %q with Content-Type %v", test.contentType, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+		expectLineWithExtra(t, tail, "GET /index.html 404", otlpExtra1)
+		expectLineWithExtra(t, tail, `{"msg":"failed"}`, otlpExtra2)
+	}
+	for _, test := range []struct {
+		contentType    string
+		body           []byte
+		expectedStatus int
+	}{
+		{"application/x-protobuf", []byte{0x0a, 0x05, 0x01}, http.StatusBadRequest}, // truncated
+		{"application/x-protobuf", otlpBytesField(1, otlpBytesField(2, otlpBytesField(2, otlpBytesField(5, otlpNestedArrays(maxOtlpValueDepth+1))))), http.StatusBadRequest},
+		{"application/json", []byte(`{"resourceLogs": {}}`), http.StatusBadRequest},
+		{"application/json", []byte(`{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"body": {"intValue": "x"}}]}]}]}`), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/logs", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		WebhookHandler(req.URL.Path).ServeHTTP(w, req)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%v: expected status %v, but got %v", test.contentType, test.expectedStatus, w.Code)
+		}
+	}
+}
+
+func TestOtlpNestedValues(t *testing.T) {
+	var v otlpAnyValue
+	if err := v.unmarshalProtobuf(otlpNestedArrays(maxOtlpValueDepth), 0); err != nil {
+		t.Fatalf("unexpected error for %v nested arrays: %v", maxOtlpValueDepth, err)
+	}
+	if err := v.unmarshalProtobuf(otlpNestedArrays(maxOtlpValueDepth+1), 0); err == nil {
+		t.Fatalf("expected error for %v nested arrays", maxOtlpValueDepth+1)
+	}
+}
+
+// An AnyValue with depth nested array values, the innermost array is empty.
+func otlpNestedArrays(depth int) []byte {
+	var result []byte
+	for i := 0; i < depth; i++ {
+		if i > 0 {
+			result = otlpBytesField(1, result) // ArrayValue values
+		}
+		result = otlpBytesField(5, result) // AnyValue array_value
+	}
+	return result
+}
+
+func otlpMessage(fields ...[]byte) []byte {
+	return bytes.Join(fields, nil)
+}
+
+func otlpBytesField(num protowire.Number, value []byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), value)
+}
+
+func otlpStringField(num protowire.Number, value string) []byte {
+	return otlpBytesField(num, []byte(value))
+}
+
+func otlpVarintField(num protowire.Number, value uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), value)
+}
+
+func otlpStringValue(s string) []byte {
+	return otlpStringField(1, s)
+}
+
+func otlpKeyValueField(key string, value []byte) []byte {
+	return otlpMessage(otlpStringField(1, key), otlpBytesField(2, value))
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the pid, uid, and gid of the process that connected to the Unix domain socket.
+func unixPeerCredentials(conn net.Conn) (map[string]interface{}, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peer credentials: %v", err)
+	}
+	return map[string]interface{}{
+		"pid": int(cred.Pid),
+		"uid": int(cred.Uid),
+		"gid": int(cred.Gid),
+	}, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A field of a protobuf message. The Loki and OTLP messages are decoded without generated code,
+// by iterating over the fields with forEachProtobufField().
+type protobufField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	bytes  []byte // strings, bytes, and embedded messages
+	number uint64 // varint, fixed32, and fixed64 values
+}
+
+// Calls f for each field of the message. Groups are deprecated and skipped.
+func forEachProtobufField(b []byte, f func(field protobufField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		field := protobufField{num: num, typ: typ}
+		switch typ {
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			field.number, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			field.number = uint64(v)
+		case protowire.Fixed64Type:
+			field.number, n = protowire.ConsumeFixed64(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.StartGroupType {
+			continue
+		}
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Like forEachProtobufField(), but only calls f for length-delimited fields with the given number.
+func forEachProtobufBytesField(b []byte, num protowire.Number, f func(value []byte) error) error {
+	return forEachProtobufField(b, func(field protobufField) error {
+		if field.num != num || field.typ != protowire.BytesType {
+			return nil
+		}
+		return f(field.bytes)
+	})
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"sync"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// Some tailers are not re-created when the configuration is reloaded: There is only one stdin, and the HTTP handlers
+// of the webhook tailers are registered when the server is started. These tailers are shared by the inputs of the old
+// and the new configuration. Each input gets its own reference, see newRef(), and the shared tailer is closed
+// when the last reference is closed.
+//
+// Only the active reference gets the lines. A reference is activated when it is added to the MultiInputTailer,
+// i.e. when the reload was successful. That way, wrappers like the multiline tailer of the old and the new input
+// never read from the shared tailer at the same time, and the settings of a reload that failed are never applied.
+type sharedTailer struct {
+	tailer    fswatcher.FileTailer
+	mutex     sync.Mutex
+	nRefs     int
+	active    *sharedTailerRef // nil if no reference is active
+	activated chan struct{}    // closed when the active reference changes
+	done      chan struct{}    // closed when the last reference is closed
+}
+
+// implements fswatcher.FileTailer
+type sharedTailerRef struct {
+	shared    *sharedTailer
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	configure func() // applies the settings of the input to the shared tailer, may be nil
+	closeOnce sync.Once
+}
+
+// Implemented by references to shared tailers, and by wrappers around tailers, see activate().
+type activator interface {
+	activate()
+}
+
+func newSharedTailer(tailer fswatcher.FileTailer) *sharedTailer {
+	return &sharedTailer{
+		tailer: tailer,
+	}
+}
+
+// If the tailer is not referenced yet, the new reference is active right away. Otherwise, configure is called when the reference is activated.
+func (s *sharedTailer) newRef(configure func()) *sharedTailerRef {
+	ref := &sharedTailerRef{
+		shared:    s,
+		lines:     make(chan *fswatcher.Line),
+		errors:    make(chan fswatcher.Error),
+		configure: configure,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nRefs == 0 {
+		ref.applyConfig()
+		s.active = ref
+		s.activated = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.forward(s.done)
+	}
+	s.nRefs++
+	return ref
+}
+
+func (s *sharedTailer) forward(done chan struct{}) {
+	for {
+		select {
+		case line, ok := <-s.tailer.Lines():
+			if !ok || !s.forwardLine(line, done) {
+				return
+			}
+		case err, ok := <-s.tailer.Errors():
+			if !ok || !s.forwardError(err, done) {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Blocks while no reference is active. Returns false if the last reference was closed.
+func (s *sharedTailer) forwardLine(line *fswatcher.Line, done chan struct{}) bool {
+	for {
+		ref, activated := s.current()
+		var lines chan *fswatcher.Line // nil if no reference is active
+		if ref != nil {
+			lines = ref.lines
+		}
+		select {
+		case lines <- line:
+			return true
+		case <-activated:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (s *sharedTailer) forwardError(err fswatcher.Error, done chan struct{}) bool {
+	for {
+		ref, activated := s.current()
+		var errors chan fswatcher.Error // nil if no reference is active
+		if ref != nil {
+			errors = ref.errors
+		}
+		select {
+		case errors <- err:
+			return true
+		case <-activated:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (s *sharedTailer) current() (*sharedTailerRef, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.active, s.activated
+}
+
+// must be called while holding the mutex.
+func (s *sharedTailer) setActive(ref *sharedTailerRef) {
+	s.active = ref
+	close(s.activated)
+	s.activated = make(chan struct{})
+}
+
+func (r *sharedTailerRef) Lines() chan *fswatcher.Line {
+	return r.lines
+}
+
+func (r *sharedTailerRef) Errors() chan fswatcher.Error {
+	return r.errors
+}
+
+func (r *sharedTailerRef) activate() {
+	s := r.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active != r {
+		r.applyConfig()
+		s.setActive(r)
+	}
+}
+
+func (r *sharedTailerRef) applyConfig() {
+	if r.configure != nil {
+		r.configure()
+	}
+}
+
+// The shared tailer is closed when the last reference is closed. It may be referenced again later.
+func (r *sharedTailerRef) Close() {
+	r.closeOnce.Do(func() {
+		s := r.shared
+		s.mutex.Lock()
+		if s.active == r {
+			s.setActive(nil)
+		}
+		s.nRefs--
+		last := s.nRefs == 0
+		if last {
+			close(s.done)
+		}
+		s.mutex.Unlock()
+		if last {
+			s.tailer.Close()
+		}
+	})
+}
+
+// Called when the tailer is added to the MultiInputTailer, see sharedTailer.
+func activate(tailer fswatcher.FileTailer) {
+	if a, ok := tailer.(activator); ok {
+		a.activate()
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// A client that does not complete the TLS handshake in time is disconnected, so that it does not occupy one of the max_connections.
+// This is a variable so that it can be changed in tests.
+var socketTlsHandshakeTimeout = 10 * time.Second
+
+// Reads newline-delimited log lines from TCP connections (input type tcp) or Unix domain socket connections (input type unix).
+type socketTailer struct {
+	*listenerTailer
+	network            string // "tcp" or "unix"
+	ln                 net.Listener
+	mutex              sync.Mutex // protects the fields below, the configuration may change when it is reloaded
+	maxLineBytes       int
+	dropOversizedLines bool
+	metrics            fswatcher.Metrics
+}
+
+// There is one socket tailer per TCP address or socket path, see listenerTailer.
+// The Unix domain socket file is removed when the listener is closed.
+var socketTailers = make(map[string]*sharedTailer)
+
+// The TLS files are read when the listener is created. Changing them requires a restart, reloading a configuration with other TLS files fails.
+func RunSocketTailer(cfg *configuration.InputConfig, metrics fswatcher.Metrics) (fswatcher.FileTailer, error) {
+	key := socketTailerKey(cfg)
+	shared, err := runSharedListener(socketTailers, key, func() (fswatcher.FileTailer, error) {
+		ln, err := listenSocket(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return runSocketTailer(cfg.Type, ln, key), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := shared.tailer.(*socketTailer)
+	return shared.newRef(func() {
+		t.configure(cfg, metrics)
+	}), nil
+}
+
+func socketTailerKey(cfg *configuration.InputConfig) string {
+	return cfg.Type + " " + cfg.TcpAddress + cfg.UnixSocketPath
+}
+
+// The new settings apply to connections accepted after the configuration was reloaded.
+func (t *socketTailer) configure(cfg *configuration.InputConfig, metrics fswatcher.Metrics) {
+	t.setMaxConnections(cfg.MaxConnections)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.maxLineBytes = cfg.MaxLineBytes
+	t.dropOversizedLines = cfg.OversizedLines == "drop"
+	t.metrics = metrics
+}
+
+func listenSocket(cfg *configuration.InputConfig) (net.Listener, error) {
+	if cfg.Type == "unix" {
+		// A socket file left over from a previous run would make Listen() fail.
+		if fileInfo, err := os.Lstat(cfg.UnixSocketPath); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.UnixSocketPath)
+		}
+		ln, err := net.Listen("unix", cfg.UnixSocketPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for log lines on Unix domain socket %v: %v", cfg.UnixSocketPath, err)
+		}
+		return ln, nil
+	}
+	var tlsConfig *tls.Config
+	if len(cfg.TlsCert) > 0 {
+		var err error
+		tlsConfig, err = makeSocketTlsConfig(cfg.TlsCert, cfg.TlsKey, cfg.TlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", cfg.TcpAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for log lines on TCP address %v: %v", cfg.TcpAddress, err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+// If a client CA is configured, clients must present a certificate signed by that CA.
+func makeSocketTlsConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls_cert and tls_key: %v", err)
+	}
+	result := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls_client_ca: %v", err)
+		}
+		result.ClientCAs = x509.NewCertPool()
+		if !result.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to load tls_client_ca %v: no PEM encoded certificates found", clientCAFile)
+		}
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return result, nil
+}
+
+func runSocketTailer(network string, ln net.Listener, key string) *socketTailer {
+	t := &socketTailer{
+		listenerTailer: newListenerTailer(socketTailers, key),
+		network:        network,
+		ln:             ln,
+	}
+	t.addListener(ln)
+	go t.accept(ln, network, t.read)
+	return t
+}
+
+// Errors on a single connection are logged, because they should not terminate grok_exporter.
+func (t *socketTailer) read(conn net.Conn) {
+	extra, err := t.connectionExtra(conn)
+	if err != nil {
+		logrus.Warnf("closing %v connection on %v: %v", t.network, t.ln.Addr(), err)
+		return
+	}
+	reader := fswatcher.NewLineReader()
+	t.mutex.Lock()
+	if t.maxLineBytes > 0 {
+		metrics := t.metrics
+		reader.LimitLineLength(t.maxLineBytes, t.dropOversizedLines, func() {
+			metrics.LineOversized("")
+		})
+	}
+	t.mutex.Unlock()
+	r := &newlineTerminatedReader{Reader: conn}
+	for {
+		line, eof, err := reader.ReadLine(r)
+		if eof {
+			return
+		}
+		if err != nil {
+			if !isStopped(t.stopped) {
+				logrus.Warnf("closing %v connection on %v: %v", t.network, t.ln.Addr(), err)
+			}
+			return
+		}
+		// All lines of a connection share the extra fields, they are never modified.
+		if !t.sendLine(&fswatcher.Line{Line: line, Extra: extra}) {
+			return
+		}
+	}
+}
+
+// TCP connections have the remote address and, if the client presented a certificate, its common name.
+// Unix domain socket connections have the peer credentials, see unixPeerCredentials().
+func (t *socketTailer) connectionExtra(conn net.Conn) (map[string]interface{}, error) {
+	if t.network == "unix" {
+		return unixPeerCredentials(conn)
+	}
+	result := map[string]interface{}{
+		"remote_addr": conn.RemoteAddr().String(),
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(socketTlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			result["tls_client_cn"] = certs[0].Subject.CommonName
+		}
+	}
+	return result, nil
+}
+
+// Appends a newline if the connection is closed after an unterminated line, so that the line is not lost.
+type newlineTerminatedReader struct {
+	io.Reader
+	last byte // the last byte that was read, 0 if nothing was read yet
+	eof  bool
+}
+
+func (r *newlineTerminatedReader) Read(p []byte) (int, error) {
+	if r.eof {
+		if r.last != 0 && r.last != '\n' && len(p) > 0 {
+			r.last = '\n'
+			p[0] = '\n'
+			return 1, nil
+		}
+		return 0, io.EOF
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last = p[n-1]
+	}
+	if err == io.EOF {
+		r.eof = true
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+func TestTcpTailer(t *testing.T) {
+	metrics := &countingMetrics{}
+	tail := runSocketTailerForTest(t, &configuration.InputConfig{
+		Type:           "tcp",
+		TcpAddress:     "127.0.0.1:0",
+		MaxConnections: 1,
+		MaxLineBytes:   10,
+		OversizedLines: "drop",
+	}, metrics)
+	defer tail.stop()
+
+	conn, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSocket(t, conn, "line 1\nline 2\n")
+	extra := expectSocketLine(t, tail, "line 1").Extra.(map[string]interface{})
+	if extra["remote_addr"] != conn.LocalAddr().String() {
+		t.Fatalf("expected remote_addr %v, but got %v", conn.LocalAddr(), extra)
+	}
+	expectSocketLine(t, tail, "line 2")
+
+	// The first connection is still open, so the second connection exceeds max_connections.
+	rejected, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := rejected.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+	rejected.Close()
+
+	// The last line is not terminated, but it is not lost when the connection is closed.
+	writeSocket(t, conn, "this line is too long\nlast line")
+	conn.Close()
+	expectSocketLine(t, tail, "last line")
+	if n := atomic.LoadInt64(&metrics.oversized); n != 1 {
+		t.Fatalf("expected one oversized line, but got %v", n)
+	}
+}
+
+func TestUnixTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "grok_exporter.sock")
+	// A socket file left over from a previous run is replaced.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("Unix domain sockets not supported: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tail := runSocketTailerForTest(t, &configuration.InputConfig{
+		Type:           "unix",
+		UnixSocketPath: socketPath,
+		MaxConnections: 10,
+	}, &countingMetrics{})
+	defer tail.stop()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeSocket(t, conn, "hello\r\nworld\n")
+	extra := expectSocketLine(t, tail, "hello").Extra.(map[string]interface{})
+	if runtime.GOOS == "linux" && (extra["uid"] != os.Getuid() || extra["gid"] != os.Getgid() || extra["pid"] != os.Getpid()) {
+		t.Fatalf("expected uid %v, gid %v, and pid %v, but got %v", os.Getuid(), os.Getgid(), os.Getpid(), extra)
+	}
+	expectSocketLine(t, tail, "world")
+}
+
+// The listener is closed and the socket file is removed when the last input using it is closed.
+func TestUnixTailerClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &configuration.InputConfig{
+		Type:           "unix",
+		UnixSocketPath: filepath.Join(dir, "grok_exporter.sock"),
+		MaxConnections: 10,
+	}
+	oldTail, err := RunSocketTailer(cfg, &countingMetrics{})
+	if err != nil {
+		t.Skipf("Unix domain sockets not supported: %v", err)
+	}
+	newTail, err := RunSocketTailer(cfg, &countingMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", cfg.UnixSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	activate(newTail)
+	oldTail.Close()
+	writeSocket(t, conn, "hello\n")
+	expectSocketLine(t, newTail, "hello")
+
+	newTail.Close()
+	if len(socketTailers) != 0 {
+		t.Fatalf("expected the socket tailer to be removed, but got %v", socketTailers)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+	if _, err = os.Lstat(cfg.UnixSocketPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket file to be removed: %v", err)
+	}
+}
+
+func TestTlsTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The self-signed certificate is used as server certificate, client certificate, and client CA.
+	cert := createTestCertificate(t, dir)
+	tail := runSocketTailerForTest(t, &configuration.InputConfig{
+		Type:           "tcp",
+		TcpAddress:     "127.0.0.1:0",
+		MaxConnections: 10,
+		TlsCert:        filepath.Join(dir, "cert.pem"),
+		TlsKey:         filepath.Join(dir, "key.pem"),
+		TlsClientCA:    filepath.Join(dir, "cert.pem"),
+	}, &countingMetrics{})
+	defer tail.stop()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert.Leaf)
+
+	// Connections without client certificate are rejected.
+	conn, err := tls.Dial("tcp", tail.ln.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "localhost"})
+	if err == nil {
+		conn.Write([]byte("not accepted\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Fatalf("expected the connection without client certificate to fail: %v", err)
+		}
+		conn.Close()
+	}
+
+	conn, err = tls.Dial("tcp", tail.ln.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "localhost", Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeSocket(t, conn, "encrypted line\n")
+	extra := expectSocketLine(t, tail, "encrypted line").Extra.(map[string]interface{})
+	if extra["tls_client_cn"] != "grok_exporter test" {
+		t.Fatalf("expected tls_client_cn \"grok_exporter test\", but got %v", extra)
+	}
+}
+
+// A client that never completes the TLS handshake does not occupy a connection forever.
+func TestTlsHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		socketTlsHandshakeTimeout = timeout
+	}(socketTlsHandshakeTimeout)
+	socketTlsHandshakeTimeout = 100 * time.Millisecond
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := createTestCertificate(t, dir)
+	tail := runSocketTailerForTest(t, &configuration.InputConfig{
+		Type:           "tcp",
+		TcpAddress:     "127.0.0.1:0",
+		MaxConnections: 1,
+		TlsCert:        filepath.Join(dir, "cert.pem"),
+		TlsKey:         filepath.Join(dir, "key.pem"),
+	}, &countingMetrics{})
+	defer tail.stop()
+
+	idle, err := net.Dial("tcp", tail.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := idle.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert.Leaf)
+	var conn *tls.Conn
+	// The idle connection is counted until the tailer noticed that it was closed.
+	for i := 0; i < 50; i++ {
+		conn, err = tls.Dial("tcp", tail.ln.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "localhost"})
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeSocket(t, conn, "line 1\n")
+	expectSocketLine(t, tail, "line 1")
+}
+
+func runSocketTailerForTest(t *testing.T, cfg *configuration.InputConfig, metrics *countingMetrics) *socketTailer {
+	ln, err := listenSocket(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := runSocketTailer(cfg.Type, ln, socketTailerKey(cfg))
+	tail.configure(cfg, metrics)
+	return tail
+}
+
+// Writes cert.pem and key.pem to dir.
+func createTestCertificate(t *testing.T, dir string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "grok_exporter test"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	for file, content := range map[string][]byte{"cert.pem": certPem, "key.pem": keyPem} {
+		if err = ioutil.WriteFile(filepath.Join(dir, file), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func expectSocketLine(t *testing.T, tail fswatcher.FileTailer, expectedLine string) *fswatcher.Line {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expectedLine {
+			t.Fatalf("expected %q, but got %q", expectedLine, line.Line)
+		}
+		return line
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", expectedLine)
+	}
+	return nil
+}
+
+func writeSocket(t *testing.T, conn net.Conn, s string) {
+	if _, err := conn.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
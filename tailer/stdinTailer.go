@@ -1,29 +1,21 @@
-// Copyright 2016-2019 The grok_exporter Authors
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
 package tailer
 
 import (
-	"bufio"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
 	"os"
-	"strings"
+	"sync"
 )
 
 type stdinTailer struct {
-	lines  chan *fswatcher.Line
-	errors chan fswatcher.Error
+	lines              chan *fswatcher.Line
+	errors             chan fswatcher.Error
+	mutex              sync.Mutex // protects the fields below, which are replaced when the configuration is reloaded
+	maxLineBytes       int
+	dropOversizedLines bool
+	metrics            fswatcher.Metrics
+	changed            bool // the settings must be applied to the line reader
 }
 
 func (t *stdinTailer) Lines() chan *fswatcher.Line {
@@ -38,23 +30,60 @@ func (t *stdinTailer) Close() {
 	// TODO: How to stop the go-routine reading on stdin?
 }
 
-func RunStdinTailer() fswatcher.FileTailer {
-	lineChan := make(chan *fswatcher.Line)
-	errorChan := make(chan fswatcher.Error)
-	go func() {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
-				return
-			}
-			line = strings.TrimRight(line, "\r\n")
-			lineChan <- &fswatcher.Line{Line: line}
+var stdinTailerSingleton *sharedTailer
+
+func RunStdinTailer(cfg *configuration.InputConfig, metrics fswatcher.Metrics) fswatcher.FileTailer {
+	// There is only one stdin, so we must not start another go-routine reading from it
+	// if the tailer is re-created after the configuration was reloaded. Each input gets its own reference, see sharedTailer.
+	if stdinTailerSingleton == nil {
+		stdinTailerSingleton = newSharedTailer(runStdinTailer(os.Stdin, cfg, metrics))
+	}
+	t := stdinTailerSingleton.tailer.(*stdinTailer)
+	return stdinTailerSingleton.newRef(func() {
+		t.configure(cfg, metrics)
+	})
+}
+
+func runStdinTailer(in io.Reader, cfg *configuration.InputConfig, metrics fswatcher.Metrics) *stdinTailer {
+	t := &stdinTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+	}
+	t.configure(cfg, metrics)
+	go t.read(in)
+	return t
+}
+
+// The new settings apply from the next line on, because the line reader might be waiting for input.
+func (t *stdinTailer) configure(cfg *configuration.InputConfig, metrics fswatcher.Metrics) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.maxLineBytes = cfg.MaxLineBytes
+	t.dropOversizedLines = cfg.OversizedLines == "drop"
+	t.metrics = metrics
+	t.changed = true
+}
+
+func (t *stdinTailer) read(in io.Reader) {
+	reader := fswatcher.NewLineReader()
+	for {
+		t.mutex.Lock()
+		if t.changed {
+			metrics := t.metrics
+			reader.LimitLineLength(t.maxLineBytes, t.dropOversizedLines, func() {
+				metrics.LineOversized("")
+			})
+			t.changed = false
+		}
+		t.mutex.Unlock()
+		line, eof, err := reader.ReadLine(in)
+		if eof {
+			err = io.EOF
+		}
+		if err != nil {
+			t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
+			return
 		}
-	}()
-	return &stdinTailer{
-		lines:  lineChan,
-		errors: errorChan,
+		t.lines <- &fswatcher.Line{Line: line}
 	}
 }
@@ -0,0 +1,44 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+)
+
+func TestStdinTailerReload(t *testing.T) {
+	in, out := io.Pipe()
+	defer out.Close()
+	oldMetrics, newMetrics := &countingMetrics{}, &countingMetrics{}
+	tail := runStdinTailer(in, &configuration.InputConfig{Type: "stdin"}, oldMetrics)
+	go out.Write([]byte("line 1\n"))
+	expectLine(t, tail, "line 1", "")
+
+	// The configuration was reloaded. The new settings apply from the next line on, which is short enough for both settings.
+	tail.configure(&configuration.InputConfig{Type: "stdin", MaxLineBytes: 4, OversizedLines: "drop"}, newMetrics)
+	go out.Write([]byte("x\nline 2\ny\n"))
+	expectLine(t, tail, "x", "")
+	expectLine(t, tail, "y", "")
+	if n := atomic.LoadInt64(&newMetrics.oversized); n != 1 {
+		t.Fatalf("expected one oversized line, but got %v", n)
+	}
+	if n := atomic.LoadInt64(&oldMetrics.oversized); n != 0 {
+		t.Fatalf("expected no oversized line with the old metrics, but got %v", n)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// Messages without a valid PRI part are treated as user.notice, as recommended in RFC 3164 section 4.3.3.
+const defaultSyslogPriority = 13
+
+// Parses a syslog message in RFC 5424 or RFC 3164 format.
+// The MSG part is returned as the log line, the header fields are returned as the extra fields,
+// see the syslog input type in CONFIG.md for the names of the extra fields.
+// The parser is lenient: If the header cannot be parsed, the remaining message is returned as the log line.
+func parseSyslogMessage(msg string) (string, map[string]interface{}) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	// All fields are always present, so that label templates don't need to check if a field exists.
+	extra := map[string]interface{}{
+		"timestamp":       "",
+		"hostname":        "",
+		"app_name":        "",
+		"procid":          "",
+		"msgid":           "",
+		"structured_data": map[string]interface{}{},
+	}
+	priority, rest, ok := parseSyslogPriority(msg)
+	if !ok {
+		priority, rest = defaultSyslogPriority, msg
+	}
+	extra["facility"] = syslogFacilities[priority/8]
+	extra["severity"] = syslogSeverities[priority%8]
+	if strings.HasPrefix(rest, "1 ") {
+		return parseRfc5424(rest[2:], extra)
+	}
+	return parseRfc3164(rest, extra)
+}
+
+func parseSyslogPriority(msg string) (int, string, bool) {
+	if !strings.HasPrefix(msg, "<") {
+		return 0, msg, false
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return 0, msg, false
+	}
+	priority, err := strconv.Atoi(msg[1:end])
+	if err != nil || priority < 0 || priority >= len(syslogFacilities)*8 {
+		return 0, msg, false
+	}
+	return priority, msg[end+1:], true
+}
+
+// RFC 5424: VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+// The VERSION was already removed when this is called.
+func parseRfc5424(msg string, extra map[string]interface{}) (string, map[string]interface{}) {
+	for _, field := range []string{"timestamp", "hostname", "app_name", "procid", "msgid"} {
+		var value string
+		value, msg = nextSyslogField(msg)
+		if value == "-" {
+			value = ""
+		}
+		extra[field] = value
+	}
+	structuredData, msg := parseStructuredData(msg)
+	extra["structured_data"] = structuredData
+	msg = strings.TrimPrefix(msg, " ")
+	msg = strings.TrimPrefix(msg, "\xEF\xBB\xBF") // UTF-8 byte order mark
+	return msg, extra
+}
+
+// STRUCTURED-DATA is either "-", or a sequence of SD-ELEMENTs like [exampleSDID@32473 iut="3" eventSource="Application"].
+// The result maps each SD-ID to its parameters. If an element cannot be parsed, the remaining text is treated as MSG.
+func parseStructuredData(msg string) (map[string]interface{}, string) {
+	result := make(map[string]interface{})
+	if strings.HasPrefix(msg, "-") {
+		return result, msg[1:]
+	}
+	for strings.HasPrefix(msg, "[") {
+		var (
+			id     string
+			params = make(map[string]interface{})
+			i      = 1
+		)
+		for i < len(msg) && msg[i] != ' ' && msg[i] != ']' {
+			i++
+		}
+		id = msg[1:i]
+		for i < len(msg) && msg[i] == ' ' {
+			// PARAM-NAME="PARAM-VALUE", where '"', '\', and ']' in PARAM-VALUE are escaped with '\'.
+			nameStart := i + 1
+			eq := strings.IndexByte(msg[nameStart:], '=')
+			if eq < 0 || nameStart+eq+1 >= len(msg) || msg[nameStart+eq+1] != '"' {
+				return result, msg
+			}
+			name := msg[nameStart : nameStart+eq]
+			var value strings.Builder
+			i = nameStart + eq + 2
+			for i < len(msg) && msg[i] != '"' {
+				if msg[i] == '\\' && i+1 < len(msg) && (msg[i+1] == '"' || msg[i+1] == '\\' || msg[i+1] == ']') {
+					i++
+				}
+				value.WriteByte(msg[i])
+				i++
+			}
+			params[name] = value.String()
+			i++ // closing quote
+		}
+		if i >= len(msg) || msg[i] != ']' {
+			return result, msg
+		}
+		result[id] = params
+		msg = msg[i+1:]
+	}
+	return result, msg
+}
+
+// RFC 3164: TIMESTAMP SP HOSTNAME SP TAG[PID]: MSG, where TIMESTAMP is like "Oct 11 22:14:15".
+// Many implementations deviate from RFC 3164, so if there is no valid timestamp,
+// the remaining message is returned as it is.
+func parseRfc3164(msg string, extra map[string]interface{}) (string, map[string]interface{}) {
+	const timestampLayout = "Jan _2 15:04:05"
+	if len(msg) < len(timestampLayout)+1 || msg[len(timestampLayout)] != ' ' {
+		return msg, extra
+	}
+	if _, err := time.Parse(timestampLayout, msg[:len(timestampLayout)]); err != nil {
+		return msg, extra
+	}
+	extra["timestamp"] = msg[:len(timestampLayout)]
+	msg = msg[len(timestampLayout)+1:]
+
+	// The HOSTNAME is missing if the first word is already the TAG, like in "su[123]: ..." or "su: ...".
+	word, rest := nextSyslogField(msg)
+	if !strings.HasSuffix(word, ":") && !strings.HasSuffix(word, "]") {
+		extra["hostname"] = word
+		msg = rest
+	}
+	word, rest = nextSyslogField(msg)
+	tag := strings.TrimSuffix(word, ":")
+	if tag == word && !strings.HasSuffix(word, "]") {
+		// no TAG, the remaining message is the MSG
+		return msg, extra
+	}
+	if start := strings.IndexByte(tag, '['); start > 0 && strings.HasSuffix(tag, "]") {
+		extra["procid"] = tag[start+1 : len(tag)-1]
+		tag = tag[:start]
+	}
+	extra["app_name"] = tag
+	return rest, extra
+}
+
+func nextSyslogField(msg string) (string, string) {
+	end := strings.IndexByte(msg, ' ')
+	if end < 0 {
+		return msg, ""
+	}
+	return msg[:end], msg[end+1:]
+}
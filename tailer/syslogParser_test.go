@@ -0,0 +1,97 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		msg           string
+		expectedLine  string
+		expectedExtra map[string]interface{}
+	}{
+		{
+			name:         "RFC 3164",
+			msg:          "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			expectedLine: "'su root' failed for lonvick on /dev/pts/8",
+			expectedExtra: map[string]interface{}{
+				"facility": "auth", "severity": "crit", "timestamp": "Oct 11 22:14:15", "hostname": "mymachine",
+				"app_name": "su", "procid": "", "msgid": "", "structured_data": map[string]interface{}{},
+			},
+		},
+		{
+			name:         "RFC 3164 with PID and without HOSTNAME",
+			msg:          "<30>Jun  1 08:00:01 sshd[4242]: Accepted publickey for alice\n",
+			expectedLine: "Accepted publickey for alice",
+			expectedExtra: map[string]interface{}{
+				"facility": "daemon", "severity": "info", "timestamp": "Jun  1 08:00:01", "hostname": "",
+				"app_name": "sshd", "procid": "4242", "msgid": "", "structured_data": map[string]interface{}{},
+			},
+		},
+		{
+			name:         "without PRI",
+			msg:          "just a message",
+			expectedLine: "just a message",
+			expectedExtra: map[string]interface{}{
+				"facility": "user", "severity": "notice", "timestamp": "", "hostname": "",
+				"app_name": "", "procid": "", "msgid": "", "structured_data": map[string]interface{}{},
+			},
+		},
+		{
+			name:         "RFC 5424",
+			msg:          "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xEF\xBB\xBF'su root' failed for lonvick on /dev/pts/8",
+			expectedLine: "'su root' failed for lonvick on /dev/pts/8",
+			expectedExtra: map[string]interface{}{
+				"facility": "auth", "severity": "crit", "timestamp": "2003-10-11T22:14:15.003Z", "hostname": "mymachine.example.com",
+				"app_name": "su", "procid": "", "msgid": "ID47", "structured_data": map[string]interface{}{},
+			},
+		},
+		{
+			name:         "RFC 5424 with structured data",
+			msg:          `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Appli\]cation"][examplePriority@32473 class="high"] An application event`,
+			expectedLine: "An application event",
+			expectedExtra: map[string]interface{}{
+				"facility": "local4", "severity": "notice", "timestamp": "2003-10-11T22:14:15.003Z", "hostname": "mymachine.example.com",
+				"app_name": "evntslog", "procid": "1234", "msgid": "ID47", "structured_data": map[string]interface{}{
+					"exampleSDID@32473":     map[string]interface{}{"iut": "3", "eventSource": "Appli]cation"},
+					"examplePriority@32473": map[string]interface{}{"class": "high"},
+				},
+			},
+		},
+		{
+			name:         "RFC 5424 without MSG",
+			msg:          "<165>1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 myproc 8710 - -",
+			expectedLine: "",
+			expectedExtra: map[string]interface{}{
+				"facility": "local4", "severity": "notice", "timestamp": "2003-08-24T05:14:15.000003-07:00", "hostname": "192.0.2.1",
+				"app_name": "myproc", "procid": "8710", "msgid": "", "structured_data": map[string]interface{}{},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			line, extra := parseSyslogMessage(test.msg)
+			if line != test.expectedLine {
+				t.Fatalf("expected line %q, but got %q", test.expectedLine, line)
+			}
+			if !reflect.DeepEqual(extra, test.expectedExtra) {
+				t.Fatalf("expected extra fields %v, but got %v", test.expectedExtra, extra)
+			}
+		})
+	}
+}
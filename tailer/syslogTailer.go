@@ -0,0 +1,169 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum size of a syslog message. UDP datagrams cannot be larger than that anyway.
+const maxSyslogMessageSize = 64 * 1024
+
+type syslogTailer struct {
+	*listenerTailer
+	udpConn net.PacketConn
+	tcpLn   net.Listener
+}
+
+// There is one syslog tailer per combination of UDP and TCP address, see listenerTailer.
+var syslogTailers = make(map[string]*sharedTailer)
+
+func RunSyslogTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	shared, err := runSharedListener(syslogTailers, syslogTailerKey(cfg.SyslogUdpAddress, cfg.SyslogTcpAddress), func() (fswatcher.FileTailer, error) {
+		return runSyslogTailer(cfg.SyslogUdpAddress, cfg.SyslogTcpAddress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shared.newRef(nil), nil
+}
+
+func syslogTailerKey(udpAddress, tcpAddress string) string {
+	return udpAddress + " " + tcpAddress
+}
+
+func runSyslogTailer(udpAddress, tcpAddress string) (*syslogTailer, error) {
+	var err error
+	t := &syslogTailer{
+		listenerTailer: newListenerTailer(syslogTailers, syslogTailerKey(udpAddress, tcpAddress)),
+	}
+	if len(udpAddress) > 0 {
+		t.udpConn, err = net.ListenPacket("udp", udpAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog messages on UDP address %v: %v", udpAddress, err)
+		}
+		t.addListener(t.udpConn)
+	}
+	if len(tcpAddress) > 0 {
+		t.tcpLn, err = net.Listen("tcp", tcpAddress)
+		if err != nil {
+			t.stop()
+			return nil, fmt.Errorf("failed to listen for syslog messages on TCP address %v: %v", tcpAddress, err)
+		}
+		t.addListener(t.tcpLn)
+	}
+	if t.udpConn != nil {
+		go t.readUdp()
+	}
+	if t.tcpLn != nil {
+		go t.accept(t.tcpLn, "syslog", t.readTcp)
+	}
+	return t, nil
+}
+
+// Each UDP datagram contains exactly one syslog message.
+func (t *syslogTailer) readUdp() {
+	buf := make([]byte, maxSyslogMessageSize)
+	for {
+		n, _, err := t.udpConn.ReadFrom(buf)
+		if err != nil {
+			if isTemporary(err) {
+				continue
+			}
+			t.sendError(fswatcher.NewErrorf(fswatcher.NotSpecified, err, "failed to read syslog message from %v", t.udpConn.LocalAddr()))
+			return
+		}
+		t.process(string(buf[:n]))
+	}
+}
+
+// Messages on a TCP connection are framed as described in RFC 6587: With octet counting, each message is prefixed
+// with its length, like "11 <13>message". With non-transparent framing, each message is terminated by a newline.
+// Errors on a single connection are logged, because they should not terminate grok_exporter.
+func (t *syslogTailer) readTcp(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxSyslogMessageSize)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF && !isStopped(t.stopped) {
+				logrus.Warnf("closing syslog connection from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		t.process(msg)
+	}
+}
+
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] < '0' || first[0] > '9' {
+		return readSyslogLine(reader)
+	}
+	// ReadSlice() fails if there is no space within maxSyslogMessageSize bytes.
+	lengthBytes, err := reader.ReadSlice(' ')
+	if err != nil {
+		return "", err
+	}
+	lengthString := string(lengthBytes)
+	length, err := strconv.Atoi(strings.TrimSuffix(lengthString, " "))
+	if err != nil || length <= 0 || length > maxSyslogMessageSize {
+		return "", fmt.Errorf("invalid message length %q", lengthString)
+	}
+	msg := make([]byte, length)
+	_, err = io.ReadFull(reader, msg)
+	if err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// Non-transparent framing: The message is terminated by a newline. Like with octet counting, the size is limited to maxSyslogMessageSize.
+func readSyslogLine(reader *bufio.Reader) (string, error) {
+	var msg []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if len(msg)+len(fragment) > maxSyslogMessageSize+1 {
+			return "", fmt.Errorf("message larger than %v bytes", maxSyslogMessageSize)
+		}
+		msg = append(msg, fragment...)
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(msg) > 0:
+			return string(msg), nil // last message without trailing newline
+		case err != nil:
+			return "", err
+		default:
+			return string(msg), nil
+		}
+	}
+}
+
+func (t *syslogTailer) process(msg string) {
+	line, extra := parseSyslogMessage(msg)
+	t.sendLine(&fswatcher.Line{Line: line, Extra: extra})
+}
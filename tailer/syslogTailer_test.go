@@ -0,0 +1,138 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+func TestSyslogTailer(t *testing.T) {
+	tail, err := runSyslogTailer("127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.stop()
+
+	udpConn, err := net.Dial("udp", tail.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	_, err = udpConn.Write([]byte("<34>Oct 11 22:14:15 mymachine su: udp message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSyslogLine(t, tail, "udp message", "mymachine")
+
+	tcpConn, err := net.Dial("tcp", tail.tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	// octet counting and non-transparent framing on the same connection
+	octetCounted := "<34>1 2003-10-11T22:14:15.003Z host1 su - - - tcp message\nwith newline"
+	_, err = tcpConn.Write([]byte(fmt.Sprintf("%v %v<34>Oct 11 22:14:15 host2 su: second message\n", len(octetCounted), octetCounted)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSyslogLine(t, tail, "tcp message\nwith newline", "host1")
+	expectSyslogLine(t, tail, "second message", "host2")
+}
+
+// Without octet counting, messages are terminated by a newline. A message or length that is too long closes the connection.
+func TestReadSyslogLine(t *testing.T) {
+	for _, test := range []struct {
+		input, expected string
+		expectError     bool
+	}{
+		{"<34>message\nnext", "<34>message\n", false},
+		{"<34>last message", "<34>last message", false},
+		{"<34>" + strings.Repeat("a", maxSyslogMessageSize-5) + "\n", "<34>" + strings.Repeat("a", maxSyslogMessageSize-5) + "\n", false},
+		{"<34>" + strings.Repeat("a", 2*maxSyslogMessageSize) + "\n", "", true},
+		{strings.Repeat("1", 2*maxSyslogMessageSize), "", true},
+	} {
+		msg, err := readSyslogFrame(bufio.NewReaderSize(strings.NewReader(test.input), maxSyslogMessageSize))
+		if test.expectError != (err != nil) || msg != test.expected {
+			t.Fatalf("unexpected result for %.20q: %.20q, %v", test.input, msg, err)
+		}
+	}
+}
+
+// The listeners are closed when the last input using them is closed.
+func TestSyslogTailerClose(t *testing.T) {
+	cfg := &configuration.InputConfig{
+		Type:             "syslog",
+		SyslogTcpAddress: "127.0.0.1:0",
+	}
+	oldTail, err := RunSyslogTailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTail, err := RunSyslogTailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := syslogTailers[" 127.0.0.1:0"].tailer.(*syslogTailer).tcpLn.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	activate(newTail)
+	oldTail.Close()
+	_, err = conn.Write([]byte("<34>Oct 11 22:14:15 mymachine su: message\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSyslogLine(t, newTail, "message", "mymachine")
+
+	newTail.Close()
+	if len(syslogTailers) != 0 {
+		t.Fatalf("expected the syslog tailer to be removed, but got %v", syslogTailers)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("expected the connection to be closed, but got %v bytes: %v", n, err)
+	}
+	if conn, err = net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatalf("expected the listener to be closed")
+	}
+}
+
+func expectSyslogLine(t *testing.T, tail fswatcher.FileTailer, expectedLine, expectedHostname string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expectedLine {
+			t.Fatalf("Expected %q, but got %q.", expectedLine, line.Line)
+		}
+		hostname := line.Extra.(map[string]interface{})["hostname"]
+		if hostname != expectedHostname {
+			t.Fatalf("Expected hostname %q, but got %q.", expectedHostname, hostname)
+		}
+	case err := <-tail.Errors():
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout while waiting for %q.", expectedLine)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Reasons for rejecting a webhook request, used as label values for the rejected requests metric.
+const (
+	WebhookMissingCredentials = "missing_credentials"
+	WebhookInvalidCredentials = "invalid_credentials"
+	WebhookMissingSignature   = "missing_signature"
+	WebhookInvalidSignature   = "invalid_signature"
+)
+
+var WebhookRejectReasons = []string{WebhookMissingCredentials, WebhookInvalidCredentials, WebhookMissingSignature, WebhookInvalidSignature}
+
+// Stripe signatures contain a timestamp. Older signatures are rejected to prevent replay attacks.
+const stripeSignatureTolerance = 5 * time.Minute
+
+type webhookAuth struct {
+	bearerToken  []byte
+	username     string
+	passwordHash []byte // bcrypt
+	hmacSecret   []byte
+	hmacHeader   string
+	hmacFormat   string // github, stripe, or hex
+}
+
+// Returns nil if authentication is not configured. Secret files are read again each time the configuration is reloaded,
+// because inputs with secret files are restarted on each reload.
+func newWebhookAuth(cfg *configuration.WebhookAuthConfig) (*webhookAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	bearerToken, err := readSecret(cfg.BearerToken, cfg.BearerTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := readSecret(cfg.PasswordHash, cfg.PasswordHashFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.PasswordHashFile) > 0 {
+		if _, err = bcrypt.Cost([]byte(passwordHash)); err != nil {
+			return nil, fmt.Errorf("%v: not a valid bcrypt hash: %v", cfg.PasswordHashFile, err)
+		}
+	}
+	hmacSecret, err := readSecret(cfg.HmacSecret, cfg.HmacSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookAuth{
+		bearerToken:  []byte(bearerToken),
+		username:     cfg.Username,
+		passwordHash: []byte(passwordHash),
+		hmacSecret:   []byte(hmacSecret),
+		hmacHeader:   cfg.HmacHeader,
+		hmacFormat:   cfg.HmacFormat,
+	}, nil
+}
+
+// The trailing newline is removed, because most editors and 'echo' add one.
+func readSecret(value, file string) (string, error) {
+	if len(file) == 0 {
+		return value, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %v", err)
+	}
+	secret := strings.TrimRight(string(content), "\r\n")
+	if len(secret) == 0 {
+		return "", fmt.Errorf("%v: file is empty", file)
+	}
+	return secret, nil
+}
+
+// Checks the Authorization header. Returns the reason if the request is rejected, or "" if it is accepted.
+// The body is not needed, so this can be called before the body is read.
+func (a *webhookAuth) checkCredentials(r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+	if len(a.bearerToken) > 0 {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return WebhookMissingCredentials
+		}
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		if subtle.ConstantTimeCompare(token, a.bearerToken) != 1 {
+			return WebhookInvalidCredentials
+		}
+	}
+	if len(a.username) > 0 {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return WebhookMissingCredentials
+		}
+		// The password is checked even if the username is wrong, so that the response time doesn't tell if the username exists.
+		passwordErr := bcrypt.CompareHashAndPassword(a.passwordHash, []byte(password))
+		if subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) != 1 || passwordErr != nil {
+			return WebhookInvalidCredentials
+		}
+	}
+	return ""
+}
+
+// If true, the raw request body must be hashed, see parseSignature().
+func (a *webhookAuth) signsBody() bool {
+	return a != nil && len(a.hmacSecret) > 0
+}
+
+// HMAC-SHA256 signature of the request body. The body is written to the signature while it is read,
+// so that it does not need to be kept in memory until the signature is checked.
+type webhookSignature struct {
+	mac        hash.Hash
+	signatures [][]byte // the body is accepted if it matches one of them
+}
+
+func (s *webhookSignature) Write(p []byte) (int, error) {
+	return s.mac.Write(p)
+}
+
+// Must be called after the entire body was written. Returns the reason if the request is rejected, or "" if it is accepted.
+func (s *webhookSignature) check() string {
+	sum := s.mac.Sum(nil)
+	for _, signature := range s.signatures {
+		if hmac.Equal(signature, sum) {
+			return ""
+		}
+	}
+	return WebhookInvalidSignature
+}
+
+// Parses the signature header, so that requests without a valid header are rejected before the body is read.
+// Returns the reason if the request is rejected.
+func (a *webhookAuth) parseSignature(r *http.Request, now time.Time) (*webhookSignature, string) {
+	header := r.Header.Get(a.hmacHeader)
+	if len(header) == 0 {
+		return nil, WebhookMissingSignature
+	}
+	switch a.hmacFormat {
+	case "github":
+		// X-Hub-Signature-256: sha256=<hex>
+		if !strings.HasPrefix(header, "sha256=") {
+			return nil, WebhookInvalidSignature
+		}
+		return a.newSignature("", strings.TrimPrefix(header, "sha256="))
+	case "stripe":
+		return a.parseStripeSignature(header, now)
+	default:
+		return a.newSignature("", header)
+	}
+}
+
+// Stripe-Signature: t=<unix timestamp>,v1=<hex>[,v1=<hex>...]
+// The signed payload is the timestamp, a dot, and the body. There may be multiple v1 signatures while a secret is rolled.
+func (a *webhookAuth) parseStripeSignature(header string, now time.Time) (*webhookSignature, string) {
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, field := range strings.Split(header, ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "t":
+			timestamp = keyValue[1]
+		case "v1":
+			signatures = append(signatures, keyValue[1])
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return nil, WebhookInvalidSignature
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return nil, WebhookInvalidSignature
+	}
+	return a.newSignature(timestamp+".", signatures...)
+}
+
+// The prefix is hashed before the body. Signatures that are not hex encoded are ignored, the request is rejected if none is left.
+func (a *webhookAuth) newSignature(prefix string, hexSignatures ...string) (*webhookSignature, string) {
+	result := &webhookSignature{
+		mac: hmac.New(sha256.New, a.hmacSecret),
+	}
+	for _, hexSignature := range hexSignatures {
+		if decoded, err := hex.DecodeString(hexSignature); err == nil {
+			result.signatures = append(result.signatures, decoded)
+		}
+	}
+	if len(result.signatures) == 0 {
+		return nil, WebhookInvalidSignature
+	}
+	result.mac.Write([]byte(prefix))
+	return result, ""
+}
+
+// Missing credentials are answered with 401 Unauthorized, so that clients know they should authenticate.
+// Wrong credentials are answered with 403 Forbidden.
+func (a *webhookAuth) reject(w http.ResponseWriter, reason string) int {
+	status := http.StatusForbidden
+	if reason == WebhookMissingCredentials || reason == WebhookMissingSignature {
+		status = http.StatusUnauthorized
+		if len(a.bearerToken) > 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="grok_exporter"`)
+		} else if len(a.username) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="grok_exporter"`)
+		}
+	}
+	http.Error(w, http.StatusText(status), status)
+	return status
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// implements WebhookMetrics
+type webhookRequests struct {
+	reasons  []string
+	statuses []int
+	nBytes   int
+	nLines   int
+}
+
+func (m *webhookRequests) FileRotated(_ string)   {}
+func (m *webhookRequests) FileTruncated(_ string) {}
+func (m *webhookRequests) LineOversized(_ string) {}
+
+func (m *webhookRequests) WebhookRequestRejected(reason string) {
+	m.reasons = append(m.reasons, reason)
+}
+
+func (m *webhookRequests) WebhookRequestServed(status, nBytes, nLines int) {
+	m.statuses = append(m.statuses, status)
+	m.nBytes += nBytes
+	m.nLines += nLines
+}
+
+func TestWebhookBearerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	metrics := &webhookRequests{}
+	tail := initWebhookTailerOrFail(t, "/bearer", &configuration.WebhookAuthConfig{BearerTokenFile: tokenFile}, metrics)
+	for _, test := range []struct {
+		authorization  string
+		expectedStatus int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusForbidden},
+		{"Basic czNjcjN0", http.StatusUnauthorized},
+		{"Bearer s3cr3t", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/bearer", strings.NewReader("hello"))
+		if len(test.authorization) > 0 {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := serveWebhookRequest(t, tail, req, test.expectedStatus == http.StatusOK)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%q: expected status %v, but got %v", test.authorization, test.expectedStatus, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Bearer realm="grok_exporter"` {
+			t.Fatalf("%q: unexpected WWW-Authenticate header %q", test.authorization, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	expectReasons(t, metrics, WebhookMissingCredentials, WebhookInvalidCredentials, WebhookMissingCredentials)
+}
+
+func TestWebhookBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := &webhookRequests{}
+	tail := initWebhookTailerOrFail(t, "/basic-auth", &configuration.WebhookAuthConfig{Username: "shipper", PasswordHash: string(hash)}, metrics)
+	for _, test := range []struct {
+		username, password string
+		expectedStatus     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"shipper", "wrong", http.StatusForbidden},
+		{"other", "s3cr3t", http.StatusForbidden},
+		{"shipper", "s3cr3t", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/basic-auth", strings.NewReader("hello"))
+		if len(test.username) > 0 {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		w := serveWebhookRequest(t, tail, req, test.expectedStatus == http.StatusOK)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%v:%v: expected status %v, but got %v", test.username, test.password, test.expectedStatus, w.Code)
+		}
+	}
+	expectReasons(t, metrics, WebhookMissingCredentials, WebhookInvalidCredentials, WebhookInvalidCredentials)
+}
+
+func TestWebhookHmacSignature(t *testing.T) {
+	metrics := &webhookRequests{}
+	tail := initWebhookTailerOrFail(t, "/github", &configuration.WebhookAuthConfig{HmacSecret: "s3cr3t", HmacFormat: "github", HmacHeader: "X-Hub-Signature-256"}, metrics)
+	for _, test := range []struct {
+		signature      string
+		expectedStatus int
+	}{
+		{"", http.StatusUnauthorized},
+		{"sha256=" + hmacHex("wrong", "hello"), http.StatusForbidden},
+		{hmacHex("s3cr3t", "hello"), http.StatusForbidden}, // missing sha256= prefix
+		{"sha256=" + hmacHex("s3cr3t", "hello"), http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/github", strings.NewReader("hello"))
+		if len(test.signature) > 0 {
+			req.Header.Set("X-Hub-Signature-256", test.signature)
+		}
+		w := serveWebhookRequest(t, tail, req, test.expectedStatus == http.StatusOK)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%q: expected status %v, but got %v", test.signature, test.expectedStatus, w.Code)
+		}
+	}
+	expectReasons(t, metrics, WebhookMissingSignature, WebhookInvalidSignature, WebhookInvalidSignature)
+	// The body is hashed while it is read, but the lines of rejected requests are not queued.
+	select {
+	case line := <-tail.Lines():
+		t.Fatalf("unexpected line %q", line.Line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookStripeSignature(t *testing.T) {
+	auth, err := newWebhookAuth(&configuration.WebhookAuthConfig{HmacSecret: "s3cr3t", HmacFormat: "stripe", HmacHeader: "Stripe-Signature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	valid := hmacHex("s3cr3t", "1600000000.hello")
+	for _, test := range []struct {
+		signature, expectedReason string
+	}{
+		{"t=1600000000,v1=" + valid, ""},
+		{"t=1600000000,v1=" + hmacHex("old", "1600000000.hello") + ",v1=" + valid, ""}, // secret is being rolled
+		{"t=1600000000,v0=" + valid, WebhookInvalidSignature},
+		{"t=1600000001,v1=" + valid, WebhookInvalidSignature},
+		{"t=1599999000,v1=" + hmacHex("s3cr3t", "1599999000.hello"), WebhookInvalidSignature}, // too old
+		{"v1=" + valid, WebhookInvalidSignature},
+	} {
+		req := httptest.NewRequest("POST", "/stripe", nil)
+		req.Header.Set("Stripe-Signature", test.signature)
+		signature, reason := auth.parseSignature(req, now)
+		if reason == "" {
+			signature.Write([]byte("hello"))
+			reason = signature.check()
+		}
+		if reason != test.expectedReason {
+			t.Fatalf("%q: expected %q, but got %q", test.signature, test.expectedReason, reason)
+		}
+	}
+}
+
+func initWebhookTailerOrFail(t *testing.T, path string, auth *configuration.WebhookAuthConfig, metrics WebhookMetrics) fswatcher.FileTailer {
+	tail, err := InitWebhookTailer(&configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         path,
+		WebhookFormat:       "text_single",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+		WebhookAuth:         auth,
+	}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tail
+}
+
+// If the request is expected to be accepted, the line is read from the tailer.
+func serveWebhookRequest(t *testing.T, tail fswatcher.FileTailer, req *http.Request, expectLine bool) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	WebhookHandler(req.URL.Path).ServeHTTP(w, req)
+	if expectLine {
+		expectWebhookLine(t, tail, "hello")
+	}
+	return w
+}
+
+func expectWebhookLine(t *testing.T, tail fswatcher.FileTailer, expected string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expected {
+			t.Fatalf("expected line %q, but got %q", expected, line.Line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout while waiting for line %q", expected)
+	}
+}
+
+func expectReasons(t *testing.T, metrics *webhookRequests, expected ...string) {
+	if fmt.Sprintf("%v", metrics.reasons) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("expected rejected requests %v, but got %v", expected, metrics.reasons)
+	}
+}
+
+func hmacHex(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
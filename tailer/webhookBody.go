@@ -0,0 +1,225 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	json "github.com/bitly/go-simplejson"
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Value of the Accept-Encoding header when a request with an unsupported Content-Encoding is rejected.
+const webhookAcceptEncoding = "gzip, deflate, zstd"
+
+// Returned when the request is too large, so that it can be answered with 413 Request Entity Too Large.
+var errWebhookRequestTooLarge = errors.New("request too large")
+
+// Returned when the Content-Encoding is not supported, so that it can be answered with 415 Unsupported Media Type.
+var errWebhookUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// Wraps the request body with a decompressor for the Content-Encoding.
+// The returned reader fails with errWebhookRequestTooLarge if the decompressed body is larger than maxBytes,
+// so that a small compressed request cannot make grok_exporter run out of memory.
+func decodeWebhookBody(body io.Reader, contentEncoding string, maxBytes int) (io.ReadCloser, error) {
+	var (
+		decoded io.ReadCloser
+		err     error
+	)
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		decoded = ioutil.NopCloser(body)
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(body)
+	case "deflate":
+		// HTTP's deflate is the zlib format, see RFC 9110 section 8.4.1.2.
+		decoded, err = zlib.NewReader(body)
+	case "zstd":
+		var decoder *zstd.Decoder
+		// The window size is limited, too, because the decoder allocates it before anything is read.
+		decoder, err = zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxMemory(uint64(maxBytes)+1))
+		if err == nil {
+			decoded = decoder.IOReadCloser()
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errWebhookUnsupportedEncoding, contentEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v request body: %v", contentEncoding, err)
+	}
+	return &maxBytesReader{ReadCloser: decoded, remaining: int64(maxBytes)}, nil
+}
+
+type maxBytesReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, fmt.Errorf("%w: request body exceeds webhook_max_body_bytes", errWebhookRequestTooLarge)
+	}
+	// Read one more byte than allowed to find out if the limit is exceeded.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n - 1, fmt.Errorf("%w: request body exceeds webhook_max_body_bytes", errWebhookRequestTooLarge)
+	}
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+// Calls emit for each log line in the body. The json_lines and text_bulk formats are read line by line,
+// so that the raw body doesn't need to be kept in memory. The other formats are read as a whole.
+// The Content-Type is only used for the loki_push and otlp_logs formats.
+func readWebhookBody(c *configuration.InputConfig, contentType string, body io.Reader, emit func(context_string) error) error {
+	switch c.WebhookFormat {
+	case "json_lines":
+		return readWebhookJsonLines(c, body, emit)
+	case "text_bulk":
+		return readWebhookTextBulk(c, body, emit)
+	case "loki_push":
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return webhookReadError(err)
+		}
+		return parseLokiPush(b, contentType, c.WebhookMaxBodyBytes, emit)
+	case "otlp_logs":
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return webhookReadError(err)
+		}
+		return parseOtlpLogs(b, contentType, emit)
+	default:
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return webhookReadError(err)
+		}
+		strs, err := parseWebhookBody(c, b)
+		if err != nil {
+			return err
+		}
+		for _, s := range strs {
+			if err = emit(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func readWebhookJsonLines(c *configuration.InputConfig, body io.Reader, emit func(context_string) error) error {
+	if len(c.WebhookJsonSelector) == 0 || c.WebhookJsonSelector[0] != '.' {
+		return fmt.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
+	}
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return webhookReadError(err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			j, jsonErr := json.NewJson(line)
+			if jsonErr != nil {
+				return fmt.Errorf("unable to parse JSON: %v", jsonErr)
+			}
+			s, jsonErr := processPath(j, c.WebhookJsonSelector)
+			if jsonErr != nil {
+				return fmt.Errorf("unable to find webhook_json_selector %v: %v", c.WebhookJsonSelector, jsonErr)
+			}
+			if emitErr := emit(context_string{line: strings.TrimSpace(s), extra: j.MustMap()}); emitErr != nil {
+				return emitErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Empty entries at the beginning and at the end of the body are skipped, like in parseWebhookBody() where the
+// whole body is trimmed before it is split. Unlike parseWebhookBody(), this also skips the empty entry after a
+// trailing separator if the separator is not whitespace, like in "a|b|".
+func readWebhookTextBulk(c *configuration.InputConfig, body io.Reader, emit func(context_string) error) error {
+	scanner := bufio.NewScanner(body)
+	// The size of a single entry is limited by webhook_max_body_bytes, the scanner must not fail earlier.
+	scanner.Buffer(make([]byte, 4096), c.WebhookMaxBodyBytes+len(c.WebhookTextBulkSeparator)+1)
+	scanner.Split(splitOnSeparator([]byte(c.WebhookTextBulkSeparator)))
+	nSkippedEmptyEntries, started := 0, false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			if started {
+				nSkippedEmptyEntries++
+			}
+			continue
+		}
+		for ; nSkippedEmptyEntries > 0; nSkippedEmptyEntries-- {
+			if err := emit(context_string{line: ""}); err != nil {
+				return err
+			}
+		}
+		started = true
+		if err := emit(context_string{line: line}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return webhookReadError(err)
+	}
+	return nil
+}
+
+func splitOnSeparator(separator []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.Index(data, separator); i >= 0 {
+			return i + len(separator), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// Errors decompressing the body are the client's fault, too, so they are answered with 400 Bad Request.
+func webhookReadError(err error) error {
+	if errors.Is(err, errWebhookRequestTooLarge) {
+		return err
+	}
+	return fmt.Errorf("failed to read request body: %v", err)
+}
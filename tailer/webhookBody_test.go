@@ -0,0 +1,152 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWebhookContentEncoding(t *testing.T) {
+	metrics := &webhookRequests{}
+	tail, err := InitWebhookTailer(&configuration.InputConfig{
+		Type:                     "webhook",
+		WebhookPath:              "/content-encoding",
+		WebhookFormat:            "text_bulk",
+		WebhookTextBulkSeparator: "\n",
+		WebhookQueueSize:         10,
+		WebhookMaxBodyBytes:      1024,
+	}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		contentEncoding string
+		body            []byte
+		expectedStatus  int
+	}{
+		{"", []byte("hello\n"), http.StatusOK},
+		{"identity", []byte("hello\n"), http.StatusOK},
+		{"gzip", compress(t, "gzip", "hello\n"), http.StatusOK},
+		{"x-gzip", compress(t, "gzip", "hello\n"), http.StatusOK},
+		{"deflate", compress(t, "deflate", "hello\n"), http.StatusOK},
+		{"zstd", compress(t, "zstd", "hello\n"), http.StatusOK},
+		{"br", []byte("hello\n"), http.StatusUnsupportedMediaType},
+		{"gzip", []byte("hello\n"), http.StatusBadRequest},
+		{"gzip", compress(t, "gzip", "hello\n")[:15], http.StatusBadRequest},                       // truncated
+		{"gzip", compress(t, "gzip", strings.Repeat(" ", 1025)), http.StatusRequestEntityTooLarge}, // decompresses to more than 1024 bytes
+		{"", []byte(strings.Repeat(" ", 1025)), http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/content-encoding", bytes.NewReader(test.body))
+		if len(test.contentEncoding) > 0 {
+			req.Header.Set("Content-Encoding", test.contentEncoding)
+		}
+		w := serveWebhookRequest(t, tail, req, test.expectedStatus == http.StatusOK)
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%q: expected status %v, but got %v", test.contentEncoding, test.expectedStatus, w.Code)
+		}
+		if w.Code == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Encoding") != "gzip, deflate, zstd" {
+			t.Fatalf("%q: unexpected Accept-Encoding header %q", test.contentEncoding, w.Header().Get("Accept-Encoding"))
+		}
+	}
+}
+
+// The signature is calculated over the compressed body, as it was sent.
+func TestWebhookSignedCompressedBody(t *testing.T) {
+	tail := initWebhookTailerOrFail(t, "/signed-gzip", &configuration.WebhookAuthConfig{HmacSecret: "s3cr3t", HmacFormat: "hex", HmacHeader: "X-Signature"}, &webhookRequests{})
+	body := compress(t, "gzip", "hello")
+	req := httptest.NewRequest("POST", "/signed-gzip", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Signature", hmacHex("s3cr3t", string(body)))
+	w := serveWebhookRequest(t, tail, req, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, but got %v", w.Code)
+	}
+}
+
+// text_bulk and json_lines are read line by line, the result must be the same as if the body was read as a whole.
+func TestWebhookStreamingFormats(t *testing.T) {
+	for _, test := range []struct {
+		format, separator, body string
+	}{
+		{"text_bulk", "\n\n", "a\n\nb"},
+		{"text_bulk", "\n\n", "\n\n  a\n\n\n\nb \n\n\n"},
+		{"text_bulk", "\n\n", "a\n\n\n\n\n\nb"},
+		{"text_bulk", "|", "a|b|c"},
+		{"json_lines", "", "{\"message\": \"a\"}\n\n{\"message\": \" b \"}"},
+		{"json_lines", "", "{\"message\": \"a\"}\r\n{\"message\": \"b\"}\r\n"},
+	} {
+		c := &configuration.InputConfig{
+			Type:                     "webhook",
+			WebhookFormat:            test.format,
+			WebhookJsonSelector:      ".message",
+			WebhookTextBulkSeparator: test.separator,
+			WebhookMaxBodyBytes:      1024,
+		}
+		expected, err := parseWebhookBody(c, []byte(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []context_string
+		err = readWebhookBody(c, "", strings.NewReader(test.body), func(s context_string) error {
+			actual = append(actual, s)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+			t.Fatalf("%q: expected %q, but got %q", test.body, expected, actual)
+		}
+	}
+}
+
+func compress(t *testing.T, compression, s string) []byte {
+	var (
+		buf    bytes.Buffer
+		writer interface {
+			Write([]byte) (int, error)
+			Close() error
+		}
+		err error
+	)
+	switch compression {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "zstd":
+		writer, err = zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = writer.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
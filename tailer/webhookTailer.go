@@ -19,12 +19,16 @@ import (
 	"errors"
 	"fmt"
 	json "github.com/bitly/go-simplejson"
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/jsonselector"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 type context_string struct {
@@ -35,12 +39,34 @@ type context_string struct {
 }
 
 type WebhookTailer struct {
-	lines  chan *fswatcher.Line
-	errors chan fswatcher.Error
-	config *configuration.InputConfig
+	lines   chan *fswatcher.Line
+	errors  chan fswatcher.Error
+	queue   lineBuffer // lines are queued so that requests don't wait until the lines are processed
+	shared  *sharedTailer
+	mutex   sync.Mutex // protects the following fields, which are replaced when the configuration is reloaded
+	config  *configuration.InputConfig
+	auth    *webhookAuth // nil if authentication is not configured
+	metrics WebhookMetrics
+	closed  bool
+	pending int // number of lines of requests being read, and of lines in the queue, limited by webhook_queue_size
 }
 
-var webhookTailerSingleton *WebhookTailer
+// WebhookMetrics is implemented by the caller to count webhook requests for self-monitoring.
+type WebhookMetrics interface {
+	fswatcher.Metrics
+	WebhookRequestRejected(reason string)            // reason is one of WebhookRejectReasons
+	WebhookRequestServed(status, nBytes, nLines int) // called for each request, nBytes and nLines are 0 if the request was not accepted
+}
+
+// Clients should retry after this many seconds if the queue is full.
+const webhookRetryAfterSeconds = "1"
+
+// Returned when no queue capacity can be reserved for a line, so that the request can be answered with 429 Too Many Requests.
+var errWebhookQueueFull = errors.New("the webhook queue is full")
+
+// There is one webhook tailer per webhook_path. The HTTP handlers are registered when the server is started,
+// so the tailers are re-used when the configuration is reloaded.
+var webhookTailers = make(map[string]*WebhookTailer)
 
 func (t *WebhookTailer) Lines() chan *fswatcher.Line {
 	return t.lines
@@ -50,65 +76,233 @@ func (t *WebhookTailer) Errors() chan fswatcher.Error {
 	return t.errors
 }
 
+// The webserver thread is handled by the metrics server, so requests are answered with 503 Service Unavailable after Close().
+// Close() is called when the last reference is closed, see sharedTailer.
 func (t *WebhookTailer) Close() {
-	// NO-OP, since the webserver thread is handled by the metrics server
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
 }
 
-func InitWebhookTailer(inputConfig *configuration.InputConfig) fswatcher.FileTailer {
-	if webhookTailerSingleton != nil {
-		return webhookTailerSingleton
+// Each input gets its own reference to the webhook tailer, see sharedTailer.
+func InitWebhookTailer(inputConfig *configuration.InputConfig, metrics WebhookMetrics) (fswatcher.FileTailer, error) {
+	auth, err := newWebhookAuth(inputConfig.WebhookAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration for input %v: webhook_auth: %v", inputConfig.Name, err)
 	}
+	t, exists := webhookTailers[inputConfig.WebhookPath]
+	if !exists {
+		t = newWebhookTailer(inputConfig, auth, metrics)
+		webhookTailers[inputConfig.WebhookPath] = t
+	}
+	// If the configuration was reloaded, the HTTP handler remains the same but the webhook format might have changed.
+	return t.shared.newRef(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.config = inputConfig
+		t.auth = auth
+		t.metrics = metrics
+		t.closed = false
+	}), nil
+}
 
+func newWebhookTailer(inputConfig *configuration.InputConfig, auth *webhookAuth, metrics WebhookMetrics) *WebhookTailer {
 	lineChan := make(chan *fswatcher.Line)
 	errorChan := make(chan fswatcher.Error)
-	webhookTailerSingleton = &WebhookTailer{
-		lines:  lineChan,
-		errors: errorChan,
-		config: inputConfig,
+	t := &WebhookTailer{
+		lines:   lineChan,
+		errors:  errorChan,
+		queue:   NewLineBuffer(),
+		config:  inputConfig,
+		auth:    auth,
+		metrics: metrics,
 	}
-	return webhookTailerSingleton
+	t.shared = newSharedTailer(t)
+	go func() {
+		for {
+			line := t.queue.BlockingPop()
+			if line == nil {
+				return
+			}
+			lineChan <- line
+			t.mutex.Lock()
+			t.pending--
+			t.mutex.Unlock()
+		}
+	}()
+	return t
 }
 
-func WebhookHandler() http.Handler {
-	return webhookTailerSingleton
+func WebhookHandler(webhookPath string) http.Handler {
+	return webhookTailers[webhookPath]
 }
 
-func (t WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Implement the http handler interface
+// Implement the http handler interface
+func (t *WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mutex.Lock()
+	cfg, auth, metrics, closed := t.config, t.auth, t.metrics, t.closed
+	t.mutex.Unlock()
+	var status, nBytes, nLines int
+	if closed {
+		status = webhookError(w, r, http.StatusServiceUnavailable, errors.New("the webhook input is shutting down"))
+	} else {
+		status, nBytes, nLines = t.serve(w, r, cfg, auth, metrics)
+	}
+	if metrics != nil {
+		metrics.WebhookRequestServed(status, nBytes, nLines)
+	}
+}
+
+// Errors are answered with a 4xx status if the client should not retry the request, or 429 or 503 if the client should try again later.
+// Either way, the request is rejected as a whole: Lines are only processed if the entire request is accepted.
+func (t *WebhookTailer) serve(w http.ResponseWriter, r *http.Request, cfg *configuration.InputConfig, auth *webhookAuth, metrics WebhookMetrics) (status, nBytes, nLines int) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		return webhookError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method)), 0, 0
+	}
 
-	wts := webhookTailerSingleton
-	lineChan := wts.lines
-	errorChan := wts.errors
+	if reason := auth.checkCredentials(r); reason != "" {
+		return rejectWebhookRequest(w, r, auth, metrics, reason), 0, 0
+	}
 
 	if r.Body == nil {
-		err := errors.New("got empty request body")
-		logrus.Warn(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
-		return
+		return webhookError(w, r, http.StatusBadRequest, errors.New("got empty request body")), 0, 0
+	}
+	defer r.Body.Close()
+	raw := &countingReader{Reader: r.Body}
+	var body io.Reader = raw
+
+	var signature *webhookSignature
+	if auth.signsBody() {
+		var reason string
+		if signature, reason = auth.parseSignature(r, time.Now()); reason != "" {
+			return rejectWebhookRequest(w, r, auth, metrics, reason), 0, 0
+		}
+		// The signature is calculated over the raw body, so it is hashed before the body is decompressed.
+		body = io.TeeReader(&maxBytesReader{ReadCloser: ioutil.NopCloser(raw), remaining: int64(cfg.WebhookMaxBodyBytes)}, signature)
+	}
+
+	// Lines are collected until the entire body is read, because the request is rejected as a whole if it contains an error.
+	// Queue capacity is reserved for each line as soon as it is read, so the lines of all requests that are being read
+	// and the lines in the queue never exceed the webhook_queue_size, and a request is rejected as soon as the queue is full.
+	lines := make([]*fswatcher.Line, 0)
+	decoded, err := decodeWebhookBody(body, r.Header.Get("Content-Encoding"), cfg.WebhookMaxBodyBytes)
+	if err == nil {
+		defer decoded.Close()
+		err = readWebhookBody(cfg, r.Header.Get("Content-Type"), decoded, func(context_string context_string) error {
+			line, ok := limitLineLength(context_string.line, cfg, metrics)
+			if !ok {
+				return nil
+			}
+			if len(lines) >= cfg.WebhookQueueSize {
+				return fmt.Errorf("%w: request has more than %v lines, which is the webhook_queue_size", errWebhookRequestTooLarge, cfg.WebhookQueueSize)
+			}
+			if !t.reserve(cfg.WebhookQueueSize) {
+				return errWebhookQueueFull
+			}
+			logrus.WithFields(logrus.Fields{
+				"line":  line,
+				"extra": context_string.extra,
+			}).Debug("Groking line")
+			lines = append(lines, &fswatcher.Line{Line: line, Extra: context_string.extra})
+			return nil
+		})
+	}
+
+	// The decoder may stop before the end of the body, so the rest of the body is hashed as well.
+	// Requests with a wrong signature are rejected as such, even if the body is invalid, too.
+	if signature != nil {
+		if _, drainErr := io.Copy(ioutil.Discard, body); drainErr != nil {
+			if err == nil {
+				err = webhookReadError(drainErr)
+			}
+		} else if reason := signature.check(); reason != "" {
+			t.release(len(lines))
+			return rejectWebhookRequest(w, r, auth, metrics, reason), 0, 0
+		}
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logrus.Warn(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
-		return
+		t.release(len(lines))
+		switch {
+		case errors.Is(err, errWebhookUnsupportedEncoding):
+			w.Header().Set("Accept-Encoding", webhookAcceptEncoding)
+			return webhookError(w, r, http.StatusUnsupportedMediaType, err), 0, 0
+		case errors.Is(err, errWebhookQueueFull):
+			return webhookError(w, r, http.StatusTooManyRequests, err), 0, 0
+		default:
+			return webhookReadErrorStatus(w, r, err), 0, 0
+		}
 	}
-	defer r.Body.Close()
 
-	context_strings := WebhookProcessBody(wts.config, b)
-	for _, context_string := range context_strings {
-		logrus.WithFields(logrus.Fields{
-			"line":  context_string.line,
-			"extra": context_string.extra,
-		}).Debug("Groking line")
-		lineChan <- &fswatcher.Line{Line: context_string.line, Extra: context_string.extra}
+	// The lines of a request are not interleaved with the lines of concurrent requests.
+	t.mutex.Lock()
+	for _, line := range lines {
+		t.queue.Push(line)
+	}
+	t.mutex.Unlock()
+	if cfg.WebhookFormat == "otlp_logs" {
+		writeOtlpLogsResponse(w, r.Header.Get("Content-Type"))
 	}
-	return
+	return http.StatusOK, raw.n, len(lines)
 }
 
+// Reserves queue capacity for one line. Returns false if the queue is full.
+func (t *WebhookTailer) reserve(queueSize int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending >= queueSize {
+		return false
+	}
+	t.pending++
+	return true
+}
+
+// Releases the queue capacity of lines that were reserved but will not be queued, because the request was rejected.
+func (t *WebhookTailer) release(nLines int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending -= nLines
+}
+
+func webhookReadErrorStatus(w http.ResponseWriter, r *http.Request, err error) int {
+	if errors.Is(err, errWebhookRequestTooLarge) {
+		return webhookError(w, r, http.StatusRequestEntityTooLarge, err)
+	}
+	return webhookError(w, r, http.StatusBadRequest, err)
+}
+
+func webhookError(w http.ResponseWriter, r *http.Request, status int, err error) int {
+	logrus.Warnf("rejected webhook request from %v: %v", r.RemoteAddr, err)
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", webhookRetryAfterSeconds)
+	}
+	http.Error(w, err.Error(), status)
+	return status
+}
+
+func rejectWebhookRequest(w http.ResponseWriter, r *http.Request, auth *webhookAuth, metrics WebhookMetrics, reason string) int {
+	logrus.Warnf("rejected webhook request from %v: %v", r.RemoteAddr, strings.Replace(reason, "_", " ", -1))
+	if metrics != nil {
+		metrics.WebhookRequestRejected(reason)
+	}
+	return auth.reject(w, reason)
+}
+
+// Like parseWebhookBody(), but errors are logged and no lines are returned.
 func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string {
+	strs, err := parseWebhookBody(c, b)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"post_body": string(b),
+		}).Warn(err)
+		return nil
+	}
+	return strs
+}
+
+// Returns an error if the body does not match the webhook_format.
+func parseWebhookBody(c *configuration.InputConfig, b []byte) ([]context_string, error) {
 
 	strs := []context_string{}
 
@@ -124,29 +318,20 @@ func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string
 		}
 	case "json_single":
 		if len(c.WebhookJsonSelector) == 0 || c.WebhookJsonSelector[0] != '.' {
-			logrus.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
-			break
+			return nil, fmt.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
 		}
 		j, err := json.NewJson(b)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body": string(b),
-			}).Warn("Unable to Parse JSON")
-			break
+			return nil, fmt.Errorf("unable to parse JSON: %v", err)
 		}
 		s, err := processPath(j, c.WebhookJsonSelector)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body":             string(b),
-				"webhook_json_selector": c.WebhookJsonSelector,
-			}).Warn("Unable to find selector path")
-			break
+			return nil, fmt.Errorf("unable to find webhook_json_selector %v: %v", c.WebhookJsonSelector, err)
 		}
 		strs = append(strs, context_string{line: s, extra: j.MustMap()})
 	case "json_lines":
 		if len(c.WebhookJsonSelector) == 0 || c.WebhookJsonSelector[0] != '.' {
-			logrus.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
-			break
+			return nil, fmt.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
 		}
 
 		for _, split := range bytes.Split(b, []byte("\n")) {
@@ -155,32 +340,21 @@ func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string
 			}
 			j, err := json.NewJson(split)
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"post_body": string(b),
-				}).Warn("Unable to Parse JSON")
-				break
+				return nil, fmt.Errorf("unable to parse JSON: %v", err)
 			}
 			s, err := processPath(j, c.WebhookJsonSelector)
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"post_body":             string(b),
-					"webhook_json_selector": c.WebhookJsonSelector,
-				}).Warn("Unable to find selector path")
-				break
+				return nil, fmt.Errorf("unable to find webhook_json_selector %v: %v", c.WebhookJsonSelector, err)
 			}
 			strs = append(strs, context_string{line: s, extra: j.MustMap()})
 		}
 	case "json_bulk":
 		if len(c.WebhookJsonSelector) == 0 || c.WebhookJsonSelector[0] != '.' {
-			logrus.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
-			break
+			return nil, fmt.Errorf("%v: invalid webhook json selector", c.WebhookJsonSelector)
 		}
 		j, err := json.NewJson(b)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body": string(b),
-			}).Warn("Unable to Parse JSON")
-			break
+			return nil, fmt.Errorf("unable to parse JSON: %v", err)
 		}
 
 		for _, ei := range j.MustArray() {
@@ -191,16 +365,12 @@ func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string
 			newSelector := fmt.Sprintf(".x.%v", c.WebhookJsonSelector[1:])
 			s, err := processPath(ej, newSelector)
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"post_body":             string(b),
-					"webhook_json_selector": c.WebhookJsonSelector,
-				}).Warn("Unable to find selector path")
-				break
+				return nil, fmt.Errorf("unable to find webhook_json_selector %v: %v", c.WebhookJsonSelector, err)
 			}
 			strs = append(strs, context_string{line: s, extra: ej.MustMap()})
 		}
 	default:
-		// error silently
+		return nil, fmt.Errorf("%v: invalid webhook format", c.WebhookFormat)
 	}
 
 	// Trim whitespace before and after every log entry
@@ -208,41 +378,13 @@ func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string
 		strs[i] = context_string{line: strings.TrimSpace(strs[i].line), extra: strs[i].extra}
 	}
 
-	return strs
+	return strs, nil
 }
 
 func processPath(json *json.Json, path string) (string, error) {
-	if len(path) <= 1 {
-		return "", fmt.Errorf("%q: invalid webhook json selector", path)
-	}
-	for _, pathElement := range strings.Split(path[1:], ".") {
-		i := len(pathElement) - 1
-		if i > 3 && pathElement[i] == ']' {
-			name, index, err := parseJsonPathElement(pathElement)
-			if err != nil {
-				return "", fmt.Errorf("%q: invalid webhook json selector: %v", path, err)
-			}
-			json = json.GetPath(name)
-			json = json.GetIndex(index)
-		} else {
-			json = json.GetPath(pathElement)
-		}
-	}
-	return json.String()
-}
-
-// pathElement is a string like "messages[0]", this method splits it into "messages" and 0.
-// We assume that pathElement ends with ']'.
-func parseJsonPathElement(pathElement string) (string, int, error) {
-	index := 0
-	i := len(pathElement) - 2
-	for ; i > 0 && pathElement[i] != '['; i-- {
-		digit := pathElement[i] - '0'
-		if digit < 0 || digit > 9 {
-			return "", 0, fmt.Errorf("%q: path element ends with ']' but array index is invalid", pathElement)
-		}
-		index *= 10
-		index += int(digit)
+	selector, err := jsonselector.Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook json selector: %v", err)
 	}
-	return pathElement[0:i], index, nil
+	return selector.Find(json).String()
 }
@@ -16,9 +16,12 @@ package tailer
 
 import (
 	"fmt"
-	configuration "github.com/fstab/grok_exporter/config/v3"
+	configuration "github.com/fstab/grok_exporter/config/v4"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestWebhookTextSingle(t *testing.T) {
@@ -322,3 +325,134 @@ func createMalformedJsonBlob(message string) string {
 }`, message)
 	return s
 }
+
+// Client errors are answered with 4xx, the tailer's error channel is not used.
+func TestWebhookClientErrors(t *testing.T) {
+	metrics := &webhookRequests{}
+	tail, err := InitWebhookTailer(&configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/client-errors",
+		WebhookFormat:       "json_lines",
+		WebhookJsonSelector: ".message",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+	}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method, body   string
+		expectedStatus int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "{\"message\": \"line 1\"}\n{\"message\": ", http.StatusBadRequest},
+		{"POST", "{\"message\": \"line 1\"}\n{\"msg\": \"line 2\"}", http.StatusBadRequest},
+		{"POST", "{\"message\": \"line 1\"}\n{\"message\": \"line 2\"}\n", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		WebhookHandler("/client-errors").ServeHTTP(w, httptest.NewRequest(test.method, "/client-errors", strings.NewReader(test.body)))
+		if w.Code != test.expectedStatus {
+			t.Fatalf("%v %q: expected status %v, but got %v", test.method, test.body, test.expectedStatus, w.Code)
+		}
+	}
+	// Rejected requests are rejected as a whole, so the first line is the line from the last request.
+	expectWebhookLine(t, tail, "line 1")
+	expectWebhookLine(t, tail, "line 2")
+	select {
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+	if fmt.Sprintf("%v", metrics.statuses) != "[405 400 400 200]" || metrics.nLines != 2 || metrics.nBytes != 44 {
+		t.Fatalf("unexpected metrics: %#v", metrics)
+	}
+}
+
+// The queue is tested without sharedTailer, because sharedTailer takes the next line from the queue before it is read.
+func TestWebhookQueueFull(t *testing.T) {
+	tail := newWebhookTailer(&configuration.InputConfig{
+		Type:                     "webhook",
+		WebhookPath:              "/queue-full",
+		WebhookFormat:            "text_bulk",
+		WebhookTextBulkSeparator: "\n",
+		WebhookQueueSize:         2,
+		WebhookMaxBodyBytes:      1024,
+	}, nil, &webhookRequests{})
+	post := func(body string, expectedStatus int) {
+		postWebhookLines(t, tail, "/queue-full", body, expectedStatus)
+	}
+	post("line 1\nline 2\nline 3", http.StatusRequestEntityTooLarge)
+	post("line 1\nline 2", http.StatusOK)
+	post("line 3", http.StatusTooManyRequests)
+	expectWebhookLine(t, tail, "line 1")
+	expectWebhookLine(t, tail, "line 2")
+	waitForEmptyQueue(t, tail)
+	post("line 3", http.StatusOK)
+	expectWebhookLine(t, tail, "line 3")
+	tail.Close()
+	post("line 4", http.StatusServiceUnavailable)
+}
+
+// The settings of the new input are applied when it is activated, i.e. when the reload was successful.
+func TestWebhookReload(t *testing.T) {
+	cfg := &configuration.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/reload",
+		WebhookFormat:       "text_single",
+		WebhookQueueSize:    10,
+		WebhookMaxBodyBytes: 1024,
+	}
+	reloadedCfg := *cfg
+	reloadedCfg.WebhookMaxBodyBytes = 4
+	metrics := &webhookRequests{}
+	oldTail, err := InitWebhookTailer(cfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reload failed, the new input is closed without being activated.
+	failedTail, err := InitWebhookTailer(&reloadedCfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedTail.Close()
+	postWebhookLines(t, WebhookHandler("/reload"), "/reload", "line 1", http.StatusOK)
+	expectWebhookLine(t, oldTail, "line 1")
+	// The reload was successful, the old input is closed after the new input was activated.
+	newTail, err := InitWebhookTailer(&reloadedCfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activate(newTail)
+	oldTail.Close()
+	postWebhookLines(t, WebhookHandler("/reload"), "/reload", "line 2", http.StatusRequestEntityTooLarge)
+	postWebhookLines(t, WebhookHandler("/reload"), "/reload", "ok", http.StatusOK)
+	expectWebhookLine(t, newTail, "ok")
+	// Shutdown
+	newTail.Close()
+	postWebhookLines(t, WebhookHandler("/reload"), "/reload", "ok", http.StatusServiceUnavailable)
+}
+
+func postWebhookLines(t *testing.T, handler http.Handler, path, body string, expectedStatus int) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	if w.Code != expectedStatus {
+		t.Fatalf("%q: expected status %v, but got %v", body, expectedStatus, w.Code)
+	}
+	if (w.Code == http.StatusTooManyRequests || w.Code == http.StatusServiceUnavailable) && w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("%q: expected Retry-After header, but got %q", body, w.Header().Get("Retry-After"))
+	}
+}
+
+// Lines are removed from the queue right after they were read from the tailer, but this happens asynchronously.
+func waitForEmptyQueue(t *testing.T, tail *WebhookTailer) {
+	for i := 0; i < 100; i++ {
+		tail.mutex.Lock()
+		pending := tail.pending
+		tail.mutex.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout while waiting for the webhook queue to become empty")
+}